@@ -0,0 +1,77 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"tokenize/policy"
+	"tokenize/rotation"
+
+	"github.com/danielgtaylor/huma/v2"
+)
+
+func (h *BaseHandler) RegisterAdminRoutes(api huma.API) {
+	huma.Register(api, huma.Operation{
+		OperationID:   "StartKeyRotation",
+		Summary:       "Re-encrypt every token under the current key",
+		Method:        http.MethodPost,
+		Path:          "/admin/key-rotation",
+		DefaultStatus: http.StatusAccepted,
+		Errors: []int{
+			http.StatusUnauthorized,
+			http.StatusForbidden,
+			http.StatusConflict,
+		},
+	}, mapErrors(h.StartKeyRotation))
+
+	huma.Register(api, huma.Operation{
+		OperationID:   "GetKeyRotation",
+		Summary:       "Get the progress of the key rotation",
+		Method:        http.MethodGet,
+		Path:          "/admin/key-rotation",
+		DefaultStatus: http.StatusOK,
+		Errors: []int{
+			http.StatusUnauthorized,
+			http.StatusForbidden,
+		},
+	}, mapErrors(h.GetKeyRotation))
+}
+
+type StartKeyRotationRequest struct {
+	Restart bool `query:"restart" doc:"Start over instead of resuming an interrupted rotation"`
+}
+
+type KeyRotationResponse struct {
+	Body rotation.Progress
+}
+
+func (h *BaseHandler) StartKeyRotation(ctx context.Context, in *StartKeyRotationRequest) (*KeyRotationResponse, error) {
+	if err := h.authorize(ctx, policy.ActionAdmin, policy.Resource{}); err != nil {
+		return nil, err
+	}
+	if h.Rotator == nil {
+		return nil, huma.Error501NotImplemented("key rotation is not configured")
+	}
+
+	progress, err := h.Rotator.Start(ctx, in.Restart)
+	if err != nil {
+		return nil, err
+	}
+
+	output := &KeyRotationResponse{}
+	output.Body = progress
+	return output, nil
+}
+
+func (h *BaseHandler) GetKeyRotation(ctx context.Context, _ *struct{}) (*KeyRotationResponse, error) {
+	if err := h.authorize(ctx, policy.ActionAdmin, policy.Resource{}); err != nil {
+		return nil, err
+	}
+	if h.Rotator == nil {
+		return nil, huma.Error501NotImplemented("key rotation is not configured")
+	}
+
+	output := &KeyRotationResponse{}
+	output.Body = h.Rotator.Progress()
+	return output, nil
+}
@@ -0,0 +1,134 @@
+package api
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"tokenize/models"
+	"tokenize/persistence/mock"
+	"tokenize/rotation"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// blockingStore holds up ScanTokens until release is closed, so a rotation stays running
+type blockingStore struct {
+	mock.Store
+	release chan struct{}
+}
+
+func (b blockingStore) ScanTokens(ctx context.Context, cursor string, limit int32) ([]*models.Token, string, error) {
+	<-b.release
+	return b.Store.ScanTokens(ctx, cursor, limit)
+}
+
+func TestHandler_StartKeyRotation(t *testing.T) {
+	tests := []struct {
+		name       string
+		rotator    func(t *testing.T) *rotation.Rotator
+		wantStatus int
+		want       string
+	}{
+		{
+			name: "start rotation",
+			rotator: func(t *testing.T) *rotation.Rotator {
+				return &rotation.Rotator{Store: mock.Store{}, Keys: testKeys}
+			},
+			want: rotation.StatusRunning,
+		},
+		{
+			name: "rotation already running",
+			rotator: func(t *testing.T) *rotation.Rotator {
+				release := make(chan struct{})
+				t.Cleanup(func() { close(release) })
+				rotator := &rotation.Rotator{Store: blockingStore{release: release}, Keys: testKeys}
+				_, err := rotator.Start(context.Background(), false)
+				assert.NoError(t, err)
+				return rotator
+			},
+			wantStatus: 409,
+		},
+		{
+			name: "rotation not configured",
+			rotator: func(t *testing.T) *rotation.Rotator {
+				return nil
+			},
+			wantStatus: 501,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &BaseHandler{
+				Policy:  testPolicy,
+				Store:   mock.Store{},
+				Keys:    testKeys,
+				Rotator: tt.rotator(t),
+			}
+			got, err := mapErrors(h.StartKeyRotation)(testCtx, &StartKeyRotationRequest{})
+			if tt.wantStatus != 0 {
+				var statusErr huma.StatusError
+				assert.ErrorAs(t, err, &statusErr)
+				assert.Equal(t, tt.wantStatus, statusErr.GetStatus())
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got.Body.Status)
+			assert.Eventually(t, func() bool {
+				return h.Rotator.Progress().Status == rotation.StatusCompleted
+			}, time.Second, time.Millisecond)
+		})
+	}
+}
+
+func TestHandler_GetKeyRotation(t *testing.T) {
+	tests := []struct {
+		name       string
+		rotator    *rotation.Rotator
+		wantStatus int
+		want       string
+	}{
+		{
+			name:    "rotation has not run",
+			rotator: &rotation.Rotator{Store: mock.Store{}, Keys: testKeys},
+			want:    rotation.StatusIdle,
+		},
+		{
+			name: "resumable rotation",
+			rotator: &rotation.Rotator{
+				Store: mock.Store{},
+				Keys:  testKeys,
+				Checkpoint: func() rotation.Checkpoint {
+					checkpoint := &rotation.MemoryCheckpoint{}
+					_ = checkpoint.Save(context.Background(), &rotation.Progress{Status: rotation.StatusFailed})
+					return checkpoint
+				}(),
+			},
+			want: rotation.StatusFailed,
+		},
+		{
+			name:       "rotation not configured",
+			wantStatus: 501,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &BaseHandler{
+				Policy:  testPolicy,
+				Store:   mock.Store{},
+				Keys:    testKeys,
+				Rotator: tt.rotator,
+			}
+			got, err := h.GetKeyRotation(testCtx, &struct{}{})
+			if tt.wantStatus != 0 {
+				var statusErr huma.StatusError
+				assert.ErrorAs(t, err, &statusErr)
+				assert.Equal(t, tt.wantStatus, statusErr.GetStatus())
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got.Body.Status)
+		})
+	}
+}
@@ -1,7 +1,12 @@
 package api
 
 import (
+	"tokenize/audit"
+	"tokenize/auth"
+	"tokenize/models"
 	"tokenize/persistence"
+	"tokenize/policy"
+	"tokenize/rotation"
 
 	"github.com/danielgtaylor/huma/v2"
 	"github.com/danielgtaylor/huma/v2/adapters/humamux"
@@ -9,12 +14,44 @@ import (
 )
 
 type BaseHandler struct {
-	Store persistence.Store
+	// Auth authenticates every request, requests are all rejected when it is nil
+	Auth auth.Authenticator
+	// Policy decides what each caller may do, requests are all forbidden when it is nil
+	Policy policy.Authorizer
+	Store  persistence.Store
+	// Keys are the key-encryption keys that wrap each token's data key
+	Keys models.KeyProvider
+	// TokenKeys are the keys for keyed tokenization, kept separate from the encryption keys
+	TokenKeys models.KeyProvider
+	// Tenants has the keys of each tenant, Keys and TokenKeys are used for callers that are not in a tenant
+	Tenants    models.TenantKeyResolver
+	TokenModes models.TokenModes
+	// TokenTypes is the registry of token types that can be created, every type can be when it is empty
+	TokenTypes models.TokenTypes
+	// Reveals are the reveal policies decrypted payloads can be shown with, besides the built-in ones
+	Reveals models.RevealPolicies
+	Rotator *rotation.Rotator
+	// Audit records every operation on a token, nothing is recorded when it is nil
+	Audit audit.Store
+	// AuditKeys are the keys the audit records were sealed with, to verify them
+	AuditKeys models.KeyProvider
+	// Grants keeps the reveal grants that were issued, grants cannot be issued or redeemed when it is nil
+	Grants persistence.GrantStore
+	// ClientIPHeader is the header a proxy in front of the service puts the client's address in, such as
+	// X-Forwarded-For, the address of the connection is used when it is empty
+	ClientIPHeader string
 }
 
 // Routes will register routes that are attached to the handler
 func Routes(handlers *BaseHandler) *mux.Router {
 	r := mux.NewRouter()
+	var authenticator auth.Authenticator
+	var clientIPHeader string
+	if handlers != nil {
+		authenticator = handlers.Auth
+		clientIPHeader = handlers.ClientIPHeader
+	}
+	r.Use(requestID, clientIP(clientIPHeader), authenticate(authenticator))
 	humaApi := humamux.New(r, huma.DefaultConfig("Tokenize", "3.0.0"))
 
 	huma.AutoRegister(humaApi, handlers)
@@ -3,6 +3,7 @@ package api
 import (
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"tokenize/models"
@@ -21,7 +22,9 @@ func TestRoutes(t *testing.T) {
 		{
 			name: "routes function creates router",
 			handler: &BaseHandler{
-				Store: mock.Store{},
+				Auth:   testAuth,
+				Policy: testPolicy,
+				Store:  mock.Store{},
 			},
 			test: func(t *testing.T, router *mux.Router) {
 				assert.NotNil(t, router)
@@ -31,7 +34,9 @@ func TestRoutes(t *testing.T) {
 		{
 			name: "router has registered routes",
 			handler: &BaseHandler{
-				Store: mock.Store{},
+				Auth:   testAuth,
+				Policy: testPolicy,
+				Store:  mock.Store{},
 			},
 			test: func(t *testing.T, router *mux.Router) {
 				// Create a test request to check if routes are registered
@@ -50,6 +55,8 @@ func TestRoutes(t *testing.T) {
 		{
 			name: "token routes are accessible",
 			handler: &BaseHandler{
+				Auth:   testAuth,
+				Policy: testPolicy,
 				Store: mock.Store{
 					Token: &models.Token{
 						Token: "test-token",
@@ -68,6 +75,7 @@ func TestRoutes(t *testing.T) {
 					{"POST", "/token"},
 					{"GET", "/token/test-token"},
 					{"GET", "/token/test-token/decrypt"},
+					{"POST", "/token/test-token"},
 					{"DELETE", "/token/test-token"},
 				}
 
@@ -88,6 +96,8 @@ func TestRoutes(t *testing.T) {
 		{
 			name: "router handles requests",
 			handler: &BaseHandler{
+				Auth:   testAuth,
+				Policy: testPolicy,
 				Store: mock.Store{
 					Token: &models.Token{
 						Token: "test-token",
@@ -109,6 +119,38 @@ func TestRoutes(t *testing.T) {
 				assert.NotEqual(t, 0, rr.Code, "Router should handle the request and return a status code")
 			},
 		},
+		{
+			name: "token payload cannot be updated",
+			handler: &BaseHandler{
+				Auth:   testAuth,
+				Policy: testPolicy,
+				Store: mock.Store{
+					Token: &models.Token{
+						Token: "test-token",
+						CreateToken: models.CreateToken{
+							Payload: "test-payload",
+						},
+					},
+				},
+			},
+			test: func(t *testing.T, router *mux.Router) {
+				for body, want := range map[string]int{
+					`{"metadata": {"foo": "bar"}, "ttl": 600}`: http.StatusOK,
+					`{"payload": "new payload"}`:               http.StatusBadRequest,
+					`{}`:                                       http.StatusBadRequest,
+					`{"ttl": -1}`:                              http.StatusBadRequest,
+				} {
+					req, err := http.NewRequest("POST", "/token/test-token", strings.NewReader(body))
+					assert.NoError(t, err)
+					req.Header.Set("Content-Type", "application/json")
+
+					rr := httptest.NewRecorder()
+					router.ServeHTTP(rr, req)
+					assert.Equal(t, want, rr.Code, body)
+					assert.NotContains(t, rr.Body.String(), "test-payload")
+				}
+			},
+		},
 		{
 			name:    "routes function with nil handler",
 			handler: nil,
@@ -121,7 +163,9 @@ func TestRoutes(t *testing.T) {
 		{
 			name: "router configuration",
 			handler: &BaseHandler{
-				Store: mock.Store{},
+				Auth:   testAuth,
+				Policy: testPolicy,
+				Store:  mock.Store{},
 			},
 			test: func(t *testing.T, router *mux.Router) {
 				// Test that router is properly configured
@@ -142,7 +186,9 @@ func TestRoutes(t *testing.T) {
 		{
 			name: "huma api integration",
 			handler: &BaseHandler{
-				Store: mock.Store{},
+				Auth:   testAuth,
+				Policy: testPolicy,
+				Store:  mock.Store{},
 			},
 			test: func(t *testing.T, router *mux.Router) {
 				// Test that Huma API is properly integrated
@@ -0,0 +1,335 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"tokenize/audit"
+	"tokenize/auth"
+	"tokenize/models"
+	"tokenize/persistence"
+	"tokenize/policy"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/google/uuid"
+)
+
+// RequestIDHeader carries the ID of a request, taken from the client when it sends a valid one
+const RequestIDHeader = "X-Request-ID"
+
+// validRequestID limits the request IDs accepted from clients, since they end up in the audit log
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+type requestIDKey struct{}
+
+// requestID gives every request an ID, returned in the response and recorded in the audit log
+func requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = uuid.NewString()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// requestIDFrom returns the ID of the request the context belongs to
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// auditEvent starts the audit record of an operation on a token by the caller of the request
+func auditEvent(ctx context.Context, operation audit.Operation, token string) *audit.Record {
+	record := &audit.Record{
+		Token:     token,
+		Time:      time.Now(),
+		Operation: operation,
+		RequestID: requestIDFrom(ctx),
+	}
+	if principal, ok := auth.PrincipalFrom(ctx); ok {
+		record.Principal = principal.Subject
+		record.Tenant = principal.Tenant
+	}
+	return record
+}
+
+// recordAudit appends the audit record of an operation that ended with err. An operation that succeeded fails if it
+// cannot be recorded, one that failed keeps its own error.
+func (h *BaseHandler) recordAudit(ctx context.Context, record *audit.Record, err error) error {
+	if h.Audit == nil {
+		return err
+	}
+	record.Outcome = auditOutcome(err)
+	record.Token = chainToken(record.Token)
+	if auditErr := h.Audit.Append(ctx, record); auditErr != nil {
+		slog.Error("unable to record audit event", "operation", record.Operation, "request_id", record.RequestID,
+			"error", auditErr)
+		if err == nil {
+			return fmt.Errorf("audit: %w", auditErr)
+		}
+	}
+	return err
+}
+
+// chainToken returns the token of the chain an operation on the token is recorded in. There is no chain of a token
+// before it is known, such as for a create that was denied, and a token that is not valid could name the chain of
+// another tenant's token, so those operations are recorded in a chain of the tenant, picked at random so concurrent
+// operations seldom extend the same one. A token that already names a chain of the tenant is kept.
+func chainToken(token string) string {
+	if _, ok := audit.TenantShardIndex(token); ok {
+		return token
+	}
+	if !models.ValidToken(token) {
+		return audit.TenantShard(rand.IntN(audit.TenantShards))
+	}
+	return token
+}
+
+// maxConcurrentAudits bounds how many audit records of a batch are appended at the same time
+const maxConcurrentAudits = 16
+
+// recordAudits records the audit records of the items of a batch like recordAudit, each with the error its item ended
+// with, and returns the error of every item. Records of different chains are appended concurrently, records of the
+// same chain one after the other in the order of the items.
+func (h *BaseHandler) recordAudits(ctx context.Context, records []*audit.Record, errs []error) []error {
+	results := make([]error, len(records))
+	chains := map[string][]int{}
+	order := []string{}
+	for i, record := range records {
+		record.Token = chainToken(record.Token)
+		key := models.StorageKey(record.Tenant, record.Token)
+		if _, found := chains[key]; !found {
+			order = append(order, key)
+		}
+		chains[key] = append(chains[key], i)
+	}
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, maxConcurrentAudits)
+	for _, key := range order {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(items []int) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			for _, i := range items {
+				results[i] = h.recordAudit(ctx, records[i], errs[i])
+			}
+		}(chains[key])
+	}
+	wg.Wait()
+	return results
+}
+
+func auditOutcome(err error) audit.Outcome {
+	switch {
+	case err == nil:
+		return audit.OutcomeSuccess
+	case errors.Is(err, policy.ErrForbidden):
+		return audit.OutcomeDenied
+	case errors.Is(err, models.ErrTokenNotFound):
+		return audit.OutcomeNotFound
+	default:
+		return audit.OutcomeFailure
+	}
+}
+
+func (h *BaseHandler) RegisterAuditRoutes(api huma.API) {
+	huma.Register(api, huma.Operation{
+		OperationID:   "GetTokenAudit",
+		Summary:       "Get the audit history of a token",
+		Method:        http.MethodGet,
+		Path:          "/token/{token}/audit",
+		DefaultStatus: http.StatusOK,
+		Errors: []int{
+			http.StatusUnauthorized,
+			http.StatusForbidden,
+			http.StatusNotFound,
+			http.StatusNotImplemented,
+		},
+	}, mapErrors(h.GetTokenAudit))
+
+	huma.Register(api, huma.Operation{
+		OperationID:   "GetTenantAudit",
+		Summary:       "Get the audit history of the operations that are not on a token",
+		Method:        http.MethodGet,
+		Path:          "/audit",
+		DefaultStatus: http.StatusOK,
+		Errors: []int{
+			http.StatusUnauthorized,
+			http.StatusForbidden,
+			http.StatusBadRequest,
+			http.StatusNotImplemented,
+		},
+	}, mapErrors(h.GetTenantAudit))
+}
+
+type TokenAuditResponse struct {
+	Body struct {
+		Token   string         `json:"token"`
+		Records []audit.Record `json:"records"`
+		// Verified is false when the records do not form an unbroken hash chain that reaches its signed head
+		Verified bool `json:"verified" doc:"Whether the records form an unbroken hash chain that reaches its signed head"`
+	}
+}
+
+// GetTokenAudit returns every recorded operation on a token, including tokens that have since been deleted. The
+// caller is authorized before the chain is looked up, so it cannot tell which tokens exist without the audit action.
+// The type of a token is not known until then, so the action has to be granted for every token type.
+func (h *BaseHandler) GetTokenAudit(ctx context.Context, in *GetTokenRequest) (*TokenAuditResponse, error) {
+	if h.Audit == nil || h.AuditKeys == nil {
+		return nil, huma.Error501NotImplemented("audit is not configured")
+	}
+	if err := h.authorize(ctx, policy.ActionAudit, policy.Resource{}); err != nil {
+		return nil, err
+	}
+	if err := checkToken(in.Token); err != nil {
+		return nil, err
+	}
+
+	output, head, err := h.auditHistory(ctx, in.Token)
+	if err != nil {
+		return nil, err
+	}
+	// a token whose records are gone but whose head is left is reported, its history has been tampered with
+	if len(output.Body.Records) == 0 && head == nil {
+		return nil, models.ErrTokenNotFound
+	}
+	return output, nil
+}
+
+// defaultAuditLimit is the number of records in a page of the tenant's audit history when no limit is asked for
+const defaultAuditLimit = 100
+
+type TenantAuditRequest struct {
+	Cursor string `query:"cursor" doc:"Cursor of the page to get, from next_cursor of the previous page"`
+	Limit  int    `query:"limit" minimum:"1" maximum:"1000" default:"100" doc:"Maximum number of records in the page"`
+}
+
+type TenantAuditResponse struct {
+	Body struct {
+		// Chain is the chain of the tenant the records of the page are from, each page is from one of them
+		Chain   string         `json:"chain" doc:"Chain of the tenant the records of the page are from"`
+		Records []audit.Record `json:"records"`
+		// Verified is false when the records do not continue the previous page of their chain in an unbroken hash
+		// chain, or the last page of the chain does not reach its signed head
+		Verified bool `json:"verified" doc:"Whether the records continue the previous page of their chain in an unbroken hash chain that reaches its signed head"`
+		// NextCursor is empty on the last page
+		NextCursor string `json:"next_cursor,omitempty"`
+	}
+}
+
+// GetTenantAudit returns a page of the operations of the caller's tenant that are not on a token, such as creates
+// that were denied or failed and requests for tokens that are not valid. They are spread over the chains of the
+// tenant, which are paged through one after the other, so a page can have fewer records than the limit before the
+// last one.
+func (h *BaseHandler) GetTenantAudit(ctx context.Context, in *TenantAuditRequest) (*TenantAuditResponse, error) {
+	if h.Audit == nil || h.AuditKeys == nil {
+		return nil, huma.Error501NotImplemented("audit is not configured")
+	}
+	if err := h.authorize(ctx, policy.ActionAudit, policy.Resource{}); err != nil {
+		return nil, err
+	}
+	shard, after, err := parseAuditCursor(in.Cursor)
+	if err != nil {
+		return nil, err
+	}
+	limit := in.Limit
+	if limit == 0 {
+		limit = defaultAuditLimit
+	}
+
+	output := &TenantAuditResponse{}
+	output.Body.Records = []audit.Record{}
+	for ; shard < audit.TenantShards; shard, after = shard+1, 0 {
+		chain := audit.TenantShard(shard)
+		// the record the page continues is read along with it, and one more to tell whether another page follows
+		page := audit.Page{After: after, Limit: limit + 1}
+		if after > 0 {
+			page = audit.Page{After: after - 1, Limit: limit + 2}
+		}
+		records, head, err := h.Audit.History(ctx, tenantFrom(ctx), chain, page)
+		if err != nil {
+			return nil, err
+		}
+		var prev *audit.Record
+		if after > 0 && len(records) > 0 && records[0].Sequence == after {
+			prev, records = &records[0], records[1:]
+		}
+		// a chain of the tenant that was never written to is skipped, one whose records are gone is not
+		if prev == nil && len(records) == 0 && head == nil && after == 0 {
+			continue
+		}
+		more := len(records) > limit
+		if more {
+			records = records[:limit]
+		}
+
+		output.Body.Chain = chain
+		output.Body.Records = records
+		output.Body.Verified = true
+		if err := audit.VerifyPage(ctx, h.AuditKeys, prev, records, head, more); err != nil {
+			slog.Error("audit chain failed verification", "chain", chain, "error", err)
+			output.Body.Verified = false
+		}
+		switch {
+		case more:
+			output.Body.NextCursor = auditCursor(shard, records[len(records)-1].Sequence)
+		case shard+1 < audit.TenantShards:
+			output.Body.NextCursor = auditCursor(shard+1, 0)
+		}
+		return output, nil
+	}
+	output.Body.Verified = true
+	return output, nil
+}
+
+// auditCursor is the cursor of the page of the tenant's chain with the index that starts after the sequence
+func auditCursor(shard int, after int64) string {
+	return strconv.Itoa(shard) + "." + strconv.FormatInt(after, 10)
+}
+
+// parseAuditCursor returns the index of the tenant's chain and the sequence the page of the cursor starts after, the
+// first page of the first chain for an empty cursor
+func parseAuditCursor(cursor string) (int, int64, error) {
+	if cursor == "" {
+		return 0, 0, nil
+	}
+	shardPart, afterPart, found := strings.Cut(cursor, ".")
+	shard, shardErr := strconv.Atoi(shardPart)
+	after, afterErr := strconv.ParseInt(afterPart, 10, 64)
+	if !found || shardErr != nil || afterErr != nil || shard < 0 || shard >= audit.TenantShards || after < 0 {
+		return 0, 0, persistence.ErrInvalidCursor
+	}
+	return shard, after, nil
+}
+
+// auditHistory reads the chain of the token in the caller's tenant and verifies it, returning the head of the chain
+func (h *BaseHandler) auditHistory(ctx context.Context, token string) (*TokenAuditResponse, *audit.Head, error) {
+	records, head, err := h.Audit.History(ctx, tenantFrom(ctx), token, audit.Page{})
+	if err != nil {
+		return nil, nil, err
+	}
+	output := &TokenAuditResponse{}
+	output.Body.Token = token
+	output.Body.Records = records
+	output.Body.Verified = true
+	if err := audit.Verify(ctx, h.AuditKeys, records, head); err != nil {
+		slog.Error("audit chain failed verification", "error", err)
+		output.Body.Verified = false
+	}
+	return output, head, nil
+}
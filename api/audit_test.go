@@ -0,0 +1,401 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"tokenize/audit"
+	"tokenize/auth"
+	"tokenize/models"
+	"tokenize/persistence/mock"
+	"tokenize/policy"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandler_Audit(t *testing.T) {
+	token := &models.Token{
+		Token:       "foobartesttoken",
+		CreateToken: models.CreateToken{Payload: "this is the payload", TokenType: "card"},
+	}
+	assert.NoError(t, token.Encrypt(context.Background(), testKeys))
+	reader := auth.WithPrincipal(context.Background(), &auth.Principal{Subject: "api_key:reader", Roles: []string{"reader"}})
+	get := &GetTokenRequest{Token: "foobartesttoken"}
+
+	tests := []struct {
+		name      string
+		store     mock.Store
+		ctx       context.Context
+		call      func(h *BaseHandler, ctx context.Context) error
+		operation audit.Operation
+		outcome   audit.Outcome
+		tokenType string
+	}{
+		{
+			name:  "create",
+			store: mock.Store{Token: token},
+			ctx:   testCtx,
+			call: func(h *BaseHandler, ctx context.Context) error {
+				in := &NewTokenRequest{}
+				in.Body.Data = models.CreateToken{Payload: "4111111111111111", TokenType: "card"}
+				_, err := h.CreateToken(ctx, in)
+				return err
+			},
+			operation: audit.OperationCreate,
+			outcome:   audit.OutcomeSuccess,
+			tokenType: "card",
+		},
+		{
+			name:  "read",
+			store: mock.Store{Token: token},
+			ctx:   testCtx,
+			call: func(h *BaseHandler, ctx context.Context) error {
+				_, err := h.GetEncryptedToken(ctx, get)
+				return err
+			},
+			operation: audit.OperationRead,
+			outcome:   audit.OutcomeSuccess,
+			tokenType: "card",
+		},
+		{
+			name:  "decrypt denied",
+			store: mock.Store{Token: token},
+			ctx:   reader,
+			call: func(h *BaseHandler, ctx context.Context) error {
+				_, err := h.GetDecryptedToken(ctx, &DecryptTokenRequest{GetTokenRequest: *get})
+				return err
+			},
+			operation: audit.OperationDecrypt,
+			outcome:   audit.OutcomeDenied,
+			tokenType: "card",
+		},
+		{
+			name:  "update not found",
+			store: mock.Store{GetError: models.ErrTokenNotFound},
+			ctx:   testCtx,
+			call: func(h *BaseHandler, ctx context.Context) error {
+				ttl := int64(60)
+				_, err := h.UpdateToken(ctx, &UpdateTokenRequest{Token: "foobartesttoken", Body: models.UpdateToken{TTL: &ttl}})
+				return err
+			},
+			operation: audit.OperationUpdate,
+			outcome:   audit.OutcomeNotFound,
+		},
+		{
+			name:  "delete failed",
+			store: mock.Store{Token: token, DeleteError: errors.New("connection reset")},
+			ctx:   testCtx,
+			call: func(h *BaseHandler, ctx context.Context) error {
+				_, err := h.DeleteToken(ctx, get)
+				return err
+			},
+			operation: audit.OperationDelete,
+			outcome:   audit.OutcomeFailure,
+			tokenType: "card",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auditStore := &mock.AuditStore{}
+			h := &BaseHandler{Policy: testPolicy, Store: tt.store, Keys: testKeys, TokenKeys: testTokenKeys, Audit: auditStore}
+			err := tt.call(h, context.WithValue(tt.ctx, requestIDKey{}, "request-1"))
+			if tt.outcome == audit.OutcomeSuccess {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+
+			if !assert.Len(t, auditStore.Records, 1) {
+				return
+			}
+			record := auditStore.Records[0]
+			assert.Equal(t, tt.operation, record.Operation)
+			assert.Equal(t, tt.outcome, record.Outcome)
+			assert.Equal(t, "foobartesttoken", record.Token)
+			assert.Equal(t, tt.tokenType, record.TokenType)
+			assert.Equal(t, "request-1", record.RequestID)
+			assert.NotEmpty(t, record.Principal)
+			assert.NotEmpty(t, record.Hash)
+		})
+	}
+}
+
+func TestHandler_AuditFailure(t *testing.T) {
+	token := &models.Token{Token: "foobartesttoken", CreateToken: models.CreateToken{Payload: "this is the payload"}}
+	assert.NoError(t, token.Encrypt(context.Background(), testKeys))
+	h := &BaseHandler{
+		Policy: testPolicy,
+		Store:  mock.Store{Token: token},
+		Keys:   testKeys,
+		Audit:  &mock.AuditStore{AppendError: errors.New("audit table unavailable")},
+	}
+
+	got, err := h.GetDecryptedToken(testCtx, &DecryptTokenRequest{GetTokenRequest: GetTokenRequest{Token: "foobartesttoken"}})
+	assert.Error(t, err, "payloads should not be returned when the access cannot be recorded")
+	assert.Nil(t, got)
+
+	h.Store = mock.Store{GetError: models.ErrTokenNotFound}
+	_, err = h.GetDecryptedToken(testCtx, &DecryptTokenRequest{GetTokenRequest: GetTokenRequest{Token: "foobartesttoken"}})
+	assert.ErrorIs(t, err, models.ErrTokenNotFound, "the original error should be kept")
+}
+
+// tenantRecords returns the records of the chains of the tenant's operations that are not on a token, in the order
+// they were appended
+func tenantRecords(store *mock.AuditStore, tenant string) []audit.Record {
+	records := []audit.Record{}
+	for _, record := range store.Records {
+		if _, ok := audit.TenantShardIndex(record.Token); ok && record.Tenant == tenant {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+// concurrentAuditStore keeps the most appends that ran at the same time
+type concurrentAuditStore struct {
+	mock.AuditStore
+	mu      sync.Mutex
+	running int
+	most    int
+}
+
+func (c *concurrentAuditStore) Append(ctx context.Context, record *audit.Record) error {
+	c.mu.Lock()
+	c.running++
+	c.most = max(c.most, c.running)
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.running--
+		c.mu.Unlock()
+	}()
+	time.Sleep(time.Millisecond)
+	return c.AuditStore.Append(ctx, record)
+}
+
+func TestHandler_RecordAudits(t *testing.T) {
+	auditStore := &concurrentAuditStore{}
+	h := &BaseHandler{Audit: auditStore}
+	records := make([]*audit.Record, 100)
+	errs := make([]error, len(records))
+	for i := range records {
+		records[i] = auditEvent(testCtx, audit.OperationCreate, fmt.Sprintf("token-%d", i%40))
+		records[i].RequestID = strconv.Itoa(i)
+	}
+	errs[7] = policy.ErrForbidden
+
+	results := h.recordAudits(testCtx, records, errs)
+	for i, err := range results {
+		assert.Equal(t, errs[i], err)
+	}
+	assert.Len(t, auditStore.Records, len(records))
+	assert.Greater(t, auditStore.most, 1, "chains are appended concurrently")
+	assert.LessOrEqual(t, auditStore.most, maxConcurrentAudits)
+
+	history, head, err := auditStore.History(testCtx, "", "token-7", audit.Page{})
+	assert.NoError(t, err)
+	assert.NoError(t, audit.Verify(testCtx, mock.AuditKeys, history, head))
+	requests := []string{}
+	for _, record := range history {
+		requests = append(requests, record.RequestID)
+	}
+	assert.Equal(t, []string{"7", "47", "87"}, requests, "a chain is appended in the order of the items")
+	assert.Equal(t, audit.OutcomeDenied, history[0].Outcome)
+}
+
+func TestRoutes_TokenAudit(t *testing.T) {
+	token := &models.Token{Token: "test-token", CreateToken: models.CreateToken{TokenType: "card"}}
+	auditStore := &mock.AuditStore{}
+	handler := &BaseHandler{
+		Auth:      testAuth,
+		Policy:    testPolicy,
+		Store:     mock.Store{Token: token},
+		Audit:     auditStore,
+		AuditKeys: mock.AuditKeys,
+	}
+	router := Routes(handler)
+
+	req := httptest.NewRequest(http.MethodGet, "/token/test-token", nil)
+	req.Header.Set(RequestIDHeader, "client-request-1")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "client-request-1", rr.Header().Get(RequestIDHeader))
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/token/test-token", nil))
+	assert.NotEmpty(t, rr.Header().Get(RequestIDHeader), "requests without an ID should get one")
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/token/test-token/audit", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var body TokenAuditResponse
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &body.Body))
+	assert.Len(t, body.Body.Records, 2)
+	assert.True(t, body.Body.Verified)
+	assert.Equal(t, "client-request-1", body.Body.Records[0].RequestID)
+	assert.Equal(t, "api_key:test", body.Body.Records[0].Principal)
+
+	auditStore.Records[0].Outcome = audit.OutcomeDenied
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/token/test-token/audit", nil))
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &body.Body))
+	assert.False(t, body.Body.Verified, "a changed record should fail verification")
+
+	auditStore.Records[0].Outcome = audit.OutcomeSuccess
+	auditStore.Records = auditStore.Records[:1]
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/token/test-token/audit", nil))
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &body.Body))
+	assert.Len(t, body.Body.Records, 1)
+	assert.False(t, body.Body.Verified, "removing the newest record should fail verification")
+
+	auditStore.Records = nil
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/token/test-token/audit", nil))
+	assert.Equal(t, http.StatusOK, rr.Code, "a token whose chain was removed is still reported")
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &body.Body))
+	assert.False(t, body.Body.Verified, "removing the whole chain should fail verification")
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/token/unknown-token/audit", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	handler.Auth = staticAuth{principal: &auth.Principal{Subject: "api_key:reader", Roles: []string{"detokenizer"}}}
+	router = Routes(handler)
+	for _, path := range []string{"/token/test-token/audit", "/token/unknown-token/audit", "/audit"} {
+		rr = httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, http.StatusForbidden, rr.Code, "%s is authorized before the chain is looked up", path)
+	}
+}
+
+func TestRoutes_TenantAudit(t *testing.T) {
+	cardPolicy := policy.Default()
+	cardPolicy.Roles["cards"] = []policy.Grant{{Actions: []policy.Action{policy.ActionTokenize}, TokenTypes: []string{"card"}}}
+	auditStore := &mock.AuditStore{}
+	handler := &BaseHandler{
+		Auth:      staticAuth{principal: &auth.Principal{Subject: "api_key:cards", Roles: []string{"cards"}}},
+		Policy:    cardPolicy,
+		Store:     &recordingStore{},
+		Audit:     auditStore,
+		AuditKeys: mock.AuditKeys,
+		Keys:      testKeys,
+		TokenKeys: testTokenKeys,
+	}
+	router := Routes(handler)
+
+	// a create that is denied and a token that is not valid have no chain of their own
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(`{"data": {"payload": "123-45-6789", "token_type": "ssn", "ttl": 0, "metadata": {}}}`)))
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/token/a%23b/decrypt", nil))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	handler.Auth = testAuth
+	router = Routes(handler)
+	records := []audit.Record{}
+	for path := "/audit"; path != ""; {
+		rr = httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, http.StatusOK, rr.Code)
+		var body TenantAuditResponse
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &body.Body))
+		assert.True(t, body.Body.Verified)
+		records = append(records, body.Body.Records...)
+		path = ""
+		if body.Body.NextCursor != "" {
+			path = "/audit?cursor=" + body.Body.NextCursor
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Time.Before(records[j].Time) })
+	if assert.Len(t, records, 2) {
+		assert.Equal(t, audit.OperationCreate, records[0].Operation)
+		assert.Equal(t, audit.OutcomeDenied, records[0].Outcome)
+		assert.Equal(t, "ssn", records[0].TokenType)
+		assert.Equal(t, "api_key:cards", records[0].Principal)
+		assert.Equal(t, audit.OperationDecrypt, records[1].Operation)
+		assert.Equal(t, audit.OutcomeFailure, records[1].Outcome)
+	}
+}
+
+func TestHandler_GetTenantAudit(t *testing.T) {
+	auditStore := &mock.AuditStore{}
+	h := &BaseHandler{Policy: testPolicy, Audit: auditStore, AuditKeys: mock.AuditKeys}
+	records := make([]*audit.Record, 40)
+	for i := range records {
+		records[i] = auditEvent(testCtx, audit.OperationCreate, "")
+		records[i].RequestID = strconv.Itoa(i)
+	}
+	h.recordAudits(testCtx, records, make([]error, len(records)))
+	chains := map[string]bool{}
+	for _, record := range auditStore.Records {
+		chains[record.Token] = true
+	}
+	assert.Greater(t, len(chains), 1, "the operations of the tenant are spread over its chains")
+
+	requests := []string{}
+	in := &TenantAuditRequest{Limit: 3}
+	for pages := 0; ; pages++ {
+		if !assert.Less(t, pages, 40) {
+			break
+		}
+		got, err := h.GetTenantAudit(testCtx, in)
+		assert.NoError(t, err)
+		assert.True(t, got.Body.Verified, "page %q", in.Cursor)
+		assert.LessOrEqual(t, len(got.Body.Records), 3)
+		for _, record := range got.Body.Records {
+			assert.Equal(t, got.Body.Chain, record.Token, "a page is from one chain")
+			requests = append(requests, record.RequestID)
+		}
+		if got.Body.NextCursor == "" {
+			break
+		}
+		in.Cursor = got.Body.NextCursor
+	}
+	want := []string{}
+	for _, record := range records {
+		want = append(want, record.RequestID)
+	}
+	assert.ElementsMatch(t, want, requests, "every record is on one page")
+
+	// a page whose record before it is gone does not verify
+	removed := &mock.AuditStore{}
+	for range 3 {
+		assert.NoError(t, removed.Append(testCtx, &audit.Record{Token: audit.TenantChain, Operation: audit.OperationCreate}))
+	}
+	h.Audit = removed
+	first, err := h.GetTenantAudit(testCtx, &TenantAuditRequest{Limit: 1})
+	assert.NoError(t, err)
+	assert.True(t, first.Body.Verified)
+	assert.Equal(t, "0.1", first.Body.NextCursor)
+	removed.Records = removed.Records[1:]
+	got, err := h.GetTenantAudit(testCtx, &TenantAuditRequest{Limit: 1, Cursor: first.Body.NextCursor})
+	assert.NoError(t, err)
+	assert.False(t, got.Body.Verified)
+
+	for _, cursor := range []string{"x", "1", "8.0", "-1.0", "1.-2", "1.x"} {
+		_, err := mapErrors(h.GetTenantAudit)(testCtx, &TenantAuditRequest{Cursor: cursor})
+		var p *Problem
+		if assert.ErrorAs(t, err, &p, cursor) {
+			assert.Equal(t, "invalid_cursor", p.Code, cursor)
+		}
+	}
+}
+
+func TestGetTokenAudit_NotConfigured(t *testing.T) {
+	h := &BaseHandler{Policy: policy.Default()}
+	_, err := mapErrors(h.GetTokenAudit)(testCtx, &GetTokenRequest{Token: "test-token"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,98 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"tokenize/auth"
+	"tokenize/models"
+	"tokenize/policy"
+
+	"github.com/gorilla/mux"
+)
+
+// publicPaths are the routes that authorize requests with credentials of their own, such as a signed grant, rather
+// than by the caller
+var publicPaths = map[string]bool{
+	redeemGrantPath: true,
+}
+
+// authenticate rejects requests without valid credentials and puts the caller's auth.Principal in the request
+// context. It fails closed, without an Authenticator every request is rejected.
+func authenticate(authenticator auth.Authenticator) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if route := mux.CurrentRoute(r); route != nil {
+				if path, err := route.GetPathTemplate(); err == nil && publicPaths[path] {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			if authenticator == nil {
+				writeProblem(w, problem(http.StatusUnauthorized, "unauthenticated", "authentication is not configured"))
+				return
+			}
+
+			principal, err := authenticator.Authenticate(r)
+			switch {
+			case err == nil:
+				next.ServeHTTP(w, r.WithContext(auth.WithPrincipal(r.Context(), principal)))
+			case errors.Is(err, auth.ErrNoCredentials):
+				w.Header().Set("WWW-Authenticate", `Bearer, ApiKey header="`+auth.APIKeyHeader+`"`)
+				writeProblem(w, problem(http.StatusUnauthorized, "unauthenticated", "credentials are required"))
+			case errors.Is(err, auth.ErrInvalidCredentials):
+				slog.Info("rejected credentials", "error", err)
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				writeProblem(w, problem(http.StatusUnauthorized, "invalid_credentials", "credentials are not valid"))
+			default:
+				writeProblem(w, mapError(err))
+			}
+		})
+	}
+}
+
+// writeProblem writes an error response outside of a huma handler
+func writeProblem(w http.ResponseWriter, err error) {
+	var p *Problem
+	if !errors.As(err, &p) {
+		p = problem(http.StatusInternalServerError, "internal_error", http.StatusText(http.StatusInternalServerError))
+	}
+	var headers interface{ GetHeaders() http.Header }
+	if errors.As(err, &headers) {
+		for name, values := range headers.GetHeaders() {
+			w.Header()[name] = values
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	_ = json.NewEncoder(w).Encode(p)
+}
+
+// authorize checks the caller of the request may take the action on the resource. It fails closed, without a policy
+// every action is forbidden.
+func (h *BaseHandler) authorize(ctx context.Context, action policy.Action, resource policy.Resource) error {
+	if h.Policy == nil {
+		return policy.ErrForbidden
+	}
+	principal, _ := auth.PrincipalFrom(ctx)
+	err := h.Policy.Authorize(principal, action, resource)
+	// the admin endpoints act on every tenant, so callers in a tenant cannot use them
+	if err == nil && action == policy.ActionAdmin && principal.Tenant != "" {
+		err = fmt.Errorf("%w: %s belongs to tenant %s", policy.ErrForbidden, principal.Subject, principal.Tenant)
+	}
+	if err != nil {
+		slog.Info("denied request", "error", err)
+		return err
+	}
+	return nil
+}
+
+// tokenResource is what the policy is checked against for a stored token
+func tokenResource(token *models.Token) policy.Resource {
+	return policy.Resource{TokenType: token.TokenType, Metadata: token.Metadata}
+}
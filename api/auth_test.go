@@ -0,0 +1,292 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"tokenize/auth"
+	"tokenize/models"
+	"tokenize/persistence/mock"
+	"tokenize/policy"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// staticAuth authenticates every request as the same principal
+type staticAuth struct {
+	principal *auth.Principal
+}
+
+func (s staticAuth) Authenticate(_ *http.Request) (*auth.Principal, error) {
+	return s.principal, nil
+}
+
+var (
+	testPrincipal = &auth.Principal{Subject: "api_key:test", Method: auth.MethodAPIKey, Roles: []string{"admin"}}
+	testAuth      = staticAuth{principal: testPrincipal}
+	testPolicy    = policy.Default()
+	// testCtx is the context of a request by testPrincipal
+	testCtx = auth.WithPrincipal(context.Background(), testPrincipal)
+)
+
+// failingAuth fails every request with err
+type failingAuth struct {
+	err error
+}
+
+func (f failingAuth) Authenticate(_ *http.Request) (*auth.Principal, error) {
+	return nil, f.err
+}
+
+func TestRoutes_Authentication(t *testing.T) {
+	key, apiKey, err := models.NewAPIKey("test", []string{"reader"})
+	assert.NoError(t, err)
+	_, revokedKey, err := models.NewAPIKey("revoked", nil)
+	assert.NoError(t, err)
+	revokedKey.Revoked = true
+	keyStore := &mock.APIKeyStore{Keys: map[string]*models.APIKey{
+		apiKey.KeyHash:     apiKey,
+		revokedKey.KeyHash: revokedKey,
+	}}
+
+	tests := []struct {
+		name       string
+		auth       auth.Authenticator
+		apiKey     string
+		wantStatus int
+		wantCode   string
+	}{
+		{
+			name:       "valid api key",
+			auth:       auth.Chain{auth.APIKeys{Store: keyStore}},
+			apiKey:     key,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "no credentials",
+			auth:       auth.Chain{auth.APIKeys{Store: keyStore}},
+			wantStatus: http.StatusUnauthorized,
+			wantCode:   "unauthenticated",
+		},
+		{
+			name:       "unknown api key",
+			auth:       auth.Chain{auth.APIKeys{Store: keyStore}},
+			apiKey:     "tk_not-a-real-key",
+			wantStatus: http.StatusUnauthorized,
+			wantCode:   "invalid_credentials",
+		},
+		{
+			name:       "authentication not configured",
+			wantStatus: http.StatusUnauthorized,
+			wantCode:   "unauthenticated",
+		},
+		{
+			name:       "key store unavailable",
+			auth:       failingAuth{err: errors.New("connection refused")},
+			apiKey:     key,
+			wantStatus: http.StatusInternalServerError,
+			wantCode:   "internal_error",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := Routes(&BaseHandler{
+				Auth:   tt.auth,
+				Policy: testPolicy,
+				Store:  mock.Store{Token: &models.Token{Token: "test-token"}},
+			})
+			req := httptest.NewRequest(http.MethodGet, "/token/test-token", nil)
+			if tt.apiKey != "" {
+				req.Header.Set(auth.APIKeyHeader, tt.apiKey)
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.wantStatus, rr.Code)
+			if tt.wantCode == "" {
+				return
+			}
+			var body Problem
+			assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &body))
+			assert.Equal(t, tt.wantCode, body.Code)
+			assert.Equal(t, "application/problem+json", rr.Header().Get("Content-Type"))
+			assert.NotContains(t, rr.Body.String(), "connection refused")
+		})
+	}
+}
+
+func TestAuthenticate_PrincipalInContext(t *testing.T) {
+	var got *auth.Principal
+	handler := authenticate(testAuth)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = auth.PrincipalFrom(r.Context())
+	}))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/token/test-token", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, testAuth.principal, got)
+}
+
+func TestHandler_Authorization(t *testing.T) {
+	scoped, err := policy.Parse([]byte(`{"roles": {
+		"eu-cards": [{"actions": ["read", "detokenize", "update"], "token_types": ["card"], "metadata": {"region": ["eu"]}}],
+		"tokenizer": [{"actions": ["tokenize"], "token_types": ["card"]}]
+	}}`))
+	assert.NoError(t, err)
+
+	token := &models.Token{
+		Token:       "foobartesttoken",
+		CreateToken: models.CreateToken{Payload: "4111111111111111", TokenType: "card", Metadata: map[string]any{"region": "eu"}},
+	}
+	assert.NoError(t, token.Encrypt(context.Background(), testKeys))
+	usToken := *token
+	usToken.Metadata = map[string]any{"region": "us"}
+
+	as := func(roles ...string) context.Context {
+		return auth.WithPrincipal(context.Background(), &auth.Principal{Subject: "api_key:scoped", Roles: roles})
+	}
+	get := &GetTokenRequest{Token: "foobartesttoken"}
+
+	tests := []struct {
+		name   string
+		policy policy.Authorizer
+		token  *models.Token
+		call   func(h *BaseHandler, ctx context.Context) error
+		ctx    context.Context
+		want   error
+	}{
+		{
+			name:   "decrypt within scope",
+			policy: scoped,
+			token:  token,
+			ctx:    as("eu-cards"),
+			call: func(h *BaseHandler, ctx context.Context) error {
+				_, err := h.GetDecryptedToken(ctx, &DecryptTokenRequest{GetTokenRequest: *get})
+				return err
+			},
+		},
+		{
+			name:   "decrypt outside the metadata scope",
+			policy: scoped,
+			token:  &usToken,
+			ctx:    as("eu-cards"),
+			call: func(h *BaseHandler, ctx context.Context) error {
+				_, err := h.GetDecryptedToken(ctx, &DecryptTokenRequest{GetTokenRequest: *get})
+				return err
+			},
+			want: policy.ErrForbidden,
+		},
+		{
+			name:   "tokenizer cannot decrypt",
+			policy: scoped,
+			token:  token,
+			ctx:    as("tokenizer"),
+			call: func(h *BaseHandler, ctx context.Context) error {
+				_, err := h.GetDecryptedToken(ctx, &DecryptTokenRequest{GetTokenRequest: *get})
+				return err
+			},
+			want: policy.ErrForbidden,
+		},
+		{
+			name:   "tokenize another token type",
+			policy: scoped,
+			token:  token,
+			ctx:    as("tokenizer"),
+			call: func(h *BaseHandler, ctx context.Context) error {
+				in := &NewTokenRequest{}
+				in.Body.Data = models.CreateToken{Payload: "secret", TokenType: "access"}
+				_, err := h.CreateToken(ctx, in)
+				return err
+			},
+			want: policy.ErrForbidden,
+		},
+		{
+			name:   "update metadata out of scope",
+			policy: scoped,
+			token:  token,
+			ctx:    as("eu-cards"),
+			call: func(h *BaseHandler, ctx context.Context) error {
+				_, err := h.UpdateToken(ctx, &UpdateTokenRequest{
+					Token: "foobartesttoken",
+					Body:  models.UpdateToken{Metadata: map[string]any{"region": "us"}},
+				})
+				return err
+			},
+			want: policy.ErrForbidden,
+		},
+		{
+			name:   "delete without a grant",
+			policy: scoped,
+			token:  token,
+			ctx:    as("eu-cards"),
+			call: func(h *BaseHandler, ctx context.Context) error {
+				_, err := h.DeleteToken(ctx, get)
+				return err
+			},
+			want: policy.ErrForbidden,
+		},
+		{
+			name:   "admin endpoints need the admin action",
+			policy: policy.Default(),
+			token:  token,
+			ctx:    as("detokenizer"),
+			call: func(h *BaseHandler, ctx context.Context) error {
+				_, err := h.GetKeyRotation(ctx, &struct{}{})
+				return err
+			},
+			want: policy.ErrForbidden,
+		},
+		{
+			name:   "no principal",
+			policy: policy.Default(),
+			token:  token,
+			ctx:    context.Background(),
+			call: func(h *BaseHandler, ctx context.Context) error {
+				_, err := h.GetEncryptedToken(ctx, get)
+				return err
+			},
+			want: policy.ErrForbidden,
+		},
+		{
+			name:  "no policy",
+			token: token,
+			ctx:   testCtx,
+			call: func(h *BaseHandler, ctx context.Context) error {
+				_, err := h.GetEncryptedToken(ctx, get)
+				return err
+			},
+			want: policy.ErrForbidden,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &BaseHandler{Policy: tt.policy, Store: mock.Store{Token: tt.token}, Keys: testKeys, TokenKeys: testTokenKeys}
+			err := tt.call(h, tt.ctx)
+			if tt.want == nil {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, tt.want)
+		})
+	}
+}
+
+func TestRoutes_Forbidden(t *testing.T) {
+	router := Routes(&BaseHandler{
+		Auth:   staticAuth{principal: &auth.Principal{Subject: "api_key:reader", Roles: []string{"reader"}}},
+		Policy: policy.Default(),
+		Store:  mock.Store{Token: &models.Token{Token: "test-token", CreateToken: models.CreateToken{TokenType: "card"}}},
+	})
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/token/test-token/decrypt", nil))
+
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	var body Problem
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &body))
+	assert.Equal(t, "forbidden", body.Code)
+	assert.NotContains(t, rr.Body.String(), "api_key:reader")
+}
@@ -0,0 +1,301 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"tokenize/audit"
+	"tokenize/models"
+
+	"github.com/danielgtaylor/huma/v2"
+)
+
+func (h *BaseHandler) RegisterBatchRoutes(api huma.API) {
+	huma.Register(api, huma.Operation{
+		OperationID:   "CreateTokens",
+		Summary:       "Create a batch of tokens",
+		Method:        http.MethodPost,
+		Path:          "/tokens/batch",
+		DefaultStatus: http.StatusOK,
+		Errors: []int{
+			http.StatusUnauthorized,
+			http.StatusForbidden,
+			http.StatusBadRequest,
+		},
+	}, mapErrors(h.CreateTokens))
+
+	huma.Register(api, huma.Operation{
+		OperationID:   "GetDecryptedTokens",
+		Summary:       "Get a batch of decrypted tokens",
+		Method:        http.MethodPost,
+		Path:          "/tokens/decrypt",
+		DefaultStatus: http.StatusOK,
+		Errors: []int{
+			http.StatusUnauthorized,
+			http.StatusForbidden,
+			http.StatusBadRequest,
+		},
+	}, mapErrors(h.GetDecryptedTokens))
+}
+
+type BatchTokenRequest struct {
+	Mode models.TokenMode `query:"token_mode" enum:"hmac,random,card" doc:"Overrides the token mode of the token types"`
+	Body struct {
+		Items []models.CreateToken `json:"items" minItems:"1" maxItems:"1000" doc:"The payloads to tokenize"`
+	}
+}
+
+// BatchTokenResult is the outcome of an item of a batch, either its token or the error it failed with
+type BatchTokenResult struct {
+	Token string   `json:"token,omitempty"`
+	Error *Problem `json:"error,omitempty"`
+}
+
+type BatchTokenResponse struct {
+	Body struct {
+		Results []BatchTokenResult `json:"results" doc:"The result of each item, in the order of the items"`
+	}
+}
+
+// batchItem is an item of a batch as it is tokenized and stored
+type batchItem struct {
+	event *audit.Record
+	token *models.Token
+	err   error
+	// sameAs is the index of an earlier item with the same deterministic token, whose outcome the item shares
+	sameAs int
+	// created is set when the token of the item was written by the batch, and not read back from the store
+	created bool
+}
+
+// newBatchItem returns an item of a batch of the token type, with the audit record of its create
+func newBatchItem(ctx context.Context, tokenType string) *batchItem {
+	item := &batchItem{event: auditEvent(ctx, audit.OperationCreate, ""), sameAs: -1}
+	item.event.TokenType = tokenType
+	return item
+}
+
+// CreateTokens tokenizes every item of a batch like CreateToken, and stores the new tokens in a single batch. Each
+// item is authorized and audited on its own, and an item that fails is reported in its result without failing the
+// rest of the batch.
+func (h *BaseHandler) CreateTokens(ctx context.Context, in *BatchTokenRequest) (*BatchTokenResponse, error) {
+	tenant := tenantFrom(ctx)
+	keys, err := h.tenantKeys(tenant)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]*batchItem, len(in.Body.Items))
+	for i, data := range in.Body.Items {
+		items[i] = newBatchItem(ctx, data.TokenType)
+		items[i].token, items[i].err = h.tokenizeItem(ctx, in.Mode, data, tenant, keys.TokenKeys)
+	}
+	h.storeItems(ctx, tenant, keys, items)
+
+	events := make([]*audit.Record, len(items))
+	errs := make([]error, len(items))
+	for i, item := range items {
+		events[i], errs[i] = item.event, item.err
+	}
+
+	output := &BatchTokenResponse{}
+	output.Body.Results = make([]BatchTokenResult, len(items))
+	for i, err := range h.recordAudits(ctx, events, errs) {
+		if err != nil {
+			output.Body.Results[i].Error = itemProblem(err)
+			continue
+		}
+		output.Body.Results[i].Token = items[i].token.Token
+	}
+	return output, nil
+}
+
+// storeItems encrypts the tokenized items of a batch that did not fail and stores them in a single batch, setting the
+// token of the audit record of every item that is stored
+func (h *BaseHandler) storeItems(ctx context.Context, tenant string, keys models.TenantKeys, items []*batchItem) {
+	// items with the same deterministic token are written once
+	seen := map[string]int{}
+	writes := []*models.Token{}
+	written := []*batchItem{}
+	for i, item := range items {
+		if item.err != nil {
+			continue
+		}
+		if item.token.Mode.Deterministic() {
+			if j, found := seen[item.token.Token]; found {
+				item.sameAs = j
+				continue
+			}
+			seen[item.token.Token] = i
+		}
+		if item.err = item.token.Encrypt(ctx, keys.Keys); item.err != nil {
+			continue
+		}
+		writes = append(writes, item.token)
+		written = append(written, item)
+	}
+
+	// the store does not overwrite stored tokens, deterministic tokens that already exist are read back and reused like
+	// storeToken does, as long as they have the same token type and format. Random tokens that already exist fail,
+	// which is as unlikely as guessing one.
+	lookups := []string{}
+	if len(writes) > 0 {
+		for i, err := range h.Store.CreateTokens(ctx, writes) {
+			written[i].err, written[i].created = err, err == nil
+			if errors.Is(err, models.ErrTokenExists) && writes[i].Mode.Deterministic() {
+				lookups = append(lookups, writes[i].Token)
+			}
+		}
+	}
+	if len(lookups) > 0 {
+		existing, err := h.Store.GetTokens(ctx, tenant, lookups)
+		for _, item := range written {
+			if !errors.Is(item.err, models.ErrTokenExists) || !item.token.Mode.Deterministic() {
+				continue
+			}
+			if err != nil {
+				item.err = err
+			} else if stored, found := existing[item.token.Token]; found {
+				if item.err = item.token.CheckReuse(stored); item.err == nil {
+					item.token = stored
+				}
+			}
+		}
+	}
+
+	for _, item := range items {
+		if item.sameAs >= 0 {
+			shared := items[item.sameAs]
+			if item.err = shared.err; item.err == nil {
+				item.err = item.token.CheckReuse(shared.token)
+			}
+			if item.err == nil {
+				item.token = shared.token
+			}
+		}
+		if item.err == nil {
+			item.event.Token = item.token.Token
+		}
+	}
+}
+
+// tokenizeItem authorizes tokenizing an item of a batch and tokenizes it in the tenant, without encrypting it
+func (h *BaseHandler) tokenizeItem(ctx context.Context, requested models.TokenMode, data models.CreateToken, tenant string, tokenKeys models.KeyProvider) (*models.Token, error) {
+	payload := data.Payload
+	if err := h.authorizeTokenize(ctx, &data); err != nil {
+		return nil, err
+	}
+	spec, err := h.tokenType(&data, payload)
+	if err != nil {
+		return nil, err
+	}
+	mode, err := h.tokenMode(requested, &data, spec)
+	if err != nil {
+		return nil, err
+	}
+
+	base, err := models.NewBaseModel()
+	if err != nil {
+		return nil, err
+	}
+	base.Tenant = tenant
+	token := &models.Token{BaseModel: base, CreateToken: data, Mode: mode, RevealsLeft: data.MaxReveals}
+	if err := token.Tokenize(ctx, tokenKeys); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+type BatchDecryptRequest struct {
+	Reveal string `query:"reveal" doc:"Reveal policy to show the payloads with, each token type's default when empty"`
+	Body   struct {
+		Tokens []string `json:"tokens" minItems:"1" maxItems:"1000" doc:"The tokens to decrypt"`
+	}
+}
+
+// BatchDecryptResult is the outcome of a token of a batch, either the decrypted token or the error it failed with
+type BatchDecryptResult struct {
+	Token          string        `json:"token"`
+	DecryptedToken *models.Token `json:"decrypted_token,omitempty"`
+	Error          *Problem      `json:"error,omitempty"`
+}
+
+type BatchDecryptResponse struct {
+	Body struct {
+		Results []BatchDecryptResult `json:"results" doc:"The result of each token, in the order of the tokens"`
+	}
+}
+
+// GetDecryptedTokens decrypts every token of a batch like GetDecryptedToken, reading them from the store in a single
+// batch. Each token is authorized and audited on its own, and a token that is not found or may not be decrypted is
+// reported in its result without failing the rest of the batch.
+func (h *BaseHandler) GetDecryptedTokens(ctx context.Context, in *BatchDecryptRequest) (*BatchDecryptResponse, error) {
+	tenant := tenantFrom(ctx)
+	keys, err := h.tenantKeys(tenant)
+	if err != nil {
+		return nil, err
+	}
+
+	lookups := []string{}
+	for _, token := range in.Body.Tokens {
+		if models.ValidToken(token) {
+			lookups = append(lookups, token)
+		}
+	}
+	stored := map[string]*models.Token{}
+	if len(lookups) > 0 {
+		if stored, err = h.Store.GetTokens(ctx, tenant, lookups); err != nil {
+			return nil, err
+		}
+	}
+
+	output := &BatchDecryptResponse{}
+	output.Body.Results = make([]BatchDecryptResult, len(in.Body.Tokens))
+	events := make([]*audit.Record, len(in.Body.Tokens))
+	errs := make([]error, len(in.Body.Tokens))
+	for i, token := range in.Body.Tokens {
+		output.Body.Results[i].Token = token
+		event := auditEvent(ctx, audit.OperationDecrypt, token)
+		var tokenVal *models.Token
+		err := checkToken(token)
+		if err == nil {
+			tokenVal, err = h.decryptItem(ctx, stored[token], tenant, in.Reveal, keys.Keys)
+		}
+		if tokenVal != nil {
+			event.TokenType = tokenVal.TokenType
+		}
+		// the reveal is taken before the decrypt is recorded, so a token that is in the batch more often than it has
+		// reveals left is recorded once for each time, as a decrypt that failed
+		if err == nil {
+			err = h.consumeReveal(ctx, tokenVal)
+		}
+		if err == nil {
+			output.Body.Results[i].DecryptedToken = tokenVal
+		}
+		events[i], errs[i] = event, err
+	}
+	for i, err := range h.recordAudits(ctx, events, errs) {
+		if err != nil {
+			output.Body.Results[i].DecryptedToken = nil
+			output.Body.Results[i].Error = itemProblem(err)
+		}
+	}
+	return output, nil
+}
+
+// decryptItem returns a copy of a stored token of a batch with its payload shown by the reveal policy. The token is
+// returned along with the error when it was found but could not be decrypted.
+func (h *BaseHandler) decryptItem(ctx context.Context, stored *models.Token, tenant string, reveal string, keys models.KeyProvider) (*models.Token, error) {
+	// tokens of other tenants are reported as not found, like getToken does
+	if stored == nil || stored.Tenant != tenant {
+		return nil, models.ErrTokenNotFound
+	}
+	payload, err := h.revealPayload(ctx, stored, reveal, keys)
+	if err != nil {
+		return stored, err
+	}
+	decrypted := *stored
+	decrypted.Payload = payload
+	return &decrypted, nil
+}
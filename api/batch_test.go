@@ -0,0 +1,385 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"tokenize/audit"
+	"tokenize/auth"
+	"tokenize/models"
+	"tokenize/persistence"
+	"tokenize/persistence/mock"
+	"tokenize/policy"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// batchStore keeps the batches of tokens it is asked to create
+type batchStore struct {
+	mock.Store
+	batches [][]*models.Token
+}
+
+func (b *batchStore) CreateTokens(ctx context.Context, tokens []*models.Token) []error {
+	b.batches = append(b.batches, tokens)
+	return b.Store.CreateTokens(ctx, tokens)
+}
+
+func TestHandler_CreateTokens(t *testing.T) {
+	cardPolicy := &policy.Policy{Roles: map[string][]policy.Grant{
+		"cards": {{Actions: []policy.Action{policy.ActionTokenize}, TokenTypes: []string{"card"}}},
+	}}
+	cards := auth.WithPrincipal(testCtx, &auth.Principal{Subject: "api_key:cards", Roles: []string{"cards"}})
+	card := models.CreateToken{Payload: "4111111111111111", TokenType: "card"}
+	ssn := models.CreateToken{Payload: "123-45-6789", TokenType: "ssn"}
+	existing := &models.Token{CreateToken: card, Mode: models.TokenModes{}.ModeFor(card.TokenType)}
+	assert.NoError(t, existing.Tokenize(testCtx, testTokenKeys))
+	otherType := *existing
+	otherType.TokenType = "debit"
+
+	tests := []struct {
+		name       string
+		ctx        context.Context
+		policy     *policy.Policy
+		store      mock.Store
+		mode       models.TokenMode
+		items      []models.CreateToken
+		wantErrors []string
+		wantWrites int
+	}{
+		{
+			name:       "new tokens are written in one batch",
+			store:      mock.Store{},
+			items:      []models.CreateToken{card, ssn},
+			wantErrors: []string{"", ""},
+			wantWrites: 2,
+		},
+		{
+			name:       "existing deterministic tokens are reused",
+			store:      mock.Store{Tokens: []*models.Token{existing}},
+			items:      []models.CreateToken{card, ssn},
+			wantErrors: []string{"", ""},
+			wantWrites: 2,
+		},
+		{
+			name:       "existing deterministic tokens of another type are not reused",
+			store:      mock.Store{Tokens: []*models.Token{&otherType}},
+			items:      []models.CreateToken{card, ssn},
+			wantErrors: []string{"token_conflict", ""},
+			wantWrites: 2,
+		},
+		{
+			name:       "random tokens are not looked up",
+			store:      mock.Store{GetError: assert.AnError},
+			mode:       models.TokenModeRandom,
+			items:      []models.CreateToken{card, card},
+			wantErrors: []string{"", ""},
+			wantWrites: 2,
+		},
+		{
+			name:       "items the caller may not tokenize fail on their own",
+			ctx:        cards,
+			policy:     cardPolicy,
+			store:      mock.Store{},
+			items:      []models.CreateToken{ssn, card},
+			wantErrors: []string{"forbidden", ""},
+			wantWrites: 1,
+		},
+		{
+			name:       "invalid items fail on their own",
+			store:      mock.Store{},
+			mode:       models.TokenModeCard,
+			items:      []models.CreateToken{{Payload: "4111", TokenType: "card"}, card},
+			wantErrors: []string{"invalid_card_number", ""},
+			wantWrites: 1,
+		},
+		{
+			name:       "lookup errors",
+			store:      mock.Store{Tokens: []*models.Token{existing}, GetError: assert.AnError},
+			items:      []models.CreateToken{card, ssn},
+			wantErrors: []string{"internal_error", ""},
+			wantWrites: 2,
+		},
+		{
+			name:       "write errors",
+			store:      mock.Store{CreateError: persistence.ErrThrottled},
+			items:      []models.CreateToken{card, ssn},
+			wantErrors: []string{"throttled", "throttled"},
+			wantWrites: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, pol := tt.ctx, tt.policy
+			if ctx == nil {
+				ctx, pol = testCtx, testPolicy
+			}
+			store := &batchStore{Store: tt.store}
+			h := &BaseHandler{Policy: pol, Store: store, Keys: testKeys, TokenKeys: testTokenKeys}
+			in := &BatchTokenRequest{Mode: tt.mode}
+			in.Body.Items = tt.items
+
+			got, err := h.CreateTokens(ctx, in)
+			assert.NoError(t, err)
+			assert.Len(t, got.Body.Results, len(tt.items))
+			for i, result := range got.Body.Results {
+				if tt.wantErrors[i] == "" {
+					assert.Nil(t, result.Error)
+					assert.NotEmpty(t, result.Token)
+					continue
+				}
+				assert.Empty(t, result.Token)
+				if assert.NotNil(t, result.Error) {
+					assert.Equal(t, tt.wantErrors[i], result.Error.Code)
+				}
+			}
+
+			writes := 0
+			for _, batch := range store.batches {
+				writes += len(batch)
+				for _, token := range batch {
+					assert.NotEqual(t, card.Payload, token.Payload, "payloads should be encrypted")
+				}
+			}
+			assert.Equal(t, tt.wantWrites, writes)
+			assert.LessOrEqual(t, len(store.batches), 1)
+		})
+	}
+}
+
+func TestHandler_CreateTokensDuplicates(t *testing.T) {
+	store := &batchStore{Store: mock.Store{}}
+	auditStore := &mock.AuditStore{}
+	h := &BaseHandler{Policy: testPolicy, Store: store, Audit: auditStore, Keys: testKeys, TokenKeys: testTokenKeys}
+	in := &BatchTokenRequest{}
+	in.Body.Items = []models.CreateToken{
+		{Payload: "4111111111111111", TokenType: "card"},
+		{Payload: "5555555555554444", TokenType: "card"},
+		{Payload: "4111111111111111", TokenType: "card"},
+	}
+
+	got, err := h.CreateTokens(testCtx, in)
+	assert.NoError(t, err)
+	results := got.Body.Results
+	assert.Equal(t, results[0].Token, results[2].Token)
+	assert.NotEqual(t, results[0].Token, results[1].Token)
+	assert.Len(t, store.batches[0], 2, "the same token is only written once")
+
+	// every item is audited, including the duplicate
+	assert.Len(t, auditStore.Records, 3)
+	for _, record := range auditStore.Records {
+		assert.Equal(t, audit.OperationCreate, record.Operation)
+		assert.Equal(t, audit.OutcomeSuccess, record.Outcome)
+	}
+	history, _, err := auditStore.History(testCtx, "", results[0].Token, audit.Page{})
+	assert.NoError(t, err)
+	assert.Len(t, history, 2)
+}
+
+func TestHandler_CreateTokensUnknownTenant(t *testing.T) {
+	h := &BaseHandler{Policy: testPolicy, Store: &batchStore{}, Keys: testKeys, TokenKeys: testTokenKeys}
+	in := &BatchTokenRequest{}
+	in.Body.Items = []models.CreateToken{{Payload: "4111111111111111", TokenType: "card"}}
+
+	_, err := h.CreateTokens(tenantCtx("payments"), in)
+	assert.ErrorIs(t, err, models.ErrUnknownTenant)
+}
+
+func TestRoutes_CreateTokens(t *testing.T) {
+	router := Routes(&BaseHandler{
+		Auth: testAuth, Policy: testPolicy, Store: mock.Store{},
+		Keys: testKeys, TokenKeys: testTokenKeys,
+	})
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/tokens/batch?token_mode=card", strings.NewReader(`{"items": [
+		{"payload": "4111111111111111", "token_type": "card", "ttl": 0, "metadata": {}},
+		{"payload": "4111", "token_type": "card", "ttl": 0, "metadata": {}}
+	]}`)))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var body BatchTokenResponse
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &body.Body))
+	if assert.Len(t, body.Body.Results, 2) {
+		assert.NotEmpty(t, body.Body.Results[0].Token)
+		assert.Nil(t, body.Body.Results[0].Error)
+		assert.Equal(t, http.StatusBadRequest, body.Body.Results[1].Error.Status)
+		assert.Equal(t, "invalid_card_number", body.Body.Results[1].Error.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/tokens/batch", strings.NewReader(`{"items": []}`)))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	// batches hold up to 1000 items, as set by maxItems on BatchTokenRequest
+	items := make([]string, 1001)
+	for i := range items {
+		items[i] = fmt.Sprintf(`{"payload": "payload %d", "token_type": "card", "ttl": 0, "metadata": {}}`, i)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/tokens/batch",
+		strings.NewReader(`{"items": [`+strings.Join(items, ",")+`]}`)))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestHandler_GetDecryptedTokens(t *testing.T) {
+	sealed := func(token string, tenant string, tokenType string) *models.Token {
+		tokenVal := &models.Token{
+			Token:       token,
+			BaseModel:   models.BaseModel{Tenant: tenant},
+			CreateToken: models.CreateToken{Payload: "payload of " + token, TokenType: tokenType},
+		}
+		assert.NoError(t, tokenVal.Encrypt(context.Background(), testKeys))
+		return tokenVal
+	}
+	tampered := sealed("tampered", "", "card")
+	tampered.TokenType = "ssn"
+	tokens := []*models.Token{
+		sealed("card-1", "", "card"),
+		sealed("card-2", "", "card"),
+		sealed("ssn-1", "", "ssn"),
+		sealed("card-3", "payments", "card"),
+		tampered,
+	}
+	cardPolicy := &policy.Policy{Roles: map[string][]policy.Grant{
+		"cards": {{Actions: []policy.Action{policy.ActionDetokenize}, TokenTypes: []string{"card"}}},
+	}}
+	cards := auth.WithPrincipal(testCtx, &auth.Principal{Subject: "api_key:cards", Roles: []string{"cards"}})
+
+	tests := []struct {
+		name       string
+		ctx        context.Context
+		policy     *policy.Policy
+		store      mock.Store
+		tokens     []string
+		wantErrors []string
+		wantErr    error
+	}{
+		{
+			name:       "decrypts every token",
+			store:      mock.Store{Tokens: tokens},
+			tokens:     []string{"card-2", "ssn-1", "card-1", "card-2"},
+			wantErrors: []string{"", "", "", ""},
+		},
+		{
+			name:       "tokens that are not found fail on their own",
+			store:      mock.Store{Tokens: tokens},
+			tokens:     []string{"card-1", "missing", "card-3", ""},
+			wantErrors: []string{"", "token_not_found", "token_not_found", "invalid_request"},
+		},
+		{
+			name:       "tokens the caller may not decrypt fail on their own",
+			ctx:        cards,
+			policy:     cardPolicy,
+			store:      mock.Store{Tokens: tokens},
+			tokens:     []string{"ssn-1", "card-1"},
+			wantErrors: []string{"forbidden", ""},
+		},
+		{
+			name:       "payloads that fail their integrity check fail on their own",
+			store:      mock.Store{Tokens: tokens},
+			tokens:     []string{"tampered", "card-1"},
+			wantErrors: []string{"integrity_check_failed", ""},
+		},
+		{
+			name:    "store errors fail the batch",
+			store:   mock.Store{GetError: persistence.ErrThrottled},
+			tokens:  []string{"card-1"},
+			wantErr: persistence.ErrThrottled,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, pol := tt.ctx, tt.policy
+			if ctx == nil {
+				ctx, pol = testCtx, testPolicy
+			}
+			h := &BaseHandler{Policy: pol, Store: tt.store, Keys: testKeys, TokenKeys: testTokenKeys}
+			in := &BatchDecryptRequest{}
+			in.Body.Tokens = tt.tokens
+
+			got, err := h.GetDecryptedTokens(ctx, in)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Len(t, got.Body.Results, len(tt.tokens))
+			for i, result := range got.Body.Results {
+				assert.Equal(t, tt.tokens[i], result.Token)
+				if tt.wantErrors[i] == "" {
+					assert.Nil(t, result.Error)
+					if assert.NotNil(t, result.DecryptedToken) {
+						assert.Equal(t, "payload of "+tt.tokens[i], result.DecryptedToken.Payload)
+					}
+					continue
+				}
+				assert.Nil(t, result.DecryptedToken)
+				if assert.NotNil(t, result.Error) {
+					assert.Equal(t, tt.wantErrors[i], result.Error.Code)
+				}
+			}
+		})
+	}
+
+	for _, stored := range tokens {
+		assert.NotContains(t, stored.Payload, "payload of", "stored tokens are not changed")
+	}
+
+	// payloads are shown with the reveal policy
+	h := &BaseHandler{Policy: testPolicy, Store: mock.Store{Tokens: tokens}, Keys: testKeys}
+	in := &BatchDecryptRequest{Reveal: "last4"}
+	in.Body.Tokens = []string{"card-1"}
+	got, err := h.GetDecryptedTokens(testCtx, in)
+	assert.NoError(t, err)
+	assert.Equal(t, strings.Repeat("*", 13)+"rd-1", got.Body.Results[0].DecryptedToken.Payload)
+}
+
+func TestHandler_GetDecryptedTokensAudit(t *testing.T) {
+	tokenVal := &models.Token{Token: "card-1", CreateToken: models.CreateToken{Payload: "4111111111111111", TokenType: "card"}}
+	assert.NoError(t, tokenVal.Encrypt(context.Background(), testKeys))
+	auditStore := &mock.AuditStore{}
+	h := &BaseHandler{Policy: testPolicy, Store: mock.Store{Tokens: []*models.Token{tokenVal}}, Audit: auditStore, Keys: testKeys}
+	in := &BatchDecryptRequest{}
+	in.Body.Tokens = []string{"card-1", "missing", "card-1"}
+
+	_, err := h.GetDecryptedTokens(testCtx, in)
+	assert.NoError(t, err)
+	assert.Len(t, auditStore.Records, 3)
+	history, _, err := auditStore.History(testCtx, "", "card-1", audit.Page{})
+	assert.NoError(t, err)
+	if assert.Len(t, history, 2) {
+		assert.Equal(t, audit.OutcomeSuccess, history[0].Outcome)
+		assert.Equal(t, "card", history[0].TokenType)
+		assert.Equal(t, audit.OperationDecrypt, history[1].Operation)
+	}
+	history, _, err = auditStore.History(testCtx, "", "missing", audit.Page{})
+	assert.NoError(t, err)
+	if assert.Len(t, history, 1) {
+		assert.Equal(t, audit.OutcomeNotFound, history[0].Outcome)
+	}
+}
+
+func TestRoutes_GetDecryptedTokens(t *testing.T) {
+	tokenVal := &models.Token{Token: "card-1", CreateToken: models.CreateToken{Payload: "4111111111111111", TokenType: "card"}}
+	assert.NoError(t, tokenVal.Encrypt(context.Background(), testKeys))
+	router := Routes(&BaseHandler{Auth: testAuth, Policy: testPolicy, Store: mock.Store{Tokens: []*models.Token{tokenVal}}, Keys: testKeys})
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/tokens/decrypt", strings.NewReader(`{"tokens": ["card-1", "missing"]}`)))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var body BatchDecryptResponse
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &body.Body))
+	if assert.Len(t, body.Body.Results, 2) {
+		assert.Equal(t, "4111111111111111", body.Body.Results[0].DecryptedToken.Payload)
+		assert.Equal(t, http.StatusNotFound, body.Body.Results[1].Error.Status)
+	}
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/tokens/decrypt", strings.NewReader(`{"tokens": []}`)))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
@@ -0,0 +1,288 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"tokenize/audit"
+	"tokenize/jsonpath"
+	"tokenize/models"
+
+	"github.com/danielgtaylor/huma/v2"
+)
+
+func (h *BaseHandler) RegisterDocumentRoutes(api huma.API) {
+	huma.Register(api, huma.Operation{
+		OperationID:   "TokenizeDocument",
+		Summary:       "Replace fields of a JSON document with tokens",
+		Method:        http.MethodPost,
+		Path:          "/documents/tokenize",
+		DefaultStatus: http.StatusOK,
+		Errors: []int{
+			http.StatusUnauthorized,
+			http.StatusForbidden,
+			http.StatusBadRequest,
+		},
+	}, mapErrors(h.TokenizeDocument))
+
+	huma.Register(api, huma.Operation{
+		OperationID:   "DetokenizeDocument",
+		Summary:       "Replace tokens in fields of a JSON document with their payloads",
+		Method:        http.MethodPost,
+		Path:          "/documents/detokenize",
+		DefaultStatus: http.StatusOK,
+		Errors: []int{
+			http.StatusUnauthorized,
+			http.StatusForbidden,
+			http.StatusBadRequest,
+			http.StatusNotFound,
+			http.StatusUnprocessableEntity,
+			http.StatusGone,
+		},
+	}, mapErrors(h.DetokenizeDocument))
+}
+
+// DocumentField selects the values of a document to tokenize, and the token type they are tokenized as
+type DocumentField struct {
+	Path      string         `json:"path" minLength:"1" doc:"JSONPath of the values, such as $.card.number or $.cards[*].pan"`
+	TokenType string         `json:"token_type" doc:"Token type of the values"`
+	TTL       int64          `json:"ttl,omitempty" minimum:"0" doc:"TTL of the tokens in seconds, 0 never expires"`
+	Metadata  map[string]any `json:"metadata,omitempty" doc:"Metadata of the tokens"`
+}
+
+type TokenizeDocumentRequest struct {
+	Mode models.TokenMode `query:"token_mode" enum:"hmac,random,card" doc:"Overrides the token mode of the token types"`
+	Body struct {
+		Document any             `json:"document" doc:"The JSON document"`
+		Fields   []DocumentField `json:"fields" minItems:"1" doc:"The fields to tokenize"`
+	}
+}
+
+type DetokenizeDocumentRequest struct {
+	Body struct {
+		Document any      `json:"document" doc:"The JSON document"`
+		Paths    []string `json:"paths" minItems:"1" doc:"JSONPaths of the tokens to replace with their payloads"`
+	}
+}
+
+type DocumentResponse struct {
+	Body struct {
+		Document any `json:"document"`
+	}
+}
+
+// TokenizeDocument replaces the values the fields select with their tokens, tokenizing each one like CreateToken.
+// Selected values have to be strings, and fields may not select the same values. Every value is checked, authorized
+// and tokenized before any token is stored, and the tokens are then stored in a single batch like CreateTokens does.
+// The document is only returned when every value was tokenized, and the tokens a document that fails created are
+// deleted again.
+func (h *BaseHandler) TokenizeDocument(ctx context.Context, in *TokenizeDocumentRequest) (*DocumentResponse, error) {
+	paths, err := parsePaths(in.Body.Fields, func(field DocumentField) string { return field.Path })
+	if err != nil {
+		return nil, err
+	}
+	// a value selected twice would be tokenized twice, the second time as its own token
+	if err := checkOverlaps(paths); err != nil {
+		return nil, err
+	}
+	tenant := tenantFrom(ctx)
+	keys, err := h.tenantKeys(tenant)
+	if err != nil {
+		return nil, err
+	}
+
+	// the values are tokenized in the order they are replaced in below, and left in the document until then
+	items := []*batchItem{}
+	for i, field := range in.Body.Fields {
+		_, err := paths[i].Replace(in.Body.Document, func(value any) (any, error) {
+			payload, err := documentString(paths[i], value)
+			if err != nil {
+				return nil, err
+			}
+			item := newBatchItem(ctx, field.TokenType)
+			item.token, err = h.tokenizeItem(ctx, in.Mode, models.CreateToken{
+				Payload:   payload,
+				TokenType: field.TokenType,
+				TTL:       field.TTL,
+				Metadata:  field.Metadata,
+			}, tenant, keys.TokenKeys)
+			if err != nil {
+				return nil, h.recordAudit(ctx, item.event, err)
+			}
+			items = append(items, item)
+			return value, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	h.storeItems(ctx, tenant, keys, items)
+	events := make([]*audit.Record, len(items))
+	errs := make([]error, len(items))
+	for i, item := range items {
+		events[i], errs[i] = item.event, item.err
+		if err == nil {
+			err = item.err
+		}
+	}
+	// every token of a document that fails is recorded as failed with it
+	for i := range errs {
+		if errs[i] == nil {
+			errs[i] = err
+		}
+	}
+	for _, auditErr := range h.recordAudits(ctx, events, errs) {
+		if auditErr != nil && err == nil {
+			err = auditErr
+		}
+	}
+	if err != nil {
+		h.discardItems(ctx, items)
+		return nil, err
+	}
+
+	next := 0
+	document := in.Body.Document
+	for _, path := range paths {
+		document, err = path.Replace(document, func(any) (any, error) {
+			token := items[next].token.Token
+			next++
+			return token, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	output := &DocumentResponse{}
+	output.Body.Document = document
+	return output, nil
+}
+
+// discardItems deletes the random tokens a document that failed created. Deterministic tokens are left in the store,
+// another request may have been given the same token since, and tokenizing the payload again reuses them.
+func (h *BaseHandler) discardItems(ctx context.Context, items []*batchItem) {
+	for _, item := range items {
+		if !item.created || item.token.Mode.Deterministic() {
+			continue
+		}
+		if err := h.Store.DeleteToken(ctx, item.token); err != nil {
+			slog.Error("unable to delete token of a document that failed", "request_id", requestIDFrom(ctx), "error", err)
+		}
+	}
+}
+
+// revealedToken is a token of a document whose payload was shown, and the audit record of its decrypt
+type revealedToken struct {
+	token *models.Token
+	event *audit.Record
+}
+
+// DetokenizeDocument replaces the tokens the paths select with their payloads, decrypting each one like
+// GetDecryptedToken. The document is only returned when every token was decrypted. Every token is resolved and
+// authorized before the reveals of the tokens with a reveal limit are taken, all of them or none, so a token that
+// cannot be decrypted does not use up any reveals, and the decrypts are recorded once the reveals were taken. A token
+// that is in the document several times is decrypted once.
+func (h *BaseHandler) DetokenizeDocument(ctx context.Context, in *DetokenizeDocumentRequest) (*DocumentResponse, error) {
+	paths, err := parsePaths(in.Body.Paths, func(path string) string { return path })
+	if err != nil {
+		return nil, err
+	}
+	// a token selected twice would be read the second time as its payload, which is then taken for a token
+	if err := checkOverlaps(paths); err != nil {
+		return nil, err
+	}
+
+	revealed := map[string]*revealedToken{}
+	order := []*revealedToken{}
+	document := in.Body.Document
+	for _, path := range paths {
+		document, err = path.Replace(document, func(value any) (any, error) {
+			token, err := documentString(path, value)
+			if err != nil {
+				return nil, err
+			}
+			if found, ok := revealed[token]; ok {
+				return found.token.Payload, nil
+			}
+			event := auditEvent(ctx, audit.OperationDecrypt, token)
+			if err := checkToken(token); err != nil {
+				return nil, h.recordAudit(ctx, event, err)
+			}
+			tokenVal, err := h.resolveToken(ctx, token, "", event)
+			if err != nil {
+				return nil, h.recordAudit(ctx, event, err)
+			}
+			revealed[token] = &revealedToken{token: tokenVal, event: event}
+			order = append(order, revealed[token])
+			return tokenVal.Payload, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the reveals of every token are taken together, so a token without reveals left does not use up those of the
+	// others, and every token of the document is then recorded with the outcome of the document
+	tokens := make([]*models.Token, len(order))
+	for i, entry := range order {
+		tokens[i] = entry.token
+	}
+	err = h.consumeReveals(ctx, tokens)
+	events := make([]*audit.Record, len(order))
+	errs := make([]error, len(order))
+	for i, entry := range order {
+		events[i] = entry.event
+		errs[i] = err
+	}
+	for _, auditErr := range h.recordAudits(ctx, events, errs) {
+		if auditErr != nil && err == nil {
+			err = auditErr
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	output := &DocumentResponse{}
+	output.Body.Document = document
+	return output, nil
+}
+
+// parsePaths parses the path of every entry, so a document is not changed at all when one of them is invalid
+func parsePaths[T any](entries []T, path func(T) string) ([]jsonpath.Path, error) {
+	paths := make([]jsonpath.Path, len(entries))
+	for i, entry := range entries {
+		parsed, err := jsonpath.Parse(path(entry))
+		if err != nil {
+			return nil, err
+		}
+		paths[i] = parsed
+	}
+	return paths, nil
+}
+
+// checkOverlaps rejects paths that select the same values as an earlier path, in part or in full
+func checkOverlaps(paths []jsonpath.Path) error {
+	for i := range paths {
+		for j := range i {
+			if paths[i].Overlaps(paths[j]) {
+				return fmt.Errorf("%w: %s selects values %s selects", jsonpath.ErrInvalidPath, paths[i], paths[j])
+			}
+		}
+	}
+	return nil
+}
+
+// documentString returns a value selected by the path, which has to be a string
+func documentString(path jsonpath.Path, value any) (string, error) {
+	s, ok := value.(string)
+	if !ok {
+		// the value is not echoed back, it may be the sensitive data being tokenized
+		return "", huma.Error400BadRequest(fmt.Sprintf("the value at %s is not a string", path))
+	}
+	return s, nil
+}
@@ -0,0 +1,293 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"tokenize/auth"
+	"tokenize/jsonpath"
+	"tokenize/models"
+	"tokenize/persistence/mock"
+	"tokenize/policy"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// documentStore returns the tokens created through it
+type documentStore struct {
+	recordingStore
+}
+
+func (d *documentStore) GetToken(_ context.Context, tenant string, token string) (*models.Token, error) {
+	for _, created := range d.created {
+		if created.Tenant == tenant && created.Token == token {
+			stored := *created
+			return &stored, nil
+		}
+	}
+	return nil, models.ErrTokenNotFound
+}
+
+// decodeDocument decodes a JSON document like huma decodes request bodies
+func decodeDocument(t *testing.T, doc string) any {
+	var value any
+	assert.NoError(t, json.Unmarshal([]byte(doc), &value))
+	return value
+}
+
+func TestHandler_Documents(t *testing.T) {
+	const doc = `{
+		"card": {"number": "4111111111111111", "exp": "0128"},
+		"cards": [{"pan": "5555555555554444"}, {"pan": "4111111111111111"}],
+		"name": "A. Cardholder"
+	}`
+	store := &documentStore{}
+	h := &BaseHandler{Policy: testPolicy, Store: store, Keys: testKeys, TokenKeys: testTokenKeys}
+
+	in := &TokenizeDocumentRequest{}
+	in.Body.Document = decodeDocument(t, doc)
+	in.Body.Fields = []DocumentField{
+		{Path: "$.card.number", TokenType: "pan"},
+		{Path: "$.cards[*].pan", TokenType: "pan", Metadata: map[string]any{"source": "wallet"}},
+		{Path: "$.missing", TokenType: "pan"},
+	}
+	tokenized, err := h.TokenizeDocument(testCtx, in)
+	assert.NoError(t, err)
+
+	document := tokenized.Body.Document.(map[string]any)
+	card := document["card"].(map[string]any)
+	cards := document["cards"].([]any)
+	assert.Equal(t, "0128", card["exp"], "fields that are not selected are kept")
+	assert.Equal(t, "A. Cardholder", document["name"])
+	assert.NotEqual(t, "4111111111111111", card["number"])
+	assert.Equal(t, card["number"], cards[1].(map[string]any)["pan"], "the same value gets the same token")
+	assert.Len(t, store.created, 2, "a value that is in the document twice is stored once")
+	assert.Equal(t, map[string]any{"source": "wallet"}, store.created[1].Metadata)
+	for _, created := range store.created {
+		assert.Equal(t, "pan", created.TokenType)
+	}
+
+	out := &DetokenizeDocumentRequest{}
+	out.Body.Document = tokenized.Body.Document
+	out.Body.Paths = []string{"$.card.number", "$.cards[*].pan"}
+	detokenized, err := h.DetokenizeDocument(testCtx, out)
+	assert.NoError(t, err)
+	encoded, err := json.Marshal(detokenized.Body.Document)
+	assert.NoError(t, err)
+	assert.JSONEq(t, doc, string(encoded))
+}
+
+func TestHandler_DocumentErrors(t *testing.T) {
+	cardPolicy := &policy.Policy{Roles: map[string][]policy.Grant{
+		"cards": {{Actions: []policy.Action{policy.ActionTokenize, policy.ActionDetokenize}, TokenTypes: []string{"card"}}},
+	}}
+	cards := auth.WithPrincipal(testCtx, &auth.Principal{Subject: "api_key:cards", Roles: []string{"cards"}})
+	const doc = `{"card": {"number": "4111111111111111", "retries": 3}, "ssn": "123-45-6789"}`
+
+	tests := []struct {
+		name       string
+		ctx        context.Context
+		tokenize   []DocumentField
+		detokenize []string
+		wantStatus int
+	}{
+		{
+			name:       "invalid path",
+			tokenize:   []DocumentField{{Path: "$.card.number", TokenType: "card"}, {Path: "card", TokenType: "card"}},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "value that is not a string",
+			tokenize:   []DocumentField{{Path: "$.card.retries", TokenType: "card"}},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "token type the caller may not tokenize",
+			ctx:        cards,
+			tokenize:   []DocumentField{{Path: "$.card.number", TokenType: "card"}, {Path: "$.ssn", TokenType: "ssn"}},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "overlapping paths",
+			tokenize:   []DocumentField{{Path: "$.card", TokenType: "card"}, {Path: "$.*.number", TokenType: "card"}},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "invalid detokenize path",
+			detokenize: []string{"$.card["},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "duplicate detokenize paths",
+			detokenize: []string{"$.card.number", "$.card.number"},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "detokenize path inside another",
+			detokenize: []string{"$.card", "$.card.number"},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "token that does not exist",
+			detokenize: []string{"$.ssn"},
+			wantStatus: http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, pol := testCtx, testPolicy
+			if tt.ctx != nil {
+				ctx, pol = tt.ctx, cardPolicy
+			}
+			store := &documentStore{}
+			h := &BaseHandler{Policy: pol, Store: store, Keys: testKeys, TokenKeys: testTokenKeys}
+
+			var err error
+			if tt.tokenize != nil {
+				in := &TokenizeDocumentRequest{}
+				in.Body.Document = decodeDocument(t, doc)
+				in.Body.Fields = tt.tokenize
+				_, err = mapErrors(h.TokenizeDocument)(ctx, in)
+			} else {
+				in := &DetokenizeDocumentRequest{}
+				in.Body.Document = decodeDocument(t, doc)
+				in.Body.Paths = tt.detokenize
+				_, err = mapErrors(h.DetokenizeDocument)(ctx, in)
+			}
+			var statusErr huma.StatusError
+			assert.ErrorAs(t, err, &statusErr)
+			assert.Equal(t, tt.wantStatus, statusErr.GetStatus())
+			assert.NotContains(t, err.Error(), "4111111111111111", "values are not echoed back")
+			assert.Empty(t, store.created, "nothing is stored when a value fails")
+		})
+	}
+}
+
+func TestHandler_TokenizeDocumentStoreFails(t *testing.T) {
+	tokenize := func(mode models.TokenMode) (*limitedStore, error) {
+		store := &limitedStore{}
+		store.createErrors = []error{nil, assert.AnError}
+		h := &BaseHandler{Policy: testPolicy, Store: store, Keys: testKeys, TokenKeys: testTokenKeys}
+		in := &TokenizeDocumentRequest{Mode: mode}
+		in.Body.Document = map[string]any{"a": "first secret", "b": "second secret"}
+		in.Body.Fields = []DocumentField{{Path: "$.a", TokenType: "secret"}, {Path: "$.b", TokenType: "secret"}}
+		_, err := h.TokenizeDocument(testCtx, in)
+		return store, err
+	}
+
+	store, err := tokenize(models.TokenModeRandom)
+	assert.ErrorIs(t, err, assert.AnError)
+	if assert.Len(t, store.created, 2) {
+		assert.Equal(t, []string{store.created[0].Token}, store.deleted, "the tokens the document created are deleted")
+	}
+
+	store, err = tokenize(models.TokenModeHMAC)
+	assert.ErrorIs(t, err, assert.AnError)
+	assert.Empty(t, store.deleted, "deterministic tokens are kept for the next tokenization of the payload")
+}
+
+func TestHandler_DetokenizeDocumentLimitedReveals(t *testing.T) {
+	store := &limitedStore{}
+	auditStore := &mock.AuditStore{}
+	h := &BaseHandler{Policy: testPolicy, Store: store, Audit: auditStore, Keys: testKeys, TokenKeys: testTokenKeys}
+	in := &NewTokenRequest{}
+	in.Body.Data = models.CreateToken{Payload: "one time secret", TokenType: "secret", MaxReveals: 1}
+	created, err := h.CreateToken(testCtx, in)
+	assert.NoError(t, err)
+	token := created.Body.Token
+	store.Token = store.created[0]
+
+	detokenize := func(paths ...string) (*DocumentResponse, error) {
+		out := &DetokenizeDocumentRequest{}
+		out.Body.Document = map[string]any{"a": token, "b": token, "missing": "unknown-token"}
+		out.Body.Paths = paths
+		return h.DetokenizeDocument(testCtx, out)
+	}
+
+	// a token selected twice is rejected before its payload is read as a token and recorded
+	_, err = detokenize("$.a", "$.a")
+	assert.ErrorIs(t, err, jsonpath.ErrInvalidPath)
+
+	// a token that fails leaves the reveals of every token
+	_, err = detokenize("$.a", "$.missing")
+	assert.ErrorIs(t, err, models.ErrTokenNotFound)
+	assert.Equal(t, int64(1), store.Token.RevealsLeft)
+	assert.Empty(t, store.deleted)
+
+	got, err := detokenize("$.a", "$.b")
+	assert.NoError(t, err)
+	document := got.Body.Document.(map[string]any)
+	assert.Equal(t, "one time secret", document["a"])
+	assert.Equal(t, "one time secret", document["b"], "a token that is in the document twice takes one reveal")
+	assert.Equal(t, []string{token}, store.deleted)
+
+	operations := []string{}
+	for _, record := range auditStore.Records {
+		operations = append(operations, string(record.Operation)+" "+string(record.Outcome)+" "+record.Token)
+	}
+	assert.Equal(t, []string{
+		"create success " + token,
+		"decrypt not_found unknown-token",
+		"decrypt success " + token,
+	}, operations, "tokens are not recorded when another token of the document fails")
+}
+
+func TestHandler_DetokenizeDocumentExhaustedToken(t *testing.T) {
+	store := &limitedStore{}
+	h := &BaseHandler{Policy: testPolicy, Store: store, Audit: &mock.AuditStore{}, Keys: testKeys, TokenKeys: testTokenKeys}
+	tokens := []string{}
+	for range 2 {
+		in := &NewTokenRequest{}
+		in.Body.Data = models.CreateToken{Payload: "one time secret", TokenType: "secret", MaxReveals: 1}
+		created, err := h.CreateToken(testCtx, in)
+		assert.NoError(t, err)
+		tokens = append(tokens, created.Body.Token)
+	}
+	// the reveal of the second token is taken by another request after the document read it
+	exhausted := *store.created[1]
+	exhausted.RevealsLeft = 0
+	store.Tokens = []*models.Token{store.created[0], &exhausted}
+
+	out := &DetokenizeDocumentRequest{}
+	out.Body.Document = map[string]any{"a": tokens[0], "b": tokens[1]}
+	out.Body.Paths = []string{"$.a", "$.b"}
+	_, err := h.DetokenizeDocument(testCtx, out)
+	assert.ErrorIs(t, err, models.ErrRevealsExhausted)
+	assert.Equal(t, int64(1), store.created[0].RevealsLeft, "the single use token keeps its reveal")
+	assert.Empty(t, store.deleted)
+}
+
+func TestRoutes_Documents(t *testing.T) {
+	router := Routes(&BaseHandler{Auth: testAuth, Policy: testPolicy, Store: &documentStore{}, Keys: testKeys, TokenKeys: testTokenKeys})
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/documents/tokenize", strings.NewReader(`{
+		"document": {"card": {"number": "4111111111111111", "exp": "0128"}},
+		"fields": [{"path": "$.card.number", "token_type": "card"}]
+	}`)))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var body DocumentResponse
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &body.Body))
+	card := body.Body.Document.(map[string]any)["card"].(map[string]any)
+	assert.NotEqual(t, "4111111111111111", card["number"])
+	assert.Equal(t, "0128", card["exp"])
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/documents/tokenize", strings.NewReader(`{
+		"document": {}, "fields": [{"path": "$..number", "token_type": "card"}]
+	}`)))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "invalid_path")
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/documents/detokenize", strings.NewReader(`{
+		"document": {"card": {"number": "`+card["number"].(string)+`"}}, "paths": ["$.card.number"]
+	}`)))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"number":"4111111111111111"`)
+}
@@ -0,0 +1,197 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"tokenize/jsonpath"
+	"tokenize/models"
+	"tokenize/persistence"
+	"tokenize/policy"
+	"tokenize/rotation"
+
+	"github.com/danielgtaylor/huma/v2"
+)
+
+// retryAfter is how many seconds clients are asked to wait when the store is throttling
+const retryAfter = 1
+
+// Problem is an RFC 9457 problem details response with a stable machine readable error code. Its detail never
+// includes payloads, tokens or the text of unexpected errors.
+type Problem struct {
+	huma.ErrorModel
+	Code string `json:"code" doc:"Stable machine readable error code" example:"token_not_found"`
+}
+
+// statusCodes are the error codes of problems that do not come from a mapped domain error
+var statusCodes = map[int]string{
+	http.StatusBadRequest:            "invalid_request",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not_found",
+	http.StatusMethodNotAllowed:      "method_not_allowed",
+	http.StatusNotAcceptable:         "not_acceptable",
+	http.StatusConflict:              "conflict",
+	http.StatusGone:                  "gone",
+	http.StatusRequestEntityTooLarge: "request_too_large",
+	http.StatusUnsupportedMediaType:  "unsupported_media_type",
+	http.StatusUnprocessableEntity:   "unprocessable",
+	http.StatusNotImplemented:        "not_implemented",
+	http.StatusServiceUnavailable:    "unavailable",
+}
+
+// domainErrors maps the errors handlers return to the problem reported for them
+var domainErrors = []struct {
+	err     error
+	status  int
+	code    string
+	headers http.Header
+}{
+	{models.ErrTokenNotFound, http.StatusNotFound, "token_not_found", nil},
+	{models.ErrIntegrity, http.StatusUnprocessableEntity, "integrity_check_failed", nil},
+	{models.ErrTokenChanged, http.StatusConflict, "token_changed", nil},
+	{models.ErrRevealsExhausted, http.StatusGone, "reveals_exhausted", nil},
+	{models.ErrTokenExists, http.StatusConflict, "token_exists", nil},
+	{models.ErrTokenConflict, http.StatusConflict, "token_conflict", nil},
+	{models.ErrInvalidToken, http.StatusBadRequest, "invalid_token", nil},
+	{models.ErrEmptyUpdate, http.StatusBadRequest, "empty_update", nil},
+	{models.ErrInvalidCardNumber, http.StatusBadRequest, "invalid_card_number", nil},
+	{models.ErrCardTooShort, http.StatusBadRequest, "card_too_short", nil},
+	{models.ErrInvalidCardExpiry, http.StatusBadRequest, "invalid_card_expiry", nil},
+	{models.ErrInvalidSSN, http.StatusBadRequest, "invalid_ssn", nil},
+	{models.ErrInvalidBankAccount, http.StatusBadRequest, "invalid_bank_account", nil},
+	{models.ErrInvalidRoutingNumber, http.StatusBadRequest, "invalid_routing_number", nil},
+	{models.ErrInvalidEmail, http.StatusBadRequest, "invalid_email", nil},
+	{models.ErrInvalidPhone, http.StatusBadRequest, "invalid_phone", nil},
+	{models.ErrUnknownTokenMode, http.StatusBadRequest, "unknown_token_mode", nil},
+	{policy.ErrForbidden, http.StatusForbidden, "forbidden", nil},
+	{models.ErrUnknownTenant, http.StatusForbidden, "unknown_tenant", nil},
+	{rotation.ErrAlreadyRunning, http.StatusConflict, "rotation_running", nil},
+	{persistence.ErrInvalidCursor, http.StatusBadRequest, "invalid_cursor", nil},
+	{persistence.ErrTooManyReveals, http.StatusBadRequest, "too_many_reveals", nil},
+	{jsonpath.ErrInvalidPath, http.StatusBadRequest, "invalid_path", nil},
+	{models.ErrUnknownRevealPolicy, http.StatusBadRequest, "unknown_reveal_policy", nil},
+	{models.ErrUnknownTokenType, http.StatusBadRequest, "unknown_token_type", nil},
+	{models.ErrInvalidPayload, http.StatusBadRequest, "invalid_payload", nil},
+	{models.ErrInvalidMetadata, http.StatusBadRequest, "invalid_metadata", nil},
+	{models.ErrTTLTooLong, http.StatusBadRequest, "ttl_too_long", nil},
+	{models.ErrNegativeTTL, http.StatusBadRequest, "invalid_ttl", nil},
+	{models.ErrInvalidGrant, http.StatusUnauthorized, "invalid_grant", nil},
+	{models.ErrGrantClientMismatch, http.StatusForbidden, "grant_client_mismatch", nil},
+	{models.ErrGrantNotFound, http.StatusNotFound, "grant_not_found", nil},
+	{models.ErrGrantExpired, http.StatusGone, "grant_expired", nil},
+	{models.ErrGrantRevoked, http.StatusGone, "grant_revoked", nil},
+	{persistence.ErrThrottled, http.StatusServiceUnavailable, "throttled",
+		http.Header{"Retry-After": {strconv.Itoa(retryAfter)}}},
+}
+
+func init() {
+	huma.NewError = newProblem
+}
+
+// newProblem replaces huma.NewError so every error response is a Problem. Huma reports request validation failures
+// as 422, they are reported as 400 so that 422 is left for payloads that fail their integrity check.
+func newProblem(status int, message string, errs ...error) huma.StatusError {
+	code := statusCodes[status]
+	if status == http.StatusUnprocessableEntity {
+		status, code = http.StatusBadRequest, "validation_failed"
+	}
+	if status >= http.StatusInternalServerError {
+		// unexpected errors can carry anything, including payloads, so only their status is reported
+		if code == "" {
+			code, message = "internal_error", http.StatusText(status)
+		}
+		errs = nil
+	}
+
+	var details []*huma.ErrorDetail
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		detail := &huma.ErrorDetail{Message: err.Error()}
+		var detailer huma.ErrorDetailer
+		if errors.As(err, &detailer) {
+			// the invalid value is not echoed back, it may be the sensitive data being tokenized
+			detail = &huma.ErrorDetail{Message: detailer.ErrorDetail().Message, Location: detailer.ErrorDetail().Location}
+		}
+		details = append(details, detail)
+	}
+
+	return &Problem{
+		ErrorModel: huma.ErrorModel{
+			Status: status,
+			Title:  http.StatusText(status),
+			Detail: message,
+			Errors: details,
+		},
+		Code: code,
+	}
+}
+
+// problem creates a Problem with a specific error code
+func problem(status int, code string, detail string) *Problem {
+	return &Problem{
+		ErrorModel: huma.ErrorModel{
+			Status: status,
+			Title:  http.StatusText(status),
+			Detail: detail,
+		},
+		Code: code,
+	}
+}
+
+// mapError turns the error returned by a handler into the problem reported to the client. Errors that are already
+// problems pass through, unknown errors are logged and reported as a 500 without their message.
+func mapError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var statusErr huma.StatusError
+	if errors.As(err, &statusErr) {
+		return err
+	}
+	for _, domain := range domainErrors {
+		if !errors.Is(err, domain.err) {
+			continue
+		}
+		p := problem(domain.status, domain.code, domain.err.Error())
+		// schema errors say where a payload or metadata does not match, they never include the values
+		var schemaErr *models.SchemaError
+		if errors.As(err, &schemaErr) {
+			for _, issue := range schemaErr.Errors {
+				p.Errors = append(p.Errors, &huma.ErrorDetail{Message: issue.Message, Location: issue.Location})
+			}
+		}
+		if domain.headers != nil {
+			return huma.ErrorWithHeaders(p, domain.headers.Clone())
+		}
+		return p
+	}
+
+	slog.Error("unexpected error handling request", "error", err)
+	return problem(http.StatusInternalServerError, "internal_error", http.StatusText(http.StatusInternalServerError))
+}
+
+// itemProblem returns the problem reported for an item of a batch that failed with err
+func itemProblem(err error) *Problem {
+	var p *Problem
+	if errors.As(mapError(err), &p) {
+		return p
+	}
+	return problem(http.StatusInternalServerError, "internal_error", http.StatusText(http.StatusInternalServerError))
+}
+
+// mapErrors wraps a handler so the errors it returns go through mapError
+func mapErrors[I, O any](handler func(context.Context, *I) (*O, error)) func(context.Context, *I) (*O, error) {
+	return func(ctx context.Context, in *I) (*O, error) {
+		out, err := handler(ctx, in)
+		if err != nil {
+			return nil, mapError(err)
+		}
+		return out, nil
+	}
+}
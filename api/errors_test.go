@@ -0,0 +1,130 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"tokenize/models"
+	"tokenize/persistence"
+	"tokenize/persistence/mock"
+	"tokenize/rotation"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMapError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantCode   string
+	}{
+		{"not found", models.ErrTokenNotFound, http.StatusNotFound, "token_not_found"},
+		{"wrapped not found", fmt.Errorf("loading token: %w", models.ErrTokenNotFound), http.StatusNotFound, "token_not_found"},
+		{"integrity", models.ErrIntegrity, http.StatusUnprocessableEntity, "integrity_check_failed"},
+		{"changed concurrently", models.ErrTokenChanged, http.StatusConflict, "token_changed"},
+		{"invalid card", models.ErrInvalidCardNumber, http.StatusBadRequest, "invalid_card_number"},
+		{"rotation running", rotation.ErrAlreadyRunning, http.StatusConflict, "rotation_running"},
+		{"throttled", fmt.Errorf("%w: slow down", persistence.ErrThrottled), http.StatusServiceUnavailable, "throttled"},
+		{"huma error passes through", huma.Error400BadRequest("token is required"), http.StatusBadRequest, "invalid_request"},
+		{"unknown error", errors.New("dial tcp: payload 4111111111111111"), http.StatusInternalServerError, "internal_error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := mapError(tt.err)
+			var p *Problem
+			assert.ErrorAs(t, err, &p)
+			assert.Equal(t, tt.wantStatus, p.GetStatus())
+			assert.Equal(t, tt.wantCode, p.Code)
+			assert.NotContains(t, p.Detail, "4111111111111111")
+		})
+	}
+
+	assert.NoError(t, mapError(nil))
+
+	var headersErr huma.HeadersError
+	assert.ErrorAs(t, mapError(persistence.ErrThrottled), &headersErr)
+	assert.Equal(t, "1", headersErr.GetHeaders().Get("Retry-After"))
+}
+
+func TestRoutes_Problems(t *testing.T) {
+	tests := []struct {
+		name        string
+		store       mock.Store
+		method      string
+		path        string
+		body        string
+		wantStatus  int
+		wantCode    string
+		wantHeaders map[string]string
+	}{
+		{
+			name:       "token not found",
+			store:      mock.Store{GetError: models.ErrTokenNotFound},
+			method:     http.MethodGet,
+			path:       "/token/missing-token",
+			wantStatus: http.StatusNotFound,
+			wantCode:   "token_not_found",
+		},
+		{
+			name:        "store throttled",
+			store:       mock.Store{GetError: fmt.Errorf("%w: too many requests", persistence.ErrThrottled)},
+			method:      http.MethodGet,
+			path:        "/token/some-token",
+			wantStatus:  http.StatusServiceUnavailable,
+			wantCode:    "throttled",
+			wantHeaders: map[string]string{"Retry-After": "1"},
+		},
+		{
+			name:       "unexpected error",
+			store:      mock.Store{GetError: errors.New("connection reset reading 4111111111111111")},
+			method:     http.MethodGet,
+			path:       "/token/some-token",
+			wantStatus: http.StatusInternalServerError,
+			wantCode:   "internal_error",
+		},
+		{
+			name:       "validation error",
+			method:     http.MethodPost,
+			path:       "/token",
+			body:       `{"data": {"payload": "4111111111111111", "token_type": "card"}}`,
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "validation_failed",
+		},
+		{
+			name:       "invalid card number",
+			method:     http.MethodPost,
+			path:       "/token",
+			body:       `{"data": {"payload": "4111111111111112", "token_type": "card", "ttl": 0, "metadata": {}}}`,
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "invalid_card_number",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := Routes(&BaseHandler{Auth: testAuth, Policy: testPolicy, Store: tt.store, Keys: testKeys, TokenKeys: testTokenKeys})
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.wantStatus, rr.Code)
+			assert.Equal(t, "application/problem+json", rr.Header().Get("Content-Type"))
+			for name, value := range tt.wantHeaders {
+				assert.Equal(t, value, rr.Header().Get(name))
+			}
+			assert.NotContains(t, rr.Body.String(), "411111111111111", "sensitive values should not be echoed")
+
+			var body Problem
+			assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &body))
+			assert.Equal(t, tt.wantCode, body.Code)
+			assert.Equal(t, tt.wantStatus, body.Status)
+		})
+	}
+}
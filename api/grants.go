@@ -0,0 +1,328 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"tokenize/audit"
+	"tokenize/auth"
+	"tokenize/models"
+	"tokenize/policy"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/gorilla/mux"
+)
+
+// redeemGrantPath is where reveal grants are redeemed, the grant is the only credential it takes. The grant is sent in
+// the body so it is not written to the access logs of proxies along the way.
+const redeemGrantPath = "/grants/redeem"
+
+type clientIPKey struct{}
+
+// clientIP puts the address of the client in the request context. It is read from the last entry of the header when
+// one is set, which the proxy in front of the service appends, and from the connection otherwise.
+func clientIP(header string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			address, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				address = r.RemoteAddr
+			}
+			if header != "" {
+				if values := r.Header.Values(header); len(values) > 0 {
+					entries := strings.Split(values[len(values)-1], ",")
+					address = strings.TrimSpace(entries[len(entries)-1])
+				}
+			}
+			addr, _ := netip.ParseAddr(address)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIPKey{}, addr.Unmap())))
+		})
+	}
+}
+
+// clientIPFrom returns the address of the client of the request, the zero address when it is not known
+func clientIPFrom(ctx context.Context) netip.Addr {
+	addr, _ := ctx.Value(clientIPKey{}).(netip.Addr)
+	return addr
+}
+
+func (h *BaseHandler) RegisterGrantRoutes(api huma.API) {
+	huma.Register(api, huma.Operation{
+		OperationID:   "CreateGrant",
+		Summary:       "Issue a short-lived grant to reveal a token",
+		Method:        http.MethodPost,
+		Path:          "/token/{token}/grants",
+		DefaultStatus: http.StatusCreated,
+		Errors: []int{
+			http.StatusUnauthorized,
+			http.StatusForbidden,
+			http.StatusBadRequest,
+			http.StatusNotFound,
+			http.StatusNotImplemented,
+		},
+	}, mapErrors(h.CreateGrant))
+
+	huma.Register(api, huma.Operation{
+		OperationID:   "RevokeGrant",
+		Summary:       "Revoke a grant to reveal a token",
+		Method:        http.MethodDelete,
+		Path:          "/token/{token}/grants/{id}",
+		DefaultStatus: http.StatusNoContent,
+		Errors: []int{
+			http.StatusUnauthorized,
+			http.StatusForbidden,
+			http.StatusNotFound,
+			http.StatusNotImplemented,
+		},
+	}, mapErrors(h.RevokeGrant))
+
+	huma.Register(api, huma.Operation{
+		OperationID:   "RedeemGrant",
+		Summary:       "Reveal a token with a grant",
+		Description:   "Takes no credentials, the signed grant in the body is what authorizes the request.",
+		Method:        http.MethodPost,
+		Path:          redeemGrantPath,
+		DefaultStatus: http.StatusOK,
+		Errors: []int{
+			http.StatusUnauthorized,
+			http.StatusForbidden,
+			http.StatusNotFound,
+			http.StatusGone,
+			http.StatusUnprocessableEntity,
+		},
+	}, mapErrors(h.RedeemGrant))
+}
+
+type CreateGrantRequest struct {
+	Token string `path:"token" validate:"required"`
+	Body  struct {
+		Reveal   string `json:"reveal,omitempty" doc:"Reveal policy the payload is shown with, the token type's default when empty"`
+		TTL      int64  `json:"ttl,omitempty" minimum:"0" maximum:"3600" doc:"Seconds the grant is valid for, 300 when 0"`
+		ClientIP string `json:"client_ip,omitempty" doc:"The only IP address the grant can be redeemed from"`
+	}
+}
+
+type CreateGrantResponse struct {
+	Body struct {
+		ID        string    `json:"id" doc:"ID of the grant, to revoke it with"`
+		Grant     string    `json:"grant" doc:"The signed grant"`
+		URL       string    `json:"url" doc:"Path the grant is redeemed at, with a POST of the grant"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+}
+
+// CreateGrant issues a signed grant that reveals the token with a reveal policy until it expires. The caller needs
+// the grant action and may only hand out reveals they could make themselves.
+func (h *BaseHandler) CreateGrant(ctx context.Context, in *CreateGrantRequest) (output *CreateGrantResponse, err error) {
+	if h.Grants == nil {
+		return nil, huma.Error501NotImplemented("reveal grants are not configured")
+	}
+	event := auditEvent(ctx, audit.OperationGrant, in.Token)
+	defer func() {
+		if err = h.recordAudit(ctx, event, err); err != nil {
+			output = nil
+		}
+	}()
+	if err := checkToken(in.Token); err != nil {
+		return nil, err
+	}
+
+	tokenVal, err := h.getToken(ctx, in.Token)
+	if err != nil {
+		return nil, err
+	}
+	event.TokenType = tokenVal.TokenType
+	reveal := in.Body.Reveal
+	if reveal == "" {
+		reveal = h.TokenTypes.Reveal(tokenVal.TokenType)
+	}
+	if _, err := h.Reveals.For(tokenVal.TokenType, reveal); err != nil {
+		return nil, err
+	}
+	resource := tokenResource(tokenVal)
+	resource.Reveal = reveal
+	if err := h.authorize(ctx, policy.ActionGrant, resource); err != nil {
+		return nil, err
+	}
+	if err := h.authorize(ctx, policy.ActionDetokenize, resource); err != nil {
+		return nil, err
+	}
+
+	client := ""
+	if in.Body.ClientIP != "" {
+		addr, err := netip.ParseAddr(in.Body.ClientIP)
+		if err != nil {
+			return nil, huma.Error400BadRequest("client_ip is not an IP address")
+		}
+		client = addr.Unmap().String()
+	}
+	ttl := in.Body.TTL
+	if ttl == 0 {
+		ttl = models.DefaultGrantTTL
+	}
+
+	issuedBy := ""
+	if principal, ok := auth.PrincipalFrom(ctx); ok {
+		issuedBy = principal.Subject
+	}
+	grant, err := models.NewRevealGrant(tokenVal.Tenant, tokenVal.Token, reveal, client, ttl, issuedBy)
+	if err != nil {
+		return nil, err
+	}
+	event.Grant = grant.ID
+	keys, err := h.tenantKeys(tokenVal.Tenant)
+	if err != nil {
+		return nil, err
+	}
+	signed, err := grant.Sign(ctx, keys.TokenKeys)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.Grants.CreateGrant(ctx, grant); err != nil {
+		return nil, err
+	}
+
+	output = &CreateGrantResponse{}
+	output.Body.ID = grant.ID
+	output.Body.Grant = signed
+	output.Body.URL = redeemGrantPath
+	output.Body.ExpiresAt = time.Unix(grant.ExpiresAt, 0).UTC()
+	return output, nil
+}
+
+type RevokeGrantRequest struct {
+	Token string `path:"token" validate:"required"`
+	ID    string `path:"id" validate:"required"`
+}
+
+// RevokeGrant revokes a grant of the token, so it cannot be redeemed any more
+func (h *BaseHandler) RevokeGrant(ctx context.Context, in *RevokeGrantRequest) (_ *struct{}, err error) {
+	if h.Grants == nil {
+		return nil, huma.Error501NotImplemented("reveal grants are not configured")
+	}
+	event := auditEvent(ctx, audit.OperationRevoke, in.Token)
+	event.Grant = in.ID
+	defer func() {
+		err = h.recordAudit(ctx, event, err)
+	}()
+	if err := checkToken(in.Token); err != nil {
+		return nil, err
+	}
+
+	tokenVal, err := h.getToken(ctx, in.Token)
+	if err != nil {
+		return nil, err
+	}
+	event.TokenType = tokenVal.TokenType
+	if err := h.authorize(ctx, policy.ActionGrant, tokenResource(tokenVal)); err != nil {
+		return nil, err
+	}
+	return nil, h.Grants.RevokeGrant(ctx, tokenVal.Tenant, tokenVal.Token, in.ID)
+}
+
+type RedeemGrantRequest struct {
+	Body struct {
+		Grant string `json:"grant" minLength:"1" doc:"The signed grant"`
+	}
+}
+
+type RedeemGrantResponse struct {
+	Body struct {
+		Token     string `json:"token"`
+		TokenType string `json:"token_type,omitempty"`
+		Reveal    string `json:"reveal" doc:"Reveal policy the payload is shown with"`
+		Payload   string `json:"payload"`
+	}
+}
+
+// RedeemGrant reveals the token of a grant with its reveal policy. The grant is the caller, so only the payload is
+// returned and not the metadata of the token. Like decryptToken, a reveal of a token with a reveal limit is taken
+// before the redemption is recorded, so the audit log has a single outcome for it.
+func (h *BaseHandler) RedeemGrant(ctx context.Context, in *RedeemGrantRequest) (output *RedeemGrantResponse, err error) {
+	if h.Grants == nil {
+		return nil, models.ErrInvalidGrant
+	}
+	grant, err := models.ParseRevealGrant(ctx, in.Body.Grant, func(tenant string) (models.KeyProvider, error) {
+		keys, err := h.tenantKeys(tenant)
+		return keys.TokenKeys, err
+	})
+	if err != nil && grant != nil {
+		return nil, h.recordRejectedGrant(ctx, grant, err)
+	}
+	if err != nil {
+		// anyone can send a grant, so one that is not signed by a tenant is logged rather than recorded in its chain
+		slog.Info("rejected grant", "request_id", requestIDFrom(ctx), "error", err)
+		return nil, err
+	}
+
+	// from here on the redemption is recorded in the audit log of the token, with the grant as the caller
+	ctx = auth.WithPrincipal(ctx, &auth.Principal{
+		Subject: auth.MethodGrant + ":" + grant.ID,
+		Method:  auth.MethodGrant,
+		Tenant:  grant.Tenant,
+	})
+	event := auditEvent(ctx, audit.OperationDecrypt, grant.Token)
+	event.Grant = grant.ID
+	defer func() {
+		if err = h.recordAudit(ctx, event, err); err != nil {
+			output = nil
+		}
+	}()
+
+	if !grant.AllowsClient(clientIPFrom(ctx)) {
+		return nil, models.ErrGrantClientMismatch
+	}
+	stored, err := h.Grants.GetGrant(ctx, grant.Tenant, grant.ID)
+	if errors.Is(err, models.ErrGrantNotFound) {
+		return nil, models.ErrInvalidGrant
+	}
+	if err != nil {
+		return nil, err
+	}
+	if stored.Revoked {
+		return nil, models.ErrGrantRevoked
+	}
+
+	tokenVal, err := h.getToken(ctx, grant.Token)
+	if err != nil {
+		return nil, err
+	}
+	event.TokenType = tokenVal.TokenType
+	revealPolicy, err := h.Reveals.For(tokenVal.TokenType, grant.Reveal)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := h.tenantKeys(grant.Tenant)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := h.showPayload(ctx, tokenVal, revealPolicy, keys.Keys)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.consumeReveal(ctx, tokenVal); err != nil {
+		return nil, err
+	}
+
+	output = &RedeemGrantResponse{}
+	output.Body.Token = tokenVal.Token
+	output.Body.TokenType = tokenVal.TokenType
+	output.Body.Reveal = grant.Reveal
+	output.Body.Payload = payload
+	return output, nil
+}
+
+// recordRejectedGrant records a redemption of a grant whose signature verified but that was rejected, such as an
+// expired one, with the error it was rejected with, in the chain of the grant's tenant
+func (h *BaseHandler) recordRejectedGrant(ctx context.Context, grant *models.RevealGrant, err error) error {
+	principal := &auth.Principal{Subject: auth.MethodGrant + ":" + grant.ID, Method: auth.MethodGrant, Tenant: grant.Tenant}
+	event := auditEvent(auth.WithPrincipal(ctx, principal), audit.OperationDecrypt, "")
+	event.Grant = grant.ID
+	return h.recordAudit(ctx, event, err)
+}
@@ -0,0 +1,171 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"tokenize/audit"
+	"tokenize/auth"
+	"tokenize/models"
+	"tokenize/persistence/mock"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// redeem redeems a grant through the routes, from the remote address and with the headers
+func redeem(router http.Handler, grant string, remoteAddr string, headers map[string]string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(map[string]string{"grant": grant})
+	req := httptest.NewRequest(http.MethodPost, redeemGrantPath, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.RemoteAddr = remoteAddr
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestHandler_Grants(t *testing.T) {
+	store := &documentStore{}
+	grants := &mock.GrantStore{}
+	auditStore := &mock.AuditStore{}
+	h := &BaseHandler{
+		// the third party redeeming a grant has no credentials
+		Auth:   failingAuth{err: auth.ErrNoCredentials},
+		Policy: testPolicy, Store: store, Keys: testKeys, TokenKeys: testTokenKeys,
+		Audit: auditStore, Grants: grants, ClientIPHeader: "X-Forwarded-For",
+	}
+	router := Routes(h)
+
+	in := &NewTokenRequest{}
+	in.Body.Data = models.CreateToken{Payload: "4111111111111111", TokenType: "pan"}
+	created, err := h.CreateToken(testCtx, in)
+	assert.NoError(t, err)
+	token := created.Body.Token
+
+	issue := &CreateGrantRequest{Token: token}
+	issue.Body.Reveal = "last4"
+	issue.Body.ClientIP = "203.0.113.7"
+	issued, err := h.CreateGrant(testCtx, issue)
+	assert.NoError(t, err)
+	assert.Equal(t, "/grants/redeem", issued.Body.URL)
+	assert.NotContains(t, issued.Body.URL, issued.Body.Grant, "the grant is not put in a path")
+	assert.NotContains(t, issued.Body.Grant, "4111111111111111")
+	assert.Equal(t, "api_key:test", grants.Grants[issued.Body.ID].IssuedBy)
+
+	rr := redeem(router, issued.Body.Grant, "192.0.2.1:5000", map[string]string{"X-Forwarded-For": "198.51.100.1, 203.0.113.7"})
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var body RedeemGrantResponse
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &body.Body))
+	assert.Equal(t, token, body.Body.Token)
+	assert.Equal(t, "last4", body.Body.Reveal)
+	assert.Equal(t, "************1111", body.Body.Payload)
+
+	rr = redeem(router, issued.Body.Grant, "192.0.2.1:5000", map[string]string{"X-Forwarded-For": "203.0.113.7, 198.51.100.1"})
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"code":"grant_client_mismatch"`)
+
+	rr = redeem(router, strings.Replace(issued.Body.Grant, ".", ".x", 1), "203.0.113.7:5000", nil)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"code":"invalid_grant"`)
+
+	_, err = h.RevokeGrant(testCtx, &RevokeGrantRequest{Token: token, ID: "unknown"})
+	assert.ErrorIs(t, err, models.ErrGrantNotFound)
+	_, err = h.RevokeGrant(testCtx, &RevokeGrantRequest{Token: token, ID: issued.Body.ID})
+	assert.NoError(t, err)
+	rr = redeem(router, issued.Body.Grant, "203.0.113.7:5000", nil)
+	assert.Equal(t, http.StatusGone, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"code":"grant_revoked"`)
+
+	expired := &models.RevealGrant{ID: "expired-grant", Token: token, Reveal: "last4", ExpiresAt: time.Now().Add(-time.Second).Unix()}
+	signed, err := expired.Sign(testCtx, testTokenKeys)
+	assert.NoError(t, err)
+	rr = redeem(router, signed, "203.0.113.7:5000", nil)
+	assert.Equal(t, http.StatusGone, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"code":"grant_expired"`)
+
+	// other requests still need credentials
+	req := httptest.NewRequest(http.MethodGet, "/token/"+token, nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	records, _, err := auditStore.History(context.Background(), "", token, audit.Page{})
+	assert.NoError(t, err)
+	operations := []string{}
+	for _, record := range records {
+		operations = append(operations, string(record.Operation)+" "+string(record.Outcome)+" "+record.Principal)
+		if record.Operation == audit.OperationGrant || record.Operation == audit.OperationDecrypt {
+			assert.Equal(t, issued.Body.ID, record.Grant)
+		}
+	}
+	grantPrincipal := "grant:" + issued.Body.ID
+	assert.Equal(t, []string{
+		"create success api_key:test",
+		"grant success api_key:test",
+		"decrypt success " + grantPrincipal,
+		"decrypt failure " + grantPrincipal,
+		"revoke failure api_key:test",
+		"revoke success api_key:test",
+		"decrypt failure " + grantPrincipal,
+	}, operations, "a grant with an invalid signature never reaches the audit log of the token")
+
+	operations = []string{}
+	for _, record := range tenantRecords(auditStore, "") {
+		operations = append(operations, string(record.Operation)+" "+string(record.Outcome)+" "+record.Principal+" "+record.Grant)
+	}
+	assert.Equal(t, []string{
+		"decrypt failure grant:expired-grant expired-grant",
+	}, operations, "only rejected grants whose signature verified are recorded in the chain of the tenant")
+}
+
+func TestHandler_RedeemGrantNotConfigured(t *testing.T) {
+	auditStore := &mock.AuditStore{}
+	h := &BaseHandler{Policy: testPolicy, Keys: testKeys, TokenKeys: testTokenKeys, Audit: auditStore}
+	in := &RedeemGrantRequest{}
+	in.Body.Grant = "rg_foo.bar"
+	_, err := h.RedeemGrant(context.Background(), in)
+	assert.ErrorIs(t, err, models.ErrInvalidGrant)
+
+	assert.Empty(t, auditStore.Records, "a grant cannot be verified without grants, so it is not recorded")
+}
+
+func TestHandler_CreateGrantErrors(t *testing.T) {
+	stored := &models.Token{Token: "foobartesttoken", CreateToken: models.CreateToken{TokenType: "pan"}}
+	detokenizer := auth.WithPrincipal(context.Background(), &auth.Principal{Subject: "api_key:detokenizer", Roles: []string{"detokenizer"}})
+	tests := []struct {
+		name     string
+		ctx      context.Context
+		grants   *mock.GrantStore
+		reveal   string
+		clientIP string
+		wantCode string
+	}{
+		{name: "grants not configured", ctx: testCtx, wantCode: "not_implemented"},
+		{name: "detokenizers cannot hand out reveals", ctx: detokenizer, grants: &mock.GrantStore{}, wantCode: "forbidden"},
+		{name: "unknown reveal policy", ctx: testCtx, grants: &mock.GrantStore{}, reveal: "partial", wantCode: "unknown_reveal_policy"},
+		{name: "invalid client address", ctx: testCtx, grants: &mock.GrantStore{}, clientIP: "localhost", wantCode: "invalid_request"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &BaseHandler{Policy: testPolicy, Store: mock.Store{Token: stored}, Keys: testKeys, TokenKeys: testTokenKeys}
+			if tt.grants != nil {
+				h.Grants = tt.grants
+			}
+			in := &CreateGrantRequest{Token: "foobartesttoken"}
+			in.Body.Reveal = tt.reveal
+			in.Body.ClientIP = tt.clientIP
+			_, err := mapErrors(h.CreateGrant)(tt.ctx, in)
+			var p *Problem
+			assert.ErrorAs(t, err, &p)
+			assert.Equal(t, tt.wantCode, p.Code)
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"tokenize/models"
+	"tokenize/persistence"
+	"tokenize/policy"
+
+	"github.com/danielgtaylor/huma/v2"
+)
+
+func (h *BaseHandler) RegisterListRoutes(api huma.API) {
+	huma.Register(api, huma.Operation{
+		OperationID:   "ListTokens",
+		Summary:       "List and search tokens",
+		Method:        http.MethodGet,
+		Path:          "/tokens",
+		DefaultStatus: http.StatusOK,
+		Errors: []int{
+			http.StatusUnauthorized,
+			http.StatusForbidden,
+			http.StatusBadRequest,
+		},
+	}, mapErrors(h.ListTokens))
+}
+
+type ListTokensRequest struct {
+	TokenType     string    `query:"token_type" doc:"Only tokens of this type"`
+	CreatedAfter  time.Time `query:"created_after" doc:"Only tokens created at or after this time"`
+	CreatedBefore time.Time `query:"created_before" doc:"Only tokens created at or before this time"`
+	ExpiresAfter  time.Time `query:"expires_after" doc:"Only tokens expiring at or after this time"`
+	ExpiresBefore time.Time `query:"expires_before" doc:"Only tokens expiring at or before this time"`
+	Metadata      []string  `query:"metadata,explode" doc:"Only tokens with the metadata attribute set to the value, as key:value. Numbers and true or false also match numeric and boolean attributes"`
+	Cursor        string    `query:"cursor" doc:"Cursor of the page to get, from next_cursor of the previous page"`
+	Limit         int32     `query:"limit" minimum:"1" maximum:"1000" default:"100" doc:"Maximum number of tokens in the page"`
+}
+
+type ListTokensResponse struct {
+	Body struct {
+		Tokens []models.Token `json:"tokens"`
+		// NextCursor is empty on the last page
+		NextCursor string `json:"next_cursor,omitempty"`
+	}
+}
+
+// ListTokens returns a page of the caller's tokens without their payloads. The filter has to be within what the caller
+// may read, so every token that matches it can be returned.
+func (h *BaseHandler) ListTokens(ctx context.Context, in *ListTokensRequest) (*ListTokensResponse, error) {
+	filter := models.TokenFilter{
+		TokenType:     in.TokenType,
+		CreatedAfter:  in.CreatedAfter,
+		CreatedBefore: in.CreatedBefore,
+		ExpiresAfter:  in.ExpiresAfter,
+		ExpiresBefore: in.ExpiresBefore,
+	}
+	resource := policy.Resource{TokenType: in.TokenType}
+	for _, entry := range in.Metadata {
+		name, value, found := strings.Cut(entry, ":")
+		if !found || name == "" {
+			return nil, huma.Error400BadRequest("metadata filters are written as key:value")
+		}
+		if filter.Metadata == nil {
+			filter.Metadata = map[string]string{}
+			resource.Metadata = map[string]any{}
+		}
+		filter.Metadata[name] = value
+		resource.Metadata[name] = value
+	}
+	if err := h.authorize(ctx, policy.ActionRead, resource); err != nil {
+		return nil, err
+	}
+
+	limit := in.Limit
+	if limit == 0 {
+		limit = persistence.DefaultListLimit
+	}
+	tokens, next, err := h.Store.ListTokens(ctx, tenantFrom(ctx), filter, in.Cursor, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	output := &ListTokensResponse{}
+	output.Body.Tokens = make([]models.Token, 0, len(tokens))
+	for _, token := range tokens {
+		listed := *token
+		listed.Payload = ""
+		output.Body.Tokens = append(output.Body.Tokens, listed)
+	}
+	output.Body.NextCursor = next
+	return output, nil
+}
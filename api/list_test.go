@@ -0,0 +1,143 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"tokenize/auth"
+	"tokenize/models"
+	"tokenize/persistence/mock"
+	"tokenize/policy"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandler_ListTokens(t *testing.T) {
+	created := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	tokens := []*models.Token{
+		{Token: "card-eu", BaseModel: models.BaseModel{CreatedAt: created}, CreateToken: models.CreateToken{
+			Payload: "v2:sealed", TokenType: "card", Metadata: map[string]any{"region": "eu"},
+		}},
+		{Token: "card-us", BaseModel: models.BaseModel{CreatedAt: created.Add(time.Hour)}, CreateToken: models.CreateToken{
+			Payload: "v2:sealed", TokenType: "card", Metadata: map[string]any{"region": "us"},
+		}},
+		{Token: "ssn", BaseModel: models.BaseModel{CreatedAt: created}, CreateToken: models.CreateToken{
+			Payload: "v2:sealed", TokenType: "ssn",
+		}},
+		{Token: "other-tenant", BaseModel: models.BaseModel{Tenant: "payments", CreatedAt: created}, CreateToken: models.CreateToken{
+			Payload: "v2:sealed", TokenType: "card",
+		}},
+	}
+	supportPolicy := &policy.Policy{Roles: map[string][]policy.Grant{
+		"eu-support": {{Actions: []policy.Action{policy.ActionRead}, TokenTypes: []string{"card"}, Metadata: map[string][]string{"region": {"eu"}}}},
+	}}
+	support := auth.WithPrincipal(testCtx, &auth.Principal{Subject: "api_key:support", Roles: []string{"eu-support"}})
+
+	tests := []struct {
+		name       string
+		handler    *BaseHandler
+		in         *ListTokensRequest
+		want       []string
+		wantNext   string
+		wantStatus int
+	}{
+		{
+			name:    "every token of the caller's tenant",
+			handler: &BaseHandler{Policy: testPolicy, Store: mock.Store{Tokens: tokens}},
+			in:      &ListTokensRequest{},
+			want:    []string{"card-eu", "card-us", "ssn"},
+		},
+		{
+			name:     "paginated",
+			handler:  &BaseHandler{Policy: testPolicy, Store: mock.Store{Tokens: tokens}},
+			in:       &ListTokensRequest{Limit: 2},
+			want:     []string{"card-eu", "card-us"},
+			wantNext: "card-us",
+		},
+		{
+			name:    "next page",
+			handler: &BaseHandler{Policy: testPolicy, Store: mock.Store{Tokens: tokens}},
+			in:      &ListTokensRequest{Limit: 2, Cursor: "card-us"},
+			want:    []string{"ssn"},
+		},
+		{
+			name:    "filtered",
+			handler: &BaseHandler{Policy: testPolicy, Store: mock.Store{Tokens: tokens}},
+			in:      &ListTokensRequest{TokenType: "card", CreatedAfter: created.Add(time.Minute), Metadata: []string{"region:us"}},
+			want:    []string{"card-us"},
+		},
+		{
+			name:       "malformed metadata filter",
+			handler:    &BaseHandler{Policy: testPolicy, Store: mock.Store{Tokens: tokens}},
+			in:         &ListTokensRequest{Metadata: []string{"region"}},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "filter outside the caller's grants",
+			handler:    &BaseHandler{Policy: supportPolicy, Store: mock.Store{Tokens: tokens}},
+			in:         &ListTokensRequest{TokenType: "card"},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "store error",
+			handler:    &BaseHandler{Policy: testPolicy, Store: mock.Store{ListError: assert.AnError}},
+			in:         &ListTokensRequest{},
+			wantStatus: http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := mapErrors(tt.handler.ListTokens)(testCtx, tt.in)
+			if tt.wantStatus != 0 {
+				var statusErr huma.StatusError
+				assert.ErrorAs(t, err, &statusErr)
+				assert.Equal(t, tt.wantStatus, statusErr.GetStatus())
+				return
+			}
+			assert.NoError(t, err)
+			values := []string{}
+			for _, token := range got.Body.Tokens {
+				values = append(values, token.Token)
+				assert.Empty(t, token.Payload, "payloads are never listed")
+			}
+			assert.Equal(t, tt.want, values)
+			assert.Equal(t, tt.wantNext, got.Body.NextCursor)
+		})
+	}
+
+	// grants limited by metadata can list when the filter is within them
+	h := &BaseHandler{Policy: supportPolicy, Store: mock.Store{Tokens: tokens}}
+	got, err := h.ListTokens(support, &ListTokensRequest{TokenType: "card", Metadata: []string{"region:eu"}})
+	assert.NoError(t, err)
+	assert.Len(t, got.Body.Tokens, 1)
+}
+
+func TestRoutes_ListTokens(t *testing.T) {
+	tokens := []*models.Token{{Token: "card-eu", CreateToken: models.CreateToken{TokenType: "card", Metadata: map[string]any{"region": "eu"}}}}
+	router := Routes(&BaseHandler{Auth: testAuth, Policy: testPolicy, Store: mock.Store{Tokens: tokens}})
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet,
+		"/tokens?token_type=card&metadata=region:eu&created_after=2025-01-01T00:00:00Z&limit=10", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var body ListTokensResponse
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &body.Body))
+	assert.Len(t, body.Body.Tokens, 0, "the token was created before the range")
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/tokens?metadata=region:eu&metadata=tier:gold", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/tokens?token_type=card", nil))
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &body.Body))
+	assert.Len(t, body.Body.Tokens, 1)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/tokens?limit=5000", nil))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
@@ -0,0 +1,207 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+
+	"tokenize/models"
+
+	"github.com/danielgtaylor/huma/v2"
+)
+
+// schemaRegistry resolves references while validating, token type schemas cannot have any
+var schemaRegistry = huma.NewMapRegistry("#/components/schemas/", huma.DefaultSchemaNamer)
+
+// schemaValidator validates payloads and metadata the way huma validates request bodies
+type schemaValidator struct {
+	schema *huma.Schema
+}
+
+// schemaKeyword is how the value of a keyword is checked for keywords within it
+type schemaKeyword int
+
+const (
+	// keywordValue is a keyword whose value is not a schema
+	keywordValue schemaKeyword = iota
+	// keywordSchema is a keyword whose value is a schema
+	keywordSchema
+	// keywordSchemaOrBool is a keyword whose value is a schema or a boolean
+	keywordSchemaOrBool
+	// keywordSchemaList is a keyword whose value is a list of schemas
+	keywordSchemaList
+	// keywordSchemaMap is a keyword whose value maps names to schemas
+	keywordSchemaMap
+)
+
+// schemaKeywords are the JSON Schema keywords huma validates, along with the annotations it reads. Schemas with any
+// other keyword are rejected, huma would drop it and the schema would accept values it was meant to reject.
+var schemaKeywords = map[string]schemaKeyword{
+	"title":                keywordValue,
+	"description":          keywordValue,
+	"examples":             keywordValue,
+	"default":              keywordValue,
+	"deprecated":           keywordValue,
+	"readOnly":             keywordValue,
+	"writeOnly":            keywordValue,
+	"type":                 keywordValue,
+	"format":               keywordValue,
+	"enum":                 keywordValue,
+	"minimum":              keywordValue,
+	"exclusiveMinimum":     keywordValue,
+	"maximum":              keywordValue,
+	"exclusiveMaximum":     keywordValue,
+	"multipleOf":           keywordValue,
+	"minLength":            keywordValue,
+	"maxLength":            keywordValue,
+	"pattern":              keywordValue,
+	"minItems":             keywordValue,
+	"maxItems":             keywordValue,
+	"uniqueItems":          keywordValue,
+	"required":             keywordValue,
+	"minProperties":        keywordValue,
+	"maxProperties":        keywordValue,
+	"dependentRequired":    keywordValue,
+	"items":                keywordSchema,
+	"not":                  keywordSchema,
+	"additionalProperties": keywordSchemaOrBool,
+	"oneOf":                keywordSchemaList,
+	"anyOf":                keywordSchemaList,
+	"allOf":                keywordSchemaList,
+	"properties":           keywordSchemaMap,
+}
+
+// CompileSchema compiles a JSON Schema of a token type with huma
+func CompileSchema(value map[string]any) (models.SchemaValidator, error) {
+	if err := checkKeywords(value, "schema"); err != nil {
+		return nil, err
+	}
+	schema, err := decodeSchema(value)
+	if err != nil {
+		return nil, err
+	}
+	return &schemaValidator{schema: schema}, nil
+}
+
+// Validate reports where the value does not match the schema without the values, which huma includes in its errors
+func (v *schemaValidator) Validate(location string, value any) []models.SchemaIssue {
+	path := huma.NewPathBuffer([]byte{}, 0)
+	path.Push(location)
+	result := &huma.ValidateResult{}
+	huma.Validate(schemaRegistry, v.schema, path, huma.ModeWriteToServer, value, result)
+
+	var issues []models.SchemaIssue
+	for _, err := range result.Errors {
+		issue := models.SchemaIssue{Message: err.Error()}
+		var detailer huma.ErrorDetailer
+		if errors.As(err, &detailer) {
+			detail := detailer.ErrorDetail()
+			issue = models.SchemaIssue{Message: detail.Message, Location: detail.Location}
+		}
+		issues = append(issues, issue)
+	}
+	return issues
+}
+
+// checkKeywords checks that the schema at location, and every schema within it, only has keywords huma validates.
+// References are rejected along with every other unknown keyword, there is nothing for them to refer to.
+func checkKeywords(value any, location string) error {
+	schema, ok := value.(map[string]any)
+	if !ok {
+		return fmt.Errorf("%s: schema must be an object", location)
+	}
+	for name, value := range schema {
+		keyword, known := schemaKeywords[name]
+		if !known {
+			return fmt.Errorf("%s: unsupported keyword %q", location, name)
+		}
+		at := location + "." + name
+		switch keyword {
+		case keywordSchema:
+			if err := checkKeywords(value, at); err != nil {
+				return err
+			}
+		case keywordSchemaOrBool:
+			if _, ok := value.(bool); ok {
+				continue
+			}
+			if err := checkKeywords(value, at); err != nil {
+				return err
+			}
+		case keywordSchemaList:
+			list, ok := value.([]any)
+			if !ok {
+				return fmt.Errorf("%s: must be a list of schemas", at)
+			}
+			for i, child := range list {
+				if err := checkKeywords(child, fmt.Sprintf("%s[%d]", at, i)); err != nil {
+					return err
+				}
+			}
+		case keywordSchemaMap:
+			children, ok := value.(map[string]any)
+			if !ok {
+				return fmt.Errorf("%s: must be an object of schemas", at)
+			}
+			for name, child := range children {
+				if err := checkKeywords(child, at+"."+name); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// decodeSchema reads a JSON Schema and prepares it for validation
+func decodeSchema(value any) (*huma.Schema, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	schema := &huma.Schema{}
+	if err := json.Unmarshal(data, schema); err != nil {
+		return nil, err
+	}
+	if err := prepareSchema(schema); err != nil {
+		return nil, err
+	}
+	return schema, nil
+}
+
+// prepareSchema precomputes the messages of the schema and every schema within it. huma panics on invalid patterns,
+// so they are checked first.
+func prepareSchema(schema *huma.Schema) error {
+	if schema.Pattern != "" {
+		if _, err := regexp.Compile(schema.Pattern); err != nil {
+			return fmt.Errorf("pattern: %w", err)
+		}
+	}
+	// additional properties are decoded as a map, huma only validates them as a schema
+	if additional, ok := schema.AdditionalProperties.(map[string]any); ok {
+		decoded, err := decodeSchema(additional)
+		if err != nil {
+			return err
+		}
+		schema.AdditionalProperties = decoded
+	}
+
+	children := []*huma.Schema{schema.Items, schema.Not}
+	children = append(children, schema.OneOf...)
+	children = append(children, schema.AnyOf...)
+	children = append(children, schema.AllOf...)
+	for _, property := range schema.Properties {
+		children = append(children, property)
+	}
+	for _, child := range children {
+		if child == nil {
+			continue
+		}
+		if err := prepareSchema(child); err != nil {
+			return err
+		}
+	}
+	schema.PrecomputeMessages()
+	return nil
+}
@@ -0,0 +1,77 @@
+package api
+
+import (
+	"testing"
+
+	"tokenize/models"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompileSchema(t *testing.T) {
+	tests := []struct {
+		name    string
+		schema  map[string]any
+		wantErr string
+	}{
+		{name: "valid", schema: map[string]any{"type": "object", "required": []any{"zip"}, "additionalProperties": map[string]any{"type": "string"}}},
+		{name: "invalid pattern", schema: map[string]any{"type": "object", "properties": map[string]any{"n": map[string]any{"type": "string", "pattern": "("}}}, wantErr: "pattern"},
+		{name: "invalid type", schema: map[string]any{"type": 5}, wantErr: "cannot unmarshal"},
+		{name: "const", schema: map[string]any{"const": "x"}, wantErr: `schema: unsupported keyword "const"`},
+		{name: "pattern properties", schema: map[string]any{"type": "object", "patternProperties": map[string]any{"^a": map[string]any{"type": "string"}}}, wantErr: `unsupported keyword "patternProperties"`},
+		{name: "reference", schema: map[string]any{"$ref": "#/components/schemas/Nope"}, wantErr: `unsupported keyword "$ref"`},
+		{name: "nested reference", schema: map[string]any{"type": "object", "properties": map[string]any{"zip": map[string]any{"$ref": "#/components/schemas/Zip"}}}, wantErr: `schema.properties.zip: unsupported keyword "$ref"`},
+		{name: "unknown keyword in a list", schema: map[string]any{"anyOf": []any{map[string]any{"type": "string"}, map[string]any{"if": map[string]any{}}}}, wantErr: `schema.anyOf[1]: unsupported keyword "if"`},
+		{name: "unknown keyword in additional properties", schema: map[string]any{"additionalProperties": map[string]any{"contains": map[string]any{}}}, wantErr: `unsupported keyword "contains"`},
+		{name: "keywords are case sensitive", schema: map[string]any{"MinLength": 3}, wantErr: `unsupported keyword "MinLength"`},
+		{name: "boolean additional properties", schema: map[string]any{"type": "object", "additionalProperties": false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := CompileSchema(tt.schema)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestSchemaValidator_Validate(t *testing.T) {
+	types, err := models.ParseTokenTypes([]byte(`{
+		"address": {
+			"schema": {"type": "object", "required": ["zip"], "properties": {"zip": {"type": "string", "pattern": "^\\d{5}$"}}},
+			"metadata_schema": {"type": "object", "properties": {"region": {"enum": ["eu", "us"]}}, "additionalProperties": {"type": "string"}}
+		}
+	}`), CompileSchema)
+	assert.NoError(t, err)
+	spec := types["address"]
+
+	tests := []struct {
+		name    string
+		data    models.CreateToken
+		wantErr error
+		wantIn  string
+	}{
+		{name: "matching", data: models.CreateToken{Payload: `{"zip": "12345"}`, Metadata: map[string]any{"region": "eu", "source": "web"}}},
+		{name: "payload pattern", data: models.CreateToken{Payload: `{"zip": "1234a"}`}, wantErr: models.ErrInvalidPayload, wantIn: "payload.zip"},
+		{name: "missing property", data: models.CreateToken{Payload: `{}`}, wantErr: models.ErrInvalidPayload, wantIn: "payload"},
+		{name: "metadata enum", data: models.CreateToken{Payload: `{"zip": "12345"}`, Metadata: map[string]any{"region": "apac"}}, wantErr: models.ErrInvalidMetadata, wantIn: "metadata.region"},
+		{name: "additional metadata", data: models.CreateToken{Payload: `{"zip": "12345"}`, Metadata: map[string]any{"retries": 3}}, wantErr: models.ErrInvalidMetadata, wantIn: "metadata.retries"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := tt.data
+			err := spec.Apply(&data, data.Payload)
+			if tt.wantErr == nil {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, tt.wantErr)
+			assert.ErrorContains(t, err, tt.wantIn)
+			assert.NotContains(t, err.Error(), "1234a", "values are not echoed back")
+			assert.NotContains(t, err.Error(), "apac", "values are not echoed back")
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package api
+
+import (
+	"context"
+
+	"tokenize/auth"
+	"tokenize/models"
+
+	"github.com/danielgtaylor/huma/v2"
+)
+
+// tenantFrom returns the tenant of the caller of the request, empty for callers that are not in a tenant
+func tenantFrom(ctx context.Context) string {
+	if principal, ok := auth.PrincipalFrom(ctx); ok {
+		return principal.Tenant
+	}
+	return ""
+}
+
+// tenantKeys returns the keys of the tenant
+func (h *BaseHandler) tenantKeys(tenant string) (models.TenantKeys, error) {
+	return models.KeysForTenant(h.Tenants, models.TenantKeys{Keys: h.Keys, TokenKeys: h.TokenKeys}, tenant)
+}
+
+// checkToken checks a token from the request before it is looked up. Requests for tokens that are not valid are recorded
+// in the chain of the tenant, see chainToken.
+func checkToken(token string) error {
+	if token == "" {
+		return huma.Error400BadRequest("token is required")
+	}
+	if !models.ValidToken(token) {
+		return models.ErrInvalidToken
+	}
+	return nil
+}
+
+// getToken returns the token from the caller's tenant. Tokens of other tenants are reported as not found, so callers
+// cannot tell whether they exist.
+func (h *BaseHandler) getToken(ctx context.Context, token string) (*models.Token, error) {
+	tenant := tenantFrom(ctx)
+	tokenVal, err := h.Store.GetToken(ctx, tenant, token)
+	if err != nil {
+		return nil, err
+	}
+	if tokenVal.Tenant != tenant {
+		return nil, models.ErrTokenNotFound
+	}
+	return tokenVal, nil
+}
@@ -0,0 +1,127 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"tokenize/audit"
+	"tokenize/auth"
+	"tokenize/keys"
+	"tokenize/models"
+	"tokenize/persistence/mock"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// tenantCtx returns the context of a request by an admin of the tenant
+func tenantCtx(tenant string) context.Context {
+	return auth.WithPrincipal(context.Background(), &auth.Principal{
+		Subject: "api_key:" + tenant,
+		Method:  auth.MethodAPIKey,
+		Roles:   []string{"admin"},
+		Tenant:  tenant,
+	})
+}
+
+func TestHandler_Tenants(t *testing.T) {
+	paymentsKeys := models.TenantKeys{
+		Keys:      keys.Static("this is the payments tenant key!"),
+		TokenKeys: keys.Static("payments tenant tokenization key"),
+	}
+	store := &recordingStore{}
+	h := &BaseHandler{
+		Policy:    testPolicy,
+		Store:     store,
+		Keys:      testKeys,
+		TokenKeys: testTokenKeys,
+		Tenants:   keys.Tenants{"payments": paymentsKeys},
+	}
+
+	for _, ctx := range []context.Context{testCtx, tenantCtx("payments")} {
+		in := &NewTokenRequest{}
+		in.Body.Data = models.CreateToken{Payload: "this is the payload", TokenType: "access"}
+		_, err := h.CreateToken(ctx, in)
+		assert.NoError(t, err)
+	}
+	defaultToken, paymentsToken := store.created[0], store.created[1]
+	assert.Empty(t, defaultToken.Tenant)
+	assert.Equal(t, "payments", paymentsToken.Tenant)
+	assert.NotEqual(t, defaultToken.Token, paymentsToken.Token, "tenants tokenize with their own key")
+
+	// the payload is sealed with the tenant's key
+	_, err := paymentsToken.Decrypt(context.Background(), testKeys)
+	assert.Error(t, err)
+	h.Store = mock.Store{Token: paymentsToken}
+	got, err := h.GetDecryptedToken(tenantCtx("payments"), &DecryptTokenRequest{GetTokenRequest: GetTokenRequest{Token: paymentsToken.Token}})
+	assert.NoError(t, err)
+	assert.Equal(t, "this is the payload", got.Body.Token.Payload)
+
+	// tokens of another tenant are not found
+	for _, ctx := range []context.Context{testCtx, tenantCtx("shipping")} {
+		_, err = h.GetEncryptedToken(ctx, &GetTokenRequest{Token: paymentsToken.Token})
+		assert.ErrorIs(t, err, models.ErrTokenNotFound)
+		_, err = h.DeleteToken(ctx, &GetTokenRequest{Token: paymentsToken.Token})
+		assert.ErrorIs(t, err, models.ErrTokenNotFound)
+	}
+}
+
+func TestHandler_UnknownTenant(t *testing.T) {
+	h := &BaseHandler{Policy: testPolicy, Store: mock.Store{}, Keys: testKeys, TokenKeys: testTokenKeys}
+	in := &NewTokenRequest{}
+	in.Body.Data = models.CreateToken{Payload: "this is the payload", TokenType: "access"}
+
+	_, err := mapErrors(h.CreateToken)(tenantCtx("payments"), in)
+	var p *Problem
+	assert.ErrorAs(t, err, &p)
+	assert.Equal(t, http.StatusForbidden, p.Status)
+	assert.Equal(t, "unknown_tenant", p.Code)
+}
+
+func TestHandler_AdminDeniedToTenants(t *testing.T) {
+	h := &BaseHandler{Policy: testPolicy}
+	_, err := mapErrors(h.GetKeyRotation)(tenantCtx("payments"), &struct{}{})
+	var statusErr huma.StatusError
+	assert.ErrorAs(t, err, &statusErr)
+	assert.Equal(t, http.StatusForbidden, statusErr.GetStatus())
+
+	_, err = mapErrors(h.GetKeyRotation)(testCtx, &struct{}{})
+	assert.ErrorAs(t, err, &statusErr)
+	assert.Equal(t, http.StatusNotImplemented, statusErr.GetStatus(), "callers without a tenant may use the admin endpoints")
+}
+
+func TestHandler_TokenWithTenantSeparator(t *testing.T) {
+	paymentsToken := &models.Token{Token: "abc", BaseModel: models.BaseModel{Tenant: "payments"}}
+	auditStore := &mock.AuditStore{}
+	h := &BaseHandler{Auth: testAuth, Policy: testPolicy, Store: mock.Store{Token: paymentsToken}, Audit: auditStore, AuditKeys: mock.AuditKeys}
+	router := Routes(h)
+
+	// the key of the payments tenant's token, which a caller without a tenant must not be able to name
+	for _, path := range []string{"/token/payments%23abc", "/token/payments%23abc/decrypt", "/token/payments%23abc/audit"} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, http.StatusBadRequest, rr.Code, path)
+		assert.Contains(t, rr.Body.String(), `"code":"invalid_token"`, path)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodDelete, "/token/payments%23abc", nil))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	batch := &BatchDecryptRequest{}
+	batch.Body.Tokens = []string{"payments#abc"}
+	got, err := h.GetDecryptedTokens(testCtx, batch)
+	assert.NoError(t, err)
+	assert.Equal(t, "invalid_token", got.Body.Results[0].Error.Code)
+
+	history, _, err := auditStore.History(testCtx, "payments", "abc", audit.Page{})
+	assert.NoError(t, err)
+	assert.Empty(t, history, "nothing should be recorded in the chain of the other tenant's token")
+	assert.Len(t, auditStore.Records, 4, "the requests are recorded in the chain of the caller's tenant")
+	for _, record := range auditStore.Records {
+		assert.Equal(t, "", record.Tenant)
+		_, ok := audit.TenantShardIndex(record.Token)
+		assert.True(t, ok, "%s is a chain of the tenant", record.Token)
+	}
+}
@@ -2,9 +2,13 @@ package api
 
 import (
 	"context"
+	"errors"
+	"log/slog"
 	"net/http"
 
+	"tokenize/audit"
 	"tokenize/models"
+	"tokenize/policy"
 
 	"github.com/danielgtaylor/huma/v2"
 )
@@ -21,7 +25,7 @@ func (h *BaseHandler) RegisterTokensRoutes(api huma.API) {
 			http.StatusForbidden,
 			http.StatusBadRequest,
 		},
-	}, h.CreateToken)
+	}, mapErrors(h.CreateToken))
 
 	huma.Register(api, huma.Operation{
 		OperationID:   "GetEncryptedToken",
@@ -35,7 +39,7 @@ func (h *BaseHandler) RegisterTokensRoutes(api huma.API) {
 			http.StatusBadRequest,
 			http.StatusNotFound,
 		},
-	}, h.GetEncryptedToken)
+	}, mapErrors(h.GetEncryptedToken))
 
 	huma.Register(api, huma.Operation{
 		OperationID:   "GetDecryptedToken",
@@ -48,8 +52,24 @@ func (h *BaseHandler) RegisterTokensRoutes(api huma.API) {
 			http.StatusForbidden,
 			http.StatusBadRequest,
 			http.StatusNotFound,
+			http.StatusUnprocessableEntity,
+			http.StatusGone,
 		},
-	}, h.GetDecryptedToken)
+	}, mapErrors(h.GetDecryptedToken))
+
+	huma.Register(api, huma.Operation{
+		OperationID:   "UpdateToken",
+		Summary:       "Update the metadata and TTL of a token",
+		Method:        http.MethodPost,
+		Path:          "/token/{token}",
+		DefaultStatus: http.StatusOK,
+		Errors: []int{
+			http.StatusUnauthorized,
+			http.StatusForbidden,
+			http.StatusBadRequest,
+			http.StatusNotFound,
+		},
+	}, mapErrors(h.UpdateToken))
 
 	huma.Register(api, huma.Operation{
 		OperationID:   "DeleteToken",
@@ -63,11 +83,15 @@ func (h *BaseHandler) RegisterTokensRoutes(api huma.API) {
 			http.StatusBadRequest,
 			http.StatusNotFound,
 		},
-	}, h.DeleteToken)
+	}, mapErrors(h.DeleteToken))
 
 }
 
+// maxTokenAttempts is how many random tokens are tried before giving up on finding an unused one
+const maxTokenAttempts = 3
+
 type NewTokenRequest struct {
+	Mode models.TokenMode `query:"token_mode" enum:"hmac,random,card" doc:"Overrides the token mode of the token type"`
 	Body struct {
 		Data models.CreateToken `json:"data" validate:"required"`
 	}
@@ -80,26 +104,147 @@ type NewTokenResponse struct {
 }
 
 func (h *BaseHandler) CreateToken(ctx context.Context, in *NewTokenRequest) (*NewTokenResponse, error) {
+	tokenVal, err := h.tokenize(ctx, in.Mode, in.Body.Data)
+	if err != nil {
+		return nil, err
+	}
 
-	newToken := models.Token{
-		CreateToken: in.Body.Data,
+	output := &NewTokenResponse{}
+	output.Body.Token = tokenVal.Token
+
+	return output, nil
+}
+
+// tokenize authorizes tokenizing data, stores its token with the requested mode and audits it
+func (h *BaseHandler) tokenize(ctx context.Context, requested models.TokenMode, data models.CreateToken) (tokenVal *models.Token, err error) {
+	event := auditEvent(ctx, audit.OperationCreate, "")
+	event.TokenType = data.TokenType
+	defer func() {
+		if err = h.recordAudit(ctx, event, err); err != nil {
+			tokenVal = nil
+		}
+	}()
+
+	payload := data.Payload
+	if err := h.authorizeTokenize(ctx, &data); err != nil {
+		return nil, err
 	}
-	if err := newToken.Tokenize(); err != nil {
+	spec, err := h.tokenType(&data, payload)
+	if err != nil {
 		return nil, err
 	}
-	if err := newToken.Encrypt(); err != nil {
+	mode, err := h.tokenMode(requested, &data, spec)
+	if err != nil {
 		return nil, err
 	}
 
-	tokenVal, err := h.Store.CreateToken(ctx, &newToken)
+	tokenVal, err = h.storeToken(ctx, models.Token{
+		CreateToken: data,
+		Mode:        mode,
+		RevealsLeft: data.MaxReveals,
+	})
 	if err != nil {
 		return nil, err
 	}
+	event.Token = tokenVal.Token
+	return tokenVal, nil
+}
 
-	output := &NewTokenResponse{}
-	output.Body.Token = tokenVal.Token
+// authorizeTokenize normalizes data and authorizes tokenizing it. The token type is authorized before the payload is
+// normalized, so a caller who may not tokenize the type cannot learn which payloads are valid for it, and the metadata
+// the token is stored with, including the derived attributes, once they are known.
+func (h *BaseHandler) authorizeTokenize(ctx context.Context, data *models.CreateToken) error {
+	if err := h.authorize(ctx, policy.ActionTokenize, policy.Resource{TokenType: data.TokenType, AnyMetadata: true}); err != nil {
+		return err
+	}
+	if err := data.Normalize(); err != nil {
+		return err
+	}
+	return h.authorize(ctx, policy.ActionTokenize, policy.Resource{TokenType: data.TokenType, Metadata: data.Metadata})
+}
 
-	return output, nil
+// tokenType checks data against its token type in the registry, and gives it the defaults of the type. The payload is
+// the one the client sent, before it was normalized.
+func (h *BaseHandler) tokenType(data *models.CreateToken, payload string) (*models.TokenTypeSpec, error) {
+	spec, err := h.TokenTypes.Spec(data.TokenType)
+	if err != nil {
+		return nil, err
+	}
+	if err := spec.Apply(data, payload); err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+// tokenMode returns the mode to tokenize data with: the requested mode, card for formatted tokens, or else the mode of
+// the token type. The format of the token type is used when neither a mode nor a format is requested.
+func (h *BaseHandler) tokenMode(requested models.TokenMode, data *models.CreateToken, spec *models.TokenTypeSpec) (models.TokenMode, error) {
+	mode := requested
+	if mode == "" && data.Format == nil && data.MaxReveals > 0 {
+		// every tokenization of the payload gets its own token, and with it its own reveals
+		mode = models.TokenModeRandom
+	}
+	if mode == "" && data.Format == nil && spec != nil {
+		data.Format = spec.Format
+	}
+	if data.Format != nil {
+		if mode != "" && mode != models.TokenModeCard {
+			return "", huma.Error400BadRequest("format can only be used with the card token mode")
+		}
+		mode = models.TokenModeCard
+	}
+	if mode == "" && spec != nil {
+		mode = spec.Mode
+	}
+	if mode == "" {
+		mode = h.TokenModes.ModeFor(data.TokenType)
+	}
+	if data.MaxReveals > 0 && mode.Deterministic() {
+		return "", huma.Error400BadRequest("max_reveals can only be used with the random token mode")
+	}
+	return mode, nil
+}
+
+// storeToken tokenizes, encrypts and stores a new token in the caller's tenant, with the tenant's keys. Deterministic
+// tokens that already exist are reused instead of being overwritten when they have the same token type and format,
+// random tokens are regenerated until an unused one is found.
+func (h *BaseHandler) storeToken(ctx context.Context, plain models.Token) (*models.Token, error) {
+	tenant := tenantFrom(ctx)
+	keys, err := h.tenantKeys(tenant)
+	if err != nil {
+		return nil, err
+	}
+	for attempt := 0; attempt < maxTokenAttempts; attempt++ {
+		base, err := models.NewBaseModel()
+		if err != nil {
+			return nil, err
+		}
+		base.Tenant = tenant
+		newToken := plain
+		newToken.BaseModel = base
+		if err := newToken.Tokenize(ctx, keys.TokenKeys); err != nil {
+			return nil, err
+		}
+		if err := newToken.Encrypt(ctx, keys.Keys); err != nil {
+			return nil, err
+		}
+
+		tokenVal, err := h.Store.CreateToken(ctx, &newToken)
+		if !errors.Is(err, models.ErrTokenExists) {
+			return tokenVal, err
+		}
+		if newToken.Mode.Deterministic() {
+			stored, err := h.Store.GetToken(ctx, tenant, newToken.Token)
+			if err != nil {
+				return nil, err
+			}
+			if err := newToken.CheckReuse(stored); err != nil {
+				return nil, err
+			}
+			return stored, nil
+		}
+	}
+	return nil, huma.Error500InternalServerError("unable to generate an unused token")
 }
 
 type GetTokenRequest struct {
@@ -112,52 +257,244 @@ type GetTokenResponse struct {
 	}
 }
 
-func (h *BaseHandler) GetEncryptedToken(ctx context.Context, in *GetTokenRequest) (*GetTokenResponse, error) {
+func (h *BaseHandler) GetEncryptedToken(ctx context.Context, in *GetTokenRequest) (output *GetTokenResponse, err error) {
 	token := in.Token
-	if token == "" {
-		return nil, huma.Error400BadRequest("token is required")
+	event := auditEvent(ctx, audit.OperationRead, token)
+	defer func() {
+		if err = h.recordAudit(ctx, event, err); err != nil {
+			output = nil
+		}
+	}()
+	if err := checkToken(token); err != nil {
+		return nil, err
 	}
 
-	tokenVal, err := h.Store.GetToken(ctx, token)
+	tokenVal, err := h.getToken(ctx, token)
 	if err != nil {
 		return nil, err
 	}
+	event.TokenType = tokenVal.TokenType
+	if err := h.authorize(ctx, policy.ActionRead, tokenResource(tokenVal)); err != nil {
+		return nil, err
+	}
 
 	tokenVal.Payload = ""
+	output = &GetTokenResponse{}
+	output.Body.Token = *tokenVal
+	return output, nil
+}
+
+type DecryptTokenRequest struct {
+	GetTokenRequest
+	Reveal string `query:"reveal" doc:"Reveal policy to show the payload with, such as last4 or first6_last4, the token type's default when empty"`
+}
+
+func (h *BaseHandler) GetDecryptedToken(ctx context.Context, in *DecryptTokenRequest) (*GetTokenResponse, error) {
+	tokenVal, err := h.decryptToken(ctx, in.Token, in.Reveal)
+	if err != nil {
+		return nil, err
+	}
+
 	output := &GetTokenResponse{}
 	output.Body.Token = *tokenVal
 	return output, nil
 }
 
-func (h *BaseHandler) GetDecryptedToken(ctx context.Context, in *GetTokenRequest) (*GetTokenResponse, error) {
-	token := in.Token
-	if token == "" {
-		return nil, huma.Error400BadRequest("token is required")
+// decryptToken returns a token of the caller's tenant with its payload shown by the reveal policy, and audits it
+func (h *BaseHandler) decryptToken(ctx context.Context, token string, reveal string) (tokenVal *models.Token, err error) {
+	event := auditEvent(ctx, audit.OperationDecrypt, token)
+	defer func() {
+		if err = h.recordAudit(ctx, event, err); err != nil {
+			tokenVal = nil
+		}
+	}()
+	if err := checkToken(token); err != nil {
+		return nil, err
 	}
 
-	tokenVal, err := h.Store.GetToken(ctx, token)
+	tokenVal, err = h.resolveToken(ctx, token, reveal, event)
 	if err != nil {
 		return nil, err
 	}
+	if err := h.consumeReveal(ctx, tokenVal); err != nil {
+		return nil, err
+	}
+	return tokenVal, nil
+}
 
-	payload, err := tokenVal.Decrypt()
+// resolveToken returns a token of the caller's tenant with its payload shown by the reveal policy, without taking a
+// reveal of a token with a reveal limit
+func (h *BaseHandler) resolveToken(ctx context.Context, token string, reveal string, event *audit.Record) (*models.Token, error) {
+	tokenVal, err := h.getToken(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	event.TokenType = tokenVal.TokenType
+	keys, err := h.tenantKeys(tokenVal.Tenant)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := h.revealPayload(ctx, tokenVal, reveal, keys.Keys)
 	if err != nil {
 		return nil, err
 	}
-
 	tokenVal.Payload = payload
-	output := &GetTokenResponse{}
+	return tokenVal, nil
+}
+
+// revealPayload authorizes detokenizing the token with the named reveal policy, the default of its token type when
+// empty, and returns its payload as the policy shows it
+func (h *BaseHandler) revealPayload(ctx context.Context, tokenVal *models.Token, reveal string, keys models.KeyProvider) (string, error) {
+	if reveal == "" {
+		reveal = h.TokenTypes.Reveal(tokenVal.TokenType)
+	}
+	revealPolicy, err := h.Reveals.For(tokenVal.TokenType, reveal)
+	if err != nil {
+		return "", err
+	}
+	resource := tokenResource(tokenVal)
+	resource.Reveal = reveal
+	if err := h.authorize(ctx, policy.ActionDetokenize, resource); err != nil {
+		return "", err
+	}
+	return h.showPayload(ctx, tokenVal, revealPolicy, keys)
+}
+
+// showPayload decrypts the payload of the token and shows it with the reveal policy. It does not take a reveal of
+// tokens with a reveal limit, that is left to consumeReveal once the payload was shown, but tokens without reveals left
+// already fail here.
+func (h *BaseHandler) showPayload(ctx context.Context, tokenVal *models.Token, revealPolicy *models.RevealPolicy, keys models.KeyProvider) (string, error) {
+	if tokenVal.MaxReveals > 0 && tokenVal.RevealsLeft <= 0 {
+		return "", models.ErrRevealsExhausted
+	}
+	payload, err := tokenVal.Decrypt(ctx, keys)
+	if err != nil {
+		return "", err
+	}
+	return revealPolicy.Apply(payload), nil
+}
+
+// consumeReveal takes one of the reveals left of a token with a reveal limit. It runs once the payload was shown and
+// before the decrypt is recorded in the audit log, so a request that loses the race for the last reveal is recorded
+// once, as a decrypt that failed. The token is deleted with its last reveal, and when that fails it stays in the store
+// without any reveals left.
+func (h *BaseHandler) consumeReveal(ctx context.Context, tokenVal *models.Token) error {
+	if tokenVal.MaxReveals == 0 {
+		return nil
+	}
+	left, err := h.Store.ConsumeReveal(ctx, tokenVal)
+	if err != nil {
+		return err
+	}
+	tokenVal.RevealsLeft = left
+	if left > 0 {
+		return nil
+	}
+	if err := h.Store.DeleteToken(ctx, tokenVal); err != nil {
+		slog.Error("unable to delete token without reveals left", "request_id", requestIDFrom(ctx), "error", err)
+	}
+	return nil
+}
+
+// consumeReveals takes a reveal of each of the tokens with a reveal limit like consumeReveal, of all of them or of
+// none, so a request that fails on one of its tokens does not use up the reveals of the others
+func (h *BaseHandler) consumeReveals(ctx context.Context, tokens []*models.Token) error {
+	limited := []*models.Token{}
+	for _, tokenVal := range tokens {
+		if tokenVal.MaxReveals > 0 {
+			limited = append(limited, tokenVal)
+		}
+	}
+	if len(limited) == 0 {
+		return nil
+	}
+	left, err := h.Store.ConsumeReveals(ctx, limited)
+	if err != nil {
+		return err
+	}
+	for i, tokenVal := range limited {
+		tokenVal.RevealsLeft = left[i]
+		if left[i] > 0 {
+			continue
+		}
+		if err := h.Store.DeleteToken(ctx, tokenVal); err != nil {
+			slog.Error("unable to delete token without reveals left", "request_id", requestIDFrom(ctx), "error", err)
+		}
+	}
+	return nil
+}
+
+type UpdateTokenRequest struct {
+	Token string `path:"token" validate:"required"`
+	Body  models.UpdateToken
+}
+
+// UpdateToken changes the metadata and TTL of a token, the payload cannot be changed
+func (h *BaseHandler) UpdateToken(ctx context.Context, in *UpdateTokenRequest) (output *GetTokenResponse, err error) {
+	if in.Body.TTL == nil && in.Body.Metadata == nil {
+		return nil, models.ErrEmptyUpdate
+	}
+	event := auditEvent(ctx, audit.OperationUpdate, in.Token)
+	defer func() {
+		if err = h.recordAudit(ctx, event, err); err != nil {
+			output = nil
+		}
+	}()
+	if err := checkToken(in.Token); err != nil {
+		return nil, err
+	}
+
+	current, err := h.getToken(ctx, in.Token)
+	if err != nil {
+		return nil, err
+	}
+	event.TokenType = current.TokenType
+	resource := tokenResource(current)
+	if err := h.authorize(ctx, policy.ActionUpdate, resource); err != nil {
+		return nil, err
+	}
+	in.Body.Metadata = current.KeepDerivedMetadata(in.Body.Metadata)
+	// the token must stay within what the caller may update, metadata cannot be used to move it out of reach
+	if in.Body.Metadata != nil {
+		resource.Metadata = in.Body.Metadata
+		if err := h.authorize(ctx, policy.ActionUpdate, resource); err != nil {
+			return nil, err
+		}
+	}
+	// tokens of types that are not in the registry, such as ones created before it, are not checked
+	if err := h.TokenTypes[current.TokenType].CheckUpdate(in.Body); err != nil {
+		return nil, err
+	}
+
+	tokenVal, err := h.Store.UpdateToken(ctx, current.Tenant, in.Token, in.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	tokenVal.Payload = ""
+	output = &GetTokenResponse{}
 	output.Body.Token = *tokenVal
 	return output, nil
 }
 
-func (h *BaseHandler) DeleteToken(ctx context.Context, in *GetTokenRequest) (*struct{}, error) {
+func (h *BaseHandler) DeleteToken(ctx context.Context, in *GetTokenRequest) (_ *struct{}, err error) {
 	token := in.Token
+	event := auditEvent(ctx, audit.OperationDelete, token)
+	defer func() {
+		err = h.recordAudit(ctx, event, err)
+	}()
+	if err := checkToken(token); err != nil {
+		return nil, err
+	}
 
-	tokenVal, err := h.Store.GetToken(ctx, token)
+	tokenVal, err := h.getToken(ctx, token)
 	if err != nil {
 		return nil, err
 	}
+	event.TokenType = tokenVal.TokenType
+	if err := h.authorize(ctx, policy.ActionDelete, tokenResource(tokenVal)); err != nil {
+		return nil, err
+	}
 
 	err = h.Store.DeleteToken(ctx, tokenVal)
 	if err != nil {
@@ -3,15 +3,29 @@ package api
 import (
 	"context"
 	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
 
+	"tokenize/audit"
+	"tokenize/auth"
+	"tokenize/keys"
 	"tokenize/models"
 	"tokenize/persistence"
 	"tokenize/persistence/mock"
+	"tokenize/policy"
 
+	"github.com/danielgtaylor/huma/v2"
 	"github.com/stretchr/testify/assert"
 )
 
+var (
+	testKeys      = keys.Static("this is the secret key and stuff")
+	testTokenKeys = keys.Static("this is the tokenization key....")
+)
+
 func TestHandler_CreateToken(t *testing.T) {
 	type fields struct {
 		Store persistence.Store
@@ -44,7 +58,7 @@ func TestHandler_CreateToken(t *testing.T) {
 				},
 			},
 			args: args{
-				ctx: context.Background(),
+				ctx: testCtx,
 				in: &NewTokenRequest{
 					Body: struct {
 						Data models.CreateToken `json:"data" validate:"required"`
@@ -67,7 +81,7 @@ func TestHandler_CreateToken(t *testing.T) {
 				},
 			},
 			args: args{
-				ctx: context.Background(),
+				ctx: testCtx,
 				in: &NewTokenRequest{
 					Body: struct {
 						Data models.CreateToken `json:"data" validate:"required"`
@@ -88,7 +102,10 @@ func TestHandler_CreateToken(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			h := &BaseHandler{
-				Store: tt.fields.Store,
+				Policy:    testPolicy,
+				Store:     tt.fields.Store,
+				Keys:      testKeys,
+				TokenKeys: testTokenKeys,
 			}
 			got, err := h.CreateToken(tt.args.ctx, tt.args.in)
 			if tt.wantErr {
@@ -130,7 +147,7 @@ func TestHandler_GetEncryptedToken(t *testing.T) {
 				},
 			},
 			args: args{
-				ctx: context.Background(), in: &GetTokenRequest{Token: "foobartesttoken"},
+				ctx: testCtx, in: &GetTokenRequest{Token: "foobartesttoken"},
 			},
 			want: &models.Token{
 				Token:     "foobartesttoken",
@@ -147,7 +164,7 @@ func TestHandler_GetEncryptedToken(t *testing.T) {
 				},
 			},
 			args: args{
-				ctx: context.Background(), in: &GetTokenRequest{Token: ""},
+				ctx: testCtx, in: &GetTokenRequest{Token: ""},
 			},
 			wantErr: true,
 		}, {
@@ -158,7 +175,7 @@ func TestHandler_GetEncryptedToken(t *testing.T) {
 				},
 			},
 			args: args{
-				ctx: context.Background(), in: &GetTokenRequest{Token: "foobartesttoken"},
+				ctx: testCtx, in: &GetTokenRequest{Token: "foobartesttoken"},
 			},
 			wantErr: true,
 		},
@@ -166,7 +183,10 @@ func TestHandler_GetEncryptedToken(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			h := &BaseHandler{
-				Store: tt.fields.Store,
+				Policy:    testPolicy,
+				Store:     tt.fields.Store,
+				Keys:      testKeys,
+				TokenKeys: testTokenKeys,
 			}
 			got, err := h.GetEncryptedToken(tt.args.ctx, tt.args.in)
 			if tt.wantErr {
@@ -185,7 +205,7 @@ func TestHandler_GetDecryptedToken(t *testing.T) {
 	}
 	type args struct {
 		ctx context.Context
-		in  *GetTokenRequest
+		in  *DecryptTokenRequest
 	}
 	tests := []struct {
 		name    string
@@ -208,7 +228,7 @@ func TestHandler_GetDecryptedToken(t *testing.T) {
 				},
 			},
 			args: args{
-				ctx: context.Background(), in: &GetTokenRequest{Token: "foobartesttoken"},
+				ctx: testCtx, in: &DecryptTokenRequest{GetTokenRequest: GetTokenRequest{Token: "foobartesttoken"}},
 			},
 			want: &models.Token{
 				Token:     "foobartesttoken",
@@ -223,7 +243,7 @@ func TestHandler_GetDecryptedToken(t *testing.T) {
 				Store: mock.Store{},
 			},
 			args: args{
-				ctx: context.Background(), in: &GetTokenRequest{Token: ""},
+				ctx: testCtx, in: &DecryptTokenRequest{GetTokenRequest: GetTokenRequest{Token: ""}},
 			},
 			wantErr: true,
 		}, {
@@ -234,7 +254,7 @@ func TestHandler_GetDecryptedToken(t *testing.T) {
 				},
 			},
 			args: args{
-				ctx: context.Background(), in: &GetTokenRequest{Token: "foobartesttoken"},
+				ctx: testCtx, in: &DecryptTokenRequest{GetTokenRequest: GetTokenRequest{Token: "foobartesttoken"}},
 			},
 			wantErr: true,
 		}, {
@@ -251,7 +271,7 @@ func TestHandler_GetDecryptedToken(t *testing.T) {
 				},
 			},
 			args: args{
-				ctx: context.Background(), in: &GetTokenRequest{Token: "foobartesttoken"},
+				ctx: testCtx, in: &DecryptTokenRequest{GetTokenRequest: GetTokenRequest{Token: "foobartesttoken"}},
 			},
 			wantErr: true,
 		},
@@ -259,7 +279,10 @@ func TestHandler_GetDecryptedToken(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			h := &BaseHandler{
-				Store: tt.fields.Store,
+				Policy:    testPolicy,
+				Store:     tt.fields.Store,
+				Keys:      testKeys,
+				TokenKeys: testTokenKeys,
 			}
 			got, err := h.GetDecryptedToken(tt.args.ctx, tt.args.in)
 			if tt.wantErr {
@@ -272,6 +295,33 @@ func TestHandler_GetDecryptedToken(t *testing.T) {
 	}
 }
 
+func TestHandler_GetDecryptedTokenIntegrity(t *testing.T) {
+	store := &recordingStore{}
+	h := &BaseHandler{Policy: testPolicy, Store: store, Keys: testKeys, TokenKeys: testTokenKeys}
+	for _, payload := range []string{"first payload", "second payload"} {
+		in := &NewTokenRequest{}
+		in.Body.Data = models.CreateToken{Payload: payload, TokenType: "access"}
+		_, err := h.CreateToken(testCtx, in)
+		assert.NoError(t, err)
+	}
+
+	// the second token's encrypted payload copied onto the first record
+	swapped := *store.created[0]
+	swapped.Payload = store.created[1].Payload
+	swapped.WrappedKey = store.created[1].WrappedKey
+	h.Store = mock.Store{Token: &swapped}
+
+	_, err := mapErrors(h.GetDecryptedToken)(testCtx, &DecryptTokenRequest{GetTokenRequest: GetTokenRequest{Token: swapped.Token}})
+	var statusErr huma.StatusError
+	assert.ErrorAs(t, err, &statusErr)
+	assert.Equal(t, http.StatusUnprocessableEntity, statusErr.GetStatus())
+
+	h.Store = mock.Store{Token: store.created[0]}
+	got, err := h.GetDecryptedToken(testCtx, &DecryptTokenRequest{GetTokenRequest: GetTokenRequest{Token: swapped.Token}})
+	assert.NoError(t, err)
+	assert.Equal(t, "first payload", got.Body.Token.Payload)
+}
+
 func TestHandler_DeleteToken(t *testing.T) {
 	type fields struct {
 		Store persistence.Store
@@ -297,7 +347,7 @@ func TestHandler_DeleteToken(t *testing.T) {
 				},
 			},
 			args: args{
-				ctx: context.Background(),
+				ctx: testCtx,
 				in: &GetTokenRequest{
 					Token: "foobartesttoken",
 				},
@@ -310,7 +360,7 @@ func TestHandler_DeleteToken(t *testing.T) {
 				},
 			},
 			args: args{
-				ctx: context.Background(),
+				ctx: testCtx,
 				in: &GetTokenRequest{
 					Token: "foobartesttoken",
 				},
@@ -327,7 +377,7 @@ func TestHandler_DeleteToken(t *testing.T) {
 				},
 			},
 			args: args{
-				ctx: context.Background(),
+				ctx: testCtx,
 				in: &GetTokenRequest{
 					Token: "foobartesttoken",
 				},
@@ -338,7 +388,10 @@ func TestHandler_DeleteToken(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			h := &BaseHandler{
-				Store: tt.fields.Store,
+				Policy:    testPolicy,
+				Store:     tt.fields.Store,
+				Keys:      testKeys,
+				TokenKeys: testTokenKeys,
 			}
 			got, err := h.DeleteToken(tt.args.ctx, tt.args.in)
 			if tt.wantErr {
@@ -350,3 +403,621 @@ func TestHandler_DeleteToken(t *testing.T) {
 		})
 	}
 }
+
+// recordingStore keeps the tokens it is asked to create, failing creates with the queued errors
+type recordingStore struct {
+	mock.Store
+	createErrors []error
+	created      []*models.Token
+}
+
+func (r *recordingStore) CreateToken(_ context.Context, token *models.Token) (*models.Token, error) {
+	r.created = append(r.created, token)
+	if len(r.createErrors) > 0 {
+		err := r.createErrors[0]
+		r.createErrors = r.createErrors[1:]
+		if err != nil {
+			return nil, err
+		}
+	}
+	return token, nil
+}
+
+func (r *recordingStore) CreateTokens(ctx context.Context, tokens []*models.Token) []error {
+	errs := make([]error, len(tokens))
+	for i, token := range tokens {
+		_, errs[i] = r.CreateToken(ctx, token)
+	}
+	return errs
+}
+
+func TestHandler_CreateTokenModes(t *testing.T) {
+	tests := []struct {
+		name       string
+		store      *recordingStore
+		modes      models.TokenModes
+		mode       models.TokenMode
+		wantMode   models.TokenMode
+		wantToken  string
+		wantStores int
+		wantErr    bool
+	}{
+		{
+			name:       "default mode",
+			store:      &recordingStore{},
+			wantMode:   models.TokenModeHMAC,
+			wantStores: 1,
+		},
+		{
+			name:       "mode configured for the token type",
+			store:      &recordingStore{},
+			modes:      models.TokenModes{ByType: map[string]models.TokenMode{"access": models.TokenModeRandom}},
+			wantMode:   models.TokenModeRandom,
+			wantStores: 1,
+		},
+		{
+			name:       "mode chosen for the request",
+			store:      &recordingStore{},
+			modes:      models.TokenModes{ByType: map[string]models.TokenMode{"access": models.TokenModeRandom}},
+			mode:       models.TokenModeHMAC,
+			wantMode:   models.TokenModeHMAC,
+			wantStores: 1,
+		},
+		{
+			name:       "random token collision is retried",
+			store:      &recordingStore{createErrors: []error{models.ErrTokenExists}},
+			mode:       models.TokenModeRandom,
+			wantMode:   models.TokenModeRandom,
+			wantStores: 2,
+		},
+		{
+			name: "random token keeps colliding",
+			store: &recordingStore{
+				createErrors: []error{models.ErrTokenExists, models.ErrTokenExists, models.ErrTokenExists},
+			},
+			mode:    models.TokenModeRandom,
+			wantErr: true,
+		},
+		{
+			name: "existing deterministic token is reused",
+			store: &recordingStore{
+				Store: mock.Store{Token: &models.Token{
+					Token:       "existing-token",
+					CreateToken: models.CreateToken{TokenType: "access"},
+				}},
+				createErrors: []error{models.ErrTokenExists},
+			},
+			wantToken:  "existing-token",
+			wantStores: 1,
+		},
+		{
+			name: "existing deterministic token of another type is not reused",
+			store: &recordingStore{
+				Store: mock.Store{Token: &models.Token{
+					Token:       "existing-token",
+					CreateToken: models.CreateToken{TokenType: "debit"},
+				}},
+				createErrors: []error{models.ErrTokenExists},
+			},
+			wantErr: true,
+		},
+		{
+			name: "existing deterministic token with another format is not reused",
+			store: &recordingStore{
+				Store: mock.Store{Token: &models.Token{
+					Token:       "existing-token",
+					CreateToken: models.CreateToken{TokenType: "access", Format: &models.FormatOptions{PreserveLast4: true}},
+				}},
+				createErrors: []error{models.ErrTokenExists},
+			},
+			wantErr: true,
+		},
+		{
+			name:    "store error",
+			store:   &recordingStore{createErrors: []error{errors.New("unknown error")}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &BaseHandler{
+				Policy:     testPolicy,
+				Store:      tt.store,
+				Keys:       testKeys,
+				TokenKeys:  testTokenKeys,
+				TokenModes: tt.modes,
+			}
+			in := &NewTokenRequest{Mode: tt.mode}
+			in.Body.Data = models.CreateToken{
+				Payload:   "this is the payload",
+				TokenType: "access",
+			}
+
+			got, err := h.CreateToken(testCtx, in)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Len(t, tt.store.created, tt.wantStores)
+
+			if tt.wantToken != "" {
+				assert.Equal(t, tt.wantToken, got.Body.Token)
+				return
+			}
+			stored := tt.store.created[len(tt.store.created)-1]
+			assert.Equal(t, tt.wantMode, stored.Mode)
+			assert.Equal(t, stored.Token, got.Body.Token)
+			assert.NotEqual(t, "this is the payload", stored.Payload, "payload should be encrypted")
+			if tt.wantStores > 1 {
+				assert.NotEqual(t, tt.store.created[0].Token, stored.Token, "a new token should be generated")
+			}
+		})
+	}
+}
+
+func TestHandler_CreateCardToken(t *testing.T) {
+	tests := []struct {
+		name       string
+		tokenType  string
+		payload    string
+		mode       models.TokenMode
+		format     *models.FormatOptions
+		wantPrefix string
+		wantSuffix string
+		wantStatus int
+	}{
+		{
+			name:      "card token type",
+			tokenType: "card",
+			payload:   `{"card_number": "4111111111111111", "exp": "0128"}`,
+		},
+		{
+			name:       "format option on another token type",
+			tokenType:  "payment",
+			payload:    "4111 1111 1111 1111",
+			format:     &models.FormatOptions{PreserveBIN: true, PreserveLast4: true},
+			wantPrefix: "411111",
+			wantSuffix: "1111",
+		},
+		{
+			name:       "format option with another mode",
+			tokenType:  "card",
+			payload:    "4111111111111111",
+			mode:       models.TokenModeRandom,
+			format:     &models.FormatOptions{PreserveLast4: true},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "payload is not a card number",
+			tokenType:  "card",
+			payload:    "this is the payload",
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &recordingStore{}
+			h := &BaseHandler{Policy: testPolicy, Store: store, Keys: testKeys, TokenKeys: testTokenKeys}
+			in := &NewTokenRequest{Mode: tt.mode}
+			in.Body.Data = models.CreateToken{
+				Payload:   tt.payload,
+				TokenType: tt.tokenType,
+				Format:    tt.format,
+			}
+
+			got, err := mapErrors(h.CreateToken)(testCtx, in)
+			if tt.wantStatus != 0 {
+				var statusErr huma.StatusError
+				assert.ErrorAs(t, err, &statusErr)
+				assert.Equal(t, tt.wantStatus, statusErr.GetStatus())
+				return
+			}
+			assert.NoError(t, err)
+			assert.Regexp(t, "^[0-9]{16}$", got.Body.Token)
+			assert.NotEqual(t, "4111111111111111", got.Body.Token)
+			assert.True(t, strings.HasPrefix(got.Body.Token, tt.wantPrefix))
+			assert.True(t, strings.HasSuffix(got.Body.Token, tt.wantSuffix))
+			assert.Equal(t, models.TokenModeCard, store.created[0].Mode)
+		})
+	}
+}
+
+func TestHandler_CardMetadata(t *testing.T) {
+	store := &recordingStore{}
+	h := &BaseHandler{Policy: testPolicy, Store: store, Keys: testKeys, TokenKeys: testTokenKeys}
+
+	in := &NewTokenRequest{Mode: models.TokenModeHMAC}
+	in.Body.Data = models.CreateToken{
+		Payload:   `{"card_number": "5555555555554444", "exp": "01/28"}`,
+		TokenType: "card",
+		Metadata:  map[string]any{"bin": "411111", "bin8": "41111111", "last4": "1111", "region": "eu"},
+	}
+	_, err := h.CreateToken(testCtx, in)
+	assert.NoError(t, err)
+	assert.Equal(t,
+		map[string]any{"bin": "555555", "bin8": "55555555", "last4": "4444", "brand": "mastercard", "expiry": "2028-01", "region": "eu"},
+		store.created[0].Metadata,
+		"derived metadata replaces the client's",
+	)
+
+	in.Body.Data.Payload = "5555555555554445"
+	_, err = mapErrors(h.CreateToken)(testCtx, in)
+	var p *Problem
+	assert.ErrorAs(t, err, &p)
+	assert.Equal(t, "invalid_card_number", p.Code, "card numbers are checked whatever the token mode")
+
+	stored := *store.created[0]
+	h.Store = mock.Store{Token: &stored}
+	updated, err := h.UpdateToken(testCtx, &UpdateTokenRequest{
+		Token: stored.Token,
+		Body:  models.UpdateToken{Metadata: map[string]any{"bin": "411111", "bin8": "41111111", "region": "uk"}},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t,
+		map[string]any{"bin": "555555", "bin8": "55555555", "last4": "4444", "brand": "mastercard", "expiry": "2028-01", "region": "uk"},
+		updated.Body.Token.Metadata,
+		"updates cannot change derived metadata",
+	)
+}
+
+func TestHandler_BuiltinTypes(t *testing.T) {
+	store := &documentStore{}
+	h := &BaseHandler{Policy: testPolicy, Store: store, Keys: testKeys, TokenKeys: testTokenKeys}
+
+	tokens := []string{}
+	for _, payload := range []string{"Jane.Doe@Example.com", " jane.doe@example.COM "} {
+		in := &NewTokenRequest{}
+		in.Body.Data = models.CreateToken{Payload: payload, TokenType: "email"}
+		got, err := h.CreateToken(testCtx, in)
+		assert.NoError(t, err)
+		tokens = append(tokens, got.Body.Token)
+	}
+	assert.Equal(t, tokens[0], tokens[1], "the same address gets the same token")
+	assert.Equal(t, map[string]any{"domain": "example.com"}, store.created[0].Metadata)
+
+	decrypted, err := h.GetDecryptedToken(testCtx, &DecryptTokenRequest{GetTokenRequest: GetTokenRequest{Token: tokens[0]}, Reveal: "masked"})
+	assert.NoError(t, err)
+	assert.Equal(t, "j*******@example.com", decrypted.Body.Token.Payload)
+
+	in := &NewTokenRequest{}
+	in.Body.Data = models.CreateToken{Payload: "415-555-2671", TokenType: "phone"}
+	_, err = mapErrors(h.CreateToken)(testCtx, in)
+	var p *Problem
+	assert.ErrorAs(t, err, &p)
+	assert.Equal(t, "invalid_phone", p.Code)
+}
+
+// limitedStore reveals the tokens it created through the mock store and keeps the tokens it is asked to delete
+type limitedStore struct {
+	documentStore
+	deleted []string
+}
+
+func (l *limitedStore) DeleteToken(_ context.Context, token *models.Token) error {
+	l.deleted = append(l.deleted, token.Token)
+	return nil
+}
+
+func TestHandler_LimitedReveals(t *testing.T) {
+	store := &limitedStore{}
+	h := &BaseHandler{Policy: testPolicy, Store: store, Keys: testKeys, TokenKeys: testTokenKeys}
+
+	in := &NewTokenRequest{}
+	in.Body.Data = models.CreateToken{Payload: "one time secret", TokenType: "secret", MaxReveals: 2}
+	created, err := h.CreateToken(testCtx, in)
+	assert.NoError(t, err)
+	again, err := h.CreateToken(testCtx, in)
+	assert.NoError(t, err)
+	assert.NotEqual(t, created.Body.Token, again.Body.Token, "every limited token has its own reveals")
+	assert.Equal(t, models.TokenModeRandom, store.created[0].Mode)
+	assert.Equal(t, int64(2), store.created[0].RevealsLeft)
+	store.Token = store.created[0]
+
+	decrypt := &DecryptTokenRequest{GetTokenRequest: GetTokenRequest{Token: created.Body.Token}}
+	got, err := h.GetDecryptedToken(testCtx, decrypt)
+	assert.NoError(t, err)
+	assert.Equal(t, "one time secret", got.Body.Token.Payload)
+	assert.Equal(t, int64(1), got.Body.Token.RevealsLeft)
+	assert.Empty(t, store.deleted)
+
+	got, err = h.GetDecryptedToken(testCtx, decrypt)
+	assert.NoError(t, err)
+	assert.Equal(t, "one time secret", got.Body.Token.Payload)
+	assert.Equal(t, []string{created.Body.Token}, store.deleted, "the token is deleted with its last reveal")
+
+	// a token that could not be deleted stays locked
+	_, err = mapErrors(h.GetDecryptedToken)(testCtx, decrypt)
+	var p *Problem
+	assert.ErrorAs(t, err, &p)
+	assert.Equal(t, http.StatusGone, p.Status)
+	assert.Equal(t, "reveals_exhausted", p.Code)
+
+	in.Mode = models.TokenModeHMAC
+	_, err = mapErrors(h.CreateToken)(testCtx, in)
+	assert.ErrorAs(t, err, &p)
+	assert.Equal(t, http.StatusBadRequest, p.Status)
+}
+
+func TestHandler_LimitedRevealsConcurrent(t *testing.T) {
+	const maxReveals, callers = 3, 20
+	store := &limitedStore{}
+	auditStore := &mock.AuditStore{}
+	h := &BaseHandler{Policy: testPolicy, Store: store, Audit: auditStore, Keys: testKeys, TokenKeys: testTokenKeys}
+	in := &NewTokenRequest{}
+	in.Body.Data = models.CreateToken{Payload: "one time secret", TokenType: "secret", MaxReveals: maxReveals}
+	created, err := h.CreateToken(testCtx, in)
+	assert.NoError(t, err)
+	// the counter is kept apart from the record the reveals read
+	counter := *store.created[0]
+	store.Token = &counter
+
+	var wg sync.WaitGroup
+	revealed := make(chan string, callers)
+	for range callers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got, err := h.GetDecryptedToken(testCtx, &DecryptTokenRequest{GetTokenRequest: GetTokenRequest{Token: created.Body.Token}})
+			if err == nil {
+				revealed <- got.Body.Token.Payload
+				return
+			}
+			assert.ErrorIs(t, err, models.ErrRevealsExhausted)
+		}()
+	}
+	wg.Wait()
+	close(revealed)
+	assert.Len(t, revealed, maxReveals)
+	assert.Len(t, store.deleted, 1)
+
+	// every caller is recorded once, and only the callers that got the payload as a success
+	outcomes := map[audit.Outcome]int{}
+	for _, record := range auditStore.Records {
+		if record.Operation == audit.OperationDecrypt {
+			outcomes[record.Outcome]++
+		}
+	}
+	assert.Equal(t, maxReveals, outcomes[audit.OutcomeSuccess])
+	assert.Equal(t, callers, outcomes[audit.OutcomeSuccess]+outcomes[audit.OutcomeFailure])
+}
+
+func TestHandler_LimitedRevealsAudit(t *testing.T) {
+	store := &limitedStore{}
+	auditStore := &mock.AuditStore{}
+	h := &BaseHandler{
+		Policy: testPolicy, Store: store, Keys: testKeys, TokenKeys: testTokenKeys,
+		Audit: auditStore, Grants: &mock.GrantStore{},
+	}
+	in := &NewTokenRequest{}
+	in.Body.Data = models.CreateToken{Payload: "one time secret", TokenType: "secret", MaxReveals: 1}
+	created, err := h.CreateToken(testCtx, in)
+	assert.NoError(t, err)
+	token := created.Body.Token
+	store.Token = store.created[0]
+	store.Tokens = []*models.Token{store.Token}
+	issued, err := h.CreateGrant(testCtx, &CreateGrantRequest{Token: token})
+	assert.NoError(t, err)
+
+	// a token that is in the batch twice is revealed once, the other time is recorded as a decrypt that failed
+	batch := &BatchDecryptRequest{}
+	batch.Body.Tokens = []string{token, token}
+	results, err := h.GetDecryptedTokens(testCtx, batch)
+	assert.NoError(t, err)
+	assert.Equal(t, "one time secret", results.Body.Results[0].DecryptedToken.Payload)
+	assert.Nil(t, results.Body.Results[1].DecryptedToken)
+	if assert.NotNil(t, results.Body.Results[1].Error) {
+		assert.Equal(t, "reveals_exhausted", results.Body.Results[1].Error.Code)
+	}
+	assert.Equal(t, []string{token}, store.deleted)
+
+	_, err = h.GetDecryptedToken(testCtx, &DecryptTokenRequest{GetTokenRequest: GetTokenRequest{Token: token}})
+	assert.ErrorIs(t, err, models.ErrRevealsExhausted)
+	redeem := &RedeemGrantRequest{}
+	redeem.Body.Grant = issued.Body.Grant
+	_, err = h.RedeemGrant(context.Background(), redeem)
+	assert.ErrorIs(t, err, models.ErrRevealsExhausted)
+
+	history, _, err := auditStore.History(testCtx, "", token, audit.Page{})
+	assert.NoError(t, err)
+	outcomes := []audit.Outcome{}
+	for _, record := range history {
+		if record.Operation == audit.OperationDecrypt {
+			outcomes = append(outcomes, record.Outcome)
+		}
+	}
+	assert.Equal(t, []audit.Outcome{
+		audit.OutcomeSuccess, audit.OutcomeFailure, audit.OutcomeFailure, audit.OutcomeFailure,
+	}, outcomes, "every decrypt is recorded once, with its outcome")
+}
+
+func TestHandler_UpdateToken(t *testing.T) {
+	ttl := int64(600)
+	stored := &models.Token{
+		Token: "foobartesttoken",
+		CreateToken: models.CreateToken{
+			Payload:  "v2:abcd",
+			TTL:      3600,
+			Metadata: map[string]any{"foo": "bar"},
+		},
+	}
+	tests := []struct {
+		name    string
+		store   persistence.Store
+		in      *UpdateTokenRequest
+		want    models.Token
+		wantErr bool
+	}{
+		{
+			name:  "update metadata and ttl",
+			store: mock.Store{Token: stored},
+			in: &UpdateTokenRequest{
+				Token: "foobartesttoken",
+				Body:  models.UpdateToken{TTL: &ttl, Metadata: map[string]any{"foo": "baz"}},
+			},
+			want: models.Token{
+				Token:       "foobartesttoken",
+				CreateToken: models.CreateToken{TTL: 600, Metadata: map[string]any{"foo": "baz"}},
+			},
+		},
+		{
+			name:  "update ttl only",
+			store: mock.Store{Token: stored},
+			in:    &UpdateTokenRequest{Token: "foobartesttoken", Body: models.UpdateToken{TTL: &ttl}},
+			want: models.Token{
+				Token:       "foobartesttoken",
+				CreateToken: models.CreateToken{TTL: 600, Metadata: map[string]any{"foo": "bar"}},
+			},
+		},
+		{
+			name:    "no token",
+			store:   mock.Store{Token: stored},
+			in:      &UpdateTokenRequest{Body: models.UpdateToken{TTL: &ttl}},
+			wantErr: true,
+		},
+		{
+			name:    "nothing to update",
+			store:   mock.Store{Token: stored},
+			in:      &UpdateTokenRequest{Token: "foobartesttoken"},
+			wantErr: true,
+		},
+		{
+			name:    "store error",
+			store:   mock.Store{Token: stored, UpdateError: models.ErrTokenNotFound},
+			in:      &UpdateTokenRequest{Token: "foobartesttoken", Body: models.UpdateToken{TTL: &ttl}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &BaseHandler{Policy: testPolicy, Store: tt.store, Keys: testKeys, TokenKeys: testTokenKeys}
+			got, err := h.UpdateToken(testCtx, tt.in)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got.Body.Token)
+			assert.Equal(t, "v2:abcd", stored.Payload, "the stored payload should not change")
+		})
+	}
+}
+
+func TestHandler_GetDecryptedTokenReveal(t *testing.T) {
+	card := &models.Token{Token: "card-token", CreateToken: models.CreateToken{Payload: "4111111111111111", TokenType: "card"}}
+	assert.NoError(t, card.Encrypt(context.Background(), testKeys))
+	supportPolicy := &policy.Policy{Roles: map[string][]policy.Grant{
+		"support": {{Actions: []policy.Action{policy.ActionDetokenize}, Reveal: []string{"first6_last4", "masked"}}},
+	}}
+	support := auth.WithPrincipal(testCtx, &auth.Principal{Subject: "api_key:support", Roles: []string{"support"}})
+	reveals := models.RevealPolicies{"card": {"masked": {Kind: models.RevealLast, Last: 2}}}
+
+	tests := []struct {
+		name       string
+		ctx        context.Context
+		reveal     string
+		want       string
+		wantStatus int
+	}{
+		{name: "full by default", ctx: testCtx, want: "4111111111111111"},
+		{name: "built-in policy", ctx: testCtx, reveal: "last4", want: "************1111"},
+		{name: "configured policy", ctx: support, reveal: "masked", want: "**************11"},
+		{name: "granted policy", ctx: support, reveal: "first6_last4", want: "411111******1111"},
+		{name: "policy that is not granted", ctx: support, reveal: "last4", wantStatus: http.StatusForbidden},
+		{name: "full is not granted", ctx: support, wantStatus: http.StatusForbidden},
+		{name: "unknown policy", ctx: testCtx, reveal: "partial", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pol := testPolicy
+			if tt.ctx == support {
+				pol = supportPolicy
+			}
+			stored := *card
+			h := &BaseHandler{Policy: pol, Store: mock.Store{Token: &stored}, Keys: testKeys, Reveals: reveals}
+			in := &DecryptTokenRequest{GetTokenRequest: GetTokenRequest{Token: card.Token}, Reveal: tt.reveal}
+
+			got, err := mapErrors(h.GetDecryptedToken)(tt.ctx, in)
+			if tt.wantStatus != 0 {
+				var statusErr huma.StatusError
+				assert.ErrorAs(t, err, &statusErr)
+				assert.Equal(t, tt.wantStatus, statusErr.GetStatus())
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got.Body.Token.Payload)
+		})
+	}
+}
+
+func TestHandler_GetDecryptedTokenRevealJSONCard(t *testing.T) {
+	card := &models.Token{Token: "card-token", CreateToken: models.CreateToken{
+		Payload: `{"card_number": "4111111111111111", "exp": "0128", "cvv": "123"}`, TokenType: "card",
+	}}
+	assert.NoError(t, card.Encrypt(context.Background(), testKeys))
+	h := &BaseHandler{Policy: testPolicy, Store: mock.Store{Token: card}, Keys: testKeys}
+
+	got, err := h.GetDecryptedToken(testCtx, &DecryptTokenRequest{GetTokenRequest: GetTokenRequest{Token: card.Token}, Reveal: "last4"})
+	assert.NoError(t, err)
+	assert.Equal(t, "************1111", got.Body.Token.Payload, "only the last four digits of the card number are shown")
+}
+
+func TestRoutes_GetDecryptedTokenReveal(t *testing.T) {
+	card := &models.Token{Token: "card-token", CreateToken: models.CreateToken{Payload: "4111111111111111", TokenType: "card"}}
+	assert.NoError(t, card.Encrypt(context.Background(), testKeys))
+	router := Routes(&BaseHandler{Auth: testAuth, Policy: testPolicy, Store: mock.Store{Token: card}, Keys: testKeys})
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/token/card-token/decrypt?reveal=first6_last4", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"payload":"411111******1111"`)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/token/card-token/decrypt?reveal=partial", nil))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "unknown_reveal_policy")
+}
+
+func TestHandler_CreateTokenAuthorizedBeforeNormalize(t *testing.T) {
+	h := &BaseHandler{
+		Policy: &policy.Policy{Roles: map[string][]policy.Grant{
+			"visa": {{
+				Actions:    []policy.Action{policy.ActionTokenize},
+				TokenTypes: []string{"card"},
+				Metadata:   map[string][]string{"brand": {"visa"}},
+			}},
+		}},
+		Store:     &recordingStore{},
+		Keys:      testKeys,
+		TokenKeys: testTokenKeys,
+	}
+	ctx := auth.WithPrincipal(testCtx, &auth.Principal{Subject: "api_key:visa", Roles: []string{"visa"}})
+
+	tests := []struct {
+		name      string
+		data      models.CreateToken
+		wantCode  string
+		wantToken bool
+	}{
+		{"invalid payload of a type that is not granted", models.CreateToken{Payload: "415-555-2671", TokenType: "phone"}, "forbidden", false},
+		{"invalid payload of a granted type", models.CreateToken{Payload: "4111111111111112", TokenType: "card"}, "invalid_card_number", false},
+		{"derived metadata that is not granted", models.CreateToken{Payload: "5555555555554444", TokenType: "card"}, "forbidden", false},
+		{"derived metadata that is granted", models.CreateToken{Payload: "4111111111111111", TokenType: "card"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := &NewTokenRequest{}
+			in.Body.Data = tt.data
+			got, err := mapErrors(h.CreateToken)(ctx, in)
+			if !tt.wantToken {
+				var p *Problem
+				if assert.ErrorAs(t, err, &p) {
+					assert.Equal(t, tt.wantCode, p.Code)
+				}
+				return
+			}
+			assert.NoError(t, err)
+			assert.NotEmpty(t, got.Body.Token)
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package api
+
+import (
+	"context"
+	"maps"
+	"net/http"
+	"slices"
+
+	"tokenize/models"
+
+	"github.com/danielgtaylor/huma/v2"
+)
+
+func (h *BaseHandler) RegisterTokenTypeRoutes(api huma.API) {
+	huma.Register(api, huma.Operation{
+		OperationID:   "ListTokenTypes",
+		Summary:       "List the registered token types",
+		Method:        http.MethodGet,
+		Path:          "/token-types",
+		DefaultStatus: http.StatusOK,
+		Errors: []int{
+			http.StatusUnauthorized,
+		},
+	}, mapErrors(h.ListTokenTypes))
+}
+
+// TokenType is a token type of the registry with its name
+type TokenType struct {
+	Name string `json:"name"`
+	models.TokenTypeSpec
+}
+
+type ListTokenTypesResponse struct {
+	Body struct {
+		TokenTypes []TokenType `json:"token_types" doc:"The registered token types, every type can be created when there are none"`
+	}
+}
+
+// ListTokenTypes returns the token types of the registry by name. Every caller may see them, they hold no data.
+func (h *BaseHandler) ListTokenTypes(_ context.Context, _ *struct{}) (*ListTokenTypesResponse, error) {
+	output := &ListTokenTypesResponse{}
+	output.Body.TokenTypes = []TokenType{}
+	for _, name := range slices.Sorted(maps.Keys(h.TokenTypes)) {
+		output.Body.TokenTypes = append(output.Body.TokenTypes, TokenType{Name: name, TokenTypeSpec: *h.TokenTypes[name]})
+	}
+	return output, nil
+}
@@ -0,0 +1,163 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"tokenize/models"
+	"tokenize/persistence/mock"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testTokenTypes is a registry of an ssn type with a pattern and a card type with a format and a masked default reveal
+func testTokenTypes(t *testing.T) models.TokenTypes {
+	types, err := models.ParseTokenTypes([]byte(`{
+		"ssn": {
+			"pattern": "\\d{3}-\\d{2}-\\d{4}",
+			"metadata_schema": {"type": "object", "properties": {"source": {"enum": ["web", "batch"]}}},
+			"max_ttl": 3600,
+			"token_mode": "random"
+		},
+		"card": {"format": {"preserve_last4": true}, "reveal": "last4"}
+	}`), CompileSchema)
+	assert.NoError(t, err)
+	return types
+}
+
+func TestHandler_CreateTokenTypes(t *testing.T) {
+	tests := []struct {
+		name     string
+		mode     models.TokenMode
+		data     models.CreateToken
+		wantCode string
+		wantTTL  int64
+		wantMode models.TokenMode
+	}{
+		{name: "registered type", data: models.CreateToken{Payload: "123-45-6789", TokenType: "ssn"}, wantTTL: 3600, wantMode: models.TokenModeRandom},
+		{name: "requested mode", mode: models.TokenModeHMAC, data: models.CreateToken{Payload: "123-45-6789", TokenType: "ssn", TTL: 60}, wantTTL: 60, wantMode: models.TokenModeHMAC},
+		{name: "unknown type", data: models.CreateToken{Payload: "123-45-6789", TokenType: "SSN"}, wantCode: "unknown_token_type"},
+		{name: "invalid payload", data: models.CreateToken{Payload: "123456789", TokenType: "ssn"}, wantCode: "invalid_payload"},
+		{name: "invalid metadata", data: models.CreateToken{Payload: "123-45-6789", TokenType: "ssn", Metadata: map[string]any{"source": "fax"}}, wantCode: "invalid_metadata"},
+		{name: "ttl too long", data: models.CreateToken{Payload: "123-45-6789", TokenType: "ssn", TTL: 7200}, wantCode: "ttl_too_long"},
+		{name: "negative ttl", data: models.CreateToken{Payload: "123-45-6789", TokenType: "ssn", TTL: -1}, wantCode: "invalid_ttl"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &recordingStore{}
+			h := &BaseHandler{Policy: testPolicy, Store: store, Keys: testKeys, TokenKeys: testTokenKeys, TokenTypes: testTokenTypes(t)}
+			in := &NewTokenRequest{Mode: tt.mode}
+			in.Body.Data = tt.data
+
+			_, err := mapErrors(h.CreateToken)(testCtx, in)
+			if tt.wantCode != "" {
+				var p *Problem
+				assert.ErrorAs(t, err, &p)
+				assert.Equal(t, http.StatusBadRequest, p.Status)
+				assert.Equal(t, tt.wantCode, p.Code)
+				assert.Empty(t, store.created)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Len(t, store.created, 1)
+			assert.Equal(t, tt.wantTTL, store.created[0].TTL)
+			assert.Equal(t, tt.wantMode, store.created[0].Mode)
+		})
+	}
+}
+
+func TestHandler_TokenTypeDefaults(t *testing.T) {
+	store := &documentStore{}
+	h := &BaseHandler{Policy: testPolicy, Store: store, Keys: testKeys, TokenKeys: testTokenKeys, TokenTypes: testTokenTypes(t)}
+
+	in := &NewTokenRequest{}
+	in.Body.Data = models.CreateToken{Payload: "4111111111111111", TokenType: "card"}
+	created, err := h.CreateToken(testCtx, in)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasSuffix(created.Body.Token, "1111"), "the format of the type is used")
+	assert.Equal(t, &models.FormatOptions{PreserveLast4: true}, store.created[0].Format)
+
+	decrypted, err := h.GetDecryptedToken(testCtx, &DecryptTokenRequest{GetTokenRequest: GetTokenRequest{Token: created.Body.Token}})
+	assert.NoError(t, err)
+	assert.Equal(t, "************1111", decrypted.Body.Token.Payload, "the reveal policy of the type is the default")
+
+	decrypted, err = h.GetDecryptedToken(testCtx, &DecryptTokenRequest{GetTokenRequest: GetTokenRequest{Token: created.Body.Token}, Reveal: "full"})
+	assert.NoError(t, err)
+	assert.Equal(t, "4111111111111111", decrypted.Body.Token.Payload)
+}
+
+func TestHandler_UpdateTokenTypes(t *testing.T) {
+	stored := &models.Token{Token: "ssn-token", CreateToken: models.CreateToken{TokenType: "ssn", TTL: 600}}
+	h := &BaseHandler{Policy: testPolicy, Store: mock.Store{Token: stored}, TokenTypes: testTokenTypes(t)}
+
+	ttl := int64(7200)
+	_, err := mapErrors(h.UpdateToken)(testCtx, &UpdateTokenRequest{Token: "ssn-token", Body: models.UpdateToken{TTL: &ttl}})
+	var p *Problem
+	assert.ErrorAs(t, err, &p)
+	assert.Equal(t, "ttl_too_long", p.Code)
+
+	ttl = 1800
+	_, err = h.UpdateToken(testCtx, &UpdateTokenRequest{Token: "ssn-token", Body: models.UpdateToken{TTL: &ttl}})
+	assert.NoError(t, err)
+}
+
+func TestRoutes_TokenTypes(t *testing.T) {
+	router := Routes(&BaseHandler{
+		Auth:       testAuth,
+		Policy:     testPolicy,
+		Store:      &recordingStore{},
+		Keys:       testKeys,
+		TokenKeys:  testTokenKeys,
+		TokenTypes: testTokenTypes(t),
+	})
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/token-types", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var body ListTokenTypesResponse
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &body.Body))
+	assert.Len(t, body.Body.TokenTypes, 2)
+	assert.Equal(t, "card", body.Body.TokenTypes[0].Name)
+	assert.Equal(t, "ssn", body.Body.TokenTypes[1].Name)
+	assert.Equal(t, `\d{3}-\d{2}-\d{4}`, body.Body.TokenTypes[1].Pattern)
+	assert.Equal(t, int64(3600), body.Body.TokenTypes[1].MaxTTL)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(
+		`{"data": {"payload": "123-45-6789", "token_type": "ssn", "ttl": 0, "metadata": {"source": "fax"}}}`)))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"code":"invalid_metadata"`)
+	assert.Contains(t, rr.Body.String(), `"location":"metadata.source"`)
+	assert.NotContains(t, rr.Body.String(), "fax", "values are not echoed back")
+
+	// a negative ttl would never expire, past the max_ttl of the type
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(
+		`{"data": {"payload": "123-45-6789", "token_type": "ssn", "ttl": -1, "metadata": {}}}`)))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"code":"validation_failed"`)
+
+	// without a registry there are no types, and every type can be created
+	rr = httptest.NewRecorder()
+	Routes(&BaseHandler{Auth: testAuth, Policy: testPolicy}).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/token-types", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"token_types":[]`)
+}
+
+func TestHandler_CreateTokensTokenTypes(t *testing.T) {
+	store := &batchStore{}
+	h := &BaseHandler{Policy: testPolicy, Store: store, Keys: testKeys, TokenKeys: testTokenKeys, TokenTypes: testTokenTypes(t)}
+	in := &BatchTokenRequest{}
+	in.Body.Items = []models.CreateToken{
+		{Payload: "123-45-6789", TokenType: "ssn"},
+		{Payload: "123-45-6789", TokenType: "cc"},
+	}
+
+	got, err := h.CreateTokens(testCtx, in)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, got.Body.Results[0].Token)
+	assert.Equal(t, "unknown_token_type", got.Body.Results[1].Error.Code)
+}
@@ -0,0 +1,241 @@
+// Package audit keeps a tamper-evident record of every operation on a token. The records of each token form a hash
+// chain, every record includes the keyed hash of the one before it, so changing or removing a record breaks the chain.
+// The end of each chain is signed and kept apart from the records, so removing the newest records is detected too.
+package audit
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"tokenize/models"
+)
+
+// ErrTampered is returned when a token's audit records do not form an unbroken hash chain
+var ErrTampered = errors.New("audit records have been tampered with")
+
+// Operation is what was done with a token
+type Operation string
+
+const (
+	OperationCreate  Operation = "create"
+	OperationRead    Operation = "read"
+	OperationDecrypt Operation = "decrypt"
+	OperationUpdate  Operation = "update"
+	OperationDelete  Operation = "delete"
+	// OperationGrant and OperationRevoke are issuing and revoking a reveal grant for a token
+	OperationGrant  Operation = "grant"
+	OperationRevoke Operation = "revoke"
+)
+
+// TenantChain is the token of the first chain of a tenant's operations that are not on a token, such as a create that
+// was denied or a request for a token that is not valid. Tokens cannot contain #, so it is never the chain of a token.
+const TenantChain = "#tenant"
+
+// TenantShards is how many chains the operations of a tenant that are not on a token are spread over. Every append
+// extends the last record of its chain, so writers of a single chain would keep retrying against each other.
+const TenantShards = 8
+
+// TenantShard returns the token of the chain of the tenant's operations with the index, from 0 to TenantShards. The
+// first is TenantChain, which has the records written before the chain was sharded.
+func TenantShard(index int) string {
+	if index == 0 {
+		return TenantChain
+	}
+	return TenantChain + "#" + strconv.Itoa(index)
+}
+
+// TenantShardIndex returns the index of the chain of the tenant's operations the token names, false when it is not
+// one of them
+func TenantShardIndex(token string) (int, bool) {
+	for index := range TenantShards {
+		if TenantShard(index) == token {
+			return index, true
+		}
+	}
+	return 0, false
+}
+
+// Outcome is how an operation ended
+type Outcome string
+
+const (
+	OutcomeSuccess  Outcome = "success"
+	OutcomeDenied   Outcome = "denied"
+	OutcomeNotFound Outcome = "not_found"
+	OutcomeFailure  Outcome = "failure"
+)
+
+// Record is one operation on a token
+type Record struct {
+	// Tenant and Token identify the token, each has its own chain
+	Tenant string `json:"tenant,omitempty" dynamodbav:"tenant,omitempty"`
+	Token  string `json:"token" dynamodbav:"token"`
+	// Sequence is the position of the record in the token's chain, starting at 1
+	Sequence  int64     `json:"sequence" dynamodbav:"sequence"`
+	Time      time.Time `json:"time" dynamodbav:"time"`
+	Principal string    `json:"principal" dynamodbav:"principal"`
+	Operation Operation `json:"operation" dynamodbav:"operation"`
+	TokenType string    `json:"token_type,omitempty" dynamodbav:"token_type,omitempty"`
+	Outcome   Outcome   `json:"outcome" dynamodbav:"outcome"`
+	RequestID string    `json:"request_id,omitempty" dynamodbav:"request_id,omitempty"`
+	// Grant is the ID of the reveal grant that was issued, revoked or redeemed
+	Grant string `json:"grant,omitempty" dynamodbav:"grant,omitempty"`
+	// PrevHash is the hash of the previous record of the token, empty for the first
+	PrevHash string `json:"prev_hash" dynamodbav:"prev_hash"`
+	// KeyID is the ID of the audit key the hash is keyed with
+	KeyID string `json:"key_id" dynamodbav:"key_id"`
+	Hash  string `json:"hash" dynamodbav:"hash"`
+}
+
+// Head is the end of a token's chain, its last sequence and hash, signed with the audit key. It is kept apart from the
+// records, so a chain that lost its newest records, or all of them, no longer ends where its head says.
+type Head struct {
+	Tenant    string `json:"tenant,omitempty" dynamodbav:"tenant,omitempty"`
+	Token     string `json:"token" dynamodbav:"token"`
+	Sequence  int64  `json:"sequence" dynamodbav:"sequence"`
+	Hash      string `json:"hash" dynamodbav:"hash"`
+	KeyID     string `json:"key_id" dynamodbav:"key_id"`
+	Signature string `json:"signature" dynamodbav:"signature"`
+}
+
+// Store appends audit records and reads them back. Records are never changed or removed.
+type Store interface {
+	// Append adds the record to the end of its token's chain, setting its sequence and hashes, and moves the head of
+	// the chain to it
+	Append(ctx context.Context, record *Record) error
+	// History returns the records of the tenant's token on the page in order, and the head of its chain, nil when it
+	// has none. The head is read before the records, so the records of the last page reach at least as far as the head.
+	History(ctx context.Context, tenant string, token string, page Page) ([]Record, *Head, error)
+}
+
+// Page selects the records of a chain after the sequence After, at most Limit of them or all of them when it is 0
+type Page struct {
+	After int64
+	Limit int
+}
+
+// Select returns the records of the chain, in order, that are on the page
+func (p Page) Select(records []Record) []Record {
+	selected := []Record{}
+	for _, record := range records {
+		if p.Limit > 0 && len(selected) == p.Limit {
+			break
+		}
+		if record.Sequence > p.After {
+			selected = append(selected, record)
+		}
+	}
+	return selected
+}
+
+// Seal links the record to prev, the last record of the token or nil for its first record, and sets its hash keyed
+// with the audit key
+func (r *Record) Seal(prev *Record, key *models.Key) {
+	r.Time = r.Time.UTC()
+	r.Sequence, r.PrevHash = 1, ""
+	if prev != nil {
+		r.Sequence, r.PrevHash = prev.Sequence+1, prev.Hash
+	}
+	r.KeyID = key.ID
+	r.Hash = r.hash(key)
+}
+
+// hash covers every field of the record but the hash itself
+func (r *Record) hash(key *models.Key) string {
+	unsealed := *r
+	unsealed.Hash = ""
+	unsealed.Time = r.Time.UTC()
+	data, _ := json.Marshal(unsealed)
+	return mac(key, "record", data)
+}
+
+// NewHead returns the signed head of a chain that ends with the record
+func NewHead(last *Record, key *models.Key) *Head {
+	head := &Head{Tenant: last.Tenant, Token: last.Token, Sequence: last.Sequence, Hash: last.Hash, KeyID: key.ID}
+	head.Signature = head.sign(key)
+	return head
+}
+
+// sign covers every field of the head but the signature itself
+func (h *Head) sign(key *models.Key) string {
+	unsigned := *h
+	unsigned.Signature = ""
+	data, _ := json.Marshal(unsigned)
+	return mac(key, "head", data)
+}
+
+// mac is the HMAC-SHA-256 of the data under the key, labelled so a record hash is never a valid head signature
+func mac(key *models.Key, label string, data []byte) string {
+	h := hmac.New(sha256.New, key.Material)
+	h.Write([]byte(label + ":"))
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Verify checks the records of a token, in order, form an unbroken hash chain under the audit keys that reaches its
+// signed head. Records appended after the head was read may follow it.
+func Verify(ctx context.Context, keys models.KeyProvider, records []Record, head *Head) error {
+	return VerifyPage(ctx, keys, nil, records, head, false)
+}
+
+// VerifyPage checks a page of the records of a token like Verify. The page continues prev, the record before it or nil
+// when it starts the chain, and only has to reach the head when no more records follow it.
+func VerifyPage(ctx context.Context, keys models.KeyProvider, prev *Record, records []Record, head *Head, more bool) error {
+	if head == nil {
+		if prev != nil || len(records) > 0 {
+			return fmt.Errorf("%w: the chain has no head", ErrTampered)
+		}
+		return nil
+	}
+	key, err := keys.KeyByID(ctx, head.KeyID)
+	if err != nil {
+		return fmt.Errorf("%w: head: %v", ErrTampered, err)
+	}
+	if !hmac.Equal([]byte(head.Signature), []byte(head.sign(key))) {
+		return fmt.Errorf("%w: head has been changed", ErrTampered)
+	}
+
+	chain := records
+	if prev != nil {
+		chain = append([]Record{*prev}, records...)
+	}
+	last := int64(0)
+	for i := range chain {
+		record := &chain[i]
+		if record.Tenant != head.Tenant || record.Token != head.Token {
+			return fmt.Errorf("%w: record %d belongs to another token", ErrTampered, record.Sequence)
+		}
+		// the record the page continues is checked, but not what comes before it
+		if i > 0 || prev == nil {
+			wantSequence, wantPrev := int64(1), ""
+			if i > 0 {
+				wantSequence, wantPrev = chain[i-1].Sequence+1, chain[i-1].Hash
+			}
+			if record.Sequence != wantSequence || record.PrevHash != wantPrev {
+				return fmt.Errorf("%w: chain is broken before record %d", ErrTampered, record.Sequence)
+			}
+		}
+		key, err := keys.KeyByID(ctx, record.KeyID)
+		if err != nil {
+			return fmt.Errorf("%w: record %d: %v", ErrTampered, record.Sequence, err)
+		}
+		if !hmac.Equal([]byte(record.Hash), []byte(record.hash(key))) {
+			return fmt.Errorf("%w: record %d has been changed", ErrTampered, record.Sequence)
+		}
+		if record.Sequence == head.Sequence && record.Hash != head.Hash {
+			return fmt.Errorf("%w: record %d is not the head of the chain", ErrTampered, record.Sequence)
+		}
+		last = record.Sequence
+	}
+	if head.Sequence < 1 || (!more && last < head.Sequence) {
+		return fmt.Errorf("%w: records have been removed after record %d", ErrTampered, last)
+	}
+	return nil
+}
@@ -0,0 +1,274 @@
+package audit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"tokenize/keys"
+	"tokenize/models"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	retiredKey = &models.Key{ID: "audit-1", Material: []byte("this is the retired audit key...")}
+	testKey    = &models.Key{ID: "audit-2", Material: []byte("this is the current audit key...")}
+	testKeys   = &keys.Keyring{Current: testKey.ID, Keys: map[string][]byte{
+		retiredKey.ID: retiredKey.Material,
+		testKey.ID:    testKey.Material,
+	}}
+)
+
+// testChain returns n records of the token sealed with the current test key
+func testChain(token string, n int) []Record {
+	return extendChain(nil, token, n, testKey)
+}
+
+// extendChain appends n records of the token sealed with the key to the chain
+func extendChain(records []Record, token string, n int, key *models.Key) []Record {
+	for i := 0; i < n; i++ {
+		var prev *Record
+		if len(records) > 0 {
+			prev = &records[len(records)-1]
+		}
+		record := Record{
+			Token:     token,
+			Time:      time.Date(2025, 1, 1, 0, 0, len(records), 0, time.UTC),
+			Principal: "api_key:test",
+			Operation: OperationRead,
+			TokenType: "card",
+			Outcome:   OutcomeSuccess,
+			RequestID: "request",
+		}
+		record.Seal(prev, key)
+		records = append(records, record)
+	}
+	return records
+}
+
+// headOf returns the signed head of the chain
+func headOf(records []Record) *Head {
+	return NewHead(&records[len(records)-1], testKey)
+}
+
+func TestRecord_Seal(t *testing.T) {
+	records := testChain("token", 3)
+	assert.Equal(t, int64(1), records[0].Sequence)
+	assert.Empty(t, records[0].PrevHash)
+	assert.Equal(t, int64(3), records[2].Sequence)
+	assert.Equal(t, records[1].Hash, records[2].PrevHash)
+	assert.Equal(t, "audit-2", records[2].KeyID)
+	assert.Regexp(t, "^[0-9a-f]{64}$", records[2].Hash)
+	assert.NotEqual(t, records[1].Hash, records[2].Hash)
+
+	local := Record{Token: "token", Time: time.Date(2025, 1, 1, 1, 0, 0, 0, time.FixedZone("CET", 3600))}
+	utc := Record{Token: "token", Time: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+	local.Seal(nil, testKey)
+	utc.Seal(nil, testKey)
+	assert.Equal(t, utc.Hash, local.Hash, "the hash should not depend on the time zone")
+
+	other := Record{Token: "token", Time: utc.Time}
+	other.Seal(nil, retiredKey)
+	assert.NotEqual(t, utc.Hash, other.Hash, "the hash should depend on the key")
+}
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		name    string
+		chain   func() ([]Record, *Head)
+		wantErr bool
+	}{
+		{
+			name: "unbroken chain",
+			chain: func() ([]Record, *Head) {
+				records := testChain("token", 4)
+				return records, headOf(records)
+			},
+		},
+		{
+			name:  "no records",
+			chain: func() ([]Record, *Head) { return nil, nil },
+		},
+		{
+			name: "records appended after the head was read",
+			chain: func() ([]Record, *Head) {
+				records := testChain("token", 4)
+				return records, headOf(records[:3])
+			},
+		},
+		{
+			name: "records sealed with a retired key",
+			chain: func() ([]Record, *Head) {
+				records := extendChain(extendChain(nil, "token", 2, retiredKey), "token", 2, testKey)
+				return records, headOf(records)
+			},
+		},
+		{
+			name: "changed record",
+			chain: func() ([]Record, *Head) {
+				records := testChain("token", 4)
+				records[1].Outcome = OutcomeDenied
+				return records, headOf(records)
+			},
+			wantErr: true,
+		},
+		{
+			name: "changed and rehashed record without the audit key",
+			chain: func() ([]Record, *Head) {
+				records := testChain("token", 4)
+				records[1].Principal = "api_key:someone-else"
+				records[1].Seal(&records[0], &models.Key{ID: testKey.ID, Material: []byte("a key that is not the audit key.")})
+				return records, headOf(records)
+			},
+			wantErr: true,
+		},
+		{
+			name: "removed record",
+			chain: func() ([]Record, *Head) {
+				records := testChain("token", 4)
+				head := headOf(records)
+				return append(records[:1], records[2:]...), head
+			},
+			wantErr: true,
+		},
+		{
+			name: "removed first record",
+			chain: func() ([]Record, *Head) {
+				records := testChain("token", 4)
+				return records[1:], headOf(records)
+			},
+			wantErr: true,
+		},
+		{
+			name: "removed newest records",
+			chain: func() ([]Record, *Head) {
+				records := testChain("token", 4)
+				return records[:2], headOf(records)
+			},
+			wantErr: true,
+		},
+		{
+			name: "removed chain",
+			chain: func() ([]Record, *Head) {
+				return nil, headOf(testChain("token", 4))
+			},
+			wantErr: true,
+		},
+		{
+			name: "removed head",
+			chain: func() ([]Record, *Head) {
+				return testChain("token", 4), nil
+			},
+			wantErr: true,
+		},
+		{
+			name: "head moved back to an earlier record",
+			chain: func() ([]Record, *Head) {
+				records := testChain("token", 4)
+				head := headOf(records)
+				head.Sequence, head.Hash = records[1].Sequence, records[1].Hash
+				return records[:2], head
+			},
+			wantErr: true,
+		},
+		{
+			name: "reordered records",
+			chain: func() ([]Record, *Head) {
+				records := testChain("token", 4)
+				head := headOf(records)
+				records[1], records[2] = records[2], records[1]
+				return records, head
+			},
+			wantErr: true,
+		},
+		{
+			name: "record of another token",
+			chain: func() ([]Record, *Head) {
+				records := testChain("token", 2)
+				other := testChain("other", 3)
+				records = append(records, other[2])
+				return records, headOf(records)
+			},
+			wantErr: true,
+		},
+		{
+			name: "record sealed with an unknown key",
+			chain: func() ([]Record, *Head) {
+				records := extendChain(nil, "token", 2, &models.Key{ID: "audit-3", Material: testKey.Material})
+				return records, headOf(records)
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, head := tt.chain()
+			err := Verify(context.Background(), testKeys, records, head)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrTampered)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestVerifyPage(t *testing.T) {
+	records := testChain("token", 6)
+	head := headOf(records[:5])
+	tests := []struct {
+		name    string
+		prev    *Record
+		records []Record
+		more    bool
+		wantErr bool
+	}{
+		{name: "first page", records: records[:2], more: true},
+		{name: "page after a record", prev: &records[1], records: records[2:4], more: true},
+		{name: "last page", prev: &records[3], records: records[4:]},
+		{name: "last page reaches the head", prev: &records[2], records: records[3:5]},
+		{name: "empty page after the head", prev: &records[5]},
+		{name: "first page does not start the chain", records: records[1:3], more: true, wantErr: true},
+		{name: "page does not continue the record before it", prev: &records[0], records: records[2:4], more: true, wantErr: true},
+		{name: "changed record before the page", prev: func() *Record {
+			changed := records[1]
+			changed.Outcome = OutcomeDenied
+			return &changed
+		}(), records: records[2:4], more: true, wantErr: true},
+		{name: "last page does not reach the head", prev: &records[1], records: records[2:4], wantErr: true},
+		{name: "record in place of the head", prev: &records[3], records: func() []Record {
+			forked := records[4]
+			forked.Outcome = OutcomeDenied
+			forked.Seal(&records[3], testKey)
+			return []Record{forked}
+		}(), more: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := VerifyPage(context.Background(), testKeys, tt.prev, tt.records, head, tt.more)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrTampered)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+
+	assert.NoError(t, VerifyPage(context.Background(), testKeys, nil, nil, nil, false))
+	assert.ErrorIs(t, VerifyPage(context.Background(), testKeys, &records[0], nil, nil, false), ErrTampered,
+		"a page after a record of a chain without a head")
+}
+
+func TestTenantShard(t *testing.T) {
+	assert.Equal(t, TenantChain, TenantShard(0), "the records from before the chain was sharded are in the first chain")
+	for index := range TenantShards {
+		got, ok := TenantShardIndex(TenantShard(index))
+		assert.True(t, ok)
+		assert.Equal(t, index, got)
+	}
+	for _, token := range []string{"token", TenantShard(TenantShards), TenantChain + "#", "#tenant#01"} {
+		_, ok := TenantShardIndex(token)
+		assert.False(t, ok, token)
+	}
+}
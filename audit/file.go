@@ -0,0 +1,138 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"sync"
+
+	"tokenize/models"
+)
+
+// FileStore appends audit records to a local file as JSON lines, and the heads of their chains to a second file next
+// to it. It is meant for running a single instance, the chains are only kept consistent between writers in the same
+// process.
+type FileStore struct {
+	Path string
+	// HeadsPath is the file the head of a chain is appended to every time it grows, the last one is current
+	HeadsPath string
+	// Keys are the audit keys records are sealed with
+	Keys models.KeyProvider
+
+	mu        sync.Mutex
+	file      *os.File
+	headsFile *os.File
+	last      map[chain]Record
+}
+
+// chain identifies the chain of a token
+type chain struct {
+	tenant string
+	token  string
+}
+
+// OpenFile opens the audit file at path, and the heads file next to it, for appending, creating them if needed
+func OpenFile(path string, keys models.KeyProvider) (*FileStore, error) {
+	store := &FileStore{Path: path, HeadsPath: path + ".heads", Keys: keys, last: map[chain]Record{}}
+	// the last record of every token is needed to continue its chain
+	err := eachLine(path, func(record Record) {
+		store.last[chain{record.Tenant, record.Token}] = record
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	store.file, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	store.headsFile, err = os.OpenFile(store.HeadsPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		store.file.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+func (s *FileStore) Append(ctx context.Context, record *Record) error {
+	key, err := s.Keys.CurrentKey(ctx)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var prev *Record
+	if last, ok := s.last[chain{record.Tenant, record.Token}]; ok {
+		prev = &last
+	}
+	record.Seal(prev, key)
+	if err := appendLine(s.file, record); err != nil {
+		return err
+	}
+	s.last[chain{record.Tenant, record.Token}] = *record
+	return appendLine(s.headsFile, NewHead(record, key))
+}
+
+func (s *FileStore) History(_ context.Context, tenant string, token string, page Page) ([]Record, *Head, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var head *Head
+	err := eachLine(s.HeadsPath, func(h Head) {
+		if h.Tenant == tenant && h.Token == token {
+			head = &h
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	records := []Record{}
+	err = eachLine(s.Path, func(record Record) {
+		if record.Tenant == tenant && record.Token == token {
+			records = append(records, record)
+		}
+	})
+	return page.Select(records), head, err
+}
+
+// Close closes the audit files
+func (s *FileStore) Close() error {
+	return errors.Join(s.file.Close(), s.headsFile.Close())
+}
+
+// appendLine writes the value to the file as a line of JSON and syncs it
+func appendLine(file *os.File, value any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// eachLine calls fn with every line in the file, in the order they were written
+func eachLine[T any](path string, fn func(T)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var value T
+		if err := json.Unmarshal(scanner.Bytes(), &value); err != nil {
+			return err
+		}
+		fn(value)
+	}
+	return scanner.Err()
+}
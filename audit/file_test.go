@@ -0,0 +1,106 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileStore(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	store, err := OpenFile(path, testKeys)
+	assert.NoError(t, err)
+	for _, token := range []string{"first", "second", "first"} {
+		assert.NoError(t, store.Append(ctx, &Record{Token: token, Time: time.Now(), Operation: OperationRead, Outcome: OutcomeSuccess}))
+	}
+	assert.NoError(t, store.Close())
+
+	// a reopened file continues the chains where they left off
+	store, err = OpenFile(path, testKeys)
+	assert.NoError(t, err)
+	defer store.Close()
+	record := &Record{Token: "first", Time: time.Now(), Operation: OperationDelete, Outcome: OutcomeSuccess}
+	assert.NoError(t, store.Append(ctx, record))
+	assert.Equal(t, int64(3), record.Sequence)
+
+	history, head, err := store.History(ctx, "", "first", Page{})
+	assert.NoError(t, err)
+	assert.Len(t, history, 3)
+	assert.Equal(t, int64(3), head.Sequence)
+	assert.NoError(t, Verify(ctx, testKeys, history, head))
+	assert.Equal(t, OperationDelete, history[2].Operation)
+
+	history, _, err = store.History(ctx, "", "first", Page{After: 1, Limit: 1})
+	assert.NoError(t, err)
+	if assert.Len(t, history, 1) {
+		assert.Equal(t, int64(2), history[0].Sequence)
+	}
+
+	history, head, err = store.History(ctx, "", "unknown", Page{})
+	assert.NoError(t, err)
+	assert.Empty(t, history)
+	assert.Nil(t, head)
+
+	for _, file := range []string{path, path + ".heads"} {
+		info, err := os.Stat(file)
+		assert.NoError(t, err)
+		assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+	}
+}
+
+func TestFileStore_Truncated(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	store, err := OpenFile(path, testKeys)
+	assert.NoError(t, err)
+	defer store.Close()
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, store.Append(ctx, &Record{Token: "token", Time: time.Now(), Operation: OperationRead}))
+	}
+
+	// dropping the newest record from the records file leaves the head behind
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	assert.NoError(t, os.WriteFile(path, bytes.Join(lines[:2], nil), 0o600))
+
+	history, head, err := store.History(ctx, "", "token", Page{})
+	assert.NoError(t, err)
+	assert.Len(t, history, 2)
+	assert.ErrorIs(t, Verify(ctx, testKeys, history, head), ErrTampered)
+}
+
+func TestOpenFile_Corrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	assert.NoError(t, os.WriteFile(path, []byte("not a record\n"), 0o600))
+	_, err := OpenFile(path, testKeys)
+	assert.Error(t, err)
+}
+
+func TestFileStore_Tenants(t *testing.T) {
+	ctx := context.Background()
+	store, err := OpenFile(filepath.Join(t.TempDir(), "audit.log"), testKeys)
+	assert.NoError(t, err)
+	defer store.Close()
+
+	for _, tenant := range []string{"", "payments", "payments"} {
+		assert.NoError(t, store.Append(ctx, &Record{Tenant: tenant, Token: "same", Time: time.Now(), Operation: OperationRead, Outcome: OutcomeSuccess}))
+	}
+
+	history, _, err := store.History(ctx, "", "same", Page{})
+	assert.NoError(t, err)
+	assert.Len(t, history, 1, "tenants have their own chains")
+
+	history, head, err := store.History(ctx, "payments", "same", Page{})
+	assert.NoError(t, err)
+	assert.Len(t, history, 2)
+	assert.Equal(t, int64(2), history[1].Sequence)
+	assert.NoError(t, Verify(ctx, testKeys, history, head))
+}
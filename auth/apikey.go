@@ -0,0 +1,43 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"tokenize/models"
+	"tokenize/persistence"
+)
+
+// APIKeyHeader is the request header API keys are sent in
+const APIKeyHeader = "X-API-Key"
+
+// APIKeys authenticates callers by an API key, looked up in the Store by its hash
+type APIKeys struct {
+	Store persistence.APIKeyStore
+}
+
+func (a APIKeys) Authenticate(r *http.Request) (*Principal, error) {
+	key := r.Header.Get(APIKeyHeader)
+	if key == "" {
+		return nil, ErrNoCredentials
+	}
+
+	apiKey, err := a.Store.GetAPIKey(r.Context(), models.HashAPIKey(key))
+	if errors.Is(err, models.ErrAPIKeyNotFound) {
+		return nil, fmt.Errorf("%w: unknown api key", ErrInvalidCredentials)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if apiKey.Revoked {
+		return nil, fmt.Errorf("%w: api key is revoked", ErrInvalidCredentials)
+	}
+
+	return &Principal{
+		Subject: MethodAPIKey + ":" + apiKey.ID,
+		Method:  MethodAPIKey,
+		Roles:   apiKey.Roles,
+		Tenant:  apiKey.Tenant,
+	}, nil
+}
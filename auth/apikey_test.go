@@ -0,0 +1,93 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"tokenize/models"
+	"tokenize/persistence/mock"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPIKeys_Authenticate(t *testing.T) {
+	key, apiKey, err := models.NewAPIKey("test", []string{"tokenizer"})
+	assert.NoError(t, err)
+	revoked, revokedKey, err := models.NewAPIKey("revoked", nil)
+	assert.NoError(t, err)
+	revokedKey.Revoked = true
+	tenant, tenantKey, err := models.NewAPIKey("tenant", []string{"reader"})
+	assert.NoError(t, err)
+	tenantKey.Tenant = "payments"
+	store := &mock.APIKeyStore{Keys: map[string]*models.APIKey{
+		apiKey.KeyHash:     apiKey,
+		revokedKey.KeyHash: revokedKey,
+		tenantKey.KeyHash:  tenantKey,
+	}}
+
+	tests := []struct {
+		name    string
+		store   *mock.APIKeyStore
+		key     string
+		want    *Principal
+		wantErr error
+	}{
+		{
+			name:  "valid key",
+			store: store,
+			key:   key,
+			want:  &Principal{Subject: "api_key:" + apiKey.ID, Method: MethodAPIKey, Roles: []string{"tokenizer"}},
+		},
+		{
+			name:  "tenant key",
+			store: store,
+			key:   tenant,
+			want:  &Principal{Subject: "api_key:" + tenantKey.ID, Method: MethodAPIKey, Roles: []string{"reader"}, Tenant: "payments"},
+		},
+		{
+			name:    "no key",
+			store:   store,
+			wantErr: ErrNoCredentials,
+		},
+		{
+			name:    "unknown key",
+			store:   store,
+			key:     "tk_unknown",
+			wantErr: ErrInvalidCredentials,
+		},
+		{
+			name:    "revoked key",
+			store:   store,
+			key:     revoked,
+			wantErr: ErrInvalidCredentials,
+		},
+		{
+			name:    "store error",
+			store:   &mock.APIKeyStore{GetError: errors.New("store unavailable")},
+			key:     key,
+			wantErr: errors.New("store unavailable"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.key != "" {
+				req.Header.Set(APIKeyHeader, tt.key)
+			}
+			got, err := APIKeys{Store: tt.store}.Authenticate(req)
+			if tt.wantErr != nil {
+				if errors.Is(tt.wantErr, ErrNoCredentials) || errors.Is(tt.wantErr, ErrInvalidCredentials) {
+					assert.ErrorIs(t, err, tt.wantErr)
+				} else {
+					assert.EqualError(t, err, tt.wantErr.Error())
+				}
+				assert.Nil(t, got)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,68 @@
+// Package auth identifies the callers of the API
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+var (
+	// ErrNoCredentials is returned when a request carries no credentials an Authenticator understands
+	ErrNoCredentials = errors.New("no credentials")
+	// ErrInvalidCredentials is returned when a request's credentials are wrong, expired or revoked
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+const (
+	MethodAPIKey = "api_key"
+	MethodJWT    = "jwt"
+	// MethodGrant is a caller redeeming a reveal grant, who has no credentials of their own
+	MethodGrant = "grant"
+)
+
+// Principal is an authenticated caller
+type Principal struct {
+	// Subject identifies the caller, prefixed by how it authenticated, such as "api_key:<id>" or "jwt:<sub>"
+	Subject string   `json:"subject"`
+	Method  string   `json:"method"`
+	Roles   []string `json:"roles,omitempty"`
+	// Tenant is the tenant the caller belongs to, it only sees that tenant's tokens
+	Tenant string `json:"tenant,omitempty"`
+	// Claims are the claims of a JWT, nil for API keys
+	Claims map[string]any `json:"-"`
+}
+
+// Authenticator identifies the caller of a request
+type Authenticator interface {
+	// Authenticate returns the caller, ErrNoCredentials if the request has no credentials for this Authenticator, or an
+	// error wrapping ErrInvalidCredentials if they are not valid
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// Chain authenticates with the first Authenticator that finds credentials on the request
+type Chain []Authenticator
+
+func (c Chain) Authenticate(r *http.Request) (*Principal, error) {
+	for _, authenticator := range c {
+		principal, err := authenticator.Authenticate(r)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		return principal, err
+	}
+	return nil, ErrNoCredentials
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a context carrying the authenticated caller
+func WithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFrom returns the authenticated caller of the request the context belongs to
+func PrincipalFrom(ctx context.Context) (*Principal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(*Principal)
+	return principal, ok && principal != nil
+}
@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fixedAuth returns the same result for every request
+type fixedAuth struct {
+	principal *Principal
+	err       error
+}
+
+func (f fixedAuth) Authenticate(_ *http.Request) (*Principal, error) {
+	return f.principal, f.err
+}
+
+func TestChain(t *testing.T) {
+	first := &Principal{Subject: "api_key:first"}
+	second := &Principal{Subject: "jwt:second"}
+	tests := []struct {
+		name    string
+		chain   Chain
+		want    *Principal
+		wantErr error
+	}{
+		{
+			name:  "first authenticator with credentials wins",
+			chain: Chain{fixedAuth{principal: first}, fixedAuth{principal: second}},
+			want:  first,
+		},
+		{
+			name:  "skips authenticators without credentials",
+			chain: Chain{fixedAuth{err: ErrNoCredentials}, fixedAuth{principal: second}},
+			want:  second,
+		},
+		{
+			name:    "invalid credentials are not retried",
+			chain:   Chain{fixedAuth{err: ErrInvalidCredentials}, fixedAuth{principal: second}},
+			wantErr: ErrInvalidCredentials,
+		},
+		{
+			name:    "no authenticator has credentials",
+			chain:   Chain{fixedAuth{err: ErrNoCredentials}},
+			wantErr: ErrNoCredentials,
+		},
+		{
+			name:    "empty chain",
+			wantErr: ErrNoCredentials,
+		},
+		{
+			name:    "other errors",
+			chain:   Chain{fixedAuth{err: errors.New("store unavailable")}},
+			wantErr: errors.New("store unavailable"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.chain.Authenticate(httptest.NewRequest(http.MethodGet, "/", nil))
+			if tt.wantErr != nil {
+				assert.Error(t, err)
+				assert.Equal(t, tt.wantErr.Error(), err.Error())
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestPrincipalContext(t *testing.T) {
+	_, ok := PrincipalFrom(context.Background())
+	assert.False(t, ok)
+
+	principal := &Principal{Subject: "api_key:test"}
+	got, ok := PrincipalFrom(WithPrincipal(context.Background(), principal))
+	assert.True(t, ok)
+	assert.Equal(t, principal, got)
+}
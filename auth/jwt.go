@@ -0,0 +1,312 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"tokenize/models"
+)
+
+const (
+	algRS256 = "RS256"
+	algES256 = "ES256"
+
+	// clockSkew is how far the expiry and not before times of a JWT are stretched for clocks that are out of sync
+	clockSkew = time.Minute
+	// defaultRolesClaim is the claim roles are read from when JWT.RolesClaim is empty
+	defaultRolesClaim = "roles"
+	// defaultTenantClaim is the claim the tenant is read from when JWT.TenantClaim is empty
+	defaultTenantClaim = "tenant"
+)
+
+// JWT authenticates callers by a JWT bearer token, signed with RS256 or ES256 by one of the keys in a JWKS
+type JWT struct {
+	Keys *JWKS
+	// Issuer and Audience are checked against the iss and aud claims when they are set
+	Issuer   string
+	Audience string
+	// RolesClaim is the claim with the caller's roles, as a list or a space separated string
+	RolesClaim string
+	// TenantClaim is the claim with the caller's tenant
+	TenantClaim string
+
+	now func() time.Time
+}
+
+func (j JWT) Authenticate(r *http.Request) (*Principal, error) {
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return nil, ErrNoCredentials
+	}
+
+	claims, err := j.verify(strings.TrimSpace(token))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidCredentials, err)
+	}
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return nil, fmt.Errorf("%w: token has no subject", ErrInvalidCredentials)
+	}
+
+	rolesClaim := j.RolesClaim
+	if rolesClaim == "" {
+		rolesClaim = defaultRolesClaim
+	}
+	tenantClaim := j.TenantClaim
+	if tenantClaim == "" {
+		tenantClaim = defaultTenantClaim
+	}
+	tenant, ok := claims[tenantClaim].(string)
+	if _, present := claims[tenantClaim]; present && (!ok || !models.ValidTenant(tenant)) {
+		return nil, fmt.Errorf("%w: token has an invalid tenant", ErrInvalidCredentials)
+	}
+	return &Principal{
+		Subject: MethodJWT + ":" + subject,
+		Method:  MethodJWT,
+		Roles:   stringList(claims[rolesClaim]),
+		Tenant:  tenant,
+		Claims:  claims,
+	}, nil
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// verify checks the signature and registered claims of a compact JWT and returns its claims
+func (j JWT) verify(token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed header: %w", err)
+	}
+	key, err := j.Keys.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed signature: %w", err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+
+	// the algorithm has to match the key, so a token cannot pick a weaker algorithm than the key was published for
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != algRS256 {
+			return nil, fmt.Errorf("algorithm %q does not match an RSA key", header.Alg)
+		}
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature); err != nil {
+			return nil, fmt.Errorf("invalid signature")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != algES256 || len(signature) != 64 {
+			return nil, fmt.Errorf("algorithm %q does not match a P-256 key", header.Alg)
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(pub, digest[:], r, s) {
+			return nil, fmt.Errorf("invalid signature")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed claims: %w", err)
+	}
+	if err := j.checkClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// checkClaims checks the expiry, not before, issuer and audience claims. Tokens must expire.
+func (j JWT) checkClaims(claims map[string]any) error {
+	now := time.Now()
+	if j.now != nil {
+		now = j.now()
+	}
+
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return fmt.Errorf("token has no expiry")
+	}
+	if now.Add(-clockSkew).After(time.Unix(int64(exp), 0)) {
+		return fmt.Errorf("token has expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(clockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return fmt.Errorf("token is not valid yet")
+	}
+	if j.Issuer != "" && claims["iss"] != j.Issuer {
+		return fmt.Errorf("unexpected issuer")
+	}
+	if j.Audience != "" && !slices.Contains(stringList(claims["aud"]), j.Audience) {
+		return fmt.Errorf("unexpected audience")
+	}
+	return nil
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// stringList reads a claim that is either a single string, split on spaces, or a list of strings
+func stringList(claim any) []string {
+	switch value := claim.(type) {
+	case string:
+		return strings.Fields(value)
+	case []any:
+		list := make([]string, 0, len(value))
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	default:
+		return nil
+	}
+}
+
+// JWKS is a set of public keys JWTs are verified with, by key ID
+type JWKS struct {
+	keys map[string]crypto.PublicKey
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	// RSA keys
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC keys
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// LoadJWKS reads a JSON Web Key Set from a file
+func LoadJWKS(path string) (*JWKS, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseJWKS(data)
+}
+
+// ParseJWKS parses a JSON Web Key Set, keeping the RSA and P-256 signing keys
+func ParseJWKS(data []byte) (*JWKS, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid jwks: %w", err)
+	}
+
+	jwks := &JWKS{keys: map[string]crypto.PublicKey{}}
+	for _, key := range set.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		pub, err := key.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("invalid jwk %q: %w", key.Kid, err)
+		}
+		jwks.keys[key.Kid] = pub
+	}
+	if len(jwks.keys) == 0 {
+		return nil, fmt.Errorf("jwks has no signing keys")
+	}
+	return jwks, nil
+}
+
+// key returns the key with the ID, tokens without a key ID can only be verified when there is a single key
+func (j *JWKS) key(kid string) (crypto.PublicKey, error) {
+	if j == nil {
+		return nil, fmt.Errorf("no keys configured")
+	}
+	if kid == "" && len(j.keys) == 1 {
+		for _, key := range j.keys {
+			return key, nil
+		}
+	}
+	key, ok := j.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	return key, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		if k.Alg != "" && k.Alg != algRS256 {
+			return nil, fmt.Errorf("unsupported algorithm %q", k.Alg)
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("invalid exponent")
+		}
+		modulus := new(big.Int).SetBytes(n)
+		if modulus.BitLen() < 2048 {
+			return nil, fmt.Errorf("rsa keys must be at least 2048 bits")
+		}
+		return &rsa.PublicKey{N: modulus, E: int(exponent.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" || (k.Alg != "" && k.Alg != algES256) {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != 32 || len(y) != 32 {
+			return nil, fmt.Errorf("invalid P-256 point")
+		}
+		// ecdh checks the point is on the curve
+		if _, err := ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
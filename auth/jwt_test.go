@@ -0,0 +1,278 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	testRSAKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+	testECKey, _  = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	testNow       = time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+)
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func testJWKS(t *testing.T) []byte {
+	t.Helper()
+	data, err := json.Marshal(map[string]any{"keys": []map[string]string{
+		{
+			"kty": "RSA", "kid": "rsa-1", "use": "sig", "alg": "RS256",
+			"n": b64(testRSAKey.N.Bytes()), "e": b64(big.NewInt(int64(testRSAKey.E)).Bytes()),
+		},
+		{
+			"kty": "EC", "kid": "ec-1", "crv": "P-256",
+			"x": b64(testECKey.X.FillBytes(make([]byte, 32))), "y": b64(testECKey.Y.FillBytes(make([]byte, 32))),
+		},
+		{"kty": "RSA", "kid": "enc-1", "use": "enc"},
+	}})
+	assert.NoError(t, err)
+	return data
+}
+
+// signJWT creates a compact JWT with the header and claims, signed with the test key for the algorithm
+func signJWT(t *testing.T, header map[string]any, claims map[string]any) string {
+	t.Helper()
+	headerJSON, err := json.Marshal(header)
+	assert.NoError(t, err)
+	claimsJSON, err := json.Marshal(claims)
+	assert.NoError(t, err)
+	input := b64(headerJSON) + "." + b64(claimsJSON)
+	digest := sha256.Sum256([]byte(input))
+
+	var signature []byte
+	switch header["alg"] {
+	case "RS256":
+		signature, err = rsa.SignPKCS1v15(rand.Reader, testRSAKey, crypto.SHA256, digest[:])
+		assert.NoError(t, err)
+	case "ES256":
+		r, s, err := ecdsa.Sign(rand.Reader, testECKey, digest[:])
+		assert.NoError(t, err)
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return input + "." + b64(signature)
+}
+
+func TestJWT_Authenticate(t *testing.T) {
+	jwks, err := ParseJWKS(testJWKS(t))
+	assert.NoError(t, err)
+	authenticator := JWT{Keys: jwks, Issuer: "https://issuer.example", Audience: "tokenize", now: func() time.Time { return testNow }}
+
+	validClaims := func() map[string]any {
+		return map[string]any{
+			"sub":   "user-1",
+			"iss":   "https://issuer.example",
+			"aud":   []string{"tokenize", "other"},
+			"exp":   testNow.Add(time.Hour).Unix(),
+			"roles": []string{"reader", "detokenizer"},
+		}
+	}
+	with := func(name string, value any) map[string]any {
+		claims := validClaims()
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+		return claims
+	}
+
+	tests := []struct {
+		name       string
+		header     string
+		want       *Principal
+		wantErr    error
+		wantRoles  []string
+		wantTenant string
+	}{
+		{
+			name:      "rs256",
+			header:    "Bearer " + signJWT(t, map[string]any{"alg": "RS256", "kid": "rsa-1"}, validClaims()),
+			wantRoles: []string{"reader", "detokenizer"},
+		},
+		{
+			name:      "es256",
+			header:    "bearer " + signJWT(t, map[string]any{"alg": "ES256", "kid": "ec-1"}, validClaims()),
+			wantRoles: []string{"reader", "detokenizer"},
+		},
+		{
+			name:      "roles as a space separated string",
+			header:    "Bearer " + signJWT(t, map[string]any{"alg": "RS256", "kid": "rsa-1"}, with("roles", "reader admin")),
+			wantRoles: []string{"reader", "admin"},
+		},
+		{
+			name:       "tenant",
+			header:     "Bearer " + signJWT(t, map[string]any{"alg": "RS256", "kid": "rsa-1"}, with("tenant", "payments")),
+			wantRoles:  []string{"reader", "detokenizer"},
+			wantTenant: "payments",
+		},
+		{
+			name:    "invalid tenant",
+			header:  "Bearer " + signJWT(t, map[string]any{"alg": "RS256", "kid": "rsa-1"}, with("tenant", "pay#ments")),
+			wantErr: ErrInvalidCredentials,
+		},
+		{
+			name:    "tenant is not a string",
+			header:  "Bearer " + signJWT(t, map[string]any{"alg": "RS256", "kid": "rsa-1"}, with("tenant", 7)),
+			wantErr: ErrInvalidCredentials,
+		},
+		{
+			name:    "no authorization header",
+			wantErr: ErrNoCredentials,
+		},
+		{
+			name:    "basic authorization",
+			header:  "Basic dXNlcjpwYXNz",
+			wantErr: ErrNoCredentials,
+		},
+		{
+			name:    "malformed token",
+			header:  "Bearer not-a-jwt",
+			wantErr: ErrInvalidCredentials,
+		},
+		{
+			name:    "expired",
+			header:  "Bearer " + signJWT(t, map[string]any{"alg": "RS256", "kid": "rsa-1"}, with("exp", testNow.Add(-time.Hour).Unix())),
+			wantErr: ErrInvalidCredentials,
+		},
+		{
+			name:    "no expiry",
+			header:  "Bearer " + signJWT(t, map[string]any{"alg": "RS256", "kid": "rsa-1"}, with("exp", nil)),
+			wantErr: ErrInvalidCredentials,
+		},
+		{
+			name:    "not valid yet",
+			header:  "Bearer " + signJWT(t, map[string]any{"alg": "RS256", "kid": "rsa-1"}, with("nbf", testNow.Add(time.Hour).Unix())),
+			wantErr: ErrInvalidCredentials,
+		},
+		{
+			name:    "wrong issuer",
+			header:  "Bearer " + signJWT(t, map[string]any{"alg": "RS256", "kid": "rsa-1"}, with("iss", "https://evil.example")),
+			wantErr: ErrInvalidCredentials,
+		},
+		{
+			name:    "wrong audience",
+			header:  "Bearer " + signJWT(t, map[string]any{"alg": "RS256", "kid": "rsa-1"}, with("aud", "other")),
+			wantErr: ErrInvalidCredentials,
+		},
+		{
+			name:    "no subject",
+			header:  "Bearer " + signJWT(t, map[string]any{"alg": "RS256", "kid": "rsa-1"}, with("sub", nil)),
+			wantErr: ErrInvalidCredentials,
+		},
+		{
+			name:    "unknown key",
+			header:  "Bearer " + signJWT(t, map[string]any{"alg": "RS256", "kid": "rsa-2"}, validClaims()),
+			wantErr: ErrInvalidCredentials,
+		},
+		{
+			name:    "key id required with several keys",
+			header:  "Bearer " + signJWT(t, map[string]any{"alg": "RS256"}, validClaims()),
+			wantErr: ErrInvalidCredentials,
+		},
+		{
+			name:    "algorithm does not match the key",
+			header:  "Bearer " + signJWT(t, map[string]any{"alg": "ES256", "kid": "rsa-1"}, validClaims()),
+			wantErr: ErrInvalidCredentials,
+		},
+		{
+			name:    "unsigned token",
+			header:  "Bearer " + signJWT(t, map[string]any{"alg": "none", "kid": "rsa-1"}, validClaims()),
+			wantErr: ErrInvalidCredentials,
+		},
+		{
+			name: "tampered claims",
+			header: func() string {
+				token := signJWT(t, map[string]any{"alg": "RS256", "kid": "rsa-1"}, validClaims())
+				parts := strings.Split(token, ".")
+				claims, _ := json.Marshal(with("roles", []string{"admin"}))
+				return "Bearer " + parts[0] + "." + b64(claims) + "." + parts[2]
+			}(),
+			wantErr: ErrInvalidCredentials,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			got, err := authenticator.Authenticate(req)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				assert.Nil(t, got)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, "jwt:user-1", got.Subject)
+			assert.Equal(t, MethodJWT, got.Method)
+			assert.Equal(t, tt.wantRoles, got.Roles)
+			assert.Equal(t, tt.wantTenant, got.Tenant)
+			assert.Equal(t, "user-1", got.Claims["sub"])
+		})
+	}
+}
+
+func TestLoadJWKS(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	assert.NoError(t, os.WriteFile(path, testJWKS(t), 0o600))
+	jwks, err := LoadJWKS(path)
+	assert.NoError(t, err)
+	assert.Len(t, jwks.keys, 2, "encryption keys are skipped")
+
+	_, err = LoadJWKS(filepath.Join(t.TempDir(), "missing.json"))
+	assert.Error(t, err)
+
+	smallKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.NoError(t, err)
+	for name, data := range map[string]string{
+		"not json":          "keys",
+		"no signing keys":   `{"keys": []}`,
+		"unsupported curve": `{"keys": [{"kty": "EC", "kid": "ec", "crv": "P-384", "x": "", "y": ""}]}`,
+		"point not on curve": `{"keys": [{"kty": "EC", "kid": "ec", "crv": "P-256", "x": "` + b64(make([]byte, 32)) +
+			`", "y": "` + b64(make([]byte, 32)) + `"}]}`,
+		"short rsa key": `{"keys": [{"kty": "RSA", "kid": "rsa", "n": "` + b64(smallKey.N.Bytes()) + `", "e": "AQAB"}]}`,
+		"symmetric key": `{"keys": [{"kty": "oct", "kid": "hmac", "k": "c2VjcmV0"}]}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := ParseJWKS([]byte(data))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestJWT_SingleKeyWithoutKeyID(t *testing.T) {
+	data, err := json.Marshal(map[string]any{"keys": []map[string]string{{
+		"kty": "RSA", "n": b64(testRSAKey.N.Bytes()), "e": b64(big.NewInt(int64(testRSAKey.E)).Bytes()),
+	}}})
+	assert.NoError(t, err)
+	jwks, err := ParseJWKS(data)
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+signJWT(t, map[string]any{"alg": "RS256"}, map[string]any{
+		"sub": "service", "exp": time.Now().Add(time.Minute).Unix(),
+	}))
+	got, err := JWT{Keys: jwks}.Authenticate(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "jwt:service", got.Subject)
+	assert.Empty(t, got.Roles)
+}
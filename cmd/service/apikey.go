@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"tokenize/models"
+	"tokenize/persistence/dynamodb"
+)
+
+// createAPIKey generates a new API key and stores its hash. The key is printed once and cannot be recovered later.
+func createAPIKey(args []string) error {
+	flags := flag.NewFlagSet("create-api-key", flag.ExitOnError)
+	name := flags.String("name", "", "name to recognize the key by")
+	roles := flags.String("roles", "", "comma separated list of roles granted to the key")
+	tenant := flags.String("tenant", "", "tenant the key belongs to, keys without one are not in a tenant")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *name == "" {
+		return errors.New("a name is required")
+	}
+	if !models.ValidTenant(*tenant) {
+		return fmt.Errorf("invalid tenant %q", *tenant)
+	}
+
+	key, apiKey, err := models.NewAPIKey(*name, parseRoles(*roles))
+	if err != nil {
+		return err
+	}
+	apiKey.Tenant = *tenant
+
+	ctx := context.Background()
+	db := dynamodb.CreateLocalClient()
+	dynamodb.SetupAPIKeyTable(ctx, db)
+	store := &dynamodb.DynamoStore{Api: db}
+	if err := store.CreateAPIKey(ctx, apiKey); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stdout, "id: %s\nkey: %s\n", apiKey.ID, key)
+	return nil
+}
+
+// parseRoles splits a comma separated list of roles, dropping empty entries
+func parseRoles(text string) []string {
+	roles := []string{}
+	for _, role := range strings.Split(text, ",") {
+		if role = strings.TrimSpace(role); role != "" {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"tokenize/api"
+	"tokenize/audit"
+	"tokenize/auth"
+	"tokenize/keys"
+	"tokenize/models"
+	"tokenize/persistence"
+	"tokenize/persistence/dynamodb"
+)
+
+// config holds the service settings, read from the environment
+type config struct {
+	Addr string
+	Keys keys.Config
+	// TokenKeys configures the tokenization keys, which must not be the encryption keys. They are pinned to one key,
+	// since deterministic tokens change with the key.
+	TokenKeys keys.Config
+	// AuditKeys configures the keys audit records are sealed with, which must not be the other keys
+	AuditKeys keys.Config
+	// DefaultTokenMode and TokenModes pick how tokens are generated, TokenModes is a list of type=mode entries
+	DefaultTokenMode string
+	TokenModes       string
+	// RotationCheckpoint is where key rotation progress is recorded, in memory for the admin endpoint when empty
+	RotationCheckpoint string
+	// JWKSPath is the JWKS file JWT bearer tokens are verified with, only API keys are accepted when it is empty
+	JWKSPath      string
+	JWTIssuer     string
+	JWTAudience   string
+	JWTRolesClaim string
+	// JWTTenantClaim is the claim with the caller's tenant
+	JWTTenantClaim string
+	// TenantKeysPath is the file with the keys of each tenant, there are no tenants when it is empty
+	TenantKeysPath string
+	// PolicyPath is the access policy file, the default roles apply when it is empty
+	PolicyPath string
+	// RevealPoliciesPath is the file with the reveal policies of each token type, only the built-in ones exist when it is empty
+	RevealPoliciesPath string
+	// TokenTypesPath is the token type registry file, every token type is accepted when it is empty
+	TokenTypesPath string
+	// AuditStore is where audit records are kept, dynamodb or file, and AuditPath the file for the file store
+	AuditStore string
+	AuditPath  string
+	// ClientIPHeader is the header a proxy puts the client's address in, the connection's address is used when empty
+	ClientIPHeader string
+}
+
+func loadConfig() config {
+	return config{
+		Addr: getEnv("TOKENIZE_ADDR", ":8080"),
+		Keys: keys.Config{
+			Provider: getEnv("TOKENIZE_KEY_PROVIDER", "env"),
+			EnvVar:   getEnv("TOKENIZE_KEY_ENV", "TOKENIZE_KEY"),
+			Path:     os.Getenv("TOKENIZE_KEY_PATH"),
+		},
+		TokenKeys: keys.Config{
+			Provider: getEnv("TOKENIZE_TOKEN_KEY_PROVIDER", "env"),
+			EnvVar:   getEnv("TOKENIZE_TOKEN_KEY_ENV", "TOKENIZE_TOKEN_KEY"),
+			Path:     os.Getenv("TOKENIZE_TOKEN_KEY_PATH"),
+			KeyID:    getEnv("TOKENIZE_TOKEN_KEY_ID", models.DefaultKeyID),
+		},
+		AuditKeys: keys.Config{
+			Provider: getEnv("TOKENIZE_AUDIT_KEY_PROVIDER", "env"),
+			EnvVar:   getEnv("TOKENIZE_AUDIT_KEY_ENV", "TOKENIZE_AUDIT_KEY"),
+			Path:     os.Getenv("TOKENIZE_AUDIT_KEY_PATH"),
+		},
+		DefaultTokenMode:   getEnv("TOKENIZE_DEFAULT_TOKEN_MODE", string(models.TokenModeHMAC)),
+		TokenModes:         os.Getenv("TOKENIZE_TOKEN_MODES"),
+		RotationCheckpoint: os.Getenv("TOKENIZE_ROTATION_CHECKPOINT"),
+		JWKSPath:           os.Getenv("TOKENIZE_JWKS_PATH"),
+		JWTIssuer:          os.Getenv("TOKENIZE_JWT_ISSUER"),
+		JWTAudience:        os.Getenv("TOKENIZE_JWT_AUDIENCE"),
+		JWTRolesClaim:      os.Getenv("TOKENIZE_JWT_ROLES_CLAIM"),
+		JWTTenantClaim:     os.Getenv("TOKENIZE_JWT_TENANT_CLAIM"),
+		TenantKeysPath:     os.Getenv("TOKENIZE_TENANT_KEYS_PATH"),
+		PolicyPath:         os.Getenv("TOKENIZE_POLICY_PATH"),
+		RevealPoliciesPath: os.Getenv("TOKENIZE_REVEAL_POLICIES_PATH"),
+		TokenTypesPath:     os.Getenv("TOKENIZE_TOKEN_TYPES_PATH"),
+		AuditStore:         getEnv("TOKENIZE_AUDIT_STORE", "dynamodb"),
+		AuditPath:          getEnv("TOKENIZE_AUDIT_PATH", "audit.log"),
+		ClientIPHeader:     os.Getenv("TOKENIZE_CLIENT_IP_HEADER"),
+	}
+}
+
+// tokenModes parses the token mode settings
+func (c config) tokenModes() (models.TokenModes, error) {
+	modes := models.TokenModes{Default: models.TokenMode(c.DefaultTokenMode)}
+	if err := modes.Default.Validate(); err != nil {
+		return modes, err
+	}
+	byType, err := models.ParseTokenModes(c.TokenModes)
+	if err != nil {
+		return modes, err
+	}
+	modes.ByType = byType
+	return modes, nil
+}
+
+// revealPolicies loads the configured reveal policies
+func (c config) revealPolicies() (models.RevealPolicies, error) {
+	if c.RevealPoliciesPath == "" {
+		return models.RevealPolicies{}, nil
+	}
+	data, err := os.ReadFile(c.RevealPoliciesPath)
+	if err != nil {
+		return nil, err
+	}
+	return models.ParseRevealPolicies(data)
+}
+
+// tokenTypes loads the token type registry, checking the reveal policy of each type exists
+func (c config) tokenTypes(reveals models.RevealPolicies) (models.TokenTypes, error) {
+	if c.TokenTypesPath == "" {
+		return models.TokenTypes{}, nil
+	}
+	data, err := os.ReadFile(c.TokenTypesPath)
+	if err != nil {
+		return nil, err
+	}
+	types, err := models.ParseTokenTypes(data, api.CompileSchema)
+	if err != nil {
+		return nil, err
+	}
+	if err := types.CheckReveals(reveals); err != nil {
+		return nil, err
+	}
+	return types, nil
+}
+
+// authenticator builds the ways callers can authenticate, API keys from the store and JWTs when a JWKS is configured
+func (c config) authenticator(keys persistence.APIKeyStore) (auth.Authenticator, error) {
+	chain := auth.Chain{auth.APIKeys{Store: keys}}
+	if c.JWKSPath == "" {
+		return chain, nil
+	}
+	jwks, err := auth.LoadJWKS(c.JWKSPath)
+	if err != nil {
+		return nil, fmt.Errorf("jwks: %w", err)
+	}
+	return append(chain, auth.JWT{
+		Keys:        jwks,
+		Issuer:      c.JWTIssuer,
+		Audience:    c.JWTAudience,
+		RolesClaim:  c.JWTRolesClaim,
+		TenantClaim: c.JWTTenantClaim,
+	}), nil
+}
+
+// tenants loads the keys of every tenant, which are checked against each other and the default keys with Tenants.Distinct
+func (c config) tenants() (keys.Tenants, error) {
+	if c.TenantKeysPath == "" {
+		return keys.Tenants{}, nil
+	}
+	return keys.LoadTenants(c.TenantKeysPath)
+}
+
+// auditStore builds the store audit records are kept in, sealing them with the audit keys
+func (c config) auditStore(db dynamodb.Api, auditKeys models.KeyProvider) (audit.Store, error) {
+	switch c.AuditStore {
+	case "dynamodb":
+		dynamodb.SetupAuditTable(context.Background(), db)
+		return &dynamodb.AuditStore{Api: db, Keys: auditKeys}, nil
+	case "file":
+		return audit.OpenFile(c.AuditPath, auditKeys)
+	default:
+		return nil, fmt.Errorf("unknown audit store %q", c.AuditStore)
+	}
+}
+
+func getEnv(name, fallback string) string {
+	if val, ok := os.LookupEnv(name); ok && val != "" {
+		return val
+	}
+	return fallback
+}
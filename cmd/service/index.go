@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"os/signal"
+	"syscall"
+
+	"tokenize/persistence/dynamodb"
+)
+
+// indexTokens adds the list index keys to the tokens stored before the list indexes existed, so they can be listed
+func indexTokens(args []string) error {
+	flags := flag.NewFlagSet("index-tokens", flag.ExitOnError)
+	batchSize := flags.Int("batch", 100, "number of tokens to read at a time")
+	start := flags.String("cursor", "", "cursor logged by a run that stopped, to continue from")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	store := &dynamodb.DynamoStore{Api: dynamodb.CreateLocalClient()}
+	total := 0
+	cursor := *start
+	for {
+		indexed, next, err := store.IndexTokens(ctx, cursor, int32(*batchSize))
+		total += indexed
+		if err != nil {
+			slog.Info("indexing tokens stopped", "indexed", total, "cursor", cursor)
+			return err
+		}
+		if next == "" {
+			slog.Info("indexed tokens", "indexed", total)
+			return nil
+		}
+		cursor = next
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
@@ -11,31 +12,167 @@ import (
 	"time"
 
 	"tokenize/api"
+	"tokenize/keys"
+	"tokenize/models"
 	"tokenize/persistence/dynamodb"
+	"tokenize/policy"
+	"tokenize/rotation"
 )
 
-func buildServer() *http.Server {
+// policyReloadInterval is how often the policy file is checked for changes
+const policyReloadInterval = 30 * time.Second
+
+// keyReloadInterval is how often the key files and keystores are checked for changes
+const keyReloadInterval = 30 * time.Second
+
+func buildServer(cfg config) (*http.Server, error) {
+	keyProvider, err := keys.New(cfg.Keys)
+	if err != nil {
+		return nil, err
+	}
+	tokenKeyProvider, err := keys.New(cfg.TokenKeys)
+	if err != nil {
+		return nil, fmt.Errorf("tokenization key: %w", err)
+	}
+	auditKeyProvider, err := keys.New(cfg.AuditKeys)
+	if err != nil {
+		return nil, fmt.Errorf("audit key: %w", err)
+	}
+	tenants, err := cfg.tenants()
+	if err != nil {
+		return nil, fmt.Errorf("tenant keys: %w", err)
+	}
+
+	// fail fast if a key is missing, malformed or used twice rather than on the first request, and check again every
+	// time a keyring is reloaded
+	distinct := tenants.Distinct(models.TenantKeys{Keys: keyProvider, TokenKeys: tokenKeyProvider})
+	distinct.Add("the audit key", auditKeyProvider)
+	if err := distinct.Validate(context.Background()); err != nil {
+		return nil, err
+	}
+	distinct.Guard()
+
+	keyProviders := []models.KeyProvider{keyProvider, tokenKeyProvider, auditKeyProvider}
+	for _, tenantKeys := range tenants {
+		keyProviders = append(keyProviders, tenantKeys.Keys, tenantKeys.TokenKeys)
+	}
+	for _, provider := range keyProviders {
+		go keys.Watch(context.Background(), provider, keyReloadInterval)
+	}
+
+	tokenModes, err := cfg.tokenModes()
+	if err != nil {
+		return nil, err
+	}
+
+	reveals, err := cfg.revealPolicies()
+	if err != nil {
+		return nil, fmt.Errorf("reveal policies: %w", err)
+	}
+	tokenTypes, err := cfg.tokenTypes(reveals)
+	if err != nil {
+		return nil, fmt.Errorf("token types: %w", err)
+	}
+
 	db := dynamodb.CreateLocalClient()
 
 	dynamodb.SetupDynamoTable(context.Background(), db)
+	dynamodb.SetupAPIKeyTable(context.Background(), db)
+	dynamodb.SetupGrantTable(context.Background(), db)
+	store := &dynamodb.DynamoStore{
+		Api: db,
+	}
+
+	authenticator, err := cfg.authenticator(store)
+	if err != nil {
+		return nil, err
+	}
+	auditStore, err := cfg.auditStore(db, auditKeyProvider)
+	if err != nil {
+		return nil, fmt.Errorf("audit: %w", err)
+	}
+
+	var authorizer policy.Authorizer = policy.Default()
+	var policyFile *policy.File
+	if cfg.PolicyPath != "" {
+		policyFile, err = policy.LoadFile(cfg.PolicyPath)
+		if err != nil {
+			return nil, fmt.Errorf("policy: %w", err)
+		}
+		go policyFile.Watch(context.Background(), policyReloadInterval)
+		authorizer = policyFile
+	}
+	go reloadOnHangup(policyFile, keyProviders)
+
+	var checkpoint rotation.Checkpoint = &rotation.MemoryCheckpoint{}
+	if cfg.RotationCheckpoint != "" {
+		checkpoint = &rotation.FileCheckpoint{Path: cfg.RotationCheckpoint}
+	}
+
 	handlers := &api.BaseHandler{
-		Store: &dynamodb.DynamoStore{
-			Api: db,
+		Auth:           authenticator,
+		Policy:         authorizer,
+		Audit:          auditStore,
+		AuditKeys:      auditKeyProvider,
+		Store:          store,
+		Keys:           keyProvider,
+		TokenKeys:      tokenKeyProvider,
+		Tenants:        tenants,
+		TokenModes:     tokenModes,
+		TokenTypes:     tokenTypes,
+		Reveals:        reveals,
+		Grants:         store,
+		ClientIPHeader: cfg.ClientIPHeader,
+		Rotator: &rotation.Rotator{
+			Store:      store,
+			Keys:       keyProvider,
+			Tenants:    tenants,
+			Checkpoint: checkpoint,
 		},
 	}
 	routes := api.Routes(handlers)
 	return &http.Server{
-		Addr:    ":8080",
+		Addr:    cfg.Addr,
 		Handler: routes,
-	}
+	}, nil
 
 }
 
+// reloadOnHangup reloads the keyrings, and the policy file when there is one, every time the service receives SIGHUP
+func reloadOnHangup(file *policy.File, providers []models.KeyProvider) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	for range hangup {
+		for _, provider := range providers {
+			if err := keys.Reload(provider); err != nil {
+				slog.Error("unable to reload keyring", "error", err)
+			}
+		}
+		if file == nil {
+			continue
+		}
+		if err := file.Reload(); err != nil {
+			slog.Error("unable to reload policy", "path", file.Path, "error", err)
+			continue
+		}
+		slog.Info("reloaded policy", "path", file.Path)
+	}
+}
+
 func main() {
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
 	slog.SetDefault(logger)
 
-	server := buildServer()
+	cfg := loadConfig()
+	if runCommand(cfg) {
+		return
+	}
+
+	server, err := buildServer(cfg)
+	if err != nil {
+		slog.Error("unable to build server", "error", err)
+		os.Exit(1)
+	}
 
 	shutdownChan := make(chan bool, 1)
 
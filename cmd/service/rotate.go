@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"tokenize/keys"
+	"tokenize/models"
+	"tokenize/persistence/dynamodb"
+	"tokenize/rotation"
+)
+
+// rotateKeys runs the key rotation from the command line, resuming from the checkpoint file if it was interrupted
+func rotateKeys(cfg config, args []string) error {
+	defaultCheckpoint := cfg.RotationCheckpoint
+	if defaultCheckpoint == "" {
+		defaultCheckpoint = "key-rotation.json"
+	}
+
+	flags := flag.NewFlagSet("rotate-keys", flag.ExitOnError)
+	batchSize := flags.Int("batch", rotation.DefaultBatchSize, "number of tokens to read at a time")
+	checkpointPath := flags.String("checkpoint", defaultCheckpoint, "file to record progress in")
+	restart := flags.Bool("restart", false, "start over instead of resuming from the checkpoint")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	keyProvider, err := keys.New(cfg.Keys)
+	if err != nil {
+		return err
+	}
+	tokenKeyProvider, err := keys.New(cfg.TokenKeys)
+	if err != nil {
+		return fmt.Errorf("tokenization key: %w", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	tenants, err := cfg.tenants()
+	if err != nil {
+		return fmt.Errorf("tenant keys: %w", err)
+	}
+	if err := tenants.Validate(ctx, models.TenantKeys{Keys: keyProvider, TokenKeys: tokenKeyProvider}); err != nil {
+		return fmt.Errorf("tenant keys: %w", err)
+	}
+
+	rotator := &rotation.Rotator{
+		Store: &dynamodb.DynamoStore{
+			Api: dynamodb.CreateLocalClient(),
+		},
+		Keys:       keyProvider,
+		Tenants:    tenants,
+		Checkpoint: &rotation.FileCheckpoint{Path: *checkpointPath},
+		BatchSize:  int32(*batchSize),
+	}
+	progress, err := rotator.Run(ctx, *restart)
+	slog.Info("key rotation finished",
+		"status", progress.Status,
+		"key_id", progress.KeyID,
+		"scanned", progress.Scanned,
+		"rotated", progress.Rotated,
+		"skipped", progress.Skipped,
+		"failed", progress.Failed,
+	)
+	return err
+}
+
+// runCommand runs a subcommand if one was given, returning false if the service should start as normal
+func runCommand(cfg config) bool {
+	if len(os.Args) < 2 {
+		return false
+	}
+
+	switch os.Args[1] {
+	case "rotate-keys":
+		if err := rotateKeys(cfg, os.Args[2:]); err != nil {
+			slog.Error("key rotation failed", "error", err)
+			os.Exit(1)
+		}
+		return true
+	case "index-tokens":
+		if err := indexTokens(os.Args[2:]); err != nil {
+			slog.Error("token indexing failed", "error", err)
+			os.Exit(1)
+		}
+		return true
+	case "create-api-key":
+		if err := createAPIKey(os.Args[2:]); err != nil {
+			slog.Error("unable to create api key", "error", err)
+			os.Exit(1)
+		}
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,183 @@
+// Package fpe implements the FF1 format-preserving encryption mode from NIST SP 800-38G
+package fpe
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/big"
+	"strings"
+)
+
+// alphabet holds the numerals for radixes up to 36, FF1 strings are written with the first radix characters of it
+const alphabet = "0123456789abcdefghijklmnopqrstuvwxyz"
+
+// minDomain is the smallest number of possible values FF1 may be used on, radix^minlen >= 1,000,000
+const minDomain = 1_000_000
+
+// rounds is the number of Feistel rounds in FF1
+const rounds = 10
+
+var (
+	ErrInvalidRadix  = errors.New("radix must be between 2 and 36")
+	ErrInvalidLength = errors.New("input is too short or too long for the radix")
+	ErrInvalidInput  = errors.New("input contains characters outside of the radix")
+)
+
+// FF1 encrypts strings of numerals in a given radix to strings of the same length and radix
+type FF1 struct {
+	block cipher.Block
+	radix int
+	// minLen and maxLen are the bounds on the input length for the radix
+	minLen int
+	maxLen int
+}
+
+// NewFF1 creates an FF1 cipher with an AES key of 16, 24 or 32 bytes
+func NewFF1(key []byte, radix int) (*FF1, error) {
+	if radix < 2 || radix > len(alphabet) {
+		return nil, ErrInvalidRadix
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	minLen, domain := 0, 1
+	for domain < minDomain {
+		domain *= radix
+		minLen++
+	}
+	return &FF1{
+		block:  block,
+		radix:  radix,
+		minLen: max(minLen, 2),
+		maxLen: math.MaxUint32,
+	}, nil
+}
+
+// Encrypt encrypts the numeral string x under the tweak
+func (f *FF1) Encrypt(tweak []byte, x string) (string, error) {
+	return f.cipher(tweak, x, true)
+}
+
+// Decrypt reverses Encrypt
+func (f *FF1) Decrypt(tweak []byte, x string) (string, error) {
+	return f.cipher(tweak, x, false)
+}
+
+func (f *FF1) cipher(tweak []byte, x string, encrypt bool) (string, error) {
+	n := len(x)
+	if n < f.minLen || n > f.maxLen {
+		return "", ErrInvalidLength
+	}
+	numerals := alphabet[:f.radix]
+	for _, c := range x {
+		if !strings.ContainsRune(numerals, c) {
+			return "", ErrInvalidInput
+		}
+	}
+
+	t := len(tweak)
+	u := n / 2
+	v := n - u
+	a, b := x[:u], x[u:]
+
+	radix := big.NewInt(int64(f.radix))
+	// b is the number of bytes needed to hold a v digit number, d the number of PRF output bytes used per round
+	byteLen := int(math.Ceil(math.Ceil(float64(v)*math.Log2(float64(f.radix))) / 8))
+	d := 4*((byteLen+3)/4) + 4
+
+	p := make([]byte, 16)
+	p[0], p[1], p[2] = 1, 2, 1
+	p[3], p[4], p[5] = byte(f.radix>>16), byte(f.radix>>8), byte(f.radix)
+	p[6] = 10
+	p[7] = byte(u % 256)
+	binary.BigEndian.PutUint32(p[8:12], uint32(n))
+	binary.BigEndian.PutUint32(p[12:16], uint32(t))
+
+	padding := mod(-t-byteLen-1, 16)
+	q := make([]byte, t+padding+1+byteLen)
+	copy(q, tweak)
+
+	modU := new(big.Int).Exp(radix, big.NewInt(int64(u)), nil)
+	modV := new(big.Int).Exp(radix, big.NewInt(int64(v)), nil)
+
+	for step := 0; step < rounds; step++ {
+		i := step
+		if !encrypt {
+			i = rounds - 1 - step
+		}
+
+		// the half that feeds the round function is B when encrypting and A when decrypting
+		feed := b
+		if !encrypt {
+			feed = a
+		}
+		q[t+padding] = byte(i)
+		num, _ := new(big.Int).SetString(feed, f.radix)
+		num.FillBytes(q[t+padding+1:])
+
+		y := new(big.Int).SetBytes(f.expand(f.prf(p, q), d))
+
+		m, modulus := u, modU
+		if i%2 == 1 {
+			m, modulus = v, modV
+		}
+
+		if encrypt {
+			c, _ := new(big.Int).SetString(a, f.radix)
+			c.Add(c, y).Mod(c, modulus)
+			a, b = b, f.str(c, m)
+		} else {
+			c, _ := new(big.Int).SetString(b, f.radix)
+			c.Sub(c, y).Mod(c, modulus)
+			a, b = f.str(c, m), a
+		}
+	}
+	return a + b, nil
+}
+
+// prf is the CBC-MAC of P || Q with a zero IV
+func (f *FF1) prf(p, q []byte) []byte {
+	r := make([]byte, 16)
+	for _, data := range [][]byte{p, q} {
+		for len(data) > 0 {
+			for j := 0; j < 16; j++ {
+				r[j] ^= data[j]
+			}
+			f.block.Encrypt(r, r)
+			data = data[16:]
+		}
+	}
+	return r
+}
+
+// expand stretches the PRF output R to d bytes: R || CIPH(R xor [1]) || CIPH(R xor [2]) ...
+func (f *FF1) expand(r []byte, d int) []byte {
+	s := append([]byte{}, r...)
+	block := make([]byte, 16)
+	for j := 1; len(s) < d; j++ {
+		copy(block, r)
+		counter := binary.BigEndian.Uint64(block[8:]) ^ uint64(j)
+		binary.BigEndian.PutUint64(block[8:], counter)
+		f.block.Encrypt(block, block)
+		s = append(s, block...)
+	}
+	return s[:d]
+}
+
+// str writes x as a numeral string of exactly m digits
+func (f *FF1) str(x *big.Int, m int) string {
+	s := x.Text(f.radix)
+	if len(s) < m {
+		s = strings.Repeat("0", m-len(s)) + s
+	}
+	return s
+}
+
+// mod is the non-negative remainder of x divided by m
+func mod(x, m int) int {
+	return ((x % m) + m) % m
+}
@@ -0,0 +1,91 @@
+package fpe
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// the FF1 samples published by NIST for SP 800-38G
+func TestFF1_NISTVectors(t *testing.T) {
+	const (
+		key128 = "2b7e151628aed2a6abf7158809cf4f3c"
+		key192 = "2b7e151628aed2a6abf7158809cf4f3cef4359d8d580aa4f"
+		key256 = "2b7e151628aed2a6abf7158809cf4f3cef4359d8d580aa4f7f036d6f04fc6a94"
+	)
+	tests := []struct {
+		name       string
+		key        string
+		radix      int
+		tweak      string
+		plaintext  string
+		ciphertext string
+	}{
+		{"sample 1", key128, 10, "", "0123456789", "2433477484"},
+		{"sample 2", key128, 10, "39383736353433323130", "0123456789", "6124200773"},
+		{"sample 3", key128, 36, "3737373770717273373737", "0123456789abcdefghi", "a9tv40mll9kdu509eum"},
+		{"sample 4", key192, 10, "", "0123456789", "2830668132"},
+		{"sample 5", key192, 10, "39383736353433323130", "0123456789", "2496655549"},
+		{"sample 6", key192, 36, "3737373770717273373737", "0123456789abcdefghi", "xbj3kv35jrawxv32ysr"},
+		{"sample 7", key256, 10, "", "0123456789", "6657667009"},
+		{"sample 8", key256, 10, "39383736353433323130", "0123456789", "1001623463"},
+		{"sample 9", key256, 36, "3737373770717273373737", "0123456789abcdefghi", "xs8a0azh2avyalyzuwd"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, _ := hex.DecodeString(tt.key)
+			tweak, _ := hex.DecodeString(tt.tweak)
+			ff1, err := NewFF1(key, tt.radix)
+			assert.NoError(t, err)
+
+			got, err := ff1.Encrypt(tweak, tt.plaintext)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.ciphertext, got)
+
+			got, err = ff1.Decrypt(tweak, tt.ciphertext)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.plaintext, got)
+		})
+	}
+}
+
+func TestFF1_RoundTrip(t *testing.T) {
+	ff1, err := NewFF1([]byte("this is the secret key and stuff"), 10)
+	assert.NoError(t, err)
+
+	for _, input := range []string{"000000", "4111111111", "5500000000000004", "12345678901234567890123456789"} {
+		encrypted, err := ff1.Encrypt([]byte("tweak"), input)
+		assert.NoError(t, err)
+		assert.Len(t, encrypted, len(input))
+		assert.Regexp(t, "^[0-9]+$", encrypted)
+		assert.NotEqual(t, input, encrypted)
+
+		decrypted, err := ff1.Decrypt([]byte("tweak"), encrypted)
+		assert.NoError(t, err)
+		assert.Equal(t, input, decrypted)
+
+		otherTweak, err := ff1.Encrypt([]byte("other"), input)
+		assert.NoError(t, err)
+		assert.NotEqual(t, encrypted, otherTweak, "the tweak should change the output")
+	}
+}
+
+func TestFF1_Errors(t *testing.T) {
+	_, err := NewFF1([]byte("this is the secret key and stuff"), 1)
+	assert.ErrorIs(t, err, ErrInvalidRadix)
+	_, err = NewFF1([]byte("this is the secret key and stuff"), 37)
+	assert.ErrorIs(t, err, ErrInvalidRadix)
+	_, err = NewFF1([]byte("bad key"), 10)
+	assert.Error(t, err)
+
+	ff1, err := NewFF1([]byte("this is the secret key and stuff"), 10)
+	assert.NoError(t, err)
+
+	_, err = ff1.Encrypt(nil, "12345")
+	assert.ErrorIs(t, err, ErrInvalidLength, "10^5 is below the minimum domain size")
+	_, err = ff1.Encrypt(nil, "12345a")
+	assert.ErrorIs(t, err, ErrInvalidInput)
+	_, err = ff1.Decrypt(nil, "1234")
+	assert.ErrorIs(t, err, ErrInvalidLength)
+}
@@ -0,0 +1,168 @@
+// Package jsonpath selects values in decoded JSON documents with a subset of JSONPath: the root $, child names as
+// .name or ['name'], array indexes as [0], and wildcards as .* or [*]
+package jsonpath
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidPath = errors.New("invalid JSONPath")
+
+// step selects children of a value: a member by name, an element by index, or every child
+type step struct {
+	name     string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+// Path is a parsed JSONPath expression
+type Path struct {
+	expr  string
+	steps []step
+}
+
+// Parse parses a JSONPath expression in the supported subset
+func Parse(expr string) (Path, error) {
+	if !strings.HasPrefix(expr, "$") {
+		return Path{}, fmt.Errorf("%w %q: it must start with $", ErrInvalidPath, expr)
+	}
+	path := Path{expr: expr}
+	rest := expr[1:]
+	for rest != "" {
+		var s step
+		var err error
+		switch rest[0] {
+		case '.':
+			s, rest, err = parseDot(rest[1:])
+		case '[':
+			s, rest, err = parseBracket(rest[1:])
+		default:
+			err = fmt.Errorf("unexpected %q", rest[0])
+		}
+		if err != nil {
+			return Path{}, fmt.Errorf("%w %q: %w", ErrInvalidPath, expr, err)
+		}
+		path.steps = append(path.steps, s)
+	}
+	return path, nil
+}
+
+// parseDot parses the step after a dot, returning what is left of the expression
+func parseDot(rest string) (step, string, error) {
+	if strings.HasPrefix(rest, "*") {
+		return step{wildcard: true}, rest[1:], nil
+	}
+	end := strings.IndexAny(rest, ".[")
+	if end < 0 {
+		end = len(rest)
+	}
+	if end == 0 {
+		return step{}, "", errors.New("missing name after .")
+	}
+	return step{name: rest[:end]}, rest[end:], nil
+}
+
+// parseBracket parses the step after an opening bracket, returning what is left of the expression
+func parseBracket(rest string) (step, string, error) {
+	if strings.HasPrefix(rest, "*]") {
+		return step{wildcard: true}, rest[2:], nil
+	}
+	if rest != "" && (rest[0] == '\'' || rest[0] == '"') {
+		end := strings.IndexByte(rest[1:], rest[0]) + 1
+		if end == 0 || !strings.HasPrefix(rest[end+1:], "]") {
+			return step{}, "", errors.New("unterminated name in brackets")
+		}
+		return step{name: rest[1:end]}, rest[end+2:], nil
+	}
+
+	end := strings.IndexByte(rest, ']')
+	if end < 0 {
+		return step{}, "", errors.New("missing ]")
+	}
+	index, err := strconv.Atoi(rest[:end])
+	if err != nil || index < 0 {
+		return step{}, "", fmt.Errorf("invalid index %q", rest[:end])
+	}
+	return step{index: index, isIndex: true}, rest[end+1:], nil
+}
+
+func (p Path) String() string {
+	return p.expr
+}
+
+// Overlaps reports whether the paths can select the same value, or a value inside a value the other one selects, in
+// some document
+func (p Path) Overlaps(other Path) bool {
+	for i := 0; i < len(p.steps) && i < len(other.steps); i++ {
+		if !p.steps[i].overlaps(other.steps[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// overlaps reports whether the steps can select the same child
+func (s step) overlaps(other step) bool {
+	if s.wildcard || other.wildcard {
+		return true
+	}
+	if s.isIndex != other.isIndex {
+		return false
+	}
+	return s.name == other.name && s.index == other.index
+}
+
+// Replace calls fn with every value the path selects in doc, and puts the value it returns in its place. Members and
+// elements that do not exist are not selected, so a path can select nothing. doc is changed in place and returned,
+// since a path of just $ replaces the whole document.
+func (p Path) Replace(doc any, fn func(value any) (any, error)) (any, error) {
+	return replace(doc, p.steps, fn)
+}
+
+func replace(value any, steps []step, fn func(value any) (any, error)) (any, error) {
+	if len(steps) == 0 {
+		return fn(value)
+	}
+	s, next := steps[0], steps[1:]
+
+	switch v := value.(type) {
+	case map[string]any:
+		names := []string{s.name}
+		if s.isIndex {
+			return value, nil
+		}
+		if s.wildcard {
+			// in order, so values are replaced the same way every time
+			names = slices.Sorted(maps.Keys(v))
+		}
+		for _, name := range names {
+			child, found := v[name]
+			if !found {
+				continue
+			}
+			replaced, err := replace(child, next, fn)
+			if err != nil {
+				return nil, err
+			}
+			v[name] = replaced
+		}
+	case []any:
+		for i, child := range v {
+			if !s.wildcard && (!s.isIndex || s.index != i) {
+				continue
+			}
+			replaced, err := replace(child, next, fn)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = replaced
+		}
+	}
+	return value, nil
+}
@@ -0,0 +1,148 @@
+package jsonpath
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		expr    string
+		want    []step
+		wantErr bool
+	}{
+		{expr: "$", want: nil},
+		{expr: "$.card.number", want: []step{{name: "card"}, {name: "number"}}},
+		{expr: "$['card']", want: []step{{name: "card"}}},
+		{expr: `$["card number"].pan`, want: []step{{name: "card number"}, {name: "pan"}}},
+		{expr: "$.cards[2]", want: []step{{name: "cards"}, {index: 2, isIndex: true}}},
+		{expr: "$.cards[*].pan", want: []step{{name: "cards"}, {wildcard: true}, {name: "pan"}}},
+		{expr: "$.*", want: []step{{wildcard: true}}},
+		{expr: "card.number", wantErr: true},
+		{expr: "$..number", wantErr: true},
+		{expr: "$.", wantErr: true},
+		{expr: "$[", wantErr: true},
+		{expr: "$['card]", wantErr: true},
+		{expr: "$[-1]", wantErr: true},
+		{expr: "$[?(@.pan)]", wantErr: true},
+		{expr: "$card", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			got, err := Parse(tt.expr)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidPath)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got.steps)
+			assert.Equal(t, tt.expr, got.String())
+		})
+	}
+}
+
+func TestPath_Replace(t *testing.T) {
+	const doc = `{
+		"card": {"number": "4111111111111111", "exp": "0128"},
+		"cards": [{"pan": "5555555555554444"}, {"pan": "4012888888881881"}, {"name": "no pan"}],
+		"tags": ["a", "b"]
+	}`
+	upper := func(value any) (any, error) {
+		return strings.ToUpper(value.(string)), nil
+	}
+
+	tests := []struct {
+		name string
+		expr string
+		fn   func(value any) (any, error)
+		want string
+	}{
+		{
+			name: "member",
+			expr: "$.card.exp",
+			fn:   func(any) (any, error) { return "tok", nil },
+			want: `{"card":{"exp":"tok","number":"4111111111111111"},"cards":[{"pan":"5555555555554444"},{"pan":"4012888888881881"},{"name":"no pan"}],"tags":["a","b"]}`,
+		},
+		{
+			name: "array elements",
+			expr: "$.cards[*].pan",
+			fn:   func(value any) (any, error) { return "tok-" + value.(string)[12:], nil },
+			want: `{"card":{"exp":"0128","number":"4111111111111111"},"cards":[{"pan":"tok-4444"},{"pan":"tok-1881"},{"name":"no pan"}],"tags":["a","b"]}`,
+		},
+		{
+			name: "index",
+			expr: "$.tags[1]",
+			fn:   upper,
+			want: `{"card":{"exp":"0128","number":"4111111111111111"},"cards":[{"pan":"5555555555554444"},{"pan":"4012888888881881"},{"name":"no pan"}],"tags":["a","B"]}`,
+		},
+		{
+			name: "nothing selected",
+			expr: "$.tags[5]",
+			fn:   upper,
+			want: `{"card":{"exp":"0128","number":"4111111111111111"},"cards":[{"pan":"5555555555554444"},{"pan":"4012888888881881"},{"name":"no pan"}],"tags":["a","b"]}`,
+		},
+		{
+			name: "root",
+			expr: "$",
+			fn:   func(any) (any, error) { return "replaced", nil },
+			want: `"replaced"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var value any
+			assert.NoError(t, json.Unmarshal([]byte(doc), &value))
+			path, err := Parse(tt.expr)
+			assert.NoError(t, err)
+
+			got, err := path.Replace(value, tt.fn)
+			assert.NoError(t, err)
+			encoded, err := json.Marshal(got)
+			assert.NoError(t, err)
+			assert.JSONEq(t, tt.want, string(encoded))
+		})
+	}
+
+	// the first error stops the replacement
+	var value any
+	assert.NoError(t, json.Unmarshal([]byte(doc), &value))
+	path, _ := Parse("$.cards[*].pan")
+	calls := 0
+	_, err := path.Replace(value, func(any) (any, error) {
+		calls++
+		return nil, errors.New("failed")
+	})
+	assert.EqualError(t, err, "failed")
+	assert.Equal(t, 1, calls)
+}
+
+func TestPath_Overlaps(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{a: "$.card.number", b: "$.card.number", want: true},
+		{a: "$.card", b: "$.card.number", want: true},
+		{a: "$", b: "$.card", want: true},
+		{a: "$.cards[*].pan", b: "$.cards[1].pan", want: true},
+		{a: "$.*.number", b: "$.card.number", want: true},
+		{a: "$.card.number", b: "$.card.exp", want: false},
+		{a: "$.cards[0].pan", b: "$.cards[1].pan", want: false},
+		{a: "$.cards[0]", b: "$.cards['0']", want: false},
+		{a: "$.cards[*].pan", b: "$.cards[*].name", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.a+" "+tt.b, func(t *testing.T) {
+			a, err := Parse(tt.a)
+			assert.NoError(t, err)
+			b, err := Parse(tt.b)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, a.Overlaps(b))
+			assert.Equal(t, tt.want, b.Overlaps(a))
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package keys
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tokenize/models"
+)
+
+// Reloader is a KeyProvider that keeps the keyring it loaded, and can load it again while the service is running
+type Reloader interface {
+	models.KeyProvider
+	// Reload loads the keyring again, swapping it in once it has been parsed. A reload that fails keeps the keyring
+	// that was loaded before.
+	Reload() error
+}
+
+// watcher is a Reloader whose keyring is read from a file, which can be watched for changes
+type watcher interface {
+	Watch(ctx context.Context, interval time.Duration)
+}
+
+// Reload loads the keyring of the provider again, or of the provider it pins. Providers that do not keep a keyring
+// have nothing to reload.
+func Reload(provider models.KeyProvider) error {
+	if pinned, ok := provider.(Pinned); ok {
+		provider = pinned.Provider
+	}
+	if reloader, ok := provider.(Reloader); ok {
+		return reloader.Reload()
+	}
+	return nil
+}
+
+// Watch reloads the keyring of the provider, or of the provider it pins, every time its file is modified, checking
+// every interval until the context is done. It returns straight away for providers whose keyring is not in a file.
+func Watch(ctx context.Context, provider models.KeyProvider, interval time.Duration) {
+	if pinned, ok := provider.(Pinned); ok {
+		provider = pinned.Provider
+	}
+	if watcher, ok := provider.(watcher); ok {
+		watcher.Watch(ctx, interval)
+	}
+}
+
+// reloads is held while a keyring is reloaded, so the checks of a reload see the keyrings of the other providers as
+// they will be once it is swapped in
+var reloads sync.Mutex
+
+// cache keeps the keyring a provider loaded, so it is not read and parsed again on every call
+type cache struct {
+	ring    atomic.Pointer[Keyring]
+	mu      sync.Mutex
+	modTime time.Time
+	// checks are run on every keyring that is reloaded, before it is swapped in
+	checks []func(*Keyring) error
+}
+
+// addCheck adds a check every reloaded keyring has to pass
+func (c *cache) addCheck(check func(*Keyring) error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks = append(c.checks, check)
+}
+
+// keyring returns the keyring, loading it the first time it is needed. A load that fails is tried again on the next
+// call.
+func (c *cache) keyring(load func() (*Keyring, error)) (*Keyring, error) {
+	if ring := c.ring.Load(); ring != nil {
+		return ring, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ring := c.ring.Load(); ring != nil {
+		return ring, nil
+	}
+	ring, err := load()
+	if err != nil {
+		return nil, err
+	}
+	c.ring.Store(ring)
+	return ring, nil
+}
+
+// reload loads the keyring again and runs the checks on it, keeping the one loaded before when either fails
+func (c *cache) reload(load func() (*Keyring, error)) error {
+	reloads.Lock()
+	defer reloads.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ring, err := load()
+	if err != nil {
+		return err
+	}
+	for _, check := range c.checks {
+		if err := check(ring); err != nil {
+			return err
+		}
+	}
+	c.ring.Store(ring)
+	return nil
+}
+
+// readFile reads the file of a keyring while the cache is locked, recording when it was modified
+func (c *cache) readFile(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrNoKey
+		}
+		return nil, err
+	}
+	// a broken file is only reported once, not every time it is watched
+	c.modTime = info.ModTime()
+	return os.ReadFile(path)
+}
+
+// watch reloads the keyring every time the file at path is modified, checking every interval until the context is done
+func (c *cache) watch(ctx context.Context, interval time.Duration, path string, load func() (*Keyring, error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !c.modified(path) {
+				continue
+			}
+			if err := c.reload(load); err != nil {
+				slog.Error("unable to reload keyring", "path", path, "error", err)
+				continue
+			}
+			slog.Info("reloaded keyring", "path", path)
+		}
+	}
+}
+
+// modified reports whether the file has changed since it was last read
+func (c *cache) modified(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !info.ModTime().Equal(c.modTime)
+}
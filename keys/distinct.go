@@ -0,0 +1,87 @@
+package keys
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"tokenize/models"
+)
+
+// Distinct is a set of named key providers whose current keys must all be different, such as the encryption,
+// tokenization and audit keys of the service and of every tenant
+type Distinct struct {
+	names     []string
+	providers []models.KeyProvider
+}
+
+// Add adds a provider to the set, the name is used in the errors about its key
+func (d *Distinct) Add(name string, provider models.KeyProvider) {
+	d.names = append(d.names, name)
+	d.providers = append(d.providers, provider)
+}
+
+// Validate checks that every provider has a usable current key, and that no two of them have the same key
+func (d *Distinct) Validate(ctx context.Context) error {
+	return d.validate(ctx, nil, nil)
+}
+
+// Guard makes every reload of the keyrings of the providers check the set again, with the new keyring in place of the
+// one it replaces. A reload that fails the check keeps the keyring that was loaded before.
+func (d *Distinct) Guard() {
+	for _, provider := range d.providers {
+		c := keyringCache(provider)
+		if c == nil {
+			continue
+		}
+		c.addCheck(func(ring *Keyring) error {
+			return d.validate(context.Background(), c, ring)
+		})
+	}
+}
+
+// validate checks the set with the keyring of the providers that keep their keyring in reloaded replaced by ring
+func (d *Distinct) validate(ctx context.Context, reloaded *cache, ring *Keyring) error {
+	seen := map[string][]byte{}
+	for i, provider := range d.providers {
+		name := d.names[i]
+		if reloaded != nil && keyringCache(provider) == reloaded {
+			provider = withKeyring(provider, ring)
+		}
+		key, err := provider.CurrentKey(ctx)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		for other, material := range seen {
+			if bytes.Equal(material, key.Material) {
+				return fmt.Errorf("%s is the same as %s", name, other)
+			}
+		}
+		seen[name] = key.Material
+	}
+	return nil
+}
+
+// cached is a provider that keeps the keyring it loaded
+type cached interface {
+	keyringCache() *cache
+}
+
+// keyringCache returns the cache of the provider, or of the provider it pins, nil when it does not keep a keyring
+func keyringCache(provider models.KeyProvider) *cache {
+	if pinned, ok := provider.(Pinned); ok {
+		provider = pinned.Provider
+	}
+	if c, ok := provider.(cached); ok {
+		return c.keyringCache()
+	}
+	return nil
+}
+
+// withKeyring returns the provider with its keyring replaced by ring, pinned to the same key when it is pinned
+func withKeyring(provider models.KeyProvider, ring *Keyring) models.KeyProvider {
+	if pinned, ok := provider.(Pinned); ok {
+		return Pinned{Provider: ring, ID: pinned.ID}
+	}
+	return ring
+}
@@ -0,0 +1,78 @@
+package keys
+
+import (
+	"context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDistinct_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		second  Static
+		wantErr string
+	}{
+		{name: "different keys", second: Static(otherKey)},
+		{name: "same key", second: Static(testKey), wantErr: "the tokenization key is the same as the encryption key"},
+		{name: "missing key", second: Static(nil), wantErr: "the tokenization key: no encryption key configured"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			distinct := &Distinct{}
+			distinct.Add("the encryption key", Static(testKey))
+			distinct.Add("the tokenization key", tt.second)
+			err := distinct.Validate(context.Background())
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestDistinct_Guard(t *testing.T) {
+	thirdKey := base64.StdEncoding.EncodeToString([]byte("yet another key material, 32 by!"))
+	dir := t.TempDir()
+	// every write is given a later modification time, so it is seen however coarse the file system's times are
+	modified := time.Now()
+	write := func(path string, contents string) {
+		assert.NoError(t, os.WriteFile(path, []byte(contents), 0o600))
+		modified = modified.Add(time.Second)
+		assert.NoError(t, os.Chtimes(path, modified, modified))
+	}
+	current := func(provider *FileProvider) string {
+		key, err := provider.CurrentKey(context.Background())
+		assert.NoError(t, err)
+		return key.ID
+	}
+
+	encryptionPath, tokenPath := filepath.Join(dir, "encryption"), filepath.Join(dir, "token")
+	write(encryptionPath, "key-1:"+testKeyEncoded)
+	write(tokenPath, "default:"+otherKeyEncoded)
+	encryption, token := &FileProvider{Path: encryptionPath}, &FileProvider{Path: tokenPath}
+	distinct := &Distinct{}
+	distinct.Add("the encryption key", encryption)
+	distinct.Add("the tokenization key", Pinned{Provider: token, ID: "default"})
+	assert.NoError(t, distinct.Validate(context.Background()))
+	distinct.Guard()
+
+	write(encryptionPath, "key-2:"+otherKeyEncoded+"\nkey-1:"+testKeyEncoded)
+	assert.EqualError(t, encryption.Reload(), "the tokenization key is the same as the encryption key")
+	assert.Equal(t, "key-1", current(encryption), "a reload that fails the check keeps the keyring")
+
+	write(tokenPath, "key-3:"+testKeyEncoded+"\ndefault:"+otherKeyEncoded)
+	assert.NoError(t, token.Reload(), "the pinned key is checked, not the current key of the keyring")
+
+	write(tokenPath, "default:"+testKeyEncoded)
+	assert.Error(t, Reload(Pinned{Provider: token, ID: "default"}))
+
+	write(encryptionPath, "key-2:"+thirdKey+"\nkey-1:"+testKeyEncoded)
+	assert.NoError(t, encryption.Reload())
+	assert.Equal(t, "key-2", current(encryption))
+}
@@ -0,0 +1,45 @@
+package keys
+
+import (
+	"context"
+	"os"
+
+	"tokenize/models"
+)
+
+// EnvProvider reads a keyring from an environment variable, either a single base64 key or a comma separated list of
+// "id:base64" keys with the current key first. The variable is parsed once and kept, and parsed again on Reload.
+type EnvProvider struct {
+	Name string
+
+	cache cache
+}
+
+func (e *EnvProvider) CurrentKey(ctx context.Context) (*models.Key, error) {
+	ring, err := e.cache.keyring(e.load)
+	if err != nil {
+		return nil, err
+	}
+	return ring.CurrentKey(ctx)
+}
+
+func (e *EnvProvider) KeyByID(ctx context.Context, id string) (*models.Key, error) {
+	ring, err := e.cache.keyring(e.load)
+	if err != nil {
+		return nil, err
+	}
+	return ring.KeyByID(ctx, id)
+}
+
+// Reload parses the environment variable again
+func (e *EnvProvider) Reload() error {
+	return e.cache.reload(e.load)
+}
+
+func (e *EnvProvider) keyringCache() *cache {
+	return &e.cache
+}
+
+func (e *EnvProvider) load() (*Keyring, error) {
+	return parseKeyring(os.Getenv(e.Name))
+}
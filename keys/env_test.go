@@ -0,0 +1,83 @@
+package keys
+
+import (
+	"context"
+	"testing"
+
+	"tokenize/models"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnvProvider(t *testing.T) {
+	tests := []struct {
+		name        string
+		value       string
+		id          string
+		wantCurrent *models.Key
+		wantByID    *models.Key
+		wantErr     error
+	}{
+		{
+			name:        "single key",
+			value:       testKeyEncoded,
+			id:          models.DefaultKeyID,
+			wantCurrent: &models.Key{ID: models.DefaultKeyID, Material: testKey},
+			wantByID:    &models.Key{ID: models.DefaultKeyID, Material: testKey},
+		},
+		{
+			name:        "rotated keys",
+			value:       "key-2:" + otherKeyEncoded + ",key-1:" + testKeyEncoded,
+			id:          "key-1",
+			wantCurrent: &models.Key{ID: "key-2", Material: otherKey},
+			wantByID:    &models.Key{ID: "key-1", Material: testKey},
+		},
+		{
+			name:    "key not set",
+			value:   "",
+			wantErr: ErrNoKey,
+		},
+		{
+			name:    "invalid key",
+			value:   "bm90IGEga2V5",
+			wantErr: ErrInvalidKey,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TOKENIZE_TEST_KEY", tt.value)
+			provider := &EnvProvider{Name: "TOKENIZE_TEST_KEY"}
+
+			current, err := provider.CurrentKey(context.Background())
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				_, err = provider.KeyByID(context.Background(), tt.id)
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantCurrent, current)
+
+			byID, err := provider.KeyByID(context.Background(), tt.id)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantByID, byID)
+		})
+	}
+}
+
+func TestEnvProvider_Reload(t *testing.T) {
+	t.Setenv("TOKENIZE_TEST_KEY", "key-1:"+testKeyEncoded)
+	provider := &EnvProvider{Name: "TOKENIZE_TEST_KEY"}
+	current, err := provider.CurrentKey(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "key-1", current.ID)
+
+	t.Setenv("TOKENIZE_TEST_KEY", "key-2:"+otherKeyEncoded)
+	current, err = provider.CurrentKey(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "key-1", current.ID, "the variable is parsed once")
+	assert.NoError(t, provider.Reload())
+	current, err = provider.CurrentKey(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "key-2", current.ID)
+}
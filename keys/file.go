@@ -0,0 +1,55 @@
+package keys
+
+import (
+	"context"
+	"time"
+
+	"tokenize/models"
+)
+
+// FileProvider reads a keyring from a file on disk, either a single base64 key or one "id:base64" key per line with
+// the current key first. The file is read once and kept, and read again on Reload or by Watch when it changes, so keys
+// can be added and rotated without restarting the service.
+type FileProvider struct {
+	Path string
+
+	cache cache
+}
+
+func (f *FileProvider) CurrentKey(ctx context.Context) (*models.Key, error) {
+	ring, err := f.cache.keyring(f.load)
+	if err != nil {
+		return nil, err
+	}
+	return ring.CurrentKey(ctx)
+}
+
+func (f *FileProvider) KeyByID(ctx context.Context, id string) (*models.Key, error) {
+	ring, err := f.cache.keyring(f.load)
+	if err != nil {
+		return nil, err
+	}
+	return ring.KeyByID(ctx, id)
+}
+
+// Reload reads the key file again
+func (f *FileProvider) Reload() error {
+	return f.cache.reload(f.load)
+}
+
+// Watch reloads the key file every time it is modified, checking every interval until the context is done
+func (f *FileProvider) Watch(ctx context.Context, interval time.Duration) {
+	f.cache.watch(ctx, interval, f.Path, f.load)
+}
+
+func (f *FileProvider) keyringCache() *cache {
+	return &f.cache
+}
+
+func (f *FileProvider) load() (*Keyring, error) {
+	data, err := f.cache.readFile(f.Path)
+	if err != nil {
+		return nil, err
+	}
+	return parseKeyring(string(data))
+}
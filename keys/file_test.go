@@ -0,0 +1,107 @@
+package keys
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"tokenize/models"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileProvider(t *testing.T) {
+	tests := []struct {
+		name        string
+		contents    *string
+		id          string
+		wantCurrent *models.Key
+		wantByID    *models.Key
+		wantErr     error
+	}{
+		{
+			name:        "single key",
+			contents:    &testKeyEncoded,
+			id:          models.DefaultKeyID,
+			wantCurrent: &models.Key{ID: models.DefaultKeyID, Material: testKey},
+			wantByID:    &models.Key{ID: models.DefaultKeyID, Material: testKey},
+		},
+		{
+			name:        "rotated keys",
+			contents:    func() *string { s := "key-2:" + otherKeyEncoded + "\nkey-1:" + testKeyEncoded + "\n"; return &s }(),
+			id:          "key-1",
+			wantCurrent: &models.Key{ID: "key-2", Material: otherKey},
+			wantByID:    &models.Key{ID: "key-1", Material: testKey},
+		},
+		{
+			name:    "missing file",
+			wantErr: ErrNoKey,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "key")
+			if tt.contents != nil {
+				assert.NoError(t, os.WriteFile(path, []byte(*tt.contents), 0o600))
+			}
+			provider := &FileProvider{Path: path}
+
+			current, err := provider.CurrentKey(context.Background())
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				_, err = provider.KeyByID(context.Background(), tt.id)
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantCurrent, current)
+
+			byID, err := provider.KeyByID(context.Background(), tt.id)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantByID, byID)
+		})
+	}
+
+	t.Run("unreadable path", func(t *testing.T) {
+		provider := &FileProvider{Path: t.TempDir()}
+		_, err := provider.CurrentKey(context.Background())
+		assert.Error(t, err)
+	})
+}
+
+func TestFileProvider_Reload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key")
+	// every write is given a later modification time, so it is seen however coarse the file system's times are
+	modified := time.Now()
+	write := func(contents string) {
+		assert.NoError(t, os.WriteFile(path, []byte(contents), 0o600))
+		modified = modified.Add(time.Second)
+		assert.NoError(t, os.Chtimes(path, modified, modified))
+	}
+	current := func(provider models.KeyProvider) string {
+		key, err := provider.CurrentKey(context.Background())
+		assert.NoError(t, err)
+		return key.ID
+	}
+	write("key-1:" + testKeyEncoded)
+	provider := &FileProvider{Path: path}
+	assert.Equal(t, "key-1", current(provider))
+
+	write("key-2:" + otherKeyEncoded + "\nkey-1:" + testKeyEncoded)
+	assert.Equal(t, "key-1", current(provider), "the file is read once")
+	assert.NoError(t, Reload(Pinned{Provider: provider, ID: "key-1"}))
+	assert.Equal(t, "key-2", current(provider))
+
+	write("not a key")
+	assert.ErrorIs(t, provider.Reload(), ErrInvalidKey)
+	assert.Equal(t, "key-2", current(provider), "a reload that fails keeps the keyring")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go Watch(ctx, provider, time.Millisecond)
+	write("key-3:" + testKeyEncoded)
+	assert.Eventually(t, func() bool { return current(provider) == "key-3" }, time.Second, time.Millisecond,
+		"a modified file is reloaded")
+}
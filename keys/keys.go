@@ -0,0 +1,185 @@
+package keys
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"tokenize/models"
+)
+
+// KeySize is the length in bytes of the AES-256 keys handed out by the providers
+const KeySize = 32
+
+var (
+	ErrNoKey           = errors.New("no encryption key configured")
+	ErrInvalidKey      = errors.New("encryption key must be 32 bytes, base64 encoded")
+	ErrUnknownKey      = errors.New("encryption key not found in keyring")
+	ErrUnknownProvider = errors.New("unknown key provider")
+)
+
+// Config selects and configures the key provider used by the service
+type Config struct {
+	// Provider is one of "env", "file" or "kms"
+	Provider string `json:"provider"`
+	// EnvVar is the environment variable holding the keys for the env provider
+	EnvVar string `json:"env_var,omitempty"`
+	// Path is the key file for the file provider or the keystore for the kms provider
+	Path string `json:"path,omitempty"`
+	// KeyID pins the provider to one key of its keyring, which is used in place of the keyring's current key
+	KeyID string `json:"key_id,omitempty"`
+}
+
+// New builds the KeyProvider described by the config
+func New(cfg Config) (models.KeyProvider, error) {
+	provider, err := newProvider(cfg)
+	if err != nil || cfg.KeyID == "" {
+		return provider, err
+	}
+	return Pinned{Provider: provider, ID: cfg.KeyID}, nil
+}
+
+// newProvider builds the provider of the keyring described by the config
+func newProvider(cfg Config) (models.KeyProvider, error) {
+	switch cfg.Provider {
+	case "env":
+		if cfg.EnvVar == "" {
+			return nil, ErrNoKey
+		}
+		return &EnvProvider{Name: cfg.EnvVar}, nil
+	case "file":
+		if cfg.Path == "" {
+			return nil, ErrNoKey
+		}
+		return &FileProvider{Path: cfg.Path}, nil
+	case "kms":
+		if cfg.Path == "" {
+			return nil, ErrNoKey
+		}
+		return &LocalKMS{Path: cfg.Path}, nil
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownProvider, cfg.Provider)
+	}
+}
+
+// Keyring is a set of keys by ID, one of which is current
+type Keyring struct {
+	Current string
+	Keys    map[string][]byte
+}
+
+func (k *Keyring) CurrentKey(ctx context.Context) (*models.Key, error) {
+	if k.Current == "" {
+		return nil, ErrNoKey
+	}
+	return k.KeyByID(ctx, k.Current)
+}
+
+func (k *Keyring) KeyByID(_ context.Context, id string) (*models.Key, error) {
+	material, ok := k.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKey, id)
+	}
+	if len(material) != KeySize {
+		return nil, ErrInvalidKey
+	}
+	return &models.Key{ID: id, Material: material}, nil
+}
+
+// Pinned is a KeyProvider whose current key is always the key with the ID, whatever the current key of its keyring is.
+// It is meant for keys that cannot change without changing everything made with them, like the tokenization keys
+// deterministic tokens are derived with.
+type Pinned struct {
+	Provider models.KeyProvider
+	ID       string
+}
+
+func (p Pinned) CurrentKey(ctx context.Context) (*models.Key, error) {
+	return p.Provider.KeyByID(ctx, p.ID)
+}
+
+func (p Pinned) KeyByID(ctx context.Context, id string) (*models.Key, error) {
+	return p.Provider.KeyByID(ctx, id)
+}
+
+// Static is a KeyProvider with a single key, stored under the default key ID. It is mostly useful for tests.
+type Static []byte
+
+func (s Static) CurrentKey(ctx context.Context) (*models.Key, error) {
+	return s.KeyByID(ctx, models.DefaultKeyID)
+}
+
+func (s Static) KeyByID(ctx context.Context, id string) (*models.Key, error) {
+	if len(s) == 0 {
+		return nil, ErrNoKey
+	}
+	return (&Keyring{Current: models.DefaultKeyID, Keys: map[string][]byte{models.DefaultKeyID: s}}).KeyByID(ctx, id)
+}
+
+// parseKeyring reads a keyring from a list of keys separated by commas or newlines. Each key is either a bare base64
+// key, which gets the default key ID, or "id:base64". The first key in the list is the current key.
+func parseKeyring(text string) (*Keyring, error) {
+	ring := &Keyring{Keys: map[string][]byte{}}
+	entries := strings.FieldsFunc(text, func(r rune) bool {
+		return r == ',' || r == '\n'
+	})
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, encoded, found := strings.Cut(entry, ":")
+		if !found {
+			id, encoded = models.DefaultKeyID, entry
+		}
+		key, err := decodeKey(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", id, err)
+		}
+		if _, dup := ring.Keys[id]; dup {
+			return nil, fmt.Errorf("duplicate key ID %q", id)
+		}
+		if ring.Current == "" {
+			ring.Current = id
+		}
+		ring.Keys[id] = key
+	}
+	if ring.Current == "" {
+		return nil, ErrNoKey
+	}
+	if err := ring.check(); err != nil {
+		return nil, err
+	}
+	return ring, nil
+}
+
+// check checks that no two keys of the keyring have the same key material, a key is only ever known by one ID
+func (k *Keyring) check() error {
+	seen := map[string]string{}
+	for id, material := range k.Keys {
+		if other, dup := seen[string(material)]; dup {
+			first, second := min(id, other), max(id, other)
+			return fmt.Errorf("keys %q and %q are the same key", first, second)
+		}
+		seen[string(material)] = id
+	}
+	return nil
+}
+
+// decodeKey decodes a base64 encoded key and checks that it is the right size
+func decodeKey(encoded string) ([]byte, error) {
+	encoded = strings.TrimSpace(encoded)
+	if encoded == "" {
+		return nil, ErrNoKey
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrInvalidKey
+	}
+	if len(key) != KeySize {
+		return nil, ErrInvalidKey
+	}
+	return key, nil
+}
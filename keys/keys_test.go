@@ -0,0 +1,284 @@
+package keys
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+
+	"tokenize/models"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	testKey         = []byte("this is the secret key and stuff")
+	testKeyEncoded  = base64.StdEncoding.EncodeToString(testKey)
+	otherKey        = []byte("this is a different key material")
+	otherKeyEncoded = base64.StdEncoding.EncodeToString(otherKey)
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		want    any
+		wantErr error
+	}{
+		{
+			name: "env provider",
+			cfg:  Config{Provider: "env", EnvVar: "TOKENIZE_KEY"},
+			want: &EnvProvider{Name: "TOKENIZE_KEY"},
+		},
+		{
+			name: "file provider",
+			cfg:  Config{Provider: "file", Path: "/etc/tokenize/key"},
+			want: &FileProvider{Path: "/etc/tokenize/key"},
+		},
+		{
+			name: "kms provider",
+			cfg:  Config{Provider: "kms", Path: "/etc/tokenize/keystore.json"},
+			want: &LocalKMS{Path: "/etc/tokenize/keystore.json"},
+		},
+		{
+			name: "pinned provider",
+			cfg:  Config{Provider: "env", EnvVar: "TOKENIZE_TOKEN_KEY", KeyID: "key-1"},
+			want: Pinned{Provider: &EnvProvider{Name: "TOKENIZE_TOKEN_KEY"}, ID: "key-1"},
+		},
+		{
+			name:    "env provider without variable",
+			cfg:     Config{Provider: "env"},
+			wantErr: ErrNoKey,
+		},
+		{
+			name:    "file provider without path",
+			cfg:     Config{Provider: "file"},
+			wantErr: ErrNoKey,
+		},
+		{
+			name:    "kms provider without path",
+			cfg:     Config{Provider: "kms"},
+			wantErr: ErrNoKey,
+		},
+		{
+			name:    "unknown provider",
+			cfg:     Config{Provider: "vault"},
+			wantErr: ErrUnknownProvider,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := New(tt.cfg)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestKeyring(t *testing.T) {
+	tests := []struct {
+		name        string
+		ring        *Keyring
+		id          string
+		wantCurrent *models.Key
+		wantByID    *models.Key
+		wantErr     error
+	}{
+		{
+			name:        "current and retired keys",
+			ring:        &Keyring{Current: "key-2", Keys: map[string][]byte{"key-1": testKey, "key-2": otherKey}},
+			id:          "key-1",
+			wantCurrent: &models.Key{ID: "key-2", Material: otherKey},
+			wantByID:    &models.Key{ID: "key-1", Material: testKey},
+		},
+		{
+			name:    "unknown key",
+			ring:    &Keyring{Current: "key-1", Keys: map[string][]byte{"key-1": testKey}},
+			id:      "key-9",
+			wantErr: ErrUnknownKey,
+		},
+		{
+			name:    "invalid key material",
+			ring:    &Keyring{Current: "key-1", Keys: map[string][]byte{"key-1": []byte("short")}},
+			id:      "key-1",
+			wantErr: ErrInvalidKey,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			current, err := tt.ring.CurrentKey(context.Background())
+			if tt.wantCurrent != nil {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.wantCurrent, current)
+			}
+			byID, err := tt.ring.KeyByID(context.Background(), tt.id)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantByID, byID)
+		})
+	}
+}
+
+func TestKeyring_NoCurrentKey(t *testing.T) {
+	ring := &Keyring{Keys: map[string][]byte{"key-1": testKey}}
+	_, err := ring.CurrentKey(context.Background())
+	assert.ErrorIs(t, err, ErrNoKey)
+}
+
+func TestStatic(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     Static
+		wantErr error
+	}{
+		{
+			name: "valid key",
+			key:  Static(testKey),
+		},
+		{
+			name:    "empty key",
+			key:     Static(nil),
+			wantErr: ErrNoKey,
+		},
+		{
+			name:    "short key",
+			key:     Static("short"),
+			wantErr: ErrInvalidKey,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.key.CurrentKey(context.Background())
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, &models.Key{ID: models.DefaultKeyID, Material: testKey}, got)
+
+			_, err = tt.key.KeyByID(context.Background(), "key-1")
+			assert.ErrorIs(t, err, ErrUnknownKey)
+		})
+	}
+}
+
+func TestPinned(t *testing.T) {
+	ring := &Keyring{Current: "key-2", Keys: map[string][]byte{"key-1": testKey, "key-2": otherKey}}
+	pinned := Pinned{Provider: ring, ID: "key-1"}
+
+	got, err := pinned.CurrentKey(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, &models.Key{ID: "key-1", Material: testKey}, got, "a pinned provider ignores the current key of its keyring")
+	got, err = pinned.KeyByID(context.Background(), "key-2")
+	assert.NoError(t, err)
+	assert.Equal(t, otherKey, got.Material)
+
+	_, err = Pinned{Provider: ring, ID: "key-3"}.CurrentKey(context.Background())
+	assert.ErrorIs(t, err, ErrUnknownKey)
+}
+
+func TestParseKeyring(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		want    *Keyring
+		wantErr error
+	}{
+		{
+			name: "single bare key",
+			text: testKeyEncoded,
+			want: &Keyring{Current: models.DefaultKeyID, Keys: map[string][]byte{models.DefaultKeyID: testKey}},
+		},
+		{
+			name: "comma separated keys",
+			text: "key-2:" + otherKeyEncoded + ",key-1:" + testKeyEncoded,
+			want: &Keyring{Current: "key-2", Keys: map[string][]byte{"key-1": testKey, "key-2": otherKey}},
+		},
+		{
+			name: "one key per line",
+			text: "key-2:" + otherKeyEncoded + "\n\n" + testKeyEncoded + "\n",
+			want: &Keyring{Current: "key-2", Keys: map[string][]byte{models.DefaultKeyID: testKey, "key-2": otherKey}},
+		},
+		{
+			name:    "empty",
+			text:    " \n",
+			wantErr: ErrNoKey,
+		},
+		{
+			name:    "invalid key",
+			text:    "key-1:c2hvcnQ=",
+			wantErr: ErrInvalidKey,
+		},
+		{
+			name: "duplicate key ID",
+			text: "key-1:" + testKeyEncoded + ",key-1:" + otherKeyEncoded,
+		},
+		{
+			name: "same key under two IDs",
+			text: "key-2:" + testKeyEncoded + ",key-1:" + testKeyEncoded,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseKeyring(tt.text)
+			if tt.want == nil {
+				assert.Error(t, err)
+				if tt.wantErr != nil {
+					assert.ErrorIs(t, err, tt.wantErr)
+				}
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestDecodeKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		encoded string
+		wantErr error
+	}{
+		{
+			name:    "valid key",
+			encoded: testKeyEncoded,
+		},
+		{
+			name:    "surrounding whitespace",
+			encoded: "  " + testKeyEncoded + "\n",
+		},
+		{
+			name:    "empty",
+			encoded: "",
+			wantErr: ErrNoKey,
+		},
+		{
+			name:    "not base64",
+			encoded: "not base64!",
+			wantErr: ErrInvalidKey,
+		},
+		{
+			name:    "wrong size",
+			encoded: base64.StdEncoding.EncodeToString([]byte("short")),
+			wantErr: ErrInvalidKey,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeKey(tt.encoded)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, testKey, got)
+		})
+	}
+}
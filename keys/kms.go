@@ -0,0 +1,120 @@
+package keys
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"tokenize/models"
+)
+
+// LocalKMS is a stand-in for a key management service, backed by a JSON keystore on disk. Retired keys stay in the
+// keystore so payloads sealed with them can still be opened until they are rotated. The keystore is read once and
+// kept, and read again on Reload or by Watch when it changes.
+//
+//	{
+//	  "current": "key-2",
+//	  "keys": {
+//	    "key-1": "<base64 key>",
+//	    "key-2": "<base64 key>"
+//	  }
+//	}
+type LocalKMS struct {
+	Path string
+
+	cache cache
+}
+
+type keystore struct {
+	Current string       `json:"current"`
+	Keys    keystoreKeys `json:"keys"`
+}
+
+// keystoreKeys are the keys of a keystore by ID, an ID that is in the keystore twice is rejected rather than the last
+// one winning
+type keystoreKeys map[string]string
+
+func (k *keystoreKeys) UnmarshalJSON(data []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return errors.New("keys must be an object")
+	}
+	keys := keystoreKeys{}
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		id := token.(string)
+		var encoded string
+		if err := decoder.Decode(&encoded); err != nil {
+			return fmt.Errorf("key %q: %w", id, err)
+		}
+		if _, dup := keys[id]; dup {
+			return fmt.Errorf("duplicate key ID %q", id)
+		}
+		keys[id] = encoded
+	}
+	*k = keys
+	return nil
+}
+
+func (l *LocalKMS) CurrentKey(ctx context.Context) (*models.Key, error) {
+	ring, err := l.cache.keyring(l.load)
+	if err != nil {
+		return nil, err
+	}
+	return ring.CurrentKey(ctx)
+}
+
+func (l *LocalKMS) KeyByID(ctx context.Context, id string) (*models.Key, error) {
+	ring, err := l.cache.keyring(l.load)
+	if err != nil {
+		return nil, err
+	}
+	return ring.KeyByID(ctx, id)
+}
+
+// Reload reads the keystore again
+func (l *LocalKMS) Reload() error {
+	return l.cache.reload(l.load)
+}
+
+// Watch reloads the keystore every time it is modified, checking every interval until the context is done
+func (l *LocalKMS) Watch(ctx context.Context, interval time.Duration) {
+	l.cache.watch(ctx, interval, l.Path, l.load)
+}
+
+func (l *LocalKMS) keyringCache() *cache {
+	return &l.cache
+}
+
+func (l *LocalKMS) load() (*Keyring, error) {
+	data, err := l.cache.readFile(l.Path)
+	if err != nil {
+		return nil, err
+	}
+	store := &keystore{}
+	if err := json.Unmarshal(data, store); err != nil {
+		return nil, err
+	}
+	if _, ok := store.Keys[store.Current]; !ok {
+		return nil, fmt.Errorf("%w: current key %q is not in the keystore", ErrNoKey, store.Current)
+	}
+
+	ring := &Keyring{Current: store.Current, Keys: make(map[string][]byte, len(store.Keys))}
+	for id, encoded := range store.Keys {
+		key, err := decodeKey(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", id, err)
+		}
+		ring.Keys[id] = key
+	}
+	if err := ring.check(); err != nil {
+		return nil, err
+	}
+	return ring, nil
+}
@@ -0,0 +1,123 @@
+package keys
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"tokenize/models"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalKMS(t *testing.T) {
+	tests := []struct {
+		name        string
+		keystore    string
+		id          string
+		wantCurrent *models.Key
+		wantByID    *models.Key
+		wantErr     error
+	}{
+		{
+			name:        "current and retired keys",
+			keystore:    `{"current": "key-2", "keys": {"key-1": "` + testKeyEncoded + `", "key-2": "` + otherKeyEncoded + `"}}`,
+			id:          "key-1",
+			wantCurrent: &models.Key{ID: "key-2", Material: otherKey},
+			wantByID:    &models.Key{ID: "key-1", Material: testKey},
+		},
+		{
+			name:     "current key missing",
+			keystore: `{"current": "key-3", "keys": {"key-1": "` + testKeyEncoded + `"}}`,
+			wantErr:  ErrNoKey,
+		},
+		{
+			name:     "invalid key material",
+			keystore: `{"current": "key-1", "keys": {"key-1": "c2hvcnQ="}}`,
+			wantErr:  ErrInvalidKey,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "keystore.json")
+			assert.NoError(t, os.WriteFile(path, []byte(tt.keystore), 0o600))
+			kms := &LocalKMS{Path: path}
+
+			current, err := kms.CurrentKey(context.Background())
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				_, err = kms.KeyByID(context.Background(), tt.id)
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantCurrent, current)
+
+			byID, err := kms.KeyByID(context.Background(), tt.id)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantByID, byID)
+		})
+	}
+
+	t.Run("missing keystore", func(t *testing.T) {
+		kms := &LocalKMS{Path: filepath.Join(t.TempDir(), "missing.json")}
+		_, err := kms.CurrentKey(context.Background())
+		assert.ErrorIs(t, err, ErrNoKey)
+	})
+
+	t.Run("reload", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "keystore.json")
+		keystore := `{"current": "%s", "keys": {"key-1": "` + testKeyEncoded + `", "key-2": "` + otherKeyEncoded + `"}}`
+		assert.NoError(t, os.WriteFile(path, []byte(fmt.Sprintf(keystore, "key-1")), 0o600))
+		kms := &LocalKMS{Path: path}
+		current, err := kms.CurrentKey(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, "key-1", current.ID)
+
+		assert.NoError(t, os.WriteFile(path, []byte(fmt.Sprintf(keystore, "key-2")), 0o600))
+		current, err = kms.CurrentKey(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, "key-1", current.ID, "the keystore is read once")
+		assert.NoError(t, kms.Reload())
+		current, err = kms.CurrentKey(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, "key-2", current.ID)
+	})
+
+	t.Run("malformed keystore", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "keystore.json")
+		assert.NoError(t, os.WriteFile(path, []byte("{"), 0o600))
+		kms := &LocalKMS{Path: path}
+		_, err := kms.CurrentKey(context.Background())
+		assert.Error(t, err)
+	})
+}
+
+func TestLocalKMS_DuplicateKeys(t *testing.T) {
+	tests := []struct {
+		name     string
+		keystore string
+		wantErr  string
+	}{
+		{
+			name:     "duplicate key ID",
+			keystore: `{"current": "key-1", "keys": {"key-1": "` + testKeyEncoded + `", "key-1": "` + otherKeyEncoded + `"}}`,
+			wantErr:  `duplicate key ID "key-1"`,
+		},
+		{
+			name:     "same key under two IDs",
+			keystore: `{"current": "key-1", "keys": {"key-1": "` + testKeyEncoded + `", "key-2": "` + testKeyEncoded + `"}}`,
+			wantErr:  `keys "key-1" and "key-2" are the same key`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "keystore.json")
+			assert.NoError(t, os.WriteFile(path, []byte(tt.keystore), 0o600))
+			_, err := (&LocalKMS{Path: path}).CurrentKey(context.Background())
+			assert.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
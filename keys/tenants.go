@@ -0,0 +1,91 @@
+package keys
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+
+	"tokenize/models"
+)
+
+// TenantConfig configures the keys of a tenant
+type TenantConfig struct {
+	Keys      Config `json:"keys"`
+	TokenKeys Config `json:"token_keys"`
+}
+
+// Tenants holds the keys of every tenant
+type Tenants map[string]models.TenantKeys
+
+func (t Tenants) TenantKeys(tenant string) (models.TenantKeys, error) {
+	keys, ok := t[tenant]
+	if !ok {
+		return models.TenantKeys{}, fmt.Errorf("%w: %q", models.ErrUnknownTenant, tenant)
+	}
+	return keys, nil
+}
+
+// LoadTenants reads the key configuration of every tenant from a JSON file:
+//
+//	{
+//	  "payments": {
+//	    "keys": {"provider": "kms", "path": "/keys/payments.json"},
+//	    "token_keys": {"provider": "file", "path": "/keys/payments-token"}
+//	  }
+//	}
+func LoadTenants(path string) (Tenants, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	configs := map[string]TenantConfig{}
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("tenant keys: %w", err)
+	}
+	return NewTenants(configs)
+}
+
+// NewTenants builds the key providers of every tenant
+func NewTenants(configs map[string]TenantConfig) (Tenants, error) {
+	tenants := Tenants{}
+	for tenant, cfg := range configs {
+		if tenant == "" || !models.ValidTenant(tenant) {
+			return nil, fmt.Errorf("invalid tenant %q", tenant)
+		}
+		keys, err := New(cfg.Keys)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %q: %w", tenant, err)
+		}
+		// like the default tokenization keys, a tenant's are pinned so adding a key to its keyring keeps its tokens
+		if cfg.TokenKeys.KeyID == "" {
+			cfg.TokenKeys.KeyID = models.DefaultKeyID
+		}
+		tokenKeys, err := New(cfg.TokenKeys)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %q tokenization key: %w", tenant, err)
+		}
+		tenants[tenant] = models.TenantKeys{Keys: keys, TokenKeys: tokenKeys}
+	}
+	return tenants, nil
+}
+
+// Validate checks every tenant has usable keys, and that no key is shared between tenants, the default keys, or a
+// tenant's own encryption and tokenization keys
+func (t Tenants) Validate(ctx context.Context, defaults models.TenantKeys) error {
+	return t.Distinct(defaults).Validate(ctx)
+}
+
+// Distinct returns the set of the default keys and the keys of every tenant, which must all be different
+func (t Tenants) Distinct(defaults models.TenantKeys) *Distinct {
+	distinct := &Distinct{}
+	distinct.Add("the encryption key", defaults.Keys)
+	distinct.Add("the tokenization key", defaults.TokenKeys)
+	for _, tenant := range slices.Sorted(maps.Keys(t)) {
+		distinct.Add(fmt.Sprintf("the encryption key of tenant %q", tenant), t[tenant].Keys)
+		distinct.Add(fmt.Sprintf("the tokenization key of tenant %q", tenant), t[tenant].TokenKeys)
+	}
+	return distinct
+}
@@ -0,0 +1,115 @@
+package keys
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"tokenize/models"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadTenants(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		wantErr  bool
+	}{
+		{
+			name:     "env and file providers",
+			contents: `{"payments": {"keys": {"provider": "env", "env_var": "PAYMENTS_KEY"}, "token_keys": {"provider": "file", "path": "/keys/payments-token"}}}`,
+		},
+		{
+			name:     "invalid json",
+			contents: `{"payments": `,
+			wantErr:  true,
+		},
+		{
+			name:     "invalid tenant",
+			contents: `{"Pay#ments": {"keys": {"provider": "env", "env_var": "KEY"}, "token_keys": {"provider": "env", "env_var": "TOKEN_KEY"}}}`,
+			wantErr:  true,
+		},
+		{
+			name:     "missing token keys",
+			contents: `{"payments": {"keys": {"provider": "env", "env_var": "KEY"}}}`,
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "tenants.json")
+			assert.NoError(t, os.WriteFile(path, []byte(tt.contents), 0o600))
+
+			tenants, err := LoadTenants(path)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			keys, err := tenants.TenantKeys("payments")
+			assert.NoError(t, err)
+			assert.Equal(t, &EnvProvider{Name: "PAYMENTS_KEY"}, keys.Keys)
+			assert.Equal(t, Pinned{Provider: &FileProvider{Path: "/keys/payments-token"}, ID: models.DefaultKeyID}, keys.TokenKeys,
+				"tokenization keys are pinned to the default key unless the tenant picks one")
+
+			_, err = tenants.TenantKeys("shipping")
+			assert.ErrorIs(t, err, models.ErrUnknownTenant)
+		})
+	}
+}
+
+func TestTenants_Validate(t *testing.T) {
+	thirdKey := []byte("yet another key material, 32 by!")
+	fourthKey := []byte("and the key of the last tenant!!")
+	defaults := models.TenantKeys{Keys: Static(testKey), TokenKeys: Static(otherKey)}
+
+	tests := []struct {
+		name    string
+		tenants Tenants
+		wantErr bool
+	}{
+		{
+			name:    "no tenants",
+			tenants: Tenants{},
+		},
+		{
+			name:    "distinct keys",
+			tenants: Tenants{"payments": {Keys: Static(thirdKey), TokenKeys: Static(fourthKey)}},
+		},
+		{
+			name:    "shares the default key",
+			tenants: Tenants{"payments": {Keys: Static(testKey), TokenKeys: Static(fourthKey)}},
+			wantErr: true,
+		},
+		{
+			name:    "same encryption and tokenization key",
+			tenants: Tenants{"payments": {Keys: Static(thirdKey), TokenKeys: Static(thirdKey)}},
+			wantErr: true,
+		},
+		{
+			name: "shared between tenants",
+			tenants: Tenants{
+				"payments": {Keys: Static(thirdKey), TokenKeys: Static(fourthKey)},
+				"shipping": {Keys: Static(fourthKey), TokenKeys: Static(thirdKey)},
+			},
+			wantErr: true,
+		},
+		{
+			name:    "missing key",
+			tenants: Tenants{"payments": {Keys: Static(nil), TokenKeys: Static(fourthKey)}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.tenants.Validate(context.Background(), defaults)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+)
+
+// apiKeyPrefix starts every API key so they are easy to recognize, for example by secret scanners
+const apiKeyPrefix = "tk_"
+
+// APIKey is an API key a caller can authenticate with. Only the hash of the key is stored.
+type APIKey struct {
+	ID      string `json:"id" dynamodbav:"id"`
+	KeyHash string `json:"-" dynamodbav:"key_hash"`
+	Name    string `json:"name" dynamodbav:"name"`
+	// Tenant is the tenant the key's caller belongs to, empty for callers that are not in a tenant
+	Tenant    string    `json:"tenant,omitempty" dynamodbav:"tenant,omitempty"`
+	Roles     []string  `json:"roles" dynamodbav:"roles"`
+	CreatedAt time.Time `json:"createdAt" dynamodbav:"createdAt"`
+	Revoked   bool      `json:"revoked,omitempty" dynamodbav:"revoked,omitempty"`
+}
+
+// NewAPIKey generates a new API key, returning the key to hand to the caller along with the APIKey to store
+func NewAPIKey(name string, roles []string) (string, *APIKey, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, err
+	}
+	base, err := NewBaseModel()
+	if err != nil {
+		return "", nil, err
+	}
+
+	key := apiKeyPrefix + base64.RawURLEncoding.EncodeToString(secret)
+	return key, &APIKey{
+		ID:        base.Id.String(),
+		KeyHash:   HashAPIKey(key),
+		Name:      name,
+		Roles:     roles,
+		CreatedAt: base.CreatedAt,
+	}, nil
+}
+
+// HashAPIKey is the hash an API key is stored and looked up by. API keys are random, so a fast hash is enough.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,24 @@
+package models
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewAPIKey(t *testing.T) {
+	key, apiKey, err := NewAPIKey("ci", []string{"tokenizer"})
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(key, "tk_"))
+	assert.Len(t, key, len("tk_")+43, "32 random bytes, base64 encoded")
+	assert.Equal(t, HashAPIKey(key), apiKey.KeyHash)
+	assert.NotContains(t, apiKey.KeyHash, key[3:], "only the hash of the key is stored")
+	assert.NotEmpty(t, apiKey.ID)
+	assert.Equal(t, "ci", apiKey.Name)
+	assert.Equal(t, []string{"tokenizer"}, apiKey.Roles)
+
+	other, _, err := NewAPIKey("ci", nil)
+	assert.NoError(t, err)
+	assert.NotEqual(t, key, other)
+}
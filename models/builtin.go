@@ -0,0 +1,110 @@
+package models
+
+import (
+	"maps"
+)
+
+// builtinType is a token type the service knows the payloads of. Its payloads are checked and normalized before they
+// are tokenized, so the same value always gets the same token, and metadata is derived from them.
+type builtinType struct {
+	// normalize checks the payload and returns its normal form, the payload is kept as it is when nil
+	normalize func(payload string) (string, error)
+	// metadata derives attributes from the normalized payload, which replace any the client sends
+	metadata func(payload string) (map[string]any, error)
+	// keys are the attributes metadata derives
+	keys []string
+	// masked shows the payload with its sensitive parts hidden, as the masked reveal policy of the type
+	masked func(payload string) string
+}
+
+// builtinTypes are the built-in token types by name
+var builtinTypes = map[string]builtinType{
+	cardTokenType: {
+		metadata: cardMetadata,
+		keys:     []string{MetadataBIN, MetadataBIN8, MetadataLast4, MetadataBrand, MetadataExpiry},
+	},
+	// the last four digits of an SSN are used to prove identity, so nothing is derived from it
+	ssnTokenType: {
+		normalize: normalizeSSN,
+		masked:    maskSSN,
+	},
+	bankAccountTokenType: {
+		normalize: normalizeBankAccount,
+		metadata:  bankAccountMetadata,
+		keys:      []string{MetadataRoutingNumber, MetadataLast4},
+		masked:    maskBankAccount,
+	},
+	emailTokenType: {
+		normalize: normalizeEmail,
+		metadata:  emailMetadata,
+		keys:      []string{MetadataDomain},
+		masked:    maskEmail,
+	},
+	phoneTokenType: {
+		normalize: normalizePhone,
+		metadata:  phoneMetadata,
+		keys:      []string{MetadataCountryCode},
+		masked:    maskPhone,
+	},
+}
+
+// Normalize checks the payload of a built-in token type, replaces it with its normal form and sets the metadata
+// derived from it, replacing any values the client sent for those attributes. Other token types are left as they are.
+func (c *CreateToken) Normalize() error {
+	builtin, ok := builtinTypes[c.TokenType]
+	if !ok {
+		return nil
+	}
+	if builtin.normalize != nil {
+		payload, err := builtin.normalize(c.Payload)
+		if err != nil {
+			return err
+		}
+		c.Payload = payload
+	}
+	if builtin.metadata == nil {
+		return nil
+	}
+	derived, err := builtin.metadata(c.Payload)
+	if err != nil {
+		return err
+	}
+
+	// the metadata is copied, the client's map can be shared between tokens
+	metadata := maps.Clone(c.Metadata)
+	if metadata == nil {
+		metadata = map[string]any{}
+	}
+	for _, key := range builtin.keys {
+		delete(metadata, key)
+	}
+	maps.Copy(metadata, derived)
+	c.Metadata = metadata
+	return nil
+}
+
+// KeepDerivedMetadata returns new metadata for the token with the attributes derived from its payload kept as they
+// are, so an update cannot change them
+func (t *Token) KeepDerivedMetadata(metadata map[string]any) map[string]any {
+	builtin, ok := builtinTypes[t.TokenType]
+	if !ok || metadata == nil || len(builtin.keys) == 0 {
+		return metadata
+	}
+	kept := maps.Clone(metadata)
+	for _, key := range builtin.keys {
+		delete(kept, key)
+		if value, ok := t.Metadata[key]; ok {
+			kept[key] = value
+		}
+	}
+	return kept
+}
+
+// builtinReveal returns the masked reveal policy of a built-in token type
+func builtinReveal(tokenType string, name string) (*RevealPolicy, bool) {
+	builtin, ok := builtinTypes[tokenType]
+	if !ok || builtin.masked == nil || name != string(RevealMasked) {
+		return nil, false
+	}
+	return &RevealPolicy{Kind: RevealMasked, mask: builtin.masked}, true
+}
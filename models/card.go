@@ -0,0 +1,200 @@
+package models
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"tokenize/fpe"
+)
+
+// FormatOptions asks for a format-preserving card token and says which digits of the card number to keep as they are
+type FormatOptions struct {
+	PreserveBIN   bool `json:"preserve_bin,omitempty" dynamodbav:"preserve_bin,omitempty" doc:"Keep the first six digits"`
+	PreserveLast4 bool `json:"preserve_last4,omitempty" dynamodbav:"preserve_last4,omitempty" doc:"Keep the last four digits"`
+}
+
+// label is the options as they are put into the FF1 tweak, the same for a missing and an empty format
+func (o FormatOptions) label() string {
+	return fmt.Sprintf("preserve_bin=%t,preserve_last4=%t", o.PreserveBIN, o.PreserveLast4)
+}
+
+const (
+	// binLength and last4Length are the digits kept by FormatOptions
+	binLength   = 6
+	last4Length = 4
+	// minCardLength and maxCardLength are the lengths of card numbers under ISO/IEC 7812
+	minCardLength = 12
+	maxCardLength = 19
+	// minEncryptedDigits is the fewest digits FF1 can encrypt in radix 10
+	minEncryptedDigits = 6
+	// cardKeyLabel derives the FF1 key from the tokenization key so the same key material is not used by two algorithms
+	cardKeyLabel = "tokenize card ff1"
+)
+
+var (
+	ErrInvalidCardNumber = errors.New("payload does not contain a valid card number")
+	ErrCardTooShort      = errors.New("card number is too short to tokenize with the digits it preserves")
+)
+
+// cardNumberFields are the payload fields a card number is read from when the payload is a JSON object
+var cardNumberFields = []string{"card_number", "pan", "number"}
+
+// cardNumber finds the card number in a payload, which is either the number on its own, optionally with spaces or
+// dashes between the digits, or a JSON object with the number in one of the cardNumberFields
+func cardNumber(payload string) (string, error) {
+	var fields map[string]any
+	if err := json.Unmarshal([]byte(payload), &fields); err == nil {
+		payload = ""
+		for _, name := range cardNumberFields {
+			if value, ok := fields[name].(string); ok {
+				payload = value
+				break
+			}
+		}
+	}
+
+	digits := strings.Map(func(r rune) rune {
+		if r == ' ' || r == '-' {
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(payload))
+	if len(digits) < minCardLength || len(digits) > maxCardLength || !isDigits(digits) || !luhnValid(digits) {
+		return "", ErrInvalidCardNumber
+	}
+	return digits, nil
+}
+
+// cardToken creates a token that looks like a card number: the same length, all digits and passing the Luhn check.
+// The digits that are not preserved are encrypted with FF1, tweaked with the token type, the format options and the
+// preserved digits, so the same card number gets a different token for every type and format.
+func cardToken(key []byte, tokenType string, pan string, options FormatOptions) (string, error) {
+	var prefix, suffix string
+	if options.PreserveBIN {
+		prefix = pan[:binLength]
+	}
+	if options.PreserveLast4 {
+		suffix = pan[len(pan)-last4Length:]
+	}
+
+	// without the last four digits the check digit is recomputed for the token rather than encrypted
+	body := pan[len(prefix) : len(pan)-len(suffix)]
+	if suffix == "" {
+		body = body[:len(body)-1]
+	}
+	if len(body) < minEncryptedDigits {
+		return "", ErrCardTooShort
+	}
+
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(cardKeyLabel))
+	ff1, err := fpe.NewFF1(h.Sum(nil), 10)
+	if err != nil {
+		return "", err
+	}
+	tweak := lengthPrefixed(tokenType, options.label(), prefix, suffix)
+
+	encrypted, err := ff1.Encrypt(tweak, body)
+	if err != nil {
+		return "", err
+	}
+	if suffix == "" {
+		token := prefix + encrypted
+		token += luhnCheckDigit(token)
+		if token == pan {
+			return "", ErrCardTooShort
+		}
+		return token, nil
+	}
+
+	// the last four digits include the check digit, so walk the FF1 cycle until the token passes the Luhn check. The
+	// cycle always comes back to the card number itself, which is the only way this loop ends without a token.
+	for encrypted != body {
+		if token := prefix + encrypted + suffix; luhnValid(token) {
+			return token, nil
+		}
+		if encrypted, err = ff1.Encrypt(tweak, encrypted); err != nil {
+			return "", err
+		}
+	}
+	return "", ErrCardTooShort
+}
+
+// luhnCheckDigit is the digit that makes number followed by it pass the Luhn check
+func luhnCheckDigit(number string) string {
+	sum := luhnSum(number, true)
+	return string(rune('0' + (10-sum%10)%10))
+}
+
+// luhnValid reports whether a number, including its check digit, passes the Luhn check
+func luhnValid(number string) bool {
+	return luhnSum(number, false)%10 == 0
+}
+
+// luhnSum adds up the digits of number, doubling every second digit from the right. double says whether the
+// rightmost digit is doubled, which is the case when the check digit is not part of number yet.
+func luhnSum(number string, double bool) int {
+	sum := 0
+	for i := len(number) - 1; i >= 0; i-- {
+		digit := int(number[i] - '0')
+		if double {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+		double = !double
+	}
+	return sum
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// tokenizeCard creates a TokenModeCard token value from the card number in the payload
+func (t *Token) tokenizeCard(ctx context.Context, keys KeyProvider) error {
+	pan, err := cardNumber(t.Payload)
+	if err != nil {
+		return err
+	}
+	key, err := keys.CurrentKey(ctx)
+	if err != nil {
+		return err
+	}
+
+	if t.Token, err = cardToken(key.Material, t.TokenType, pan, t.formatOptions()); err != nil {
+		return err
+	}
+	t.TokenKeyID = key.ID
+	return nil
+}
+
+// formatOptions are the format options of the token, the zero options when it has none
+func (t *Token) formatOptions() FormatOptions {
+	if t.Format == nil {
+		return FormatOptions{}
+	}
+	return *t.Format
+}
+
+// CheckReuse checks that a stored token with the same deterministic value as t was made for the same token type and
+// format, so it can be returned in place of t. Any other stored token fails with ErrTokenConflict, it must not be
+// handed to a caller who asked for another type.
+func (t *Token) CheckReuse(stored *Token) error {
+	if stored.TokenType != t.TokenType || stored.formatOptions() != t.formatOptions() {
+		return ErrTokenConflict
+	}
+	return nil
+}
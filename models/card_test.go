@@ -0,0 +1,136 @@
+package models
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCardNumber(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		want    string
+		wantErr error
+	}{
+		{"plain digits", "4111111111111111", "4111111111111111", nil},
+		{"spaces and dashes", " 4111 1111-1111 1111 ", "4111111111111111", nil},
+		{"json card_number", `{"card_number": "5500000000000004", "exp": "0128"}`, "5500000000000004", nil},
+		{"json pan", `{"pan": "378282246310005"}`, "378282246310005", nil},
+		{"json without a card number", `{"name": "test"}`, "", ErrInvalidCardNumber},
+		{"fails the luhn check", "4111111111111112", "", ErrInvalidCardNumber},
+		{"too short", "42424242424", "", ErrInvalidCardNumber},
+		{"too long", "42424242424242424242", "", ErrInvalidCardNumber},
+		{"not digits", "this is the payload", "", ErrInvalidCardNumber},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := cardNumber(tt.payload)
+			assert.ErrorIs(t, err, tt.wantErr)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestCardToken(t *testing.T) {
+	key := []byte("this is the tokenization key....")
+	tests := []struct {
+		name    string
+		pan     string
+		options FormatOptions
+		wantErr error
+	}{
+		{"nothing preserved", "4111111111111111", FormatOptions{}, nil},
+		{"bin preserved", "4111111111111111", FormatOptions{PreserveBIN: true}, nil},
+		{"last4 preserved", "4111111111111111", FormatOptions{PreserveLast4: true}, nil},
+		{"bin and last4 preserved", "4111111111111111", FormatOptions{PreserveBIN: true, PreserveLast4: true}, nil},
+		{"amex", "378282246310005", FormatOptions{PreserveLast4: true}, nil},
+		{"19 digits", "4000000000000000006", FormatOptions{PreserveBIN: true, PreserveLast4: true}, nil},
+		{"amex is too short for bin and last4", "378282246310005", FormatOptions{PreserveBIN: true, PreserveLast4: true}, ErrCardTooShort},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := cardToken(key, "card", tt.pan, tt.options)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Len(t, got, len(tt.pan))
+			assert.True(t, isDigits(got))
+			assert.True(t, luhnValid(got), "token should pass the luhn check")
+			assert.NotEqual(t, tt.pan, got)
+			if tt.options.PreserveBIN {
+				assert.Equal(t, tt.pan[:6], got[:6])
+			}
+			if tt.options.PreserveLast4 {
+				assert.Equal(t, tt.pan[len(tt.pan)-4:], got[len(got)-4:])
+			}
+
+			again, err := cardToken(key, "card", tt.pan, tt.options)
+			assert.NoError(t, err)
+			assert.Equal(t, got, again, "card tokens should be deterministic")
+
+			otherKey, err := cardToken([]byte("this is a different key material"), "card", tt.pan, tt.options)
+			assert.NoError(t, err)
+			assert.NotEqual(t, got, otherKey, "card tokens should depend on the key")
+
+			otherType, err := cardToken(key, "debit", tt.pan, tt.options)
+			assert.NoError(t, err)
+			assert.NotEqual(t, got, otherType, "card tokens should depend on the token type")
+		})
+	}
+}
+
+func TestLuhn(t *testing.T) {
+	assert.True(t, luhnValid("4111111111111111"))
+	assert.True(t, luhnValid("79927398713"))
+	assert.False(t, luhnValid("79927398710"))
+	assert.Equal(t, "3", luhnCheckDigit("7992739871"))
+	assert.Equal(t, "1", luhnCheckDigit("411111111111111"))
+}
+
+func TestToken_TokenizeCard(t *testing.T) {
+	token := Token{
+		CreateToken: CreateToken{
+			Payload:   `{"card_number": "4111111111111111", "exp": "0128"}`,
+			TokenType: "card",
+			Format:    &FormatOptions{PreserveLast4: true},
+		},
+		Mode: TokenModeCard,
+	}
+	err := token.Tokenize(context.Background(), testKey)
+	assert.NoError(t, err)
+	assert.Len(t, token.Token, 16)
+	assert.Equal(t, "1111", token.Token[12:])
+
+	debit := token
+	debit.TokenType = "debit"
+	assert.NoError(t, debit.Tokenize(context.Background(), testKey))
+	assert.Equal(t, "1111", debit.Token[12:])
+	assert.NotEqual(t, token.Token, debit.Token, "the same card number should get a token per type")
+
+	token.Payload = "not a card"
+	assert.ErrorIs(t, token.Tokenize(context.Background(), testKey), ErrInvalidCardNumber)
+}
+
+func TestToken_CheckReuse(t *testing.T) {
+	token := Token{CreateToken: CreateToken{TokenType: "card"}}
+	tests := []struct {
+		name    string
+		stored  CreateToken
+		wantErr error
+	}{
+		{"same type", CreateToken{TokenType: "card"}, nil},
+		{"empty format", CreateToken{TokenType: "card", Format: &FormatOptions{}}, nil},
+		{"other type", CreateToken{TokenType: "debit"}, ErrTokenConflict},
+		{"other format", CreateToken{TokenType: "card", Format: &FormatOptions{PreserveBIN: true}}, ErrTokenConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := token.CheckReuse(&Token{CreateToken: tt.stored})
+			assert.ErrorIs(t, err, tt.wantErr)
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The metadata of card tokens derived from their payload. Clients cannot set them, the derived values replace theirs.
+const (
+	MetadataBIN    = "bin"
+	MetadataBIN8   = "bin8"
+	MetadataLast4  = "last4"
+	MetadataBrand  = "brand"
+	MetadataExpiry = "expiry"
+)
+
+// BrandUnknown is the brand of card numbers outside every known IIN range
+const BrandUnknown = "unknown"
+
+// cardTokenType is the token type whose payloads are card numbers
+const cardTokenType = "card"
+
+// bin8Length is the length of the eight digit BIN that card numbers with 16 or more digits have since ISO/IEC
+// 7812-1:2017. The bin attribute keeps the six digits preserve_bin and first6_last4 use, the eight digits are bin8.
+const bin8Length = 8
+
+var ErrInvalidCardExpiry = errors.New("payload does not contain a valid card expiry")
+
+// cardExpiryFields are the payload fields an expiry is read from, besides exp_month and exp_year
+var cardExpiryFields = []string{"exp", "expiry", "expiration", "exp_date"}
+
+var (
+	// monthYear matches expiries like 0128, 01/28, 01-28 and 01/2028
+	monthYear = regexp.MustCompile(`^(\d{2})[/-]?(\d{2}|\d{4})$`)
+	// yearMonth matches expiries like 2028-01
+	yearMonth = regexp.MustCompile(`^(\d{4})-(\d{2})$`)
+)
+
+// iinRange is a range of issuer identification number prefixes of a card brand. Both ends have the same number of
+// digits and are included.
+type iinRange struct {
+	brand string
+	low   string
+	high  string
+}
+
+// iinRanges are the IIN ranges of the card brands. When ranges overlap the one with the longest prefix wins.
+var iinRanges = []iinRange{
+	{"visa", "4", "4"},
+	{"mastercard", "51", "55"},
+	{"mastercard", "2221", "2720"},
+	{"amex", "34", "34"},
+	{"amex", "37", "37"},
+	{"discover", "6011", "6011"},
+	{"discover", "644", "649"},
+	{"discover", "65", "65"},
+	{"diners", "300", "305"},
+	{"diners", "36", "36"},
+	{"diners", "38", "39"},
+	{"jcb", "3528", "3589"},
+	{"unionpay", "62", "62"},
+	{"maestro", "50", "50"},
+	{"maestro", "56", "58"},
+}
+
+// cardBrand returns the brand of the card number from the IIN range it is in
+func cardBrand(pan string) string {
+	brand, longest := BrandUnknown, 0
+	for _, r := range iinRanges {
+		prefix := pan[:len(r.low)]
+		if len(r.low) > longest && prefix >= r.low && prefix <= r.high {
+			brand, longest = r.brand, len(r.low)
+		}
+	}
+	return brand
+}
+
+// cardExpiry finds the expiry in a JSON payload as YYYY-MM, empty when the payload has none
+func cardExpiry(payload string) (string, error) {
+	var fields map[string]any
+	if err := json.Unmarshal([]byte(payload), &fields); err != nil {
+		// a card number on its own has no expiry
+		return "", nil
+	}
+	for _, name := range cardExpiryFields {
+		if value, ok := fields[name]; ok {
+			text, ok := value.(string)
+			if !ok {
+				return "", ErrInvalidCardExpiry
+			}
+			return parseCardExpiry(strings.TrimSpace(text))
+		}
+	}
+
+	month, hasMonth := fields["exp_month"]
+	year, hasYear := fields["exp_year"]
+	if !hasMonth && !hasYear {
+		return "", nil
+	}
+	return formatCardExpiry(fmt.Sprint(month), fmt.Sprint(year))
+}
+
+// parseCardExpiry reads an expiry written as month and year, or as YYYY-MM
+func parseCardExpiry(text string) (string, error) {
+	if match := monthYear.FindStringSubmatch(text); match != nil {
+		return formatCardExpiry(match[1], match[2])
+	}
+	if match := yearMonth.FindStringSubmatch(text); match != nil {
+		return formatCardExpiry(match[2], match[1])
+	}
+	return "", ErrInvalidCardExpiry
+}
+
+// formatCardExpiry returns the month and year as YYYY-MM. Two digit years are in this century.
+func formatCardExpiry(month string, year string) (string, error) {
+	m, err := strconv.Atoi(month)
+	if err != nil || m < 1 || m > 12 {
+		return "", ErrInvalidCardExpiry
+	}
+	y, err := strconv.Atoi(year)
+	switch {
+	case err != nil || y < 0:
+		return "", ErrInvalidCardExpiry
+	case len(year) == 2:
+		y += 2000
+	case len(year) != 4:
+		return "", ErrInvalidCardExpiry
+	}
+	return fmt.Sprintf("%04d-%02d", y, m), nil
+}
+
+// cardMetadata derives the BIN, last four digits, brand and expiry of a card from the card number and expiry in the
+// payload, and the eight digit BIN of card numbers long enough to have one. The card number has to pass the Luhn check.
+func cardMetadata(payload string) (map[string]any, error) {
+	pan, err := cardNumber(payload)
+	if err != nil {
+		return nil, err
+	}
+	expiry, err := cardExpiry(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := map[string]any{
+		MetadataBIN:   pan[:binLength],
+		MetadataLast4: pan[len(pan)-last4Length:],
+		MetadataBrand: cardBrand(pan),
+	}
+	if len(pan) >= 16 {
+		metadata[MetadataBIN8] = pan[:bin8Length]
+	}
+	if expiry != "" {
+		metadata[MetadataExpiry] = expiry
+	}
+	return metadata, nil
+}
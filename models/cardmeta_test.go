@@ -0,0 +1,115 @@
+package models
+
+import (
+	"maps"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCardMetadata(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    CreateToken
+		want    map[string]any
+		wantErr error
+	}{
+		{
+			name: "card number on its own",
+			data: CreateToken{Payload: "4111 1111 1111 1111", TokenType: "card"},
+			want: map[string]any{"bin": "411111", "bin8": "41111111", "last4": "1111", "brand": "visa"},
+		},
+		{
+			name: "client values are replaced",
+			data: CreateToken{
+				Payload:   `{"card_number": "5555555555554444", "exp": "0128"}`,
+				TokenType: "card",
+				Metadata:  map[string]any{"bin": "411111", "bin8": "41111111", "last4": "0000", "brand": "visa", "region": "eu"},
+			},
+			want: map[string]any{"bin": "555555", "bin8": "55555555", "last4": "4444", "brand": "mastercard", "expiry": "2028-01", "region": "eu"},
+		},
+		{
+			name: "short card number has no eight digit bin",
+			data: CreateToken{Payload: `{"pan": "378282246310005", "expiry": "2027-11"}`, TokenType: "card"},
+			want: map[string]any{"bin": "378282", "last4": "0005", "brand": "amex", "expiry": "2027-11"},
+		},
+		{
+			name: "expiry month and year",
+			data: CreateToken{Payload: `{"number": "6011111111111117", "exp_month": 3, "exp_year": "2029"}`, TokenType: "card"},
+			want: map[string]any{"bin": "601111", "bin8": "60111111", "last4": "1117", "brand": "discover", "expiry": "2029-03"},
+		},
+		{
+			name: "client expiry is removed without one in the payload",
+			data: CreateToken{Payload: "3530111333300000", TokenType: "card", Metadata: map[string]any{"expiry": "2030-01"}},
+			want: map[string]any{"bin": "353011", "bin8": "35301113", "last4": "0000", "brand": "jcb"},
+		},
+		{
+			name: "unknown brand",
+			data: CreateToken{Payload: "9999999999999995", TokenType: "card", Metadata: map[string]any{"brand": "visa"}},
+			want: map[string]any{"bin": "999999", "bin8": "99999999", "last4": "9995", "brand": "unknown"},
+		},
+		{name: "invalid card number", data: CreateToken{Payload: "4111111111111112", TokenType: "card"}, wantErr: ErrInvalidCardNumber},
+		{name: "invalid month", data: CreateToken{Payload: `{"pan": "4111111111111111", "exp": "13/28"}`, TokenType: "card"}, wantErr: ErrInvalidCardExpiry},
+		{name: "invalid expiry", data: CreateToken{Payload: `{"pan": "4111111111111111", "exp": "soon"}`, TokenType: "card"}, wantErr: ErrInvalidCardExpiry},
+		{name: "expiry that is not a string", data: CreateToken{Payload: `{"pan": "4111111111111111", "exp": 128}`, TokenType: "card"}, wantErr: ErrInvalidCardExpiry},
+		{name: "missing year", data: CreateToken{Payload: `{"pan": "4111111111111111", "exp_month": 1}`, TokenType: "card"}, wantErr: ErrInvalidCardExpiry},
+		{
+			name: "other token types",
+			data: CreateToken{Payload: "4111111111111112", TokenType: "pan", Metadata: map[string]any{"bin": "41111111"}},
+			want: map[string]any{"bin": "41111111"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := maps.Clone(tt.data.Metadata)
+			data := tt.data
+			err := data.Normalize()
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, data.Metadata)
+			if tt.data.Metadata != nil {
+				assert.Equal(t, client, tt.data.Metadata, "the client's metadata is not changed")
+			}
+		})
+	}
+}
+
+func TestCardBrand(t *testing.T) {
+	tests := map[string]string{
+		"4111111111111111": "visa",
+		"2223003122003222": "mastercard",
+		"5105105105105100": "mastercard",
+		"371449635398431":  "amex",
+		"6445644564456445": "discover",
+		"30569309025904":   "diners",
+		"3528000000000007": "jcb",
+		"6200000000000005": "unionpay",
+		"5018000000000009": "maestro",
+		"3600000000000008": "diners",
+		"2720999999999996": "mastercard",
+		"2721000000000004": "unknown",
+	}
+	for pan, want := range tests {
+		assert.Equal(t, want, cardBrand(pan), pan)
+	}
+}
+
+func TestToken_KeepDerivedMetadata(t *testing.T) {
+	card := &Token{CreateToken: CreateToken{
+		TokenType: "card",
+		Metadata:  map[string]any{"bin": "411111", "bin8": "41111111", "last4": "1111", "brand": "visa", "region": "eu"},
+	}}
+	update := map[string]any{"bin8": "55555555", "expiry": "2030-01", "region": "uk"}
+	assert.Equal(t,
+		map[string]any{"bin": "411111", "bin8": "41111111", "last4": "1111", "brand": "visa", "region": "uk"},
+		card.KeepDerivedMetadata(update),
+	)
+	assert.Equal(t, map[string]any{"bin8": "55555555", "expiry": "2030-01", "region": "uk"}, update, "the update is not changed")
+	assert.Nil(t, card.KeepDerivedMetadata(nil), "metadata that is not updated stays nil")
+
+	other := &Token{CreateToken: CreateToken{TokenType: "pan"}}
+	assert.Equal(t, update, other.KeepDerivedMetadata(update))
+}
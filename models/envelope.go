@@ -0,0 +1,106 @@
+package models
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+)
+
+const (
+	// envelopePrefix marks a value stored in a versioned envelope, legacy payloads are plain hex and never contain it
+	envelopePrefix = "v"
+	// envelopeV1 values are the hex encoded nonce followed by the AES-GCM ciphertext
+	envelopeV1 = "v1:"
+	// envelopeV2 values are laid out like v1, but sealed with additional data binding them to where they are stored
+	envelopeV2 = "v2:"
+
+	// DataKeySize is the length in bytes of the per token data keys
+	DataKeySize = 32
+)
+
+// seal encrypts plaintext with AES-GCM under a fresh random nonce. It returns a v2 envelope when there is additional
+// data to authenticate and a v1 envelope when it is nil.
+func seal(key []byte, plaintext []byte, additionalData []byte) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, plaintext, additionalData)
+	version := envelopeV1
+	if additionalData != nil {
+		version = envelopeV2
+	}
+	return version + hex.EncodeToString(sealed), nil
+}
+
+// open decrypts a value produced by seal. The additional data is only checked for v2 envelopes, older values were sealed
+// without it. Values written before nonces were stored in an envelope are opened with the all-zero nonce they were
+// sealed with.
+func open(key []byte, envelope string, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, cipherText, err := splitEnvelope(envelope, gcm.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+	if !isBoundEnvelope(envelope) {
+		additionalData = nil
+	}
+	plaintext, err := gcm.Open(nil, nonce, cipherText, additionalData)
+	if err != nil {
+		return nil, ErrIntegrity
+	}
+	return plaintext, nil
+}
+
+// isLegacyEnvelope reports whether the value was sealed with the legacy all-zero nonce
+func isLegacyEnvelope(envelope string) bool {
+	return !strings.HasPrefix(envelope, envelopePrefix)
+}
+
+// isBoundEnvelope reports whether the value was sealed with additional data
+func isBoundEnvelope(envelope string) bool {
+	return strings.HasPrefix(envelope, envelopeV2)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// splitEnvelope splits an encrypted value into its nonce and ciphertext
+func splitEnvelope(envelope string, nonceSize int) ([]byte, []byte, error) {
+	if isLegacyEnvelope(envelope) {
+		cipherText, err := hex.DecodeString(envelope)
+		if err != nil {
+			return nil, nil, err
+		}
+		return make([]byte, nonceSize), cipherText, nil
+	}
+
+	version := envelope[:min(len(envelope), len(envelopeV1))]
+	if version != envelopeV1 && version != envelopeV2 {
+		return nil, nil, ErrUnsupportedEnvelope
+	}
+	sealed, err := hex.DecodeString(envelope[len(version):])
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(sealed) < nonceSize {
+		return nil, nil, ErrUnsupportedEnvelope
+	}
+	return sealed[:nonceSize], sealed[nonceSize:], nil
+}
@@ -0,0 +1,66 @@
+package models
+
+import (
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// metadataNumber matches the metadata filter values that are also compared to numeric metadata
+var metadataNumber = regexp.MustCompile(`^-?[0-9]{1,15}(\.[0-9]{1,15})?$`)
+
+// TokenFilter selects the tokens to list. Every field that is set has to match, the zero value matches every token.
+type TokenFilter struct {
+	TokenType string
+	// CreatedAfter and CreatedBefore bound when the token was created, inclusively
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	// ExpiresAfter and ExpiresBefore bound when the token expires, inclusively. Tokens that never expire do not match
+	// either of them.
+	ExpiresAfter  time.Time
+	ExpiresBefore time.Time
+	// Metadata holds attributes that must be in the token's metadata with exactly the value, see MetadataValues
+	Metadata map[string]string
+}
+
+// Matches reports whether the token is selected by the filter
+func (f TokenFilter) Matches(token *Token) bool {
+	if f.TokenType != "" && token.TokenType != f.TokenType {
+		return false
+	}
+	if !f.CreatedAfter.IsZero() && token.CreatedAt.Before(f.CreatedAfter) {
+		return false
+	}
+	if !f.CreatedBefore.IsZero() && token.CreatedAt.After(f.CreatedBefore) {
+		return false
+	}
+	if !f.ExpiresAfter.IsZero() && (token.ExpiresAt == 0 || token.ExpiresAt < f.ExpiresAfter.Unix()) {
+		return false
+	}
+	if !f.ExpiresBefore.IsZero() && (token.ExpiresAt == 0 || token.ExpiresAt > f.ExpiresBefore.Unix()) {
+		return false
+	}
+	for name, want := range f.Metadata {
+		value, ok := token.Metadata[name]
+		if !ok || !slices.Contains(MetadataValues(want), value) {
+			return false
+		}
+	}
+	return true
+}
+
+// MetadataValues are the metadata values a filter value matches: the string itself, the number when it is a decimal
+// number, and the boolean when it is true or false
+func MetadataValues(want string) []any {
+	values := []any{want}
+	if metadataNumber.MatchString(want) {
+		if number, err := strconv.ParseFloat(want, 64); err == nil {
+			values = append(values, number)
+		}
+	}
+	if want == "true" || want == "false" {
+		values = append(values, want == "true")
+	}
+	return values
+}
@@ -0,0 +1,59 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenFilter_Matches(t *testing.T) {
+	created := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	token := &Token{
+		BaseModel:   BaseModel{CreatedAt: created},
+		CreateToken: CreateToken{TokenType: "card", Metadata: map[string]any{"region": "eu", "retries": float64(3), "verified": true, "code": "007"}},
+		ExpiresAt:   created.Add(time.Hour).Unix(),
+	}
+	forever := &Token{BaseModel: BaseModel{CreatedAt: created}, CreateToken: CreateToken{TokenType: "card"}}
+
+	tests := []struct {
+		name   string
+		filter TokenFilter
+		token  *Token
+		want   bool
+	}{
+		{name: "empty filter", token: token, want: true},
+		{name: "token type", filter: TokenFilter{TokenType: "card"}, token: token, want: true},
+		{name: "other token type", filter: TokenFilter{TokenType: "ssn"}, token: token, want: false},
+		{name: "created at the lower bound", filter: TokenFilter{CreatedAfter: created}, token: token, want: true},
+		{name: "created before the range", filter: TokenFilter{CreatedAfter: created.Add(time.Nanosecond)}, token: token, want: false},
+		{name: "created at the upper bound", filter: TokenFilter{CreatedBefore: created}, token: token, want: true},
+		{name: "created after the range", filter: TokenFilter{CreatedBefore: created.Add(-time.Nanosecond)}, token: token, want: false},
+		{name: "expires in the range", filter: TokenFilter{ExpiresAfter: created, ExpiresBefore: created.Add(2 * time.Hour)}, token: token, want: true},
+		{name: "expires after the range", filter: TokenFilter{ExpiresBefore: created}, token: token, want: false},
+		{name: "expires before the range", filter: TokenFilter{ExpiresAfter: created.Add(2 * time.Hour)}, token: token, want: false},
+		{name: "never expires", filter: TokenFilter{ExpiresAfter: created}, token: forever, want: false},
+		{name: "metadata", filter: TokenFilter{Metadata: map[string]string{"region": "eu"}}, token: token, want: true},
+		{name: "other metadata value", filter: TokenFilter{Metadata: map[string]string{"region": "us"}}, token: token, want: false},
+		{name: "missing metadata", filter: TokenFilter{Metadata: map[string]string{"region": "eu"}}, token: forever, want: false},
+		{name: "numeric metadata", filter: TokenFilter{Metadata: map[string]string{"retries": "3.0"}}, token: token, want: true},
+		{name: "other numeric metadata value", filter: TokenFilter{Metadata: map[string]string{"retries": "4"}}, token: token, want: false},
+		{name: "boolean metadata", filter: TokenFilter{Metadata: map[string]string{"verified": "true"}}, token: token, want: true},
+		{name: "other boolean metadata value", filter: TokenFilter{Metadata: map[string]string{"verified": "false"}}, token: token, want: false},
+		{name: "string metadata that looks like a number", filter: TokenFilter{Metadata: map[string]string{"code": "007"}}, token: token, want: true},
+		{name: "string metadata compared as a number", filter: TokenFilter{Metadata: map[string]string{"code": "7"}}, token: token, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.filter.Matches(tt.token))
+		})
+	}
+}
+
+func TestMetadataValues(t *testing.T) {
+	assert.Equal(t, []any{"eu"}, MetadataValues("eu"))
+	assert.Equal(t, []any{"-1.5", -1.5}, MetadataValues("-1.5"))
+	assert.Equal(t, []any{"1e3"}, MetadataValues("1e3"))
+	assert.Equal(t, []any{"true", true}, MetadataValues("true"))
+	assert.Equal(t, []any{"True"}, MetadataValues("True"))
+}
@@ -0,0 +1,142 @@
+package models
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// DefaultGrantTTL and MaxGrantTTL are how many seconds a reveal grant is valid for by default and at most
+	DefaultGrantTTL = 300
+	MaxGrantTTL     = 3600
+	// revealGrantPrefix starts every signed reveal grant so they are easy to recognize, for example by secret scanners
+	revealGrantPrefix = "rg_"
+	// grantKeyLabel derives the key grants are signed with from the tokenization key, so the same key material is not
+	// used by two algorithms
+	grantKeyLabel = "tokenize reveal grant"
+)
+
+var (
+	ErrInvalidGrant        = errors.New("grant is not valid")
+	ErrGrantExpired        = errors.New("grant has expired")
+	ErrGrantRevoked        = errors.New("grant has been revoked")
+	ErrGrantNotFound       = errors.New("grant not found")
+	ErrGrantClientMismatch = errors.New("grant cannot be redeemed from this address")
+)
+
+// RevealGrant lets whoever holds it reveal the payload of one token with one reveal policy until it expires, without
+// credentials of their own. The JSON form is what is signed and handed out, it never includes the payload.
+type RevealGrant struct {
+	ID     string `json:"id" dynamodbav:"id"`
+	Tenant string `json:"tenant,omitempty" dynamodbav:"tenant,omitempty"`
+	Token  string `json:"token" dynamodbav:"token"`
+	Reveal string `json:"reveal" dynamodbav:"reveal"`
+	// ClientIP is the only address the grant can be redeemed from, any address when empty
+	ClientIP string `json:"client_ip,omitempty" dynamodbav:"client_ip,omitempty"`
+	// KeyID is the ID of the tokenization key the grant is signed with
+	KeyID string `json:"kid" dynamodbav:"key_id"`
+	// ExpiresAt is when the grant expires in seconds since the epoch
+	ExpiresAt int64 `json:"exp" dynamodbav:"expiresAt"`
+	// IssuedBy is the subject of the caller that issued the grant
+	IssuedBy string `json:"-" dynamodbav:"issued_by"`
+	Revoked  bool   `json:"-" dynamodbav:"revoked,omitempty"`
+}
+
+// NewRevealGrant creates a grant to reveal the tenant's token with the reveal policy for ttl seconds
+func NewRevealGrant(tenant string, token string, reveal string, clientIP string, ttl int64, issuedBy string) (*RevealGrant, error) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return nil, err
+	}
+	return &RevealGrant{
+		ID:        id.String(),
+		Tenant:    tenant,
+		Token:     token,
+		Reveal:    reveal,
+		ClientIP:  clientIP,
+		ExpiresAt: ExpiresAfter(time.Now(), ttl),
+		IssuedBy:  issuedBy,
+	}, nil
+}
+
+// Sign returns the grant signed with an HMAC-SHA-256 under a key derived from the current key of the tokenization
+// keys, whose ID is recorded on the grant
+func (g *RevealGrant) Sign(ctx context.Context, keys KeyProvider) (string, error) {
+	key, err := keys.CurrentKey(ctx)
+	if err != nil {
+		return "", err
+	}
+	g.KeyID = key.ID
+	claims, err := json.Marshal(g)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(claims)
+	return revealGrantPrefix + encoded + "." + base64.RawURLEncoding.EncodeToString(grantSignature(key, encoded)), nil
+}
+
+// ParseRevealGrant verifies a signed grant with the tokenization keys of its tenant, which keysFor returns, and that
+// it has not expired. An expired grant is returned along with ErrGrantExpired, its claims are verified.
+func ParseRevealGrant(ctx context.Context, signed string, keysFor func(tenant string) (KeyProvider, error)) (*RevealGrant, error) {
+	encoded, signature, found := strings.Cut(strings.TrimPrefix(signed, revealGrantPrefix), ".")
+	if !found || !strings.HasPrefix(signed, revealGrantPrefix) {
+		return nil, fmt.Errorf("%w: malformed grant", ErrInvalidGrant)
+	}
+	claims, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed claims", ErrInvalidGrant)
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed signature", ErrInvalidGrant)
+	}
+	grant := &RevealGrant{}
+	if err := json.Unmarshal(claims, grant); err != nil {
+		return nil, fmt.Errorf("%w: malformed claims", ErrInvalidGrant)
+	}
+
+	// the tenant and key ID are read before the signature is checked, they only pick the key it is checked with
+	keys, err := keysFor(grant.Tenant)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidGrant, err)
+	}
+	key, err := keys.KeyByID(ctx, grant.KeyID)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidGrant, err)
+	}
+	if !hmac.Equal(mac, grantSignature(key, encoded)) {
+		return nil, fmt.Errorf("%w: invalid signature", ErrInvalidGrant)
+	}
+	if time.Now().Unix() >= grant.ExpiresAt {
+		return grant, ErrGrantExpired
+	}
+	return grant, nil
+}
+
+// AllowsClient reports whether the grant can be redeemed from the address
+func (g *RevealGrant) AllowsClient(addr netip.Addr) bool {
+	if g.ClientIP == "" {
+		return true
+	}
+	allowed, err := netip.ParseAddr(g.ClientIP)
+	return err == nil && allowed == addr.Unmap()
+}
+
+// grantSignature is the HMAC of the encoded claims of a grant
+func grantSignature(key *Key, encoded string) []byte {
+	derive := hmac.New(sha256.New, key.Material)
+	derive.Write([]byte(grantKeyLabel))
+	mac := hmac.New(sha256.New, derive.Sum(nil))
+	mac.Write([]byte(encoded))
+	return mac.Sum(nil)
+}
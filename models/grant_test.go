@@ -0,0 +1,90 @@
+package models
+
+import (
+	"context"
+	"encoding/base64"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRevealGrant(t *testing.T) {
+	ctx := context.Background()
+	otherKey := testKeyring{current: DefaultKeyID, keys: map[string][]byte{DefaultKeyID: []byte("this is another tenant's key....")}}
+	keysFor := func(tenant string) (KeyProvider, error) {
+		switch tenant {
+		case "":
+			return rotatedKey, nil
+		case "tenant-a":
+			return otherKey, nil
+		default:
+			return nil, ErrUnknownTenant
+		}
+	}
+	sign := func(grant *RevealGrant, keys KeyProvider) string {
+		signed, err := grant.Sign(ctx, keys)
+		assert.NoError(t, err)
+		return signed
+	}
+	newGrant := func(tenant string, ttl int64) *RevealGrant {
+		grant, err := NewRevealGrant(tenant, "test-token", "last4", "", ttl, "api_key:test")
+		assert.NoError(t, err)
+		return grant
+	}
+
+	grant := newGrant("", 300)
+	signed := sign(grant, rotatedKey)
+	assert.True(t, strings.HasPrefix(signed, "rg_"))
+	parsed, err := ParseRevealGrant(ctx, signed, keysFor)
+	assert.NoError(t, err)
+	assert.Equal(t, grant.ID, parsed.ID)
+	assert.Equal(t, "test-token", parsed.Token)
+	assert.Equal(t, "last4", parsed.Reveal)
+	assert.Equal(t, "key-2", parsed.KeyID)
+	assert.Empty(t, parsed.IssuedBy, "who issued the grant is not handed out")
+
+	// grants signed before a rotation verify with the retired key
+	_, err = ParseRevealGrant(ctx, sign(newGrant("", 300), testKey), keysFor)
+	assert.NoError(t, err)
+
+	encoded, signature, _ := strings.Cut(strings.TrimPrefix(signed, "rg_"), ".")
+	claims, _ := base64.RawURLEncoding.DecodeString(encoded)
+	tampered := "rg_" + base64.RawURLEncoding.EncodeToString([]byte(strings.Replace(string(claims), "last4", "full", 1))) + "." + signature
+
+	tests := []struct {
+		name    string
+		signed  string
+		wantErr error
+	}{
+		{name: "tampered claims", signed: tampered, wantErr: ErrInvalidGrant},
+		{name: "signed with another tenant's key", signed: sign(newGrant("tenant-a", 300), rotatedKey), wantErr: ErrInvalidGrant},
+		{name: "unknown tenant", signed: sign(newGrant("tenant-b", 300), rotatedKey), wantErr: ErrInvalidGrant},
+		{name: "expired", signed: sign(&RevealGrant{ID: "expired", Token: "test-token", ExpiresAt: time.Now().Add(-time.Second).Unix()}, rotatedKey), wantErr: ErrGrantExpired},
+		{name: "no prefix", signed: strings.TrimPrefix(signed, "rg_"), wantErr: ErrInvalidGrant},
+		{name: "no signature", signed: "rg_" + encoded, wantErr: ErrInvalidGrant},
+		{name: "not base64", signed: "rg_!!!." + signature, wantErr: ErrInvalidGrant},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parsed, err := ParseRevealGrant(ctx, tt.signed, keysFor)
+			assert.ErrorIs(t, err, tt.wantErr)
+			if tt.wantErr == ErrGrantExpired {
+				assert.Equal(t, "expired", parsed.ID, "the verified claims of an expired grant are returned")
+			} else {
+				assert.Nil(t, parsed)
+			}
+		})
+	}
+}
+
+func TestRevealGrant_AllowsClient(t *testing.T) {
+	grant := &RevealGrant{ClientIP: "203.0.113.7"}
+	assert.True(t, grant.AllowsClient(netip.MustParseAddr("203.0.113.7")))
+	assert.True(t, grant.AllowsClient(netip.MustParseAddr("::ffff:203.0.113.7")), "IPv4 mapped addresses are the same client")
+	assert.False(t, grant.AllowsClient(netip.MustParseAddr("203.0.113.8")))
+	assert.False(t, grant.AllowsClient(netip.Addr{}), "an unknown address is not the client")
+	assert.True(t, (&RevealGrant{}).AllowsClient(netip.Addr{}), "grants without an address can be redeemed from anywhere")
+}
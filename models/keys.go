@@ -0,0 +1,45 @@
+package models
+
+import "context"
+
+// DefaultKeyID is the ID of the key that payloads without a recorded key ID were sealed with
+const DefaultKeyID = "default"
+
+// Key is a version of the AES-256 key used to encrypt token payloads
+type Key struct {
+	ID       string
+	Material []byte
+}
+
+// KeyProvider is the keyring used to encrypt and decrypt token payloads
+type KeyProvider interface {
+	// CurrentKey returns the key new payloads are sealed with
+	CurrentKey(ctx context.Context) (*Key, error)
+	// KeyByID returns a key from the keyring, current or retired, so older payloads can still be opened
+	KeyByID(ctx context.Context, id string) (*Key, error)
+}
+
+// TenantKeys are the keys of a tenant, every tenant has its own
+type TenantKeys struct {
+	// Keys are the key-encryption keys that wrap each token's data key
+	Keys KeyProvider
+	// TokenKeys are the keys for keyed tokenization
+	TokenKeys KeyProvider
+}
+
+// TenantKeyResolver looks up the keys of each tenant
+type TenantKeyResolver interface {
+	// TenantKeys returns the keys of the tenant, or ErrUnknownTenant
+	TenantKeys(tenant string) (TenantKeys, error)
+}
+
+// KeysForTenant returns the keys of the tenant from the resolver. Data without a tenant uses the default keys.
+func KeysForTenant(resolver TenantKeyResolver, defaults TenantKeys, tenant string) (TenantKeys, error) {
+	if tenant == "" {
+		return defaults, nil
+	}
+	if resolver == nil {
+		return TenantKeys{}, ErrUnknownTenant
+	}
+	return resolver.TenantKeys(tenant)
+}
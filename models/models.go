@@ -2,17 +2,66 @@ package models
 
 import (
 	"errors"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 )
 
 var (
-	ErrTokenNotFound = errors.New("token not found")
+	ErrTokenNotFound       = errors.New("token not found")
+	ErrTokenChanged        = errors.New("token was modified concurrently")
+	ErrTokenExists         = errors.New("token already exists")
+	ErrUnsupportedEnvelope = errors.New("unsupported encrypted payload format")
+	ErrUnknownTokenMode    = errors.New("unknown token mode")
+	ErrIntegrity           = errors.New("encrypted value failed its integrity check")
+	ErrEmptyUpdate         = errors.New("update has nothing to change")
+	ErrAPIKeyNotFound      = errors.New("api key not found")
+	ErrUnknownTenant       = errors.New("unknown tenant")
+	ErrRevealsExhausted    = errors.New("token has no reveals left")
+	ErrInvalidToken        = errors.New("token is not valid")
+	ErrMissingTokenID      = errors.New("token has no ID")
+	ErrTokenConflict       = errors.New("token already exists with another token type or format")
 )
 
+// validTenant limits tenant IDs to characters that cannot be confused with the separator in storage keys
+var validTenant = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+// ValidTenant reports whether the tenant ID can be used, the empty tenant is the default for data without a tenant
+func ValidTenant(tenant string) bool {
+	return tenant == "" || validTenant.MatchString(tenant)
+}
+
+// ValidToken reports whether a token from a caller can be looked up. Tokens cannot contain the separator in storage
+// keys, so a token of the default tenant can never name the key of another tenant's token.
+func ValidToken(token string) bool {
+	return token != "" && !strings.Contains(token, "#")
+}
+
+// StorageKey is the key a tenant's item is stored under. Items without a tenant are stored under their own value, as
+// they were before tenants existed.
+func StorageKey(tenant string, value string) string {
+	if tenant == "" {
+		return value
+	}
+	return tenant + "#" + value
+}
+
+// NewBaseModel returns a BaseModel with a new time ordered ID
+func NewBaseModel() (BaseModel, error) {
+	id, err := uuid.NewV7()
+	if err != nil {
+		return BaseModel{}, err
+	}
+	now := time.Now()
+	return BaseModel{Id: id, CreatedAt: now, UpdatedAt: now}, nil
+}
+
 type BaseModel struct {
 	Id uuid.UUID `json:"id" dynamo:"id"`
+	// Tenant owns the item, tenants never see each other's items
+	Tenant string `json:"tenant,omitempty" dynamodbav:"tenant,omitempty"`
 
 	CreatedAt time.Time `json:"createdAt" dynamodbav:"createdAt"`
 	UpdatedAt time.Time `json:"updatedAt" dynamodbav:"updatedAt"`
@@ -0,0 +1,69 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidTenant(t *testing.T) {
+	tests := []struct {
+		tenant string
+		want   bool
+	}{
+		{tenant: "", want: true},
+		{tenant: "payments", want: true},
+		{tenant: "team-7_eu", want: true},
+		{tenant: "Payments", want: false},
+		{tenant: "pay#ments", want: false},
+		{tenant: "-payments", want: false},
+		{tenant: "pay ments", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tenant, func(t *testing.T) {
+			assert.Equal(t, tt.want, ValidTenant(tt.tenant))
+		})
+	}
+}
+
+func TestStorageKey(t *testing.T) {
+	assert.Equal(t, "abc123", StorageKey("", "abc123"), "data without a tenant keeps its own key")
+	assert.Equal(t, "payments#abc123", StorageKey("payments", "abc123"))
+}
+
+type tenantResolver map[string]TenantKeys
+
+func (r tenantResolver) TenantKeys(tenant string) (TenantKeys, error) {
+	keys, ok := r[tenant]
+	if !ok {
+		return TenantKeys{}, ErrUnknownTenant
+	}
+	return keys, nil
+}
+
+func TestKeysForTenant(t *testing.T) {
+	defaults := TenantKeys{Keys: testKey, TokenKeys: testKey}
+	payments := TenantKeys{Keys: failingKeys{}, TokenKeys: failingKeys{}}
+	resolver := tenantResolver{"payments": payments}
+
+	keys, err := KeysForTenant(resolver, defaults, "")
+	assert.NoError(t, err)
+	assert.Equal(t, defaults, keys)
+
+	keys, err = KeysForTenant(resolver, defaults, "payments")
+	assert.NoError(t, err)
+	assert.Equal(t, payments, keys)
+
+	_, err = KeysForTenant(resolver, defaults, "shipping")
+	assert.ErrorIs(t, err, ErrUnknownTenant)
+
+	_, err = KeysForTenant(nil, defaults, "payments")
+	assert.ErrorIs(t, err, ErrUnknownTenant, "tenants are unknown when none are configured")
+}
+
+func TestValidToken(t *testing.T) {
+	assert.True(t, ValidToken("4111110123451111"))
+	assert.True(t, ValidToken("tok_xyz@example.com"))
+	assert.False(t, ValidToken(""))
+	assert.False(t, ValidToken("payments#abc123"), "a token cannot name the storage key of another tenant's token")
+}
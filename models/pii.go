@@ -0,0 +1,218 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"net/mail"
+	"regexp"
+	"strings"
+)
+
+// The built-in token types of personal data besides cards
+const (
+	ssnTokenType         = "ssn"
+	bankAccountTokenType = "bank_account"
+	emailTokenType       = "email"
+	phoneTokenType       = "phone"
+)
+
+// The metadata derived from the payload of bank account, email and phone tokens
+const (
+	MetadataRoutingNumber = "routing_number"
+	MetadataDomain        = "domain"
+	MetadataCountryCode   = "country_code"
+)
+
+var (
+	ErrInvalidSSN           = errors.New("payload is not a valid SSN")
+	ErrInvalidBankAccount   = errors.New("payload does not contain a valid bank account number")
+	ErrInvalidRoutingNumber = errors.New("payload does not contain a valid ABA routing number")
+	ErrInvalidEmail         = errors.New("payload is not a valid email address")
+	ErrInvalidPhone         = errors.New("payload is not a valid E.164 phone number")
+)
+
+const (
+	// minAccountLength and maxAccountLength are the lengths of US bank account numbers
+	minAccountLength = 4
+	maxAccountLength = 17
+	// routingNumberLength is the length of ABA routing numbers
+	routingNumberLength = 9
+)
+
+// e164 matches phone numbers in E.164 form, a + and at most 15 digits
+var e164 = regexp.MustCompile(`^\+[1-9]\d{6,14}$`)
+
+// twoDigitCountryCodes are the country calling codes with two digits. 1 and 7 are the codes with one digit, and every
+// other code has three.
+var twoDigitCountryCodes = map[string]bool{
+	"20": true, "27": true, "30": true, "31": true, "32": true, "33": true, "34": true, "36": true, "39": true,
+	"40": true, "41": true, "43": true, "44": true, "45": true, "46": true, "47": true, "48": true, "49": true,
+	"51": true, "52": true, "53": true, "54": true, "55": true, "56": true, "57": true, "58": true,
+	"60": true, "61": true, "62": true, "63": true, "64": true, "65": true, "66": true,
+	"81": true, "82": true, "84": true, "86": true,
+	"90": true, "91": true, "92": true, "93": true, "94": true, "95": true, "98": true,
+}
+
+// withoutSeparators removes the separators people write between digits
+func withoutSeparators(s string, separators string) string {
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(separators, r) {
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(s))
+}
+
+// normalizeSSN returns the nine digits of an SSN, which cannot have an area of 000, 666 or 900 and above, a group of
+// 00 or a serial of 0000
+func normalizeSSN(payload string) (string, error) {
+	ssn := withoutSeparators(payload, " -")
+	if len(ssn) != 9 || !isDigits(ssn) {
+		return "", ErrInvalidSSN
+	}
+	area, group, serial := ssn[:3], ssn[3:5], ssn[5:]
+	if area == "000" || area == "666" || area[0] == '9' || group == "00" || serial == "0000" {
+		return "", ErrInvalidSSN
+	}
+	return ssn, nil
+}
+
+func maskSSN(payload string) string {
+	return maskExcept(payload, 0, last4Length)
+}
+
+// bankAccount is the payload of bank account tokens
+type bankAccount struct {
+	RoutingNumber string `json:"routing_number"`
+	AccountNumber string `json:"account_number"`
+}
+
+// normalizeBankAccount returns the routing and account numbers of a JSON payload as digits, in JSON with the fields
+// in a fixed order. The routing number has to pass the ABA checksum.
+func normalizeBankAccount(payload string) (string, error) {
+	var account bankAccount
+	if err := json.Unmarshal([]byte(payload), &account); err != nil {
+		return "", ErrInvalidBankAccount
+	}
+	account.RoutingNumber = withoutSeparators(account.RoutingNumber, " -")
+	account.AccountNumber = withoutSeparators(account.AccountNumber, " -")
+	if !routingNumberValid(account.RoutingNumber) {
+		return "", ErrInvalidRoutingNumber
+	}
+	if len(account.AccountNumber) < minAccountLength || len(account.AccountNumber) > maxAccountLength ||
+		!isDigits(account.AccountNumber) {
+		return "", ErrInvalidBankAccount
+	}
+	normal, err := json.Marshal(account)
+	if err != nil {
+		return "", err
+	}
+	return string(normal), nil
+}
+
+// routingNumberValid reports whether the routing number has nine digits that pass the ABA checksum, which weighs the
+// digits 3, 7, 1 in turn
+func routingNumberValid(routing string) bool {
+	if len(routing) != routingNumberLength || !isDigits(routing) {
+		return false
+	}
+	weights := [3]int{3, 7, 1}
+	sum := 0
+	for i := range routing {
+		sum += int(routing[i]-'0') * weights[i%3]
+	}
+	return sum%10 == 0
+}
+
+// bankAccountMetadata derives the routing number, which names the bank, and the last four digits of the account
+func bankAccountMetadata(payload string) (map[string]any, error) {
+	var account bankAccount
+	if err := json.Unmarshal([]byte(payload), &account); err != nil {
+		return nil, ErrInvalidBankAccount
+	}
+	return map[string]any{
+		MetadataRoutingNumber: account.RoutingNumber,
+		MetadataLast4:         account.AccountNumber[len(account.AccountNumber)-last4Length:],
+	}, nil
+}
+
+// maskBankAccount shows the routing number and the last four digits of the account number
+func maskBankAccount(payload string) string {
+	var account bankAccount
+	if err := json.Unmarshal([]byte(payload), &account); err != nil {
+		return maskExcept(payload, 0, 0)
+	}
+	account.AccountNumber = maskExcept(account.AccountNumber, 0, last4Length)
+	masked, err := json.Marshal(account)
+	if err != nil {
+		return maskExcept(payload, 0, 0)
+	}
+	return string(masked)
+}
+
+// normalizeEmail returns an email address in lower case. Addresses with a display name or without a dot in their
+// domain are not accepted.
+func normalizeEmail(payload string) (string, error) {
+	email := strings.ToLower(strings.TrimSpace(payload))
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Name != "" || address.Address != email {
+		return "", ErrInvalidEmail
+	}
+	if !strings.Contains(emailDomain(email), ".") {
+		return "", ErrInvalidEmail
+	}
+	return email, nil
+}
+
+// emailDomain returns the domain of an email address, after its last @
+func emailDomain(email string) string {
+	return email[strings.LastIndex(email, "@")+1:]
+}
+
+func emailMetadata(payload string) (map[string]any, error) {
+	return map[string]any{MetadataDomain: emailDomain(payload)}, nil
+}
+
+// maskEmail shows the first character of the local part and the domain
+func maskEmail(payload string) string {
+	at := strings.LastIndex(payload, "@")
+	if at < 0 {
+		return maskExcept(payload, 0, 0)
+	}
+	return maskExcept(payload[:at], 1, 0) + payload[at:]
+}
+
+// normalizePhone returns a phone number in E.164 form, without the spaces, dashes, dots and parentheses it may be
+// written with
+func normalizePhone(payload string) (string, error) {
+	phone := withoutSeparators(payload, " -.()")
+	if !e164.MatchString(phone) {
+		return "", ErrInvalidPhone
+	}
+	return phone, nil
+}
+
+// countryCode returns the country calling code of a phone number in E.164 form, without the +
+func countryCode(phone string) string {
+	digits := phone[1:]
+	switch {
+	case digits[0] == '1' || digits[0] == '7':
+		return digits[:1]
+	case twoDigitCountryCodes[digits[:2]]:
+		return digits[:2]
+	default:
+		return digits[:3]
+	}
+}
+
+func phoneMetadata(payload string) (map[string]any, error) {
+	return map[string]any{MetadataCountryCode: countryCode(payload)}, nil
+}
+
+// maskPhone shows the country code and the last four digits
+func maskPhone(payload string) string {
+	if !e164.MatchString(payload) {
+		return maskExcept(payload, 0, 0)
+	}
+	return maskExcept(payload, 1+len(countryCode(payload)), last4Length)
+}
@@ -0,0 +1,119 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateToken_Normalize(t *testing.T) {
+	tests := []struct {
+		name         string
+		data         CreateToken
+		wantPayload  string
+		wantMetadata map[string]any
+		wantErr      error
+	}{
+		{name: "ssn", data: CreateToken{Payload: " 123-45-6789 ", TokenType: "ssn"}, wantPayload: "123456789"},
+		{name: "ssn without dashes", data: CreateToken{Payload: "123456789", TokenType: "ssn"}, wantPayload: "123456789"},
+		{name: "ssn too short", data: CreateToken{Payload: "123-45-678", TokenType: "ssn"}, wantErr: ErrInvalidSSN},
+		{name: "ssn area 000", data: CreateToken{Payload: "000-45-6789", TokenType: "ssn"}, wantErr: ErrInvalidSSN},
+		{name: "ssn area 666", data: CreateToken{Payload: "666-45-6789", TokenType: "ssn"}, wantErr: ErrInvalidSSN},
+		{name: "ssn area 9xx", data: CreateToken{Payload: "900-45-6789", TokenType: "ssn"}, wantErr: ErrInvalidSSN},
+		{name: "ssn group 00", data: CreateToken{Payload: "123-00-6789", TokenType: "ssn"}, wantErr: ErrInvalidSSN},
+		{name: "ssn serial 0000", data: CreateToken{Payload: "123-45-0000", TokenType: "ssn"}, wantErr: ErrInvalidSSN},
+		{
+			name:         "bank account",
+			data:         CreateToken{Payload: `{"account_number": "0001-2345-6789", "routing_number": "011000015"}`, TokenType: "bank_account"},
+			wantPayload:  `{"routing_number":"011000015","account_number":"000123456789"}`,
+			wantMetadata: map[string]any{"routing_number": "011000015", "last4": "6789"},
+		},
+		{
+			name:    "routing number checksum",
+			data:    CreateToken{Payload: `{"account_number": "000123456789", "routing_number": "011000016"}`, TokenType: "bank_account"},
+			wantErr: ErrInvalidRoutingNumber,
+		},
+		{
+			name:    "account number too short",
+			data:    CreateToken{Payload: `{"account_number": "123", "routing_number": "011000015"}`, TokenType: "bank_account"},
+			wantErr: ErrInvalidBankAccount,
+		},
+		{
+			name:    "account number with letters",
+			data:    CreateToken{Payload: `{"account_number": "12345abc", "routing_number": "011000015"}`, TokenType: "bank_account"},
+			wantErr: ErrInvalidBankAccount,
+		},
+		{name: "bank account that is not JSON", data: CreateToken{Payload: "011000015:000123456789", TokenType: "bank_account"}, wantErr: ErrInvalidBankAccount},
+		{
+			name:         "email",
+			data:         CreateToken{Payload: " Jane.Doe@Example.COM", TokenType: "email", Metadata: map[string]any{"domain": "spoofed.com", "source": "web"}},
+			wantPayload:  "jane.doe@example.com",
+			wantMetadata: map[string]any{"domain": "example.com", "source": "web"},
+		},
+		{name: "email with a display name", data: CreateToken{Payload: "Jane <jane@example.com>", TokenType: "email"}, wantErr: ErrInvalidEmail},
+		{name: "email without a domain", data: CreateToken{Payload: "jane@localhost", TokenType: "email"}, wantErr: ErrInvalidEmail},
+		{name: "not an email", data: CreateToken{Payload: "jane", TokenType: "email"}, wantErr: ErrInvalidEmail},
+		{
+			name:         "phone",
+			data:         CreateToken{Payload: "+1 (415) 555-2671", TokenType: "phone"},
+			wantPayload:  "+14155552671",
+			wantMetadata: map[string]any{"country_code": "1"},
+		},
+		{
+			name:         "phone with a two digit country code",
+			data:         CreateToken{Payload: "+44 20 7946 0958", TokenType: "phone"},
+			wantPayload:  "+442079460958",
+			wantMetadata: map[string]any{"country_code": "44"},
+		},
+		{
+			name:         "phone with a three digit country code",
+			data:         CreateToken{Payload: "+353.1.234.5678", TokenType: "phone"},
+			wantPayload:  "+35312345678",
+			wantMetadata: map[string]any{"country_code": "353"},
+		},
+		{name: "phone without a country code", data: CreateToken{Payload: "415-555-2671", TokenType: "phone"}, wantErr: ErrInvalidPhone},
+		{name: "phone that is too long", data: CreateToken{Payload: "+1234567890123456", TokenType: "phone"}, wantErr: ErrInvalidPhone},
+		{name: "other token types", data: CreateToken{Payload: " Jane@Example.com", TokenType: "contact"}, wantPayload: " Jane@Example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := tt.data
+			err := data.Normalize()
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantPayload, data.Payload)
+			assert.Equal(t, tt.wantMetadata, data.Metadata)
+		})
+	}
+}
+
+func TestMaskedReveal(t *testing.T) {
+	tests := []struct {
+		tokenType string
+		payload   string
+		want      string
+	}{
+		{tokenType: "ssn", payload: "123456789", want: "*****6789"},
+		{tokenType: "bank_account", payload: `{"routing_number":"011000015","account_number":"000123456789"}`, want: `{"routing_number":"011000015","account_number":"********6789"}`},
+		{tokenType: "bank_account", payload: "not json", want: "********"},
+		{tokenType: "email", payload: "jane.doe@example.com", want: "j*******@example.com"},
+		{tokenType: "email", payload: "j@example.com", want: "*@example.com"},
+		{tokenType: "phone", payload: "+14155552671", want: "+1******2671"},
+		{tokenType: "phone", payload: "+442079460958", want: "+44******0958"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tokenType+" "+tt.payload, func(t *testing.T) {
+			policy, err := RevealPolicies(nil).For(tt.tokenType, "masked")
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, policy.Apply(tt.payload))
+		})
+	}
+
+	_, err := RevealPolicies(nil).For("card", "masked")
+	assert.ErrorIs(t, err, ErrUnknownRevealPolicy, "only the built-in personal data types have a masked policy")
+	_, err = ParseRevealPolicies([]byte(`{"card": {"masked": {"kind": "masked"}}}`))
+	assert.ErrorContains(t, err, "masked is only built in")
+}
@@ -0,0 +1,165 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// RevealKind is how a reveal policy shows a decrypted payload
+type RevealKind string
+
+const (
+	// RevealFull shows the whole payload
+	RevealFull RevealKind = "full"
+	// RevealLast masks all but the last RevealPolicy.Last characters
+	RevealLast RevealKind = "last"
+	// RevealFirst6Last4 shows the first six and last four characters, like the BIN and last four digits of a card
+	RevealFirst6Last4 RevealKind = "first6_last4"
+	// RevealRedact masks every match of RevealPolicy.Pattern
+	RevealRedact RevealKind = "redact"
+	// RevealMasked is the masked view of a built-in token type, it cannot be configured
+	RevealMasked RevealKind = "masked"
+)
+
+// RevealDefault is the reveal policy used when a caller does not pick one
+const RevealDefault = "full"
+
+// maskChar replaces the characters a reveal policy hides
+const maskChar = "*"
+
+// ErrUnknownRevealPolicy is returned for a reveal policy that is not configured for the token type
+var ErrUnknownRevealPolicy = errors.New("unknown reveal policy")
+
+// RevealPolicy is a way of showing a decrypted payload. Characters that are hidden are replaced with *, so the masked
+// payload keeps its length.
+type RevealPolicy struct {
+	Kind RevealKind `json:"kind"`
+	// Last is the number of characters RevealLast shows
+	Last int `json:"last,omitempty"`
+	// Pattern is the regular expression RevealRedact masks the matches of
+	Pattern string `json:"pattern,omitempty"`
+
+	pattern *regexp.Regexp
+	// mask shows the payload for RevealMasked
+	mask func(payload string) string
+}
+
+// builtinReveals are the reveal policies every token type has, unless they are configured for it
+var builtinReveals = map[string]*RevealPolicy{
+	RevealDefault:  {Kind: RevealFull},
+	"last4":        {Kind: RevealLast, Last: 4},
+	"first6_last4": {Kind: RevealFirst6Last4},
+}
+
+// Validate checks the policy can be applied, compiling its pattern
+func (p *RevealPolicy) Validate() error {
+	switch p.Kind {
+	case RevealFull, RevealFirst6Last4:
+	case RevealLast:
+		if p.Last < 0 {
+			return errors.New("last must not be negative")
+		}
+	case RevealRedact:
+		if p.Pattern == "" {
+			return errors.New("redact needs a pattern")
+		}
+		pattern, err := regexp.Compile(p.Pattern)
+		if err != nil {
+			return fmt.Errorf("pattern: %w", err)
+		}
+		p.pattern = pattern
+	case RevealMasked:
+		return errors.New("masked is only built in")
+	default:
+		return fmt.Errorf("unknown kind %q", p.Kind)
+	}
+	return nil
+}
+
+// Apply returns the payload as the policy shows it. RevealLast and RevealFirst6Last4 show the card number of a JSON card
+// payload, not the end of the JSON. A payload too short to hide anything with them is masked completely.
+func (p *RevealPolicy) Apply(payload string) string {
+	switch p.Kind {
+	case RevealLast:
+		return maskExcept(jsonCardNumber(payload), 0, p.Last)
+	case RevealFirst6Last4:
+		return maskExcept(jsonCardNumber(payload), 6, 4)
+	case RevealRedact:
+		return p.pattern.ReplaceAllStringFunc(payload, func(match string) string {
+			return strings.Repeat(maskChar, utf8.RuneCountInString(match))
+		})
+	case RevealMasked:
+		return p.mask(payload)
+	default:
+		return payload
+	}
+}
+
+// jsonCardNumber returns the card number of a JSON object payload cardNumber can read one from, otherwise the payload
+func jsonCardNumber(payload string) string {
+	if !strings.HasPrefix(strings.TrimSpace(payload), "{") {
+		return payload
+	}
+	if pan, err := cardNumber(payload); err == nil {
+		return pan
+	}
+	return payload
+}
+
+// maskExcept masks all but the first and last characters of s, or all of it when it has no more than that
+func maskExcept(s string, first int, last int) string {
+	runes := []rune(s)
+	if len(runes) <= first+last {
+		return strings.Repeat(maskChar, len(runes))
+	}
+	return string(runes[:first]) + strings.Repeat(maskChar, len(runes)-first-last) + string(runes[len(runes)-last:])
+}
+
+// RevealPolicies holds the named reveal policies of each token type. The policies of the * type apply to every token
+// type, and the built-in full, last4 and first6_last4 policies to every type that does not configure them. The built-in
+// token types, other than card, also have a masked policy.
+type RevealPolicies map[string]map[string]*RevealPolicy
+
+// ParseRevealPolicies reads reveal policies by token type and name from JSON, such as
+// {"card": {"support": {"kind": "first6_last4"}}}
+func ParseRevealPolicies(data []byte) (RevealPolicies, error) {
+	policies := RevealPolicies{}
+	if err := json.Unmarshal(data, &policies); err != nil {
+		return nil, err
+	}
+	for tokenType, named := range policies {
+		for name, policy := range named {
+			if policy == nil {
+				return nil, fmt.Errorf("reveal policy %q of %q is empty", name, tokenType)
+			}
+			if err := policy.Validate(); err != nil {
+				return nil, fmt.Errorf("reveal policy %q of %q: %w", name, tokenType, err)
+			}
+		}
+	}
+	return policies, nil
+}
+
+// For returns the reveal policy of the token type with the name, RevealDefault when the name is empty
+func (r RevealPolicies) For(tokenType string, name string) (*RevealPolicy, error) {
+	if name == "" {
+		name = RevealDefault
+	}
+	if policy, ok := r[tokenType][name]; ok {
+		return policy, nil
+	}
+	if policy, ok := r["*"][name]; ok {
+		return policy, nil
+	}
+	if policy, ok := builtinReveal(tokenType, name); ok {
+		return policy, nil
+	}
+	if policy, ok := builtinReveals[name]; ok {
+		return policy, nil
+	}
+	return nil, fmt.Errorf("%w %q for %q tokens", ErrUnknownRevealPolicy, name, tokenType)
+}
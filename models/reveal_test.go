@@ -0,0 +1,103 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRevealPolicy_Apply(t *testing.T) {
+	ssn := &RevealPolicy{Kind: RevealRedact, Pattern: `\d{3}-\d{2}`}
+	assert.NoError(t, ssn.Validate())
+
+	tests := []struct {
+		name    string
+		policy  *RevealPolicy
+		payload string
+		want    string
+	}{
+		{name: "full", policy: &RevealPolicy{Kind: RevealFull}, payload: "4111111111111111", want: "4111111111111111"},
+		{name: "last 4", policy: &RevealPolicy{Kind: RevealLast, Last: 4}, payload: "4111111111111111", want: "************1111"},
+		{name: "last 0", policy: &RevealPolicy{Kind: RevealLast}, payload: "secret", want: "******"},
+		{name: "last with a short payload", policy: &RevealPolicy{Kind: RevealLast, Last: 4}, payload: "123", want: "***"},
+		{name: "first 6 last 4", policy: &RevealPolicy{Kind: RevealFirst6Last4}, payload: "4111111111111111", want: "411111******1111"},
+		{name: "first 6 last 4 with a short payload", policy: &RevealPolicy{Kind: RevealFirst6Last4}, payload: "4111111111", want: "**********"},
+		{name: "last 4 of a JSON card", policy: &RevealPolicy{Kind: RevealLast, Last: 4}, payload: `{"pan": "4111 1111 1111 1111", "exp": "0128"}`, want: "************1111"},
+		{name: "first 6 last 4 of a JSON card", policy: &RevealPolicy{Kind: RevealFirst6Last4}, payload: `{"number": "4111111111111111"}`, want: "411111******1111"},
+		{name: "JSON without a card number", policy: &RevealPolicy{Kind: RevealLast, Last: 4}, payload: `{"a": "b"}`, want: `******"b"}`},
+		{name: "characters rather than bytes", policy: &RevealPolicy{Kind: RevealLast, Last: 2}, payload: "äöüß", want: "**üß"},
+		{name: "redact", policy: ssn, payload: "SSN 123-45-6789", want: "SSN ******-6789"},
+		{name: "redact without a match", policy: ssn, payload: "none", want: "none"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.policy.Apply(tt.payload))
+		})
+	}
+}
+
+func TestParseRevealPolicies(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr string
+	}{
+		{name: "valid", data: `{"card": {"support": {"kind": "last", "last": 4}}, "*": {"ids": {"kind": "redact", "pattern": "\\d"}}}`},
+		{name: "unknown kind", data: `{"card": {"support": {"kind": "partial"}}}`, wantErr: `reveal policy "support" of "card": unknown kind "partial"`},
+		{name: "negative last", data: `{"card": {"support": {"kind": "last", "last": -1}}}`, wantErr: `reveal policy "support" of "card": last must not be negative`},
+		{name: "redact without a pattern", data: `{"card": {"support": {"kind": "redact"}}}`, wantErr: `reveal policy "support" of "card": redact needs a pattern`},
+		{name: "invalid pattern", data: `{"card": {"support": {"kind": "redact", "pattern": "("}}}`, wantErr: "pattern"},
+		{name: "empty policy", data: `{"card": {"support": null}}`, wantErr: `reveal policy "support" of "card" is empty`},
+		{name: "not JSON", data: `card`, wantErr: "invalid character"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseRevealPolicies([]byte(tt.data))
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestRevealPolicies_For(t *testing.T) {
+	policies, err := ParseRevealPolicies([]byte(`{
+		"card": {"support": {"kind": "first6_last4"}, "last4": {"kind": "last", "last": 2}},
+		"*": {"support": {"kind": "last", "last": 4}, "ids": {"kind": "redact", "pattern": "\\d"}}
+	}`))
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		tokenType string
+		reveal    string
+		want      string
+		wantErr   bool
+	}{
+		{name: "default", tokenType: "card", want: "4111111111111111"},
+		{name: "configured for the token type", tokenType: "card", reveal: "support", want: "411111******1111"},
+		{name: "configured for every token type", tokenType: "ssn", reveal: "support", want: "************1111"},
+		{name: "overrides a built-in policy", tokenType: "card", reveal: "last4", want: "**************11"},
+		{name: "built-in", tokenType: "ssn", reveal: "last4", want: "************1111"},
+		{name: "redact for every token type", tokenType: "ssn", reveal: "ids", want: "****************"},
+		{name: "unknown", tokenType: "card", reveal: "partial", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := policies.For(tt.tokenType, tt.reveal)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrUnknownRevealPolicy)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, policy.Apply("4111111111111111"))
+		})
+	}
+
+	// without a configuration only the built-in policies exist
+	policy, err := RevealPolicies(nil).For("card", "first6_last4")
+	assert.NoError(t, err)
+	assert.Equal(t, "411111******1111", policy.Apply("4111111111111111"))
+}
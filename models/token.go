@@ -1,23 +1,30 @@
 package models
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/sha512"
-	"encoding/hex"
-)
-
-var (
-	key = []byte("this is the secret key and stuff")
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"time"
 )
 
 // CreateToken is used for creating a new token, it does not have the ID or Token fields because those are generated
-// and will be part of the Token
+// and will be part of the Token. An empty token type is not stored, since DynamoDB does not allow empty index keys.
 type CreateToken struct {
 	Payload   string         `json:"payload" dynamodbav:"payload"`
-	TokenType string         `json:"token_type" dynamodbav:"token_type"`
-	TTL       int64          `json:"ttl" dynamodbav:"ttl"`
+	TokenType string         `json:"token_type" dynamodbav:"token_type,omitempty"`
+	TTL       int64          `json:"ttl" dynamodbav:"ttl" minimum:"0"`
 	Metadata  map[string]any `json:"metadata" dynamodbav:"metadata"`
+	// Format asks for a format-preserving card token, it implies TokenModeCard
+	Format *FormatOptions `json:"format,omitempty" dynamodbav:"format,omitempty"`
+	// MaxReveals limits how many times the payload can be decrypted, zero is unlimited
+	MaxReveals int64 `json:"max_reveals,omitempty" dynamodbav:"max_reveals,omitempty" minimum:"0"`
+}
+
+// UpdateToken holds the properties of a token that can be changed after it is created. The payload, and everything
+// derived from it, cannot be.
+type UpdateToken struct {
+	TTL      *int64         `json:"ttl,omitempty" minimum:"0" doc:"New TTL of the token in seconds"`
+	Metadata map[string]any `json:"metadata,omitempty" doc:"Replaces the metadata of the token"`
 }
 
 // Token is the full model of a token including the info from the BaseModel and the CreateToken
@@ -25,55 +32,159 @@ type Token struct {
 	BaseModel
 	CreateToken
 	Token string `json:"token" dynamodbav:"token"`
+	// Mode is how the token value was generated from the payload
+	Mode TokenMode `json:"token_mode,omitempty" dynamodbav:"token_mode,omitempty"`
+	// TokenKeyID is the ID of the tokenization key a keyed token value was derived with
+	TokenKeyID string `json:"token_key_id,omitempty" dynamodbav:"token_key_id,omitempty"`
+	// KeyID is the ID of the key-encryption key that wrapped the data key
+	KeyID string `json:"key_id,omitempty" dynamodbav:"key_id,omitempty"`
+	// WrappedKey is the data key the payload is sealed with, itself sealed with the key-encryption key
+	WrappedKey string `json:"-" dynamodbav:"wrapped_key,omitempty"`
+	// ExpiresAt is when the token expires in seconds since the epoch, derived from the TTL. Zero never expires.
+	ExpiresAt int64 `json:"expiresAt,omitempty" dynamodbav:"expiresAt,omitempty"`
+	// RevealsLeft is how many more times the payload of a token with MaxReveals can be decrypted
+	RevealsLeft int64 `json:"reveals_left,omitempty" dynamodbav:"reveals_left,omitempty"`
+}
+
+// ExpiresAfter returns the expiry for a TTL in seconds starting at from, zero when the TTL does not expire
+func ExpiresAfter(from time.Time, ttl int64) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return from.Add(time.Duration(ttl) * time.Second).Unix()
 }
 
-// Encrypt encrypts the payload using AES-GCM
-func (t *Token) Encrypt() error {
-	block, err := aes.NewCipher(key)
+// Expired reports whether the token has expired at now
+func (t *Token) Expired(now time.Time) bool {
+	return t.ExpiresAt != 0 && now.Unix() >= t.ExpiresAt
+}
+
+// Encrypt encrypts the payload with envelope encryption. A fresh random data key seals the payload with AES-GCM, and
+// is itself stored wrapped by the current key-encryption key from the KeyProvider, whose ID is recorded on the token.
+// The token value, type and ID are bound to the payload, so they must be set before encrypting.
+func (t *Token) Encrypt(ctx context.Context, keys KeyProvider) error {
+	kek, err := keys.CurrentKey(ctx)
+	if err != nil {
+		return err
+	}
+
+	dataKey := make([]byte, DataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return err
+	}
+	payload, err := seal(dataKey, []byte(t.Payload), t.additionalData())
 	if err != nil {
 		return err
 	}
-	gcm, err := cipher.NewGCM(block)
+	wrappedKey, err := seal(kek.Material, dataKey, nil)
 	if err != nil {
 		return err
 	}
 
-	nonce := make([]byte, gcm.NonceSize())
-	ciphertext := make([]byte, 0, len(t.Payload))
-	ciphertext = gcm.Seal(ciphertext, nonce, []byte(t.Payload), nil)
-	enc := hex.EncodeToString(ciphertext)
-	t.Payload = enc
+	t.Payload = payload
+	t.WrappedKey = wrappedKey
+	t.KeyID = kek.ID
 	return nil
 }
 
-// Decrypt decrypts the payload using AES-GCM
-func (t *Token) Decrypt() (string, error) {
-	block, err := aes.NewCipher(key)
+// Decrypt unwraps the token's data key and decrypts the payload with it. Payloads stored before envelope encryption
+// have no wrapped key and were sealed directly with the key-encryption key. A payload that does not belong to this
+// token fails with ErrIntegrity.
+func (t *Token) Decrypt(ctx context.Context, keys KeyProvider) (string, error) {
+	dataKey, err := t.dataKey(ctx, keys)
 	if err != nil {
 		return "", err
 	}
-	gcm, err := cipher.NewGCM(block)
+	decryptedData, err := open(dataKey, t.Payload, t.additionalData())
 	if err != nil {
 		return "", err
 	}
-	nonce := make([]byte, gcm.NonceSize())
-	cipherText, err := hex.DecodeString(t.Payload)
+	return string(decryptedData), nil
+}
+
+// NeedsRotation reports whether the token should be rotated, because it was sealed under a key other than
+// currentKeyID, or because it predates envelope encryption, random nonces or binding the payload to the token
+func (t *Token) NeedsRotation(currentKeyID string) bool {
+	return t.keyID() != currentKeyID || t.WrappedKey == "" || !isBoundEnvelope(t.Payload)
+}
+
+// Rotate moves the token to the current key-encryption key. Tokens using envelope encryption only have their data key
+// re-wrapped, older tokens are re-encrypted in full.
+func (t *Token) Rotate(ctx context.Context, keys KeyProvider) error {
+	if t.WrappedKey == "" || !isBoundEnvelope(t.Payload) || isLegacyEnvelope(t.WrappedKey) {
+		return t.Reencrypt(ctx, keys)
+	}
+
+	dataKey, err := t.dataKey(ctx, keys)
 	if err != nil {
-		return "", err
+		return err
 	}
-	decryptedData := make([]byte, 0, len(cipherText))
-	decryptedData, err = gcm.Open(decryptedData, nonce, cipherText, nil)
+	kek, err := keys.CurrentKey(ctx)
 	if err != nil {
-		return "", err
+		return err
 	}
-
-	return string(decryptedData), nil
+	wrappedKey, err := seal(kek.Material, dataKey, nil)
+	if err != nil {
+		return err
+	}
+	t.WrappedKey = wrappedKey
+	t.KeyID = kek.ID
+	return nil
 }
 
-// Tokenize creates a token from the payload using SHA512_256 algorithm
-func (t *Token) Tokenize() error {
-	h := sha512.New512_256()
-	h.Write([]byte(t.Payload))
-	t.Token = hex.EncodeToString(h.Sum(nil))
+// Reencrypt decrypts the payload and encrypts it again under a new data key and the current key-encryption key
+func (t *Token) Reencrypt(ctx context.Context, keys KeyProvider) error {
+	payload, err := t.Decrypt(ctx, keys)
+	if err != nil {
+		return err
+	}
+	// seal a copy so the plaintext never ends up on the token if encryption fails
+	sealed := Token{
+		BaseModel:   t.BaseModel,
+		CreateToken: CreateToken{Payload: payload, TokenType: t.TokenType},
+		Token:       t.Token,
+	}
+	if err := sealed.Encrypt(ctx, keys); err != nil {
+		return err
+	}
+	t.Payload = sealed.Payload
+	t.WrappedKey = sealed.WrappedKey
+	t.KeyID = sealed.KeyID
 	return nil
 }
+
+// dataKey returns the key the payload is sealed with
+func (t *Token) dataKey(ctx context.Context, keys KeyProvider) ([]byte, error) {
+	kek, err := keys.KeyByID(ctx, t.keyID())
+	if err != nil {
+		return nil, err
+	}
+	if t.WrappedKey == "" {
+		return kek.Material, nil
+	}
+	return open(kek.Material, t.WrappedKey, nil)
+}
+
+// additionalData is authenticated along with the payload, binding it to the token value, type and ID so a payload
+// copied onto another record does not decrypt
+func (t *Token) additionalData() []byte {
+	return lengthPrefixed(t.Token, t.TokenType, t.Id.String())
+}
+
+// lengthPrefixed joins fields, each prefixed with its length so fields cannot run into each other
+func lengthPrefixed(fields ...string) []byte {
+	var data []byte
+	for _, field := range fields {
+		data = binary.BigEndian.AppendUint32(data, uint32(len(field)))
+		data = append(data, field...)
+	}
+	return data
+}
+
+// keyID is the ID of the key-encryption key, tokens stored before key IDs were recorded use the default key
+func (t *Token) keyID() string {
+	if t.KeyID == "" {
+		return DefaultKeyID
+	}
+	return t.KeyID
+}
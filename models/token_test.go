@@ -1,6 +1,9 @@
 package models
 
 import (
+	"context"
+	"errors"
+	"strings"
 	"testing"
 	"time"
 
@@ -8,6 +11,38 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+// testKeyring is an in memory KeyProvider
+type testKeyring struct {
+	current string
+	keys    map[string][]byte
+}
+
+func (k testKeyring) CurrentKey(ctx context.Context) (*Key, error) {
+	return k.KeyByID(ctx, k.current)
+}
+
+func (k testKeyring) KeyByID(_ context.Context, id string) (*Key, error) {
+	material, ok := k.keys[id]
+	if !ok {
+		return nil, errors.New("unknown key")
+	}
+	return &Key{ID: id, Material: material}, nil
+}
+
+var (
+	testKey = testKeyring{
+		current: DefaultKeyID,
+		keys:    map[string][]byte{DefaultKeyID: []byte("this is the secret key and stuff")},
+	}
+	rotatedKey = testKeyring{
+		current: "key-2",
+		keys: map[string][]byte{
+			DefaultKeyID: []byte("this is the secret key and stuff"),
+			"key-2":      []byte("this is a different key material"),
+		},
+	}
+)
+
 func TestToken_Encrypt(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -88,7 +123,7 @@ func TestToken_Encrypt(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			originalPayload := tt.token.Payload
 
-			err := tt.token.Encrypt()
+			err := tt.token.Encrypt(context.Background(), testKey)
 
 			if tt.wantErr {
 				assert.Error(t, err)
@@ -99,11 +134,11 @@ func TestToken_Encrypt(t *testing.T) {
 			assert.NotEqual(t, originalPayload, tt.token.Payload, "payload should be encrypted")
 			assert.NotEmpty(t, tt.token.Payload, "encrypted payload should not be empty")
 
-			// Verify the encrypted payload is hex-encoded
-			assert.Regexp(t, "^[0-9a-f]+$", tt.token.Payload, "encrypted payload should be hex-encoded")
+			// Verify the encrypted payload is a hex-encoded v1 envelope
+			assert.Regexp(t, "^v2:[0-9a-f]+$", tt.token.Payload, "encrypted payload should be a hex-encoded envelope")
 
 			// Verify we can decrypt back to original
-			decrypted, err := tt.token.Decrypt()
+			decrypted, err := tt.token.Decrypt(context.Background(), testKey)
 			assert.NoError(t, err)
 			assert.Equal(t, originalPayload, decrypted, "decrypted payload should match original")
 		})
@@ -133,7 +168,7 @@ func TestToken_Decrypt(t *testing.T) {
 						Metadata:  map[string]any{"key": "value"},
 					},
 				}
-				_ = token.Encrypt()
+				_ = token.Encrypt(context.Background(), testKey)
 				return token
 			},
 			expectedResult: "test payload",
@@ -155,7 +190,7 @@ func TestToken_Decrypt(t *testing.T) {
 						Metadata:  map[string]any{},
 					},
 				}
-				_ = token.Encrypt()
+				_ = token.Encrypt(context.Background(), testKey)
 				return token
 			},
 			expectedResult: "",
@@ -177,7 +212,7 @@ func TestToken_Decrypt(t *testing.T) {
 						Metadata:  map[string]any{"role": "admin", "permissions": []string{"read", "write"}},
 					},
 				}
-				_ = token.Encrypt()
+				_ = token.Encrypt(context.Background(), testKey)
 				return token
 			},
 			expectedResult: "this is a very long payload that contains lots of text and should still decrypt properly without any issues",
@@ -199,7 +234,7 @@ func TestToken_Decrypt(t *testing.T) {
 						Metadata:  map[string]any{"special": true},
 					},
 				}
-				_ = token.Encrypt()
+				_ = token.Encrypt(context.Background(), testKey)
 				return token
 			},
 			expectedResult: "payload with special chars: !@#$%^&*(){}[]|\\:;\"'<>,.?/~`",
@@ -226,6 +261,51 @@ func TestToken_Decrypt(t *testing.T) {
 			expectedResult: "invalid hex string",
 			wantErr:        true,
 		},
+		{
+			name: "decrypt legacy zero nonce payload",
+			setupToken: func() Token {
+				return Token{
+					CreateToken: CreateToken{
+						Payload: "fc8df3ea16c7823811c85fead07f6589684f9799084fbad080134cc16d512339f5dfe9",
+					},
+				}
+			},
+			expectedResult: "this is the payload",
+			wantErr:        false,
+		},
+		{
+			name: "decrypt unsupported envelope version",
+			setupToken: func() Token {
+				return Token{
+					CreateToken: CreateToken{
+						Payload: "v9:deadbeef",
+					},
+				}
+			},
+			wantErr: true,
+		},
+		{
+			name: "decrypt truncated envelope",
+			setupToken: func() Token {
+				return Token{
+					CreateToken: CreateToken{
+						Payload: "v1:deadbeef",
+					},
+				}
+			},
+			wantErr: true,
+		},
+		{
+			name: "decrypt envelope with invalid hex",
+			setupToken: func() Token {
+				return Token{
+					CreateToken: CreateToken{
+						Payload: "v1:not hex",
+					},
+				}
+			},
+			wantErr: true,
+		},
 		{
 			name: "decrypt corrupted ciphertext",
 			setupToken: func() Token {
@@ -253,7 +333,7 @@ func TestToken_Decrypt(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			token := tt.setupToken()
 
-			result, err := token.Decrypt()
+			result, err := token.Decrypt(context.Background(), testKey)
 
 			if tt.wantErr {
 				assert.Error(t, err)
@@ -267,91 +347,343 @@ func TestToken_Decrypt(t *testing.T) {
 	}
 }
 
-func TestToken_Tokenize(t *testing.T) {
+func TestToken_EncryptUsesRandomNonce(t *testing.T) {
+	first := Token{CreateToken: CreateToken{Payload: "same payload"}}
+	second := Token{CreateToken: CreateToken{Payload: "same payload"}}
+
+	assert.NoError(t, first.Encrypt(context.Background(), testKey))
+	assert.NoError(t, second.Encrypt(context.Background(), testKey))
+	assert.NotEqual(t, first.Payload, second.Payload, "the same payload should not encrypt to the same ciphertext")
+
+	for _, token := range []Token{first, second} {
+		decrypted, err := token.Decrypt(context.Background(), testKey)
+		assert.NoError(t, err)
+		assert.Equal(t, "same payload", decrypted)
+	}
+}
+
+// failingKeys is a KeyProvider that cannot hand out a key
+type failingKeys struct{}
+
+func (failingKeys) CurrentKey(_ context.Context) (*Key, error) {
+	return nil, errors.New("no key")
+}
+
+func (failingKeys) KeyByID(_ context.Context, _ string) (*Key, error) {
+	return nil, errors.New("no key")
+}
+
+func TestToken_KeyProviderErrors(t *testing.T) {
 	tests := []struct {
-		name    string
-		payload string
-		wantErr bool
+		name string
+		keys KeyProvider
 	}{
 		{
-			name:    "tokenize simple payload",
-			payload: "test payload",
-			wantErr: false,
+			name: "provider error",
+			keys: failingKeys{},
 		},
 		{
-			name:    "tokenize empty payload",
-			payload: "",
-			wantErr: false,
+			name: "invalid key size",
+			keys: testKeyring{current: DefaultKeyID, keys: map[string][]byte{DefaultKeyID: []byte("too short")}},
 		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := Token{CreateToken: CreateToken{Payload: "test payload"}}
+			assert.Error(t, token.Encrypt(context.Background(), tt.keys))
+			assert.Equal(t, "test payload", token.Payload, "payload should be untouched on error")
+
+			_, err := token.Decrypt(context.Background(), tt.keys)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestToken_KeyVersions(t *testing.T) {
+	token := Token{CreateToken: CreateToken{Payload: "test payload"}}
+	assert.NoError(t, token.Encrypt(context.Background(), testKey))
+	assert.Equal(t, DefaultKeyID, token.KeyID)
+
+	// a keyring that has moved on to a new key can still open payloads sealed with the old one
+	decrypted, err := token.Decrypt(context.Background(), rotatedKey)
+	assert.NoError(t, err)
+	assert.Equal(t, "test payload", decrypted)
+
+	// and new payloads are sealed with the current key
+	newToken := Token{CreateToken: CreateToken{Payload: "test payload"}}
+	assert.NoError(t, newToken.Encrypt(context.Background(), rotatedKey))
+	assert.Equal(t, "key-2", newToken.KeyID)
+	_, err = newToken.Decrypt(context.Background(), testKey)
+	assert.Error(t, err, "the old keyring does not have the new key")
+}
+
+func TestToken_EnvelopeEncryption(t *testing.T) {
+	first := Token{CreateToken: CreateToken{Payload: "same payload"}}
+	second := Token{CreateToken: CreateToken{Payload: "same payload"}}
+	assert.NoError(t, first.Encrypt(context.Background(), testKey))
+	assert.NoError(t, second.Encrypt(context.Background(), testKey))
+
+	assert.Regexp(t, "^v1:[0-9a-f]+$", first.WrappedKey, "wrapped key should be a hex-encoded envelope")
+	assert.NotEqual(t, first.WrappedKey, second.WrappedKey, "every token should get its own data key")
+
+	// the data key of one token cannot open another token's payload
+	swapped := first
+	swapped.WrappedKey = second.WrappedKey
+	_, err := swapped.Decrypt(context.Background(), testKey)
+	assert.Error(t, err)
+
+	// a tampered wrapped key does not unwrap
+	tampered := first
+	tampered.WrappedKey = "v1:" + strings.Repeat("00", 60)
+	_, err = tampered.Decrypt(context.Background(), testKey)
+	assert.Error(t, err)
+}
+
+func TestToken_Rotate(t *testing.T) {
+	token := Token{CreateToken: CreateToken{Payload: "test payload"}}
+	assert.NoError(t, token.Encrypt(context.Background(), testKey))
+	payload := token.Payload
+	wrappedKey := token.WrappedKey
+
+	assert.NoError(t, token.Rotate(context.Background(), rotatedKey))
+	assert.Equal(t, "key-2", token.KeyID)
+	assert.Equal(t, payload, token.Payload, "rotating only re-wraps the data key")
+	assert.NotEqual(t, wrappedKey, token.WrappedKey)
+	assert.False(t, token.NeedsRotation("key-2"))
+
+	decrypted, err := token.Decrypt(context.Background(), rotatedKey)
+	assert.NoError(t, err)
+	assert.Equal(t, "test payload", decrypted)
+
+	// tokens sealed before envelope encryption are re-encrypted in full
+	legacy := Token{CreateToken: CreateToken{
+		Payload: "fc8df3ea16c7823811c85fead07f6589684f9799084fbad080134cc16d512339f5dfe9",
+	}}
+	assert.NoError(t, legacy.Rotate(context.Background(), rotatedKey))
+	assert.NotEmpty(t, legacy.WrappedKey)
+	assert.False(t, legacy.NeedsRotation("key-2"))
+	decrypted, err = legacy.Decrypt(context.Background(), rotatedKey)
+	assert.NoError(t, err)
+	assert.Equal(t, "this is the payload", decrypted)
+}
+
+func TestToken_RotateErrors(t *testing.T) {
+	token := Token{CreateToken: CreateToken{Payload: "test payload"}}
+	assert.NoError(t, token.Encrypt(context.Background(), testKey))
+
+	tests := []struct {
+		name  string
+		token Token
+		keys  KeyProvider
+	}{
 		{
-			name:    "tokenize long payload",
-			payload: "this is a very long payload that contains lots of text and should still generate a consistent hash",
-			wantErr: false,
+			name:  "key-encryption key is gone",
+			token: token,
+			keys:  testKeyring{current: "key-2", keys: map[string][]byte{"key-2": rotatedKey.keys["key-2"]}},
 		},
 		{
-			name:    "tokenize payload with special characters",
-			payload: "payload with special chars: !@#$%^&*(){}[]|\\:;\"'<>,.?/~`",
-			wantErr: false,
+			name:  "current key unavailable",
+			token: token,
+			keys:  testKeyring{current: "missing", keys: testKey.keys},
 		},
 		{
-			name:    "tokenize unicode payload",
-			payload: "payload with unicode: 你好世界 🚀 ñáéíóú",
-			wantErr: false,
+			name: "corrupt wrapped key",
+			token: func() Token {
+				corrupt := token
+				corrupt.WrappedKey = "v1:deadbeef"
+				return corrupt
+			}(),
+			keys: rotatedKey,
 		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			original := tt.token
+			assert.Error(t, tt.token.Rotate(context.Background(), tt.keys))
+			assert.Equal(t, original, tt.token, "token should be untouched on error")
+		})
+	}
+}
+
+func TestToken_NeedsRotation(t *testing.T) {
+	tests := []struct {
+		name    string
+		token   Token
+		current string
+		want    bool
+	}{
 		{
-			name:    "tokenize json payload",
-			payload: `{"user":"admin","role":"super","permissions":["read","write","delete"]}`,
-			wantErr: false,
+			name:    "wrapped by current key",
+			token:   Token{KeyID: "key-2", WrappedKey: "v1:abcd", CreateToken: CreateToken{Payload: "v2:abcd"}},
+			current: "key-2",
+			want:    false,
 		},
 		{
-			name:    "tokenize whitespace payload",
-			payload: "   \t\n   ",
-			wantErr: false,
+			name:    "wrapped by retired key",
+			token:   Token{KeyID: "key-1", WrappedKey: "v1:abcd", CreateToken: CreateToken{Payload: "v2:abcd"}},
+			current: "key-2",
+			want:    true,
 		},
 		{
-			name:    "tokenize numeric string payload",
-			payload: "1234567890",
-			wantErr: false,
+			name:    "no key ID is the default key",
+			token:   Token{WrappedKey: "v1:abcd", CreateToken: CreateToken{Payload: "v2:abcd"}},
+			current: DefaultKeyID,
+			want:    false,
+		},
+		{
+			name:    "payload not bound to the token",
+			token:   Token{KeyID: "key-2", WrappedKey: "v1:abcd", CreateToken: CreateToken{Payload: "v1:abcd"}},
+			current: "key-2",
+			want:    true,
+		},
+		{
+			name:    "sealed before envelope encryption",
+			token:   Token{KeyID: "key-2", CreateToken: CreateToken{Payload: "v1:abcd"}},
+			current: "key-2",
+			want:    true,
+		},
+		{
+			name:    "legacy zero nonce payload",
+			token:   Token{CreateToken: CreateToken{Payload: "abcd"}},
+			current: DefaultKeyID,
+			want:    true,
 		},
 	}
-
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			token := Token{
-				BaseModel: BaseModel{
-					Id:        uuid.New(),
-					CreatedAt: time.Now(),
-					UpdatedAt: time.Now(),
-				},
-				CreateToken: CreateToken{
-					Payload:   tt.payload,
-					TokenType: "test",
-					TTL:       3600,
-					Metadata:  map[string]any{},
-				},
-			}
-
-			err := token.Tokenize()
+			assert.Equal(t, tt.want, tt.token.NeedsRotation(tt.current))
+		})
+	}
+}
 
+func TestToken_Reencrypt(t *testing.T) {
+	tests := []struct {
+		name    string
+		token   Token
+		keys    KeyProvider
+		wantErr bool
+	}{
+		{
+			name: "legacy payload moves to the current key",
+			token: Token{CreateToken: CreateToken{
+				Payload: "fc8df3ea16c7823811c85fead07f6589684f9799084fbad080134cc16d512339f5dfe9",
+			}},
+			keys: rotatedKey,
+		},
+		{
+			name:    "undecryptable payload",
+			token:   Token{CreateToken: CreateToken{Payload: "deadbeef"}},
+			keys:    rotatedKey,
+			wantErr: true,
+		},
+		{
+			name: "current key unavailable",
+			token: Token{CreateToken: CreateToken{
+				Payload: "fc8df3ea16c7823811c85fead07f6589684f9799084fbad080134cc16d512339f5dfe9",
+			}},
+			keys:    testKeyring{current: "missing", keys: testKey.keys},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			original := tt.token.Payload
+			err := tt.token.Reencrypt(context.Background(), tt.keys)
 			if tt.wantErr {
 				assert.Error(t, err)
+				assert.Equal(t, original, tt.token.Payload, "payload should be untouched on error")
 				return
 			}
+			assert.NoError(t, err)
+			assert.Equal(t, "key-2", tt.token.KeyID)
+			assert.False(t, tt.token.NeedsRotation("key-2"))
 
+			decrypted, err := tt.token.Decrypt(context.Background(), tt.keys)
 			assert.NoError(t, err)
-			assert.NotEmpty(t, token.Token, "token should not be empty")
-			assert.Len(t, token.Token, 64, "SHA512-256 hash should be 64 hex characters")
-			assert.Regexp(t, "^[0-9a-f]+$", token.Token, "token should be hex-encoded")
+			assert.Equal(t, "this is the payload", decrypted)
+		})
+	}
+}
 
-			// Test deterministic behavior - same payload should generate same token
-			token2 := Token{
-				CreateToken: CreateToken{
-					Payload: tt.payload,
-				},
-			}
-			err2 := token2.Tokenize()
-			assert.NoError(t, err2)
-			assert.Equal(t, token.Token, token2.Token, "same payload should generate same token")
+func TestToken_AdditionalData(t *testing.T) {
+	newToken := func(token, tokenType string) Token {
+		base, err := NewBaseModel()
+		assert.NoError(t, err)
+		return Token{
+			BaseModel:   base,
+			CreateToken: CreateToken{Payload: "payload of " + token, TokenType: tokenType},
+			Token:       token,
+		}
+	}
+	first := newToken("first-token", "card")
+	second := newToken("second-token", "card")
+	assert.NoError(t, first.Encrypt(context.Background(), testKey))
+	assert.NoError(t, second.Encrypt(context.Background(), testKey))
+
+	tests := []struct {
+		name   string
+		modify func(token *Token)
+	}{
+		{
+			name: "payload moved to another record",
+			modify: func(token *Token) {
+				token.Payload = second.Payload
+				token.WrappedKey = second.WrappedKey
+			},
+		},
+		{
+			name:   "token value changed",
+			modify: func(token *Token) { token.Token = "second-token" },
+		},
+		{
+			name:   "token type changed",
+			modify: func(token *Token) { token.TokenType = "ssn" },
+		},
+		{
+			name:   "record ID changed",
+			modify: func(token *Token) { token.Id = second.Id },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := first
+			tt.modify(&token)
+			_, err := token.Decrypt(context.Background(), testKey)
+			assert.ErrorIs(t, err, ErrIntegrity)
 		})
 	}
+
+	decrypted, err := first.Decrypt(context.Background(), testKey)
+	assert.NoError(t, err)
+	assert.Equal(t, "payload of first-token", decrypted)
+
+	// payloads sealed before they were bound to the token still decrypt until they are rotated
+	unbound := newToken("first-token", "card")
+	unbound.Payload, err = seal(testKey.keys[DefaultKeyID], []byte("unbound payload"), nil)
+	assert.NoError(t, err)
+	assert.True(t, unbound.NeedsRotation(DefaultKeyID))
+	decrypted, err = unbound.Decrypt(context.Background(), testKey)
+	assert.NoError(t, err)
+	assert.Equal(t, "unbound payload", decrypted)
+
+	assert.NoError(t, unbound.Rotate(context.Background(), testKey))
+	assert.False(t, unbound.NeedsRotation(DefaultKeyID))
+	decrypted, err = unbound.Decrypt(context.Background(), testKey)
+	assert.NoError(t, err)
+	assert.Equal(t, "unbound payload", decrypted)
+}
+
+func TestToken_Expired(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, now.Add(time.Hour).Unix(), ExpiresAfter(now, 3600))
+	assert.Zero(t, ExpiresAfter(now, 0), "a TTL of zero never expires")
+	assert.Zero(t, ExpiresAfter(now, -1))
+
+	token := Token{ExpiresAt: now.Unix()}
+	assert.True(t, token.Expired(now))
+	assert.True(t, token.Expired(now.Add(time.Second)))
+	assert.False(t, token.Expired(now.Add(-time.Second)))
+	assert.False(t, (&Token{}).Expired(now), "tokens without an expiry never expire")
 }
@@ -0,0 +1,129 @@
+package models
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// TokenMode is how a token value is generated from its payload
+type TokenMode string
+
+const (
+	// TokenModeHMAC is an HMAC-SHA-512/256 of the token type and payload keyed with the tokenization key. It is the
+	// default.
+	TokenModeHMAC TokenMode = "hmac"
+	// TokenModeSHA is an unkeyed SHA-512/256 of the payload. Anyone can compute it offline, so it is only kept for
+	// token types that must keep minting the same tokens as before keyed tokenization.
+	TokenModeSHA TokenMode = "sha"
+	// TokenModeRandom is a random value from a CSPRNG, so every tokenization gets a unique token
+	TokenModeRandom TokenMode = "random"
+	// TokenModeCard is a format-preserving token for a card number, see FormatOptions
+	TokenModeCard TokenMode = "card"
+)
+
+// defaultModes are the modes of token types that are not configured in TokenModes.ByType
+var defaultModes = map[string]TokenMode{
+	cardTokenType: TokenModeCard,
+}
+
+// randomTokenSize is the number of random bytes in a TokenModeRandom token, the same size as the hashed tokens
+const randomTokenSize = 32
+
+// TokenModes picks the TokenMode for each token type
+type TokenModes struct {
+	// Default is used for token types that are not in ByType or defaultModes, TokenModeHMAC when empty
+	Default TokenMode
+	ByType  map[string]TokenMode
+}
+
+// ModeFor returns the TokenMode configured for a token type
+func (m TokenModes) ModeFor(tokenType string) TokenMode {
+	if mode, ok := m.ByType[tokenType]; ok {
+		return mode
+	}
+	if mode, ok := defaultModes[tokenType]; ok {
+		return mode
+	}
+	if m.Default != "" {
+		return m.Default
+	}
+	return TokenModeHMAC
+}
+
+// ParseTokenModes reads token modes by type from a comma separated list of "type=mode" entries
+func ParseTokenModes(text string) (map[string]TokenMode, error) {
+	modes := map[string]TokenMode{}
+	for _, entry := range strings.Split(text, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		tokenType, mode, found := strings.Cut(entry, "=")
+		if !found || tokenType == "" {
+			return nil, fmt.Errorf("invalid token mode %q, expected type=mode", entry)
+		}
+		if err := TokenMode(mode).Validate(); err != nil {
+			return nil, err
+		}
+		modes[tokenType] = TokenMode(mode)
+	}
+	return modes, nil
+}
+
+// Validate checks that the TokenMode is one the service knows how to generate
+func (m TokenMode) Validate() error {
+	switch m {
+	case TokenModeHMAC, TokenModeSHA, TokenModeRandom, TokenModeCard:
+		return nil
+	default:
+		return fmt.Errorf("%w: %q", ErrUnknownTokenMode, m)
+	}
+}
+
+// Deterministic reports whether the same payload always gets the same token in this mode
+func (m TokenMode) Deterministic() bool {
+	return m != TokenModeRandom
+}
+
+// Tokenize creates the token value from the payload according to the token's Mode, which defaults to TokenModeHMAC.
+// The keys are the tokenization keys, which must be kept separate from the encryption keys. Keyed tokens are derived
+// with their current key, whose ID is recorded on the token, so the keys should be pinned to one key.
+func (t *Token) Tokenize(ctx context.Context, keys KeyProvider) error {
+	if t.Mode == "" {
+		t.Mode = TokenModeHMAC
+	}
+
+	switch t.Mode {
+	case TokenModeHMAC:
+		key, err := keys.CurrentKey(ctx)
+		if err != nil {
+			return err
+		}
+		// the type is part of the input, so the same payload gets a different token for every type. Tokens made before it
+		// was are still found by their value, but the payload gets a new token when it is tokenized again.
+		h := hmac.New(sha512.New512_256, key.Material)
+		h.Write(lengthPrefixed(t.TokenType, t.Payload))
+		t.Token = hex.EncodeToString(h.Sum(nil))
+		t.TokenKeyID = key.ID
+	case TokenModeSHA:
+		h := sha512.New512_256()
+		h.Write([]byte(t.Payload))
+		t.Token = hex.EncodeToString(h.Sum(nil))
+	case TokenModeRandom:
+		value := make([]byte, randomTokenSize)
+		if _, err := rand.Read(value); err != nil {
+			return err
+		}
+		t.Token = hex.EncodeToString(value)
+	case TokenModeCard:
+		return t.tokenizeCard(ctx, keys)
+	default:
+		return t.Mode.Validate()
+	}
+	return nil
+}
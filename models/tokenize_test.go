@@ -0,0 +1,276 @@
+package models
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestToken_Tokenize(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		wantErr bool
+	}{
+		{
+			name:    "tokenize simple payload",
+			payload: "test payload",
+			wantErr: false,
+		},
+		{
+			name:    "tokenize empty payload",
+			payload: "",
+			wantErr: false,
+		},
+		{
+			name:    "tokenize long payload",
+			payload: "this is a very long payload that contains lots of text and should still generate a consistent hash",
+			wantErr: false,
+		},
+		{
+			name:    "tokenize payload with special characters",
+			payload: "payload with special chars: !@#$%^&*(){}[]|\\:;\"'<>,.?/~`",
+			wantErr: false,
+		},
+		{
+			name:    "tokenize unicode payload",
+			payload: "payload with unicode: 你好世界 🚀 ñáéíóú",
+			wantErr: false,
+		},
+		{
+			name:    "tokenize json payload",
+			payload: `{"user":"admin","role":"super","permissions":["read","write","delete"]}`,
+			wantErr: false,
+		},
+		{
+			name:    "tokenize whitespace payload",
+			payload: "   \t\n   ",
+			wantErr: false,
+		},
+		{
+			name:    "tokenize numeric string payload",
+			payload: "1234567890",
+			wantErr: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := Token{
+				BaseModel: BaseModel{
+					Id:        uuid.New(),
+					CreatedAt: time.Now(),
+					UpdatedAt: time.Now(),
+				},
+				CreateToken: CreateToken{
+					Payload:   tt.payload,
+					TokenType: "test",
+					TTL:       3600,
+					Metadata:  map[string]any{},
+				},
+			}
+
+			err := token.Tokenize(context.Background(), testKey)
+
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.NotEmpty(t, token.Token, "token should not be empty")
+			assert.Equal(t, TokenModeHMAC, token.Mode, "tokens should default to HMAC")
+			assert.Len(t, token.Token, 64, "HMAC-SHA512-256 should be 64 hex characters")
+			assert.Regexp(t, "^[0-9a-f]+$", token.Token, "token should be hex-encoded")
+
+			// Test deterministic behavior - same payload and type should generate same token
+			token2 := Token{
+				CreateToken: CreateToken{
+					Payload:   tt.payload,
+					TokenType: "test",
+				},
+			}
+			err2 := token2.Tokenize(context.Background(), testKey)
+			assert.NoError(t, err2)
+			assert.Equal(t, token.Token, token2.Token, "same payload should generate same token")
+
+			otherType := Token{CreateToken: CreateToken{Payload: tt.payload, TokenType: "other"}}
+			assert.NoError(t, otherType.Tokenize(context.Background(), testKey))
+			assert.NotEqual(t, token.Token, otherType.Token, "the same payload should get a token per type")
+		})
+	}
+}
+
+func TestToken_TokenizeModes(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    TokenMode
+		keys    KeyProvider
+		want    string
+		wantErr error
+	}{
+		{
+			name: "legacy sha mode is unkeyed",
+			mode: TokenModeSHA,
+			keys: failingKeys{},
+			want: "e3061477f33275654a7beebe7ac6a4941adedec434d870a8bac71e7bff2eb137",
+		},
+		{
+			name: "hmac mode",
+			mode: TokenModeHMAC,
+			keys: testKey,
+			want: "aff5ea2bc1dfab7474d297fc0a249b1cd51e266508231b1f90eaa9d78c4d6938",
+		},
+		{
+			name: "hmac mode without a tokenization key",
+			mode: TokenModeHMAC,
+			keys: failingKeys{},
+		},
+		{
+			name:    "unknown mode",
+			mode:    "rot13",
+			keys:    testKey,
+			wantErr: ErrUnknownTokenMode,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := Token{Mode: tt.mode, CreateToken: CreateToken{Payload: "this is the payload"}}
+			err := token.Tokenize(context.Background(), tt.keys)
+			if tt.want == "" {
+				assert.Error(t, err)
+				if tt.wantErr != nil {
+					assert.ErrorIs(t, err, tt.wantErr)
+				}
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, token.Token)
+		})
+	}
+}
+
+func TestToken_TokenizeKeyed(t *testing.T) {
+	hmacToken := Token{CreateToken: CreateToken{Payload: "4111111111111111"}}
+	assert.NoError(t, hmacToken.Tokenize(context.Background(), testKey))
+	assert.Equal(t, DefaultKeyID, hmacToken.TokenKeyID, "the tokenization key should be recorded")
+
+	shaToken := Token{Mode: TokenModeSHA, CreateToken: CreateToken{Payload: "4111111111111111"}}
+	assert.NoError(t, shaToken.Tokenize(context.Background(), testKey))
+	assert.NotEqual(t, shaToken.Token, hmacToken.Token, "keyed tokens should not match the plain hash")
+	assert.Empty(t, shaToken.TokenKeyID)
+
+	otherKey := Token{CreateToken: CreateToken{Payload: "4111111111111111"}}
+	assert.NoError(t, otherKey.Tokenize(context.Background(), testKeyring{
+		current: DefaultKeyID,
+		keys:    map[string][]byte{DefaultKeyID: []byte("this is a different key material")},
+	}))
+	assert.NotEqual(t, hmacToken.Token, otherKey.Token, "tokens should depend on the tokenization key")
+}
+
+func TestTokenModes_ModeFor(t *testing.T) {
+	tests := []struct {
+		name      string
+		modes     TokenModes
+		tokenType string
+		want      TokenMode
+	}{
+		{
+			name:      "zero value defaults to hmac",
+			tokenType: "access",
+			want:      TokenModeHMAC,
+		},
+		{
+			name:      "configured default",
+			modes:     TokenModes{Default: TokenModeSHA},
+			tokenType: "access",
+			want:      TokenModeSHA,
+		},
+		{
+			name:      "card type defaults to card mode",
+			modes:     TokenModes{Default: TokenModeSHA},
+			tokenType: "card",
+			want:      TokenModeCard,
+		},
+		{
+			name:      "card type configured",
+			modes:     TokenModes{ByType: map[string]TokenMode{"card": TokenModeHMAC}},
+			tokenType: "card",
+			want:      TokenModeHMAC,
+		},
+		{
+			name:      "configured for the type",
+			modes:     TokenModes{Default: TokenModeHMAC, ByType: map[string]TokenMode{"legacy": TokenModeSHA}},
+			tokenType: "legacy",
+			want:      TokenModeSHA,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.modes.ModeFor(tt.tokenType))
+		})
+	}
+}
+
+func TestParseTokenModes(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		want    map[string]TokenMode
+		wantErr bool
+	}{
+		{
+			name: "empty",
+			text: "",
+			want: map[string]TokenMode{},
+		},
+		{
+			name: "several types",
+			text: "card=hmac, legacy=sha, event=random",
+			want: map[string]TokenMode{"card": TokenModeHMAC, "legacy": TokenModeSHA, "event": TokenModeRandom},
+		},
+		{
+			name:    "missing mode",
+			text:    "card",
+			wantErr: true,
+		},
+		{
+			name:    "missing type",
+			text:    "=hmac",
+			wantErr: true,
+		},
+		{
+			name:    "unknown mode",
+			text:    "card=md5",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseTokenModes(tt.text)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestToken_TokenizeRandom(t *testing.T) {
+	assert.True(t, TokenModeHMAC.Deterministic())
+	assert.True(t, TokenModeSHA.Deterministic())
+	assert.False(t, TokenModeRandom.Deterministic())
+
+	first := Token{Mode: TokenModeRandom, CreateToken: CreateToken{Payload: "4111111111111111"}}
+	second := Token{Mode: TokenModeRandom, CreateToken: CreateToken{Payload: "4111111111111111"}}
+	assert.NoError(t, first.Tokenize(context.Background(), failingKeys{}), "random tokens do not need a key")
+	assert.NoError(t, second.Tokenize(context.Background(), failingKeys{}))
+
+	assert.Regexp(t, "^[0-9a-f]{64}$", first.Token)
+	assert.NotEqual(t, first.Token, second.Token, "the same payload should get a new token every time")
+}
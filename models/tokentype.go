@@ -0,0 +1,255 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	ErrUnknownTokenType = errors.New("unknown token type")
+	ErrInvalidPayload   = errors.New("payload is not valid for its token type")
+	ErrInvalidMetadata  = errors.New("metadata is not valid for its token type")
+	ErrTTLTooLong       = errors.New("ttl is longer than its token type allows")
+	ErrNegativeTTL      = errors.New("ttl cannot be negative")
+)
+
+// SchemaError is a payload or metadata that does not match the JSON Schema of its token type
+type SchemaError struct {
+	// Err is ErrInvalidPayload or ErrInvalidMetadata
+	Err error
+	// Errors says what does not match and where, without the values
+	Errors []SchemaIssue
+}
+
+func (e *SchemaError) Error() string {
+	messages := make([]string, len(e.Errors))
+	for i, detail := range e.Errors {
+		messages[i] = detail.Error()
+	}
+	return fmt.Sprintf("%s: %s", e.Err, strings.Join(messages, "; "))
+}
+
+func (e *SchemaError) Unwrap() error {
+	return e.Err
+}
+
+// SchemaIssue is something in a payload or metadata that does not match a schema, never including the value
+type SchemaIssue struct {
+	Message string
+	// Location is where the value is, such as payload.zip
+	Location string
+}
+
+func (i SchemaIssue) Error() string {
+	if i.Location == "" {
+		return i.Message
+	}
+	return fmt.Sprintf("%s (%s)", i.Message, i.Location)
+}
+
+// SchemaValidator is a compiled JSON Schema of a token type
+type SchemaValidator interface {
+	// Validate returns what does not match the schema in the value found at location, nothing when it matches
+	Validate(location string, value any) []SchemaIssue
+}
+
+// SchemaCompiler compiles a JSON Schema of a token type, returning why it cannot be used when it is not valid
+type SchemaCompiler func(schema map[string]any) (SchemaValidator, error)
+
+// TokenTypeSpec defines a token type: what its payloads and metadata look like, how long its tokens live, how they are
+// generated and how their payloads are shown by default
+type TokenTypeSpec struct {
+	Description string `json:"description,omitempty" doc:"What the token type holds"`
+	// Pattern is a regular expression the whole payload has to match
+	Pattern string `json:"pattern,omitempty" doc:"Regular expression the whole payload has to match"`
+	// Schema is a JSON Schema the payload has to match, payloads of types with a schema have to be JSON
+	Schema map[string]any `json:"schema,omitempty" doc:"JSON Schema the payload, parsed as JSON, has to match"`
+	// MetadataSchema is a JSON Schema the metadata has to match
+	MetadataSchema map[string]any `json:"metadata_schema,omitempty" doc:"JSON Schema the metadata has to match"`
+	// DefaultTTL is used for tokens created without a TTL, it is MaxTTL when that is set and DefaultTTL is not
+	DefaultTTL int64 `json:"default_ttl,omitempty" doc:"TTL in seconds of tokens created without one"`
+	// MaxTTL is the longest TTL tokens can have, any TTL is allowed when it is zero
+	MaxTTL int64 `json:"max_ttl,omitempty" doc:"Longest TTL in seconds tokens can have"`
+	// Mode is how tokens are generated, before TokenModes, and Format the card token format used without a requested one
+	Mode   TokenMode      `json:"token_mode,omitempty" doc:"How tokens are generated"`
+	Format *FormatOptions `json:"format,omitempty" doc:"Format of card tokens"`
+	// Reveal is the reveal policy used for decrypts that do not pick one, RevealDefault when empty
+	Reveal string `json:"reveal,omitempty" doc:"Reveal policy payloads are shown with by default"`
+
+	pattern        *regexp.Regexp
+	schema         SchemaValidator
+	metadataSchema SchemaValidator
+}
+
+// Validate checks the spec can be used, compiling its pattern, and its schemas with compile
+func (s *TokenTypeSpec) Validate(compile SchemaCompiler) error {
+	if s.DefaultTTL < 0 || s.MaxTTL < 0 {
+		return errors.New("ttls must not be negative")
+	}
+	if s.MaxTTL > 0 && s.DefaultTTL > s.MaxTTL {
+		return errors.New("default_ttl must not be longer than max_ttl")
+	}
+	if s.DefaultTTL == 0 {
+		s.DefaultTTL = s.MaxTTL
+	}
+	if s.Mode != "" {
+		if err := s.Mode.Validate(); err != nil {
+			return err
+		}
+	}
+	if s.Format != nil && s.Mode != "" && s.Mode != TokenModeCard {
+		return errors.New("format can only be used with the card token mode")
+	}
+
+	if s.Pattern != "" {
+		pattern, err := regexp.Compile(`^(?:` + s.Pattern + `)$`)
+		if err != nil {
+			return fmt.Errorf("pattern: %w", err)
+		}
+		s.pattern = pattern
+	}
+	if (s.Schema != nil || s.MetadataSchema != nil) && compile == nil {
+		return errors.New("schemas cannot be compiled")
+	}
+	var err error
+	if s.Schema != nil {
+		if s.schema, err = compile(s.Schema); err != nil {
+			return fmt.Errorf("schema: %w", err)
+		}
+	}
+	if s.MetadataSchema != nil {
+		if s.metadataSchema, err = compile(s.MetadataSchema); err != nil {
+			return fmt.Errorf("metadata_schema: %w", err)
+		}
+	}
+	return nil
+}
+
+// Apply gives the token the defaults of its type and checks it against the type. A nil spec accepts everything but a
+// negative TTL, which would never expire and so get past any maximum. The payload is checked as the client sent it, which for built-in types is not the normal form Normalize replaces it
+// with, so a pattern such as \d{3}-\d{2}-\d{4} for SSNs matches what clients send.
+func (s *TokenTypeSpec) Apply(data *CreateToken, payload string) error {
+	if data.TTL < 0 {
+		return ErrNegativeTTL
+	}
+	if s == nil {
+		return nil
+	}
+	if data.TTL == 0 {
+		data.TTL = s.DefaultTTL
+	}
+	if s.MaxTTL > 0 && data.TTL > s.MaxTTL {
+		return ErrTTLTooLong
+	}
+	if err := s.checkPayload(payload); err != nil {
+		return err
+	}
+	return s.checkMetadata(data.Metadata)
+}
+
+// CheckUpdate checks an update of a token against its type. A nil spec accepts everything.
+func (s *TokenTypeSpec) CheckUpdate(update UpdateToken) error {
+	if s == nil {
+		return nil
+	}
+	// a TTL of zero never expires, which is longer than any maximum
+	if s.MaxTTL > 0 && update.TTL != nil && (*update.TTL == 0 || *update.TTL > s.MaxTTL) {
+		return ErrTTLTooLong
+	}
+	if update.Metadata == nil {
+		return nil
+	}
+	return s.checkMetadata(update.Metadata)
+}
+
+func (s *TokenTypeSpec) checkPayload(payload string) error {
+	if s.pattern != nil && !s.pattern.MatchString(payload) {
+		return ErrInvalidPayload
+	}
+	if s.schema == nil {
+		return nil
+	}
+	var value any
+	if err := json.Unmarshal([]byte(payload), &value); err != nil {
+		// the JSON error is not used, it can quote the payload
+		return &SchemaError{Err: ErrInvalidPayload, Errors: []SchemaIssue{{Message: "expected JSON", Location: "payload"}}}
+	}
+	return checkSchema(s.schema, "payload", value, ErrInvalidPayload)
+}
+
+func (s *TokenTypeSpec) checkMetadata(metadata map[string]any) error {
+	if s.metadataSchema == nil {
+		return nil
+	}
+	return checkSchema(s.metadataSchema, "metadata", metadata, ErrInvalidMetadata)
+}
+
+// checkSchema validates a value against a schema, returning a SchemaError wrapping err when it does not match
+func checkSchema(schema SchemaValidator, location string, value any, err error) error {
+	issues := schema.Validate(location, value)
+	if len(issues) == 0 {
+		return nil
+	}
+	return &SchemaError{Err: err, Errors: issues}
+}
+
+// TokenTypes is the registry of token types by name. Without any types every token type is accepted, as before the
+// registry existed.
+type TokenTypes map[string]*TokenTypeSpec
+
+// ParseTokenTypes reads token types by name from JSON, such as {"ssn": {"pattern": "\\d{3}-\\d{2}-\\d{4}"}}, compiling
+// their schemas with compile
+func ParseTokenTypes(data []byte, compile SchemaCompiler) (TokenTypes, error) {
+	types := TokenTypes{}
+	if err := json.Unmarshal(data, &types); err != nil {
+		return nil, err
+	}
+	for name, spec := range types {
+		if name == "" {
+			return nil, errors.New("token types must have a name")
+		}
+		if spec == nil {
+			return nil, fmt.Errorf("token type %q is empty", name)
+		}
+		if err := spec.Validate(compile); err != nil {
+			return nil, fmt.Errorf("token type %q: %w", name, err)
+		}
+	}
+	return types, nil
+}
+
+// Spec returns the spec of the token type, nil when the registry is empty
+func (t TokenTypes) Spec(name string) (*TokenTypeSpec, error) {
+	if len(t) == 0 {
+		return nil, nil
+	}
+	spec, ok := t[name]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownTokenType, name)
+	}
+	return spec, nil
+}
+
+// Reveal returns the name of the reveal policy payloads of the token type are shown with by default
+func (t TokenTypes) Reveal(name string) string {
+	if spec, ok := t[name]; ok && spec.Reveal != "" {
+		return spec.Reveal
+	}
+	return RevealDefault
+}
+
+// CheckReveals checks that the default reveal policy of every token type exists
+func (t TokenTypes) CheckReveals(reveals RevealPolicies) error {
+	for name, spec := range t {
+		if spec.Reveal == "" {
+			continue
+		}
+		if _, err := reveals.For(name, spec.Reveal); err != nil {
+			return fmt.Errorf("token type %q: %w", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package models
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// requiredKeys stands in for the schemas the api compiles: a schema is a list of required keys, and a type that is not
+// a string cannot be compiled
+func requiredKeys(schema map[string]any) (SchemaValidator, error) {
+	if _, ok := schema["type"].(string); !ok {
+		return nil, errors.New("type must be a string")
+	}
+	required, _ := schema["required"].([]any)
+	return requiredValidator(required), nil
+}
+
+type requiredValidator []any
+
+func (r requiredValidator) Validate(location string, value any) []SchemaIssue {
+	object, ok := value.(map[string]any)
+	if !ok {
+		return []SchemaIssue{{Message: "expected object", Location: location}}
+	}
+	var issues []SchemaIssue
+	for _, key := range r {
+		if _, ok := object[key.(string)]; !ok {
+			issues = append(issues, SchemaIssue{Message: "expected required property", Location: location + "." + key.(string)})
+		}
+	}
+	return issues
+}
+
+func TestParseTokenTypes(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr string
+	}{
+		{name: "valid", data: `{"ssn": {"pattern": "\\d{3}-\\d{2}-\\d{4}", "max_ttl": 3600, "reveal": "last4"}, "card": {"token_mode": "card", "format": {"preserve_last4": true}}}`},
+		{name: "schemas", data: `{"address": {"schema": {"type": "object", "required": ["zip"]}, "metadata_schema": {"type": "object"}}}`},
+		{name: "invalid pattern", data: `{"ssn": {"pattern": "("}}`, wantErr: `token type "ssn": pattern`},
+		{name: "invalid schema", data: `{"ssn": {"schema": {"type": 5}}}`, wantErr: `token type "ssn": schema: type must be a string`},
+		{name: "invalid metadata schema", data: `{"ssn": {"metadata_schema": {}}}`, wantErr: `token type "ssn": metadata_schema`},
+		{name: "negative ttl", data: `{"ssn": {"max_ttl": -1}}`, wantErr: `token type "ssn": ttls must not be negative`},
+		{name: "default longer than max", data: `{"ssn": {"default_ttl": 60, "max_ttl": 30}}`, wantErr: "default_ttl must not be longer than max_ttl"},
+		{name: "unknown mode", data: `{"ssn": {"token_mode": "fpe"}}`, wantErr: "unknown token mode"},
+		{name: "format with another mode", data: `{"card": {"token_mode": "hmac", "format": {}}}`, wantErr: "format can only be used with the card token mode"},
+		{name: "empty type", data: `{"ssn": null}`, wantErr: `token type "ssn" is empty`},
+		{name: "no name", data: `{"": {}}`, wantErr: "token types must have a name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseTokenTypes([]byte(tt.data), requiredKeys)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestTokenTypeSpec_Apply(t *testing.T) {
+	types, err := ParseTokenTypes([]byte(`{
+		"ssn": {"pattern": "\\d{3}-\\d{2}-\\d{4}", "max_ttl": 3600},
+		"address": {
+			"schema": {"type": "object", "required": ["zip"]},
+			"metadata_schema": {"type": "object", "required": ["region"]},
+			"default_ttl": 60
+		}
+	}`), requiredKeys)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		tokenType string
+		data      CreateToken
+		wantTTL   int64
+		wantErr   error
+		wantIn    string
+	}{
+		{name: "matching pattern", tokenType: "ssn", data: CreateToken{Payload: "123-45-6789", TTL: 600}, wantTTL: 600},
+		{name: "max ttl is the default", tokenType: "ssn", data: CreateToken{Payload: "123-45-6789"}, wantTTL: 3600},
+		{name: "ttl over the max", tokenType: "ssn", data: CreateToken{Payload: "123-45-6789", TTL: 3601}, wantErr: ErrTTLTooLong},
+		{name: "negative ttl never expires", tokenType: "ssn", data: CreateToken{Payload: "123-45-6789", TTL: -1}, wantErr: ErrNegativeTTL},
+		{name: "pattern matches the whole payload", tokenType: "ssn", data: CreateToken{Payload: "123-45-67890"}, wantErr: ErrInvalidPayload},
+		{
+			name:      "matching schemas",
+			tokenType: "address",
+			data:      CreateToken{Payload: `{"zip": "12345"}`, Metadata: map[string]any{"region": "eu"}},
+			wantTTL:   60,
+		},
+		{
+			name:      "payload that does not match the schema",
+			tokenType: "address",
+			data:      CreateToken{Payload: `{"street": "1234a"}`, Metadata: map[string]any{"region": "eu"}},
+			wantErr:   ErrInvalidPayload,
+			wantIn:    "payload.zip",
+		},
+		{
+			name:      "payload that is not JSON",
+			tokenType: "address",
+			data:      CreateToken{Payload: `12345 Main St`, Metadata: map[string]any{"region": "eu"}},
+			wantErr:   ErrInvalidPayload,
+			wantIn:    "expected JSON",
+		},
+		{
+			name:      "metadata that does not match the schema",
+			tokenType: "address",
+			data:      CreateToken{Payload: `{"zip": "12345"}`, Metadata: map[string]any{"country": "de"}},
+			wantErr:   ErrInvalidMetadata,
+			wantIn:    "metadata.region",
+		},
+		{
+			name:      "missing metadata",
+			tokenType: "address",
+			data:      CreateToken{Payload: `{"zip": "12345"}`},
+			wantErr:   ErrInvalidMetadata,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec, err := types.Spec(tt.tokenType)
+			assert.NoError(t, err)
+			data := tt.data
+			err = spec.Apply(&data, data.Payload)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				assert.ErrorContains(t, err, tt.wantIn)
+				assert.NotContains(t, err.Error(), "1234a", "values are not echoed back")
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantTTL, data.TTL)
+		})
+	}
+}
+
+func TestTokenTypeSpec_CheckUpdate(t *testing.T) {
+	types, err := ParseTokenTypes([]byte(`{"ssn": {"max_ttl": 3600, "metadata_schema": {"type": "object", "required": ["a"]}}}`), requiredKeys)
+	assert.NoError(t, err)
+	ttl := func(ttl int64) *int64 { return &ttl }
+
+	assert.NoError(t, types["ssn"].CheckUpdate(UpdateToken{TTL: ttl(60)}))
+	assert.NoError(t, types["ssn"].CheckUpdate(UpdateToken{Metadata: map[string]any{"a": "b"}}))
+	assert.ErrorIs(t, types["ssn"].CheckUpdate(UpdateToken{TTL: ttl(3601)}), ErrTTLTooLong)
+	assert.ErrorIs(t, types["ssn"].CheckUpdate(UpdateToken{TTL: ttl(0)}), ErrTTLTooLong, "a token that never expires")
+	assert.ErrorIs(t, types["ssn"].CheckUpdate(UpdateToken{Metadata: map[string]any{"c": "d"}}), ErrInvalidMetadata)
+	assert.NoError(t, types["card"].CheckUpdate(UpdateToken{TTL: ttl(0)}), "types that are not registered are not checked")
+}
+
+func TestTokenTypes_Spec(t *testing.T) {
+	spec, err := TokenTypes{}.Spec("anything")
+	assert.NoError(t, err, "every type is accepted without a registry")
+	assert.Nil(t, spec)
+	assert.NoError(t, spec.Apply(&CreateToken{Payload: "anything"}, "anything"))
+
+	types := TokenTypes{"card": {Reveal: "last4"}}
+	_, err = types.Spec("Card")
+	assert.ErrorIs(t, err, ErrUnknownTokenType)
+	spec, err = types.Spec("card")
+	assert.NoError(t, err)
+	assert.Equal(t, "last4", spec.Reveal)
+
+	assert.Equal(t, "last4", types.Reveal("card"))
+	assert.Equal(t, RevealDefault, types.Reveal("ssn"))
+	assert.NoError(t, types.CheckReveals(nil))
+	assert.ErrorIs(t, TokenTypes{"card": {Reveal: "support"}}.CheckReveals(nil), ErrUnknownRevealPolicy)
+}
+
+func TestTokenTypeSpec_ValidateWithoutCompiler(t *testing.T) {
+	spec := &TokenTypeSpec{Schema: map[string]any{"type": "object"}}
+	assert.ErrorContains(t, spec.Validate(nil), "schemas cannot be compiled")
+	assert.NoError(t, (&TokenTypeSpec{Pattern: "[0-9]+"}).Validate(nil))
+}
@@ -0,0 +1,83 @@
+package dynamodb
+
+import (
+	"context"
+	"errors"
+
+	"tokenize/models"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+var (
+	APIKeyTableName = aws.String("api_keys")
+)
+
+func (d *DynamoStore) GetAPIKey(ctx context.Context, keyHash string) (*models.APIKey, error) {
+	output, err := d.Api.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: APIKeyTableName,
+		Key: map[string]types.AttributeValue{
+			"key_hash": &types.AttributeValueMemberS{Value: keyHash},
+		},
+	})
+	if err != nil {
+		return nil, translateError(err)
+	}
+	if output == nil || output.Item == nil {
+		return nil, models.ErrAPIKeyNotFound
+	}
+
+	key := &models.APIKey{}
+	if err := attributevalue.UnmarshalMap(output.Item, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (d *DynamoStore) CreateAPIKey(ctx context.Context, key *models.APIKey) error {
+	item, err := attributevalue.MarshalMap(key)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.Api.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           APIKeyTableName,
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(key_hash)"),
+	})
+	return translateError(err)
+}
+
+// SetupAPIKeyTable creates the API key table if it does not exist
+func SetupAPIKeyTable(ctx context.Context, client Api) {
+	_, err := client.DescribeTable(ctx, &dynamodb.DescribeTableInput{
+		TableName: APIKeyTableName,
+	})
+	var notFoundEx *types.ResourceNotFoundException
+	if errors.As(err, &notFoundEx) {
+		_ = CreateAPIKeyTable(ctx, client)
+	}
+}
+
+func CreateAPIKeyTable(ctx context.Context, client Api) error {
+	_, err := client.CreateTable(ctx, &dynamodb.CreateTableInput{
+		TableName: APIKeyTableName,
+		AttributeDefinitions: []types.AttributeDefinition{
+			{
+				AttributeName: aws.String("key_hash"),
+				AttributeType: types.ScalarAttributeTypeS,
+			},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{
+				AttributeName: aws.String("key_hash"),
+				KeyType:       types.KeyTypeHash,
+			},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	})
+	return err
+}
@@ -0,0 +1,94 @@
+package dynamodb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"tokenize/models"
+	"tokenize/persistence"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetAPIKey(t *testing.T) {
+	key := &models.APIKey{
+		ID:        "0197a4b2-0000-7000-8000-000000000001",
+		KeyHash:   models.HashAPIKey("tk_test"),
+		Name:      "test",
+		Roles:     []string{"tokenizer"},
+		CreatedAt: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	item, err := attributevalue.MarshalMap(key)
+	assert.NoError(t, err)
+
+	testCases := []struct {
+		name    string
+		client  *mockDynamoAPI
+		want    *models.APIKey
+		wantErr error
+	}{
+		{
+			name: "found",
+			client: &mockDynamoAPI{
+				getItemFunc: func(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+					assert.Equal(t, "api_keys", *params.TableName)
+					assert.Equal(t, &types.AttributeValueMemberS{Value: key.KeyHash}, params.Key["key_hash"])
+					return &dynamodb.GetItemOutput{Item: item}, nil
+				},
+			},
+			want: key,
+		},
+		{
+			name: "not found",
+			client: &mockDynamoAPI{
+				getItemFunc: func(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+					return &dynamodb.GetItemOutput{}, nil
+				},
+			},
+			wantErr: models.ErrAPIKeyNotFound,
+		},
+		{
+			name: "throttled by dynamodb",
+			client: &mockDynamoAPI{
+				getItemFunc: func(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+					return nil, &types.ProvisionedThroughputExceededException{Message: aws.String("Rate of requests exceeds the allowed throughput")}
+				},
+			},
+			wantErr: persistence.ErrThrottled,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := &DynamoStore{Api: tc.client}
+			got, err := store.GetAPIKey(context.Background(), key.KeyHash)
+			if tc.wantErr != nil {
+				assert.ErrorIs(t, err, tc.wantErr)
+				assert.Nil(t, got)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestCreateAPIKey(t *testing.T) {
+	key := &models.APIKey{ID: "id", KeyHash: models.HashAPIKey("tk_test"), Name: "test", Roles: []string{"admin"}}
+	var input *dynamodb.PutItemInput
+	store := &DynamoStore{Api: &mockDynamoAPI{
+		putItemFunc: func(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+			input = params
+			return &dynamodb.PutItemOutput{}, nil
+		},
+	}}
+
+	assert.NoError(t, store.CreateAPIKey(context.Background(), key))
+	assert.Equal(t, "api_keys", *input.TableName)
+	assert.Equal(t, "attribute_not_exists(key_hash)", *input.ConditionExpression)
+	assert.Equal(t, &types.AttributeValueMemberS{Value: key.KeyHash}, input.Item["key_hash"])
+}
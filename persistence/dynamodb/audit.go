@@ -0,0 +1,269 @@
+package dynamodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"tokenize/audit"
+	"tokenize/models"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+var (
+	AuditTableName = aws.String("token_audit")
+	// AuditHeadTableName keeps the signed head of every chain apart from its records
+	AuditHeadTableName = aws.String("token_audit_heads")
+)
+
+// maxAuditAttempts is how many times appending a record is tried when other writers extend the same chain
+const maxAuditAttempts = 5
+
+// AuditStore stores audit records in DynamoDB, keyed by the tenant prefixed token and the sequence, and the head of
+// each chain in a table of its own
+type AuditStore struct {
+	Api Api
+	// Keys are the audit keys records are sealed with
+	Keys models.KeyProvider
+}
+
+// Append adds the record after the last record of its token, and moves the head of the chain to it in the same
+// transaction. The put only succeeds if no other record has taken the sequence, so concurrent writers cannot fork a
+// chain.
+func (a *AuditStore) Append(ctx context.Context, record *audit.Record) error {
+	key, err := a.Keys.CurrentKey(ctx)
+	if err != nil {
+		return err
+	}
+	for attempt := 0; attempt < maxAuditAttempts; attempt++ {
+		prev, err := a.last(ctx, record.Tenant, record.Token)
+		if err != nil {
+			return err
+		}
+		record.Seal(prev, key)
+
+		item, err := attributevalue.MarshalMap(record)
+		if err != nil {
+			return err
+		}
+		item["token"] = &types.AttributeValueMemberS{Value: models.StorageKey(record.Tenant, record.Token)}
+		head, err := attributevalue.MarshalMap(audit.NewHead(record, key))
+		if err != nil {
+			return err
+		}
+		head["token"] = item["token"]
+		_, err = a.Api.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+			TransactItems: []types.TransactWriteItem{
+				{Put: &types.Put{
+					TableName:           AuditTableName,
+					Item:                item,
+					ConditionExpression: aws.String("attribute_not_exists(#sequence)"),
+					ExpressionAttributeNames: map[string]string{
+						"#sequence": "sequence",
+					},
+				}},
+				{Put: &types.Put{
+					TableName:           AuditHeadTableName,
+					Item:                head,
+					ConditionExpression: aws.String("attribute_not_exists(#sequence) OR #sequence < :sequence"),
+					ExpressionAttributeNames: map[string]string{
+						"#sequence": "sequence",
+					},
+					ExpressionAttributeValues: map[string]types.AttributeValue{
+						":sequence": item["sequence"],
+					},
+				}},
+			},
+		})
+		// a transaction is canceled when another writer took the sequence, or was writing to the chain at the same time
+		var canceled *types.TransactionCanceledException
+		if !errors.As(err, &canceled) {
+			return translateError(err)
+		}
+	}
+	return fmt.Errorf("unable to append audit record after %d attempts", maxAuditAttempts)
+}
+
+// head returns the head of the token's chain, nil when it has none
+func (a *AuditStore) head(ctx context.Context, tenant string, token string) (*audit.Head, error) {
+	output, err := a.Api.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: AuditHeadTableName,
+		Key: map[string]types.AttributeValue{
+			"token": &types.AttributeValueMemberS{Value: models.StorageKey(tenant, token)},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, translateError(err)
+	}
+	if len(output.Item) == 0 {
+		return nil, nil
+	}
+	head := &audit.Head{}
+	if err := attributevalue.UnmarshalMap(output.Item, head); err != nil {
+		return nil, err
+	}
+	if head.Tenant != "" {
+		head.Token = strings.TrimPrefix(head.Token, head.Tenant+"#")
+	}
+	return head, nil
+}
+
+// last returns the last record of the token, nil when it has none
+func (a *AuditStore) last(ctx context.Context, tenant string, token string) (*audit.Record, error) {
+	output, err := a.Api.Query(ctx, &dynamodb.QueryInput{
+		TableName:              AuditTableName,
+		KeyConditionExpression: aws.String("#token = :token"),
+		ExpressionAttributeNames: map[string]string{
+			"#token": "token",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":token": &types.AttributeValueMemberS{Value: models.StorageKey(tenant, token)},
+		},
+		ScanIndexForward: aws.Bool(false),
+		Limit:            aws.Int32(1),
+		ConsistentRead:   aws.Bool(true),
+	})
+	if err != nil {
+		return nil, translateError(err)
+	}
+	if len(output.Items) == 0 {
+		return nil, nil
+	}
+	return unmarshalRecord(output.Items[0])
+}
+
+// unmarshalRecord reads a stored audit record, removing the tenant prefix from its key
+func unmarshalRecord(item map[string]types.AttributeValue) (*audit.Record, error) {
+	record := &audit.Record{}
+	if err := attributevalue.UnmarshalMap(item, record); err != nil {
+		return nil, err
+	}
+	if record.Tenant != "" {
+		record.Token = strings.TrimPrefix(record.Token, record.Tenant+"#")
+	}
+	return record, nil
+}
+
+// History returns the records of the tenant's token on the page in the order they were appended, and the head of its
+// chain. The page is read from the sequence it starts after, not by skipping the records before it.
+func (a *AuditStore) History(ctx context.Context, tenant string, token string, page audit.Page) ([]audit.Record, *audit.Head, error) {
+	head, err := a.head(ctx, tenant, token)
+	if err != nil {
+		return nil, nil, err
+	}
+	if head != nil && head.Tenant != tenant {
+		head = nil
+	}
+	records := []audit.Record{}
+	var startKey map[string]types.AttributeValue
+	for {
+		input := &dynamodb.QueryInput{
+			TableName:              AuditTableName,
+			KeyConditionExpression: aws.String("#token = :token AND #sequence > :after"),
+			ExpressionAttributeNames: map[string]string{
+				"#token":    "token",
+				"#sequence": "sequence",
+			},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":token": &types.AttributeValueMemberS{Value: models.StorageKey(tenant, token)},
+				":after": &types.AttributeValueMemberN{Value: strconv.FormatInt(page.After, 10)},
+			},
+			ExclusiveStartKey: startKey,
+			ConsistentRead:    aws.Bool(true),
+		}
+		if page.Limit > 0 {
+			input.Limit = aws.Int32(int32(page.Limit - len(records)))
+		}
+		output, err := a.Api.Query(ctx, input)
+		if err != nil {
+			return nil, nil, translateError(err)
+		}
+		for _, item := range output.Items {
+			record, err := unmarshalRecord(item)
+			if err != nil {
+				return nil, nil, err
+			}
+			// keys of the default tenant are the bare token, so only records of the tenant asked for are its history
+			if record.Tenant != tenant {
+				continue
+			}
+			records = append(records, *record)
+		}
+		if len(output.LastEvaluatedKey) == 0 || (page.Limit > 0 && len(records) == page.Limit) {
+			return records, head, nil
+		}
+		startKey = output.LastEvaluatedKey
+	}
+}
+
+// SetupAuditTable creates the audit and audit head tables if they do not exist
+func SetupAuditTable(ctx context.Context, client Api) {
+	var notFoundEx *types.ResourceNotFoundException
+	_, err := client.DescribeTable(ctx, &dynamodb.DescribeTableInput{
+		TableName: AuditTableName,
+	})
+	if errors.As(err, &notFoundEx) {
+		_ = CreateAuditTable(ctx, client)
+	}
+	_, err = client.DescribeTable(ctx, &dynamodb.DescribeTableInput{
+		TableName: AuditHeadTableName,
+	})
+	if errors.As(err, &notFoundEx) {
+		_ = CreateAuditHeadTable(ctx, client)
+	}
+}
+
+func CreateAuditTable(ctx context.Context, client Api) error {
+	_, err := client.CreateTable(ctx, &dynamodb.CreateTableInput{
+		TableName: AuditTableName,
+		AttributeDefinitions: []types.AttributeDefinition{
+			{
+				AttributeName: aws.String("token"),
+				AttributeType: types.ScalarAttributeTypeS,
+			},
+			{
+				AttributeName: aws.String("sequence"),
+				AttributeType: types.ScalarAttributeTypeN,
+			},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{
+				AttributeName: aws.String("token"),
+				KeyType:       types.KeyTypeHash,
+			},
+			{
+				AttributeName: aws.String("sequence"),
+				KeyType:       types.KeyTypeRange,
+			},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	})
+	return err
+}
+
+func CreateAuditHeadTable(ctx context.Context, client Api) error {
+	_, err := client.CreateTable(ctx, &dynamodb.CreateTableInput{
+		TableName: AuditHeadTableName,
+		AttributeDefinitions: []types.AttributeDefinition{
+			{
+				AttributeName: aws.String("token"),
+				AttributeType: types.ScalarAttributeTypeS,
+			},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{
+				AttributeName: aws.String("token"),
+				KeyType:       types.KeyTypeHash,
+			},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	})
+	return err
+}
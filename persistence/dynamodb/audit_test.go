@@ -0,0 +1,188 @@
+package dynamodb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"tokenize/audit"
+	"tokenize/keys"
+	"tokenize/models"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// testAuditKeys are the audit keys of the audit store tests
+var testAuditKeys = keys.Static("this is the audit key for tests.")
+
+func TestAuditStore_Append(t *testing.T) {
+	key, err := testAuditKeys.CurrentKey(context.Background())
+	assert.NoError(t, err)
+	first := audit.Record{Token: "test-token", Time: time.Now(), Operation: audit.OperationCreate, Outcome: audit.OutcomeSuccess}
+	first.Seal(nil, key)
+	firstItem, err := attributevalue.MarshalMap(first)
+	assert.NoError(t, err)
+	canceled := &types.TransactionCanceledException{Message: aws.String("Transaction cancelled")}
+
+	t.Run("continues the chain and moves its head", func(t *testing.T) {
+		var transaction *dynamodb.TransactWriteItemsInput
+		store := &AuditStore{Keys: testAuditKeys, Api: &mockDynamoAPI{
+			queryFunc: func(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+				assert.False(t, *params.ScanIndexForward, "the last record should be read")
+				assert.Equal(t, int32(1), *params.Limit)
+				return &dynamodb.QueryOutput{Items: []map[string]types.AttributeValue{firstItem}}, nil
+			},
+			transactFunc: func(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error) {
+				transaction = params
+				return &dynamodb.TransactWriteItemsOutput{}, nil
+			},
+		}}
+
+		record := &audit.Record{Token: "test-token", Time: time.Now(), Operation: audit.OperationRead, Outcome: audit.OutcomeSuccess}
+		assert.NoError(t, store.Append(context.Background(), record))
+		assert.Equal(t, int64(2), record.Sequence)
+		assert.Equal(t, first.Hash, record.PrevHash)
+		assert.Equal(t, models.DefaultKeyID, record.KeyID)
+
+		assert.Len(t, transaction.TransactItems, 2)
+		put := transaction.TransactItems[0].Put
+		assert.Equal(t, "token_audit", *put.TableName)
+		assert.Equal(t, "attribute_not_exists(#sequence)", *put.ConditionExpression)
+		assert.Equal(t, &types.AttributeValueMemberN{Value: "2"}, put.Item["sequence"])
+
+		headPut := transaction.TransactItems[1].Put
+		assert.Equal(t, "token_audit_heads", *headPut.TableName)
+		assert.Equal(t, "attribute_not_exists(#sequence) OR #sequence < :sequence", *headPut.ConditionExpression)
+		assert.Equal(t, &types.AttributeValueMemberN{Value: "2"}, headPut.ExpressionAttributeValues[":sequence"])
+		head := audit.Head{}
+		assert.NoError(t, attributevalue.UnmarshalMap(headPut.Item, &head))
+		assert.Equal(t, *audit.NewHead(record, key), head)
+	})
+
+	t.Run("retries when another writer took the sequence", func(t *testing.T) {
+		transactions := 0
+		store := &AuditStore{Keys: testAuditKeys, Api: &mockDynamoAPI{
+			queryFunc: func(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+				if transactions == 0 {
+					return &dynamodb.QueryOutput{}, nil
+				}
+				return &dynamodb.QueryOutput{Items: []map[string]types.AttributeValue{firstItem}}, nil
+			},
+			transactFunc: func(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error) {
+				transactions++
+				if transactions == 1 {
+					return nil, canceled
+				}
+				return &dynamodb.TransactWriteItemsOutput{}, nil
+			},
+		}}
+
+		record := &audit.Record{Token: "test-token", Time: time.Now(), Operation: audit.OperationRead}
+		assert.NoError(t, store.Append(context.Background(), record))
+		assert.Equal(t, 2, transactions)
+		assert.Equal(t, int64(2), record.Sequence)
+	})
+
+	t.Run("gives up after repeated conflicts", func(t *testing.T) {
+		store := &AuditStore{Keys: testAuditKeys, Api: &mockDynamoAPI{
+			queryFunc: func(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+				return &dynamodb.QueryOutput{}, nil
+			},
+			transactFunc: func(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error) {
+				return nil, canceled
+			},
+		}}
+		assert.Error(t, store.Append(context.Background(), &audit.Record{Token: "test-token"}))
+	})
+}
+
+func TestAuditStore_History(t *testing.T) {
+	key, err := testAuditKeys.CurrentKey(context.Background())
+	assert.NoError(t, err)
+	records := []audit.Record{}
+	var prev *audit.Record
+	for i := 0; i < 3; i++ {
+		record := audit.Record{Tenant: "payments", Token: "test-token", Time: time.Now(), Operation: audit.OperationRead}
+		record.Seal(prev, key)
+		records = append(records, record)
+		prev = &records[i]
+	}
+	items := []map[string]types.AttributeValue{}
+	for _, record := range records {
+		item, err := attributevalue.MarshalMap(record)
+		assert.NoError(t, err)
+		item["token"] = &types.AttributeValueMemberS{Value: "payments#test-token"}
+		items = append(items, item)
+	}
+	// a record of the token "payments#test-token" without a tenant, which has the same key
+	other, err := attributevalue.MarshalMap(audit.Record{Token: "payments#test-token", Sequence: 4})
+	assert.NoError(t, err)
+	items = append(items, other)
+	headItem, err := attributevalue.MarshalMap(audit.NewHead(&records[2], key))
+	assert.NoError(t, err)
+	headItem["token"] = &types.AttributeValueMemberS{Value: "payments#test-token"}
+
+	calls := 0
+	store := &AuditStore{Keys: testAuditKeys, Api: &mockDynamoAPI{
+		getItemFunc: func(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+			assert.Equal(t, "token_audit_heads", *params.TableName)
+			assert.Zero(t, calls, "the head should be read before the records")
+			assert.True(t, *params.ConsistentRead)
+			return &dynamodb.GetItemOutput{Item: headItem}, nil
+		},
+		queryFunc: func(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+			calls++
+			assert.Equal(t, &types.AttributeValueMemberS{Value: "payments#test-token"}, params.ExpressionAttributeValues[":token"])
+			if params.ExclusiveStartKey == nil {
+				return &dynamodb.QueryOutput{Items: items[:2], LastEvaluatedKey: map[string]types.AttributeValue{
+					"token":    &types.AttributeValueMemberS{Value: "payments#test-token"},
+					"sequence": &types.AttributeValueMemberN{Value: "2"},
+				}}, nil
+			}
+			return &dynamodb.QueryOutput{Items: items[2:]}, nil
+		},
+	}}
+
+	got, head, err := store.History(context.Background(), "payments", "test-token", audit.Page{})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, calls, "every page should be read")
+	assert.Len(t, got, 3, "records of other tenants are not part of the history")
+	assert.Equal(t, "test-token", got[0].Token)
+	assert.Equal(t, "test-token", head.Token)
+	assert.NoError(t, audit.Verify(context.Background(), testAuditKeys, got, head))
+
+	// a page is read from the sequence it starts after, and stops at its limit
+	limits := []int32{}
+	store.Api = &mockDynamoAPI{
+		getItemFunc: func(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+			return &dynamodb.GetItemOutput{Item: headItem}, nil
+		},
+		queryFunc: func(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+			assert.Equal(t, "#token = :token AND #sequence > :after", *params.KeyConditionExpression)
+			assert.Equal(t, &types.AttributeValueMemberN{Value: "1"}, params.ExpressionAttributeValues[":after"])
+			limits = append(limits, *params.Limit)
+			if params.ExclusiveStartKey == nil {
+				// the record of another tenant takes a place in the first page
+				return &dynamodb.QueryOutput{Items: []map[string]types.AttributeValue{other, items[1]}, LastEvaluatedKey: map[string]types.AttributeValue{
+					"token":    &types.AttributeValueMemberS{Value: "payments#test-token"},
+					"sequence": &types.AttributeValueMemberN{Value: "4"},
+				}}, nil
+			}
+			return &dynamodb.QueryOutput{Items: items[2:3], LastEvaluatedKey: map[string]types.AttributeValue{
+				"token":    &types.AttributeValueMemberS{Value: "payments#test-token"},
+				"sequence": &types.AttributeValueMemberN{Value: "3"},
+			}}, nil
+		},
+	}
+	got, _, err = store.History(context.Background(), "payments", "test-token", audit.Page{After: 1, Limit: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, []int32{2, 1}, limits, "a page asks for the records it still needs")
+	if assert.Len(t, got, 2) {
+		assert.Equal(t, int64(2), got[0].Sequence)
+		assert.Equal(t, int64(3), got[1].Sequence)
+	}
+}
@@ -0,0 +1,264 @@
+package dynamodb
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"tokenize/models"
+	"tokenize/persistence"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// maxBatchWriteItems is the most items DynamoDB accepts in a single BatchWriteItem request
+const maxBatchWriteItems = 25
+
+// maxBatchGetKeys is the most keys DynamoDB accepts in a single BatchGetItem request
+const maxBatchGetKeys = 100
+
+// maxBatchAttempts is how many times a batch is sent before the items DynamoDB still has not processed are reported
+// as throttled
+const maxBatchAttempts = 5
+
+// batchBackoff is the wait before sending unprocessed items again, doubling with every attempt
+var batchBackoff = 50 * time.Millisecond
+
+// maxConcurrentPuts bounds how many deterministic tokens of a batch are written at the same time
+const maxConcurrentPuts = 16
+
+// CreateTokens stores new tokens without overwriting stored ones that have not expired, which fail with
+// models.ErrTokenExists. Deterministic tokens are the ones another request can write at the same time, so each is
+// written with the conditional put of CreateToken. Random tokens do not collide with other requests, so they are
+// written with BatchWriteItem, in batches of 25, after a consistent BatchGetItem for the ones that already exist, since
+// batch writes cannot be conditional. Items DynamoDB leaves unprocessed are written again with exponential backoff,
+// and those still not written after the last attempt fail with persistence.ErrThrottled.
+func (d *DynamoStore) CreateTokens(ctx context.Context, tokens []*models.Token) []error {
+	errs := make([]error, len(tokens))
+	items := make([]map[string]types.AttributeValue, len(tokens))
+	// DynamoDB rejects a batch with the same key twice
+	seen := map[string]bool{}
+	keys := []map[string]types.AttributeValue{}
+	deterministic := []int{}
+	for i, token := range tokens {
+		item, err := tokenItem(token)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		key := models.StorageKey(token.Tenant, token.Token)
+		if seen[key] {
+			errs[i] = models.ErrTokenExists
+			continue
+		}
+		seen[key] = true
+		items[i] = item
+		if token.Mode.Deterministic() {
+			deterministic = append(deterministic, i)
+			continue
+		}
+		keys = append(keys, tokenKey(token.Tenant, token.Token))
+	}
+	d.putEach(ctx, deterministic, items, errs)
+	for _, i := range deterministic {
+		items[i] = nil
+	}
+
+	existing, err := d.existingKeys(ctx, keys)
+	for i, item := range items {
+		switch {
+		case item == nil:
+		case err != nil:
+			errs[i], items[i] = err, nil
+		case existing[itemKey(item)]:
+			errs[i], items[i] = models.ErrTokenExists, nil
+		}
+	}
+
+	pending := []int{}
+	for i, item := range items {
+		if item != nil {
+			pending = append(pending, i)
+		}
+	}
+	for start := 0; start < len(pending); start += maxBatchWriteItems {
+		end := min(start+maxBatchWriteItems, len(pending))
+		d.writeBatch(ctx, pending[start:end], items, errs)
+	}
+	return errs
+}
+
+// putEach writes the items of the indexes one by one with putNew, setting the error of each item
+func (d *DynamoStore) putEach(ctx context.Context, indexes []int, items []map[string]types.AttributeValue, errs []error) {
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, maxConcurrentPuts)
+	for _, i := range indexes {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			errs[i] = d.putNew(ctx, items[i])
+		}()
+	}
+	wg.Wait()
+}
+
+// existingKeys returns the keys of the tokens that are stored and have not expired, with consistent reads so tokens
+// that were just written are seen
+func (d *DynamoStore) existingKeys(ctx context.Context, keys []map[string]types.AttributeValue) (map[string]bool, error) {
+	existing := map[string]bool{}
+	now := time.Now()
+	for start := 0; start < len(keys); start += maxBatchGetKeys {
+		end := min(start+maxBatchGetKeys, len(keys))
+		stored, err := d.readBatch(ctx, keys[start:end], true)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range stored {
+			token, err := unmarshalToken(item)
+			if err != nil {
+				return nil, err
+			}
+			// expired tokens that have not been deleted yet can be replaced, like CreateToken does
+			if !token.Expired(now) {
+				existing[itemKey(item)] = true
+			}
+		}
+	}
+	return existing, nil
+}
+
+// writeBatch writes up to 25 items, the indexes of the items to write, setting the error of each item that could not
+// be written
+func (d *DynamoStore) writeBatch(ctx context.Context, indexes []int, items []map[string]types.AttributeValue, errs []error) {
+	// DynamoDB reports unprocessed items by their item, so items are tracked by their key
+	pending := map[string]int{}
+	requests := []types.WriteRequest{}
+	for _, i := range indexes {
+		pending[itemKey(items[i])] = i
+		requests = append(requests, types.WriteRequest{PutRequest: &types.PutRequest{Item: items[i]}})
+	}
+
+	fail := func(err error) {
+		for _, request := range requests {
+			errs[pending[itemKey(request.PutRequest.Item)]] = err
+		}
+	}
+	for attempt := 0; len(requests) > 0; attempt++ {
+		if attempt == maxBatchAttempts {
+			fail(persistence.ErrThrottled)
+			return
+		}
+		if err := backoff(ctx, attempt); err != nil {
+			fail(err)
+			return
+		}
+
+		output, err := d.Api.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{
+			RequestItems: map[string][]types.WriteRequest{*TokenTableName: requests},
+		})
+		if err != nil {
+			err = translateError(err)
+			// DynamoDB throttles the whole request when none of the items could be processed
+			if errors.Is(err, persistence.ErrThrottled) {
+				continue
+			}
+			fail(err)
+			return
+		}
+		requests = output.UnprocessedItems[*TokenTableName]
+	}
+}
+
+// itemKey returns the key of an item as stored
+func itemKey(item map[string]types.AttributeValue) string {
+	key, _ := item["token"].(*types.AttributeValueMemberS)
+	if key == nil {
+		return ""
+	}
+	return key.Value
+}
+
+// GetTokens reads the tenant's tokens with BatchGetItem, in batches of 100. Keys DynamoDB leaves unprocessed are read
+// again with exponential backoff, and the read fails with persistence.ErrThrottled when some are still unprocessed
+// after the last attempt.
+func (d *DynamoStore) GetTokens(ctx context.Context, tenant string, tokens []string) (map[string]*models.Token, error) {
+	// DynamoDB rejects a batch with the same key twice
+	keys := []map[string]types.AttributeValue{}
+	seen := map[string]bool{}
+	for _, token := range tokens {
+		if !seen[token] {
+			seen[token] = true
+			keys = append(keys, tokenKey(tenant, token))
+		}
+	}
+
+	found := map[string]*models.Token{}
+	now := time.Now()
+	for start := 0; start < len(keys); start += maxBatchGetKeys {
+		end := min(start+maxBatchGetKeys, len(keys))
+		items, err := d.readBatch(ctx, keys[start:end], false)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			token, err := unmarshalToken(item)
+			if err != nil {
+				return nil, err
+			}
+			// DynamoDB only deletes expired items eventually, they are gone as far as callers are concerned
+			if !token.Expired(now) {
+				found[token.Token] = token
+			}
+		}
+	}
+	return found, nil
+}
+
+// readBatch reads the items with up to 100 keys, leaving out those that do not exist
+func (d *DynamoStore) readBatch(ctx context.Context, keys []map[string]types.AttributeValue, consistent bool) ([]map[string]types.AttributeValue, error) {
+	items := []map[string]types.AttributeValue{}
+	for attempt := 0; len(keys) > 0; attempt++ {
+		if attempt == maxBatchAttempts {
+			return nil, persistence.ErrThrottled
+		}
+		if err := backoff(ctx, attempt); err != nil {
+			return nil, err
+		}
+
+		output, err := d.Api.BatchGetItem(ctx, &dynamodb.BatchGetItemInput{
+			RequestItems: map[string]types.KeysAndAttributes{
+				*TokenTableName: {Keys: keys, ConsistentRead: aws.Bool(consistent)},
+			},
+		})
+		if err != nil {
+			err = translateError(err)
+			if errors.Is(err, persistence.ErrThrottled) {
+				continue
+			}
+			return nil, err
+		}
+		items = append(items, output.Responses[*TokenTableName]...)
+		keys = output.UnprocessedKeys[*TokenTableName].Keys
+	}
+	return items, nil
+}
+
+// backoff waits before the attempt to send a batch again, doubling the wait with every attempt
+func backoff(ctx context.Context, attempt int) error {
+	if attempt == 0 {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(batchBackoff << (attempt - 1)):
+		return nil
+	}
+}
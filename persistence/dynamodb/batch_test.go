@@ -0,0 +1,491 @@
+package dynamodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"tokenize/models"
+	"tokenize/persistence"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// batchTokens returns n random tokens to write, named token-0 onwards
+func batchTokens(n int) []*models.Token {
+	tokens := make([]*models.Token, n)
+	for i := range tokens {
+		tokens[i] = withID(&models.Token{Token: fmt.Sprintf("token-%d", i), CreateToken: models.CreateToken{Payload: "v2:sealed"}, Mode: models.TokenModeRandom})
+	}
+	return tokens
+}
+
+// conditionFailed is the error of a conditional put of a token that is already stored
+var conditionFailed = &types.ConditionalCheckFailedException{}
+
+// writeKeys returns the keys of the items written by a batch request
+func writeKeys(params *dynamodb.BatchWriteItemInput) []string {
+	keys := []string{}
+	for _, request := range params.RequestItems[*TokenTableName] {
+		keys = append(keys, itemKey(request.PutRequest.Item))
+	}
+	return keys
+}
+
+// noneStored is a BatchGetItem that finds none of the keys, checking they are read consistently
+func noneStored(t *testing.T) func(ctx context.Context, params *dynamodb.BatchGetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error) {
+	return func(ctx context.Context, params *dynamodb.BatchGetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error) {
+		assert.True(t, aws.ToBool(params.RequestItems[*TokenTableName].ConsistentRead), "existing tokens are read consistently")
+		return &dynamodb.BatchGetItemOutput{}, nil
+	}
+}
+
+func TestCreateTokens(t *testing.T) {
+	backoff := batchBackoff
+	batchBackoff = 0
+	t.Cleanup(func() { batchBackoff = backoff })
+	testCases := []struct {
+		name   string
+		tokens []*models.Token
+		client func(t *testing.T) *mockDynamoAPI
+		expect func(t *testing.T, errs []error)
+	}{
+		{
+			name:   "writes batches of 25",
+			tokens: batchTokens(60),
+			client: func(t *testing.T) *mockDynamoAPI {
+				calls := 0
+				return &mockDynamoAPI{
+					batchGetFunc: noneStored(t),
+					batchWriteFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+						calls++
+						keys := writeKeys(params)
+						switch calls {
+						case 1:
+							assert.Len(t, keys, 25)
+							assert.Equal(t, "token-0", keys[0])
+						case 2:
+							assert.Len(t, keys, 25)
+							assert.Equal(t, "token-25", keys[0])
+						default:
+							assert.Len(t, keys, 10)
+							assert.Equal(t, "token-50", keys[0])
+						}
+						assert.Contains(t, params.RequestItems[*TokenTableName][0].PutRequest.Item, "Id")
+						return &dynamodb.BatchWriteItemOutput{}, nil
+					},
+				}
+			},
+			expect: func(t *testing.T, errs []error) {
+				assert.Len(t, errs, 60)
+				for _, err := range errs {
+					assert.NoError(t, err)
+				}
+			},
+		},
+		{
+			name: "tenant tokens are written under the tenant prefix",
+			tokens: []*models.Token{withID(&models.Token{
+				Token: "token-0", BaseModel: models.BaseModel{Tenant: "payments"}, Mode: models.TokenModeRandom,
+			})},
+			client: func(t *testing.T) *mockDynamoAPI {
+				return &mockDynamoAPI{
+					batchGetFunc: func(ctx context.Context, params *dynamodb.BatchGetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error) {
+						assert.Equal(t, []string{"payments#token-0"}, getKeys(params))
+						return &dynamodb.BatchGetItemOutput{}, nil
+					},
+					batchWriteFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+						assert.Equal(t, []string{"payments#token-0"}, writeKeys(params))
+						return &dynamodb.BatchWriteItemOutput{}, nil
+					},
+				}
+			},
+			expect: func(t *testing.T, errs []error) {
+				assert.Equal(t, []error{nil}, errs)
+			},
+		},
+		{
+			name:   "existing tokens fail without being overwritten and expired ones are replaced",
+			tokens: batchTokens(3),
+			client: func(t *testing.T) *mockDynamoAPI {
+				return &mockDynamoAPI{
+					batchGetFunc: func(ctx context.Context, params *dynamodb.BatchGetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error) {
+						expired := listItem("token-2", "card", "2025-03-01T12:00:00Z")
+						expired[ExpiresAtAttribute] = &types.AttributeValueMemberN{Value: "1"}
+						return &dynamodb.BatchGetItemOutput{Responses: map[string][]map[string]types.AttributeValue{
+							*TokenTableName: {listItem("token-1", "card", "2025-03-01T12:00:00Z"), expired},
+						}}, nil
+					},
+					batchWriteFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+						assert.Equal(t, []string{"token-0", "token-2"}, writeKeys(params))
+						return &dynamodb.BatchWriteItemOutput{}, nil
+					},
+				}
+			},
+			expect: func(t *testing.T, errs []error) {
+				assert.NoError(t, errs[0])
+				assert.ErrorIs(t, errs[1], models.ErrTokenExists)
+				assert.NoError(t, errs[2])
+			},
+		},
+		{
+			name:   "unprocessed items are written again",
+			tokens: batchTokens(3),
+			client: func(t *testing.T) *mockDynamoAPI {
+				calls := 0
+				return &mockDynamoAPI{
+					batchGetFunc: noneStored(t),
+					batchWriteFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+						calls++
+						requests := params.RequestItems[*TokenTableName]
+						if calls == 1 {
+							return &dynamodb.BatchWriteItemOutput{UnprocessedItems: map[string][]types.WriteRequest{
+								*TokenTableName: requests[1:],
+							}}, nil
+						}
+						assert.Equal(t, []string{"token-1", "token-2"}, writeKeys(params))
+						return &dynamodb.BatchWriteItemOutput{}, nil
+					},
+				}
+			},
+			expect: func(t *testing.T, errs []error) {
+				assert.Equal(t, []error{nil, nil, nil}, errs)
+			},
+		},
+		{
+			name:   "items that stay unprocessed are throttled",
+			tokens: batchTokens(3),
+			client: func(t *testing.T) *mockDynamoAPI {
+				calls := 0
+				return &mockDynamoAPI{
+					batchGetFunc: noneStored(t),
+					batchWriteFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+						calls++
+						assert.LessOrEqual(t, calls, maxBatchAttempts)
+						requests := params.RequestItems[*TokenTableName]
+						if calls == 1 {
+							requests = requests[1:]
+						}
+						return &dynamodb.BatchWriteItemOutput{UnprocessedItems: map[string][]types.WriteRequest{
+							*TokenTableName: requests,
+						}}, nil
+					},
+				}
+			},
+			expect: func(t *testing.T, errs []error) {
+				assert.NoError(t, errs[0])
+				assert.ErrorIs(t, errs[1], persistence.ErrThrottled)
+				assert.ErrorIs(t, errs[2], persistence.ErrThrottled)
+			},
+		},
+		{
+			name:   "throttled requests are retried",
+			tokens: batchTokens(2),
+			client: func(t *testing.T) *mockDynamoAPI {
+				calls := 0
+				return &mockDynamoAPI{
+					batchGetFunc: noneStored(t),
+					batchWriteFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+						calls++
+						if calls == 1 {
+							return nil, &types.ProvisionedThroughputExceededException{}
+						}
+						assert.Len(t, writeKeys(params), 2)
+						return &dynamodb.BatchWriteItemOutput{}, nil
+					},
+				}
+			},
+			expect: func(t *testing.T, errs []error) {
+				assert.Equal(t, []error{nil, nil}, errs)
+			},
+		},
+		{
+			name:   "read errors fail the batch without writing it",
+			tokens: batchTokens(2),
+			client: func(t *testing.T) *mockDynamoAPI {
+				return &mockDynamoAPI{
+					batchGetFunc: func(ctx context.Context, params *dynamodb.BatchGetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error) {
+						return nil, errors.New("read error")
+					},
+				}
+			},
+			expect: func(t *testing.T, errs []error) {
+				assert.EqualError(t, errs[0], "read error")
+				assert.EqualError(t, errs[1], "read error")
+			},
+		},
+		{
+			name:   "request errors fail the batch",
+			tokens: batchTokens(2),
+			client: func(t *testing.T) *mockDynamoAPI {
+				return &mockDynamoAPI{
+					batchGetFunc: noneStored(t),
+					batchWriteFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+						return nil, errors.New("validation error")
+					},
+				}
+			},
+			expect: func(t *testing.T, errs []error) {
+				assert.EqualError(t, errs[0], "validation error")
+				assert.EqualError(t, errs[1], "validation error")
+			},
+		},
+		{
+			name: "the same token twice in a batch, and a token without an ID",
+			tokens: []*models.Token{
+				withID(&models.Token{Token: "token-0", Mode: models.TokenModeRandom}),
+				withID(&models.Token{Token: "token-0", Mode: models.TokenModeRandom}),
+				{Token: "token-1", Mode: models.TokenModeRandom},
+			},
+			client: func(t *testing.T) *mockDynamoAPI {
+				return &mockDynamoAPI{
+					batchGetFunc: noneStored(t),
+					batchWriteFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+						assert.Equal(t, []string{"token-0"}, writeKeys(params))
+						return &dynamodb.BatchWriteItemOutput{}, nil
+					},
+				}
+			},
+			expect: func(t *testing.T, errs []error) {
+				assert.NoError(t, errs[0])
+				assert.ErrorIs(t, errs[1], models.ErrTokenExists)
+				assert.ErrorIs(t, errs[2], models.ErrMissingTokenID, "a token without an ID is never written")
+			},
+		},
+		{
+			name: "deterministic tokens are written with conditional puts",
+			tokens: []*models.Token{
+				withID(&models.Token{Token: "hmac-0", Mode: models.TokenModeHMAC}),
+				withID(&models.Token{Token: "card-0", Mode: models.TokenModeCard}),
+				withID(&models.Token{Token: "token-0", Mode: models.TokenModeRandom}),
+			},
+			client: func(t *testing.T) *mockDynamoAPI {
+				var mu sync.Mutex
+				put := []string{}
+				return &mockDynamoAPI{
+					putItemFunc: func(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+						assert.Equal(t, createCondition, *params.ConditionExpression)
+						mu.Lock()
+						defer mu.Unlock()
+						put = append(put, itemKey(params.Item))
+						assert.Subset(t, []string{"hmac-0", "card-0"}, put)
+						return &dynamodb.PutItemOutput{}, nil
+					},
+					batchGetFunc: func(ctx context.Context, params *dynamodb.BatchGetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error) {
+						assert.Equal(t, []string{"token-0"}, getKeys(params), "only random tokens are read before they are written")
+						return &dynamodb.BatchGetItemOutput{}, nil
+					},
+					batchWriteFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+						assert.Equal(t, []string{"token-0"}, writeKeys(params), "only random tokens are written in batches")
+						return &dynamodb.BatchWriteItemOutput{}, nil
+					},
+				}
+			},
+			expect: func(t *testing.T, errs []error) {
+				assert.Equal(t, []error{nil, nil, nil}, errs)
+			},
+		},
+		{
+			name:   "a deterministic token written by another request after the batch started is not overwritten",
+			tokens: []*models.Token{withID(&models.Token{Token: "hmac-0", Mode: models.TokenModeHMAC})},
+			client: func(t *testing.T) *mockDynamoAPI {
+				return &mockDynamoAPI{
+					// the token is not stored when the batch starts, the other request's write is seen by the condition
+					batchGetFunc: noneStored(t),
+					putItemFunc: func(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+						return nil, conditionFailed
+					},
+					batchWriteFunc: func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+						t.Error("a deterministic token is never written unconditionally")
+						return &dynamodb.BatchWriteItemOutput{}, nil
+					},
+				}
+			},
+			expect: func(t *testing.T, errs []error) {
+				assert.ErrorIs(t, errs[0], models.ErrTokenExists)
+			},
+		},
+		{
+			name:   "throttled conditional puts fail their token",
+			tokens: []*models.Token{withID(&models.Token{Token: "hmac-0"}), withID(&models.Token{Token: "hmac-1"})},
+			client: func(t *testing.T) *mockDynamoAPI {
+				return &mockDynamoAPI{
+					putItemFunc: func(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+						if itemKey(params.Item) == "hmac-1" {
+							return nil, &types.ProvisionedThroughputExceededException{}
+						}
+						return &dynamodb.PutItemOutput{}, nil
+					},
+				}
+			},
+			expect: func(t *testing.T, errs []error) {
+				assert.NoError(t, errs[0])
+				assert.ErrorIs(t, errs[1], persistence.ErrThrottled, "tokens without a mode are written like deterministic ones")
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := &DynamoStore{Api: tc.client(t)}
+			tc.expect(t, store.CreateTokens(context.Background(), tc.tokens))
+		})
+	}
+}
+
+// getKeys returns the keys read by a batch request
+func getKeys(params *dynamodb.BatchGetItemInput) []string {
+	keys := []string{}
+	for _, key := range params.RequestItems[*TokenTableName].Keys {
+		keys = append(keys, itemKey(key))
+	}
+	return keys
+}
+
+// storedItems returns the stored items of the keys
+func storedItems(keys []map[string]types.AttributeValue) []map[string]types.AttributeValue {
+	items := []map[string]types.AttributeValue{}
+	for _, key := range keys {
+		items = append(items, listItem(itemKey(key), "card", "2025-03-01T12:00:00Z"))
+	}
+	return items
+}
+
+func TestGetTokens(t *testing.T) {
+	backoff := batchBackoff
+	batchBackoff = 0
+	t.Cleanup(func() { batchBackoff = backoff })
+
+	tokenValues := make([]string, 150)
+	for i := range tokenValues {
+		tokenValues[i] = fmt.Sprintf("token-%d", i)
+	}
+	testCases := []struct {
+		name   string
+		tenant string
+		tokens []string
+		client func(t *testing.T) *mockDynamoAPI
+		expect func(t *testing.T, tokens map[string]*models.Token, err error)
+	}{
+		{
+			name:   "reads batches of 100",
+			tokens: tokenValues,
+			client: func(t *testing.T) *mockDynamoAPI {
+				calls := 0
+				return &mockDynamoAPI{
+					batchGetFunc: func(ctx context.Context, params *dynamodb.BatchGetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error) {
+						calls++
+						keys := getKeys(params)
+						if calls == 1 {
+							assert.Len(t, keys, 100)
+						} else {
+							assert.Len(t, keys, 50)
+							assert.Equal(t, "token-100", keys[0])
+						}
+						return &dynamodb.BatchGetItemOutput{Responses: map[string][]map[string]types.AttributeValue{
+							*TokenTableName: storedItems(params.RequestItems[*TokenTableName].Keys),
+						}}, nil
+					},
+				}
+			},
+			expect: func(t *testing.T, tokens map[string]*models.Token, err error) {
+				assert.NoError(t, err)
+				assert.Len(t, tokens, 150)
+				assert.Equal(t, "card", tokens["token-149"].TokenType)
+			},
+		},
+		{
+			name:   "reads each key once and leaves out missing and expired tokens",
+			tenant: "payments",
+			tokens: []string{"found", "missing", "found", "expired"},
+			client: func(t *testing.T) *mockDynamoAPI {
+				return &mockDynamoAPI{
+					batchGetFunc: func(ctx context.Context, params *dynamodb.BatchGetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error) {
+						assert.Equal(t, []string{"payments#found", "payments#missing", "payments#expired"}, getKeys(params))
+						found := listItem("payments#found", "card", "2025-03-01T12:00:00Z")
+						found["tenant"] = &types.AttributeValueMemberS{Value: "payments"}
+						expired := listItem("payments#expired", "card", "2025-03-01T12:00:00Z")
+						expired["tenant"] = &types.AttributeValueMemberS{Value: "payments"}
+						expired[ExpiresAtAttribute] = &types.AttributeValueMemberN{Value: "1"}
+						return &dynamodb.BatchGetItemOutput{Responses: map[string][]map[string]types.AttributeValue{
+							*TokenTableName: {found, expired},
+						}}, nil
+					},
+				}
+			},
+			expect: func(t *testing.T, tokens map[string]*models.Token, err error) {
+				assert.NoError(t, err)
+				assert.Len(t, tokens, 1)
+				assert.Equal(t, "payments", tokens["found"].Tenant)
+			},
+		},
+		{
+			name:   "unprocessed keys are read again",
+			tokens: []string{"token-0", "token-1"},
+			client: func(t *testing.T) *mockDynamoAPI {
+				calls := 0
+				return &mockDynamoAPI{
+					batchGetFunc: func(ctx context.Context, params *dynamodb.BatchGetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error) {
+						calls++
+						keys := params.RequestItems[*TokenTableName].Keys
+						if calls == 1 {
+							return &dynamodb.BatchGetItemOutput{
+								Responses:       map[string][]map[string]types.AttributeValue{*TokenTableName: storedItems(keys[:1])},
+								UnprocessedKeys: map[string]types.KeysAndAttributes{*TokenTableName: {Keys: keys[1:]}},
+							}, nil
+						}
+						assert.Equal(t, []string{"token-1"}, getKeys(params))
+						return &dynamodb.BatchGetItemOutput{Responses: map[string][]map[string]types.AttributeValue{
+							*TokenTableName: storedItems(keys),
+						}}, nil
+					},
+				}
+			},
+			expect: func(t *testing.T, tokens map[string]*models.Token, err error) {
+				assert.NoError(t, err)
+				assert.Len(t, tokens, 2)
+			},
+		},
+		{
+			name:   "keys that stay unprocessed are throttled",
+			tokens: []string{"token-0"},
+			client: func(t *testing.T) *mockDynamoAPI {
+				return &mockDynamoAPI{
+					batchGetFunc: func(ctx context.Context, params *dynamodb.BatchGetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error) {
+						return nil, &types.ProvisionedThroughputExceededException{}
+					},
+				}
+			},
+			expect: func(t *testing.T, tokens map[string]*models.Token, err error) {
+				assert.ErrorIs(t, err, persistence.ErrThrottled)
+			},
+		},
+		{
+			name:   "request errors",
+			tokens: []string{"token-0"},
+			client: func(t *testing.T) *mockDynamoAPI {
+				return &mockDynamoAPI{
+					batchGetFunc: func(ctx context.Context, params *dynamodb.BatchGetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error) {
+						return nil, errors.New("validation error")
+					},
+				}
+			},
+			expect: func(t *testing.T, tokens map[string]*models.Token, err error) {
+				assert.EqualError(t, err, "validation error")
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := &DynamoStore{Api: tc.client(t)}
+			tokens, err := store.GetTokens(context.Background(), tc.tenant, tc.tokens)
+			tc.expect(t, tokens, err)
+		})
+	}
+}
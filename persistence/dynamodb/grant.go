@@ -0,0 +1,126 @@
+package dynamodb
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+
+	"tokenize/models"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+var (
+	GrantTableName = aws.String("reveal_grants")
+)
+
+func (d *DynamoStore) CreateGrant(ctx context.Context, grant *models.RevealGrant) error {
+	item, err := attributevalue.MarshalMap(grant)
+	if err != nil {
+		return err
+	}
+	item["id"] = &types.AttributeValueMemberS{Value: models.StorageKey(grant.Tenant, grant.ID)}
+
+	_, err = d.Api.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           GrantTableName,
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(id)"),
+	})
+	return translateError(err)
+}
+
+func (d *DynamoStore) GetGrant(ctx context.Context, tenant string, id string) (*models.RevealGrant, error) {
+	output, err := d.Api.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: GrantTableName,
+		Key:       grantKey(tenant, id),
+		// a grant that was just revoked must not be redeemed from a stale read
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, translateError(err)
+	}
+	if output == nil || output.Item == nil {
+		return nil, models.ErrGrantNotFound
+	}
+
+	grant := &models.RevealGrant{}
+	if err := attributevalue.UnmarshalMap(output.Item, grant); err != nil {
+		return nil, err
+	}
+	if grant.Tenant != "" {
+		grant.ID = strings.TrimPrefix(grant.ID, grant.Tenant+"#")
+	}
+	return grant, nil
+}
+
+func (d *DynamoStore) RevokeGrant(ctx context.Context, tenant string, token string, id string) error {
+	_, err := d.Api.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           GrantTableName,
+		Key:                 grantKey(tenant, id),
+		UpdateExpression:    aws.String("SET revoked = :revoked"),
+		ConditionExpression: aws.String("attribute_exists(id) AND #token = :token"),
+		ExpressionAttributeNames: map[string]string{
+			"#token": "token",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":revoked": &types.AttributeValueMemberBOOL{Value: true},
+			":token":   &types.AttributeValueMemberS{Value: token},
+		},
+	})
+	if err != nil {
+		var conditionFailed *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionFailed) {
+			return models.ErrGrantNotFound
+		}
+		return translateError(err)
+	}
+	return nil
+}
+
+// grantKey is the key of a tenant's grant, prefixed with the tenant like tokenKey
+func grantKey(tenant string, id string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"id": &types.AttributeValueMemberS{Value: models.StorageKey(tenant, id)},
+	}
+}
+
+// SetupGrantTable creates the reveal grant table if it does not exist, with TTL deleting expired grants
+func SetupGrantTable(ctx context.Context, client Api) {
+	_, err := client.DescribeTable(ctx, &dynamodb.DescribeTableInput{
+		TableName: GrantTableName,
+	})
+	var notFoundEx *types.ResourceNotFoundException
+	if errors.As(err, &notFoundEx) {
+		if err := CreateGrantTable(ctx, client); err != nil {
+			return
+		}
+	}
+	// expired grants are rejected by their signature, TTL only keeps the table small
+	if err := enableTimeToLive(ctx, client, GrantTableName); err != nil {
+		slog.Warn("unable to enable TTL on the grant table", "error", err)
+	}
+}
+
+func CreateGrantTable(ctx context.Context, client Api) error {
+	_, err := client.CreateTable(ctx, &dynamodb.CreateTableInput{
+		TableName: GrantTableName,
+		AttributeDefinitions: []types.AttributeDefinition{
+			{
+				AttributeName: aws.String("id"),
+				AttributeType: types.ScalarAttributeTypeS,
+			},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{
+				AttributeName: aws.String("id"),
+				KeyType:       types.KeyTypeHash,
+			},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	})
+	return err
+}
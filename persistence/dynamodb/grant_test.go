@@ -0,0 +1,131 @@
+package dynamodb
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"tokenize/models"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func testGrant() *models.RevealGrant {
+	return &models.RevealGrant{
+		ID:        "0197a4b2-0000-7000-8000-000000000002",
+		Tenant:    "tenant-a",
+		Token:     "test-token",
+		Reveal:    "last4",
+		KeyID:     "default",
+		ExpiresAt: 1767225600,
+		IssuedBy:  "api_key:test",
+	}
+}
+
+func TestCreateGrant(t *testing.T) {
+	client := &mockDynamoAPI{
+		putItemFunc: func(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+			assert.Equal(t, "reveal_grants", *params.TableName)
+			assert.Equal(t, &types.AttributeValueMemberS{Value: "tenant-a#0197a4b2-0000-7000-8000-000000000002"}, params.Item["id"])
+			assert.Equal(t, &types.AttributeValueMemberN{Value: "1767225600"}, params.Item["expiresAt"])
+			assert.Equal(t, &types.AttributeValueMemberS{Value: "api_key:test"}, params.Item["issued_by"])
+			assert.NotContains(t, params.Item, "revoked")
+			assert.Equal(t, "attribute_not_exists(id)", *params.ConditionExpression)
+			return &dynamodb.PutItemOutput{}, nil
+		},
+	}
+	store := &DynamoStore{Api: client}
+	assert.NoError(t, store.CreateGrant(context.Background(), testGrant()))
+}
+
+func TestGetGrant(t *testing.T) {
+	grant := testGrant()
+	item, err := attributevalue.MarshalMap(grant)
+	assert.NoError(t, err)
+	item["id"] = &types.AttributeValueMemberS{Value: "tenant-a#" + grant.ID}
+
+	testCases := []struct {
+		name    string
+		client  *mockDynamoAPI
+		want    *models.RevealGrant
+		wantErr error
+	}{
+		{
+			name: "found",
+			client: &mockDynamoAPI{
+				getItemFunc: func(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+					assert.Equal(t, "reveal_grants", *params.TableName)
+					assert.Equal(t, &types.AttributeValueMemberS{Value: "tenant-a#" + grant.ID}, params.Key["id"])
+					assert.True(t, *params.ConsistentRead)
+					return &dynamodb.GetItemOutput{Item: item}, nil
+				},
+			},
+			want: grant,
+		},
+		{
+			name: "not found",
+			client: &mockDynamoAPI{
+				getItemFunc: func(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+					return &dynamodb.GetItemOutput{}, nil
+				},
+			},
+			wantErr: models.ErrGrantNotFound,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := &DynamoStore{Api: tc.client}
+			got, err := store.GetGrant(context.Background(), "tenant-a", grant.ID)
+			if tc.wantErr != nil {
+				assert.ErrorIs(t, err, tc.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestRevokeGrant(t *testing.T) {
+	testCases := []struct {
+		name    string
+		err     error
+		wantErr error
+	}{
+		{name: "revoked"},
+		{
+			name:    "grant of another token or no grant",
+			err:     &types.ConditionalCheckFailedException{Message: aws.String("The conditional request failed")},
+			wantErr: models.ErrGrantNotFound,
+		},
+		{name: "dynamodb error", err: errors.New("dynamodb error"), wantErr: errors.New("dynamodb error")},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := &mockDynamoAPI{
+				updateItemFunc: func(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+					assert.Equal(t, "reveal_grants", *params.TableName)
+					assert.Equal(t, &types.AttributeValueMemberS{Value: "tenant-a#grant-id"}, params.Key["id"])
+					assert.Equal(t, "SET revoked = :revoked", *params.UpdateExpression)
+					assert.Equal(t, "attribute_exists(id) AND #token = :token", *params.ConditionExpression)
+					assert.Equal(t, &types.AttributeValueMemberS{Value: "test-token"}, params.ExpressionAttributeValues[":token"])
+					return &dynamodb.UpdateItemOutput{}, tc.err
+				},
+			}
+			store := &DynamoStore{Api: client}
+			err := store.RevokeGrant(context.Background(), "tenant-a", "test-token", "grant-id")
+			switch {
+			case tc.wantErr == nil:
+				assert.NoError(t, err)
+			case errors.Is(tc.wantErr, models.ErrGrantNotFound):
+				assert.ErrorIs(t, err, tc.wantErr)
+			default:
+				assert.EqualError(t, err, tc.wantErr.Error())
+			}
+		})
+	}
+}
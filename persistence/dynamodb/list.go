@@ -0,0 +1,301 @@
+package dynamodb
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"tokenize/models"
+	"tokenize/persistence"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// TenantIndex is the global secondary index with the tokens of each tenant by when they were created
+const TenantIndex = "tenant_key-createdAt"
+
+// TenantTypeIndex is the global secondary index with the tokens of each type of a tenant by when they were created
+const TenantTypeIndex = "tenant_type-createdAt"
+
+// The partition keys of the list indexes. Every token has a tenant key, tokens with a type also have a tenant type.
+const (
+	tenantKeyAttribute  = "tenant_key"
+	tenantTypeAttribute = "tenant_type"
+)
+
+// createdAtPrefix formats the seconds of a creation time. Creation times are stored in UTC as RFC 3339 with optional
+// fractional seconds, so every time within a second sorts after its prefix and before the prefix of the next second.
+const createdAtPrefix = "2006-01-02T15:04:05"
+
+// ListTokens queries the tenant type index when the filter has a token type, and the tenant index when it does not.
+// DynamoDB narrows the tokens down as far as it can, and the filter is applied again to what it returns, since creation
+// times are only compared to the second in DynamoDB.
+func (d *DynamoStore) ListTokens(ctx context.Context, tenant string, filter models.TokenFilter, cursor string, limit int32) ([]*models.Token, string, error) {
+	if limit <= 0 {
+		limit = persistence.DefaultListLimit
+	}
+	startKey, err := decodeCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	query := newListQuery(tenant, filter, time.Now())
+
+	// a page of DynamoDB results can be cut short by the filter, so pages are read until there are enough tokens
+	tokens := []*models.Token{}
+	for {
+		items, lastKey, err := d.listPage(ctx, query, startKey, limit-int32(len(tokens)))
+		if err != nil {
+			return nil, "", err
+		}
+		for _, item := range items {
+			token, err := unmarshalToken(item)
+			if err != nil {
+				return nil, "", err
+			}
+			if filter.Matches(token) {
+				tokens = append(tokens, token)
+			}
+		}
+
+		if len(lastKey) == 0 {
+			return tokens, "", nil
+		}
+		if len(tokens) >= int(limit) {
+			next, err := encodeCursor(lastKey)
+			return tokens, next, err
+		}
+		startKey = lastKey
+	}
+}
+
+// listPartition is the partition key of a tenant's tokens of a type in the list indexes, or of all of them with an
+// empty type. The default tenant is empty, and tenants cannot contain '#', so no two partitions are the same.
+func listPartition(tenant string, tokenType string) string {
+	return tenant + "#" + tokenType
+}
+
+// listKeys are the partition keys of a token in the list indexes
+func listKeys(tenant string, tokenType string) map[string]types.AttributeValue {
+	keys := map[string]types.AttributeValue{
+		tenantKeyAttribute: &types.AttributeValueMemberS{Value: listPartition(tenant, "")},
+	}
+	// DynamoDB does not allow empty index keys, tokens without a type are only in the tenant index
+	if tokenType != "" {
+		keys[tenantTypeAttribute] = &types.AttributeValueMemberS{Value: listPartition(tenant, tokenType)}
+	}
+	return keys
+}
+
+// listQuery holds the expressions selecting the tokens to list
+type listQuery struct {
+	index string
+	// keyCondition selects by tenant, token type and creation time on the index, filter holds every other condition
+	keyCondition []string
+	filter       []string
+	names        map[string]string
+	values       map[string]types.AttributeValue
+}
+
+func newListQuery(tenant string, filter models.TokenFilter, now time.Time) *listQuery {
+	q := &listQuery{
+		index:        TenantIndex,
+		keyCondition: []string{"#partition = :partition"},
+		filter:       []string{"(attribute_not_exists(#expiresAt) OR #expiresAt > :now)"},
+		names:        map[string]string{"#partition": tenantKeyAttribute, "#expiresAt": ExpiresAtAttribute},
+		values: map[string]types.AttributeValue{
+			":partition": &types.AttributeValueMemberS{Value: listPartition(tenant, "")},
+			":now":       epochValue(now),
+		},
+	}
+	if filter.TokenType != "" {
+		q.index = TenantTypeIndex
+		q.names["#partition"] = tenantTypeAttribute
+		q.values[":partition"] = &types.AttributeValueMemberS{Value: listPartition(tenant, filter.TokenType)}
+	}
+
+	created := &q.keyCondition
+	if !filter.CreatedAfter.IsZero() || !filter.CreatedBefore.IsZero() {
+		q.names["#createdAt"] = "createdAt"
+	}
+	switch {
+	case !filter.CreatedAfter.IsZero() && !filter.CreatedBefore.IsZero():
+		*created = append(*created, "#createdAt BETWEEN :createdAfter AND :createdBefore")
+	case !filter.CreatedAfter.IsZero():
+		*created = append(*created, "#createdAt >= :createdAfter")
+	case !filter.CreatedBefore.IsZero():
+		*created = append(*created, "#createdAt < :createdBefore")
+	}
+	if !filter.CreatedAfter.IsZero() {
+		q.values[":createdAfter"] = &types.AttributeValueMemberS{
+			Value: filter.CreatedAfter.UTC().Truncate(time.Second).Format(createdAtPrefix),
+		}
+	}
+	if !filter.CreatedBefore.IsZero() {
+		q.values[":createdBefore"] = &types.AttributeValueMemberS{
+			Value: filter.CreatedBefore.UTC().Truncate(time.Second).Add(time.Second).Format(createdAtPrefix),
+		}
+	}
+
+	if !filter.ExpiresAfter.IsZero() {
+		q.filter = append(q.filter, "#expiresAt >= :expiresAfter")
+		q.values[":expiresAfter"] = epochValue(filter.ExpiresAfter)
+	}
+	if !filter.ExpiresBefore.IsZero() {
+		q.filter = append(q.filter, "#expiresAt <= :expiresBefore")
+		q.values[":expiresBefore"] = epochValue(filter.ExpiresBefore)
+	}
+
+	if len(filter.Metadata) > 0 {
+		q.names["#metadata"] = "metadata"
+	}
+	for i, name := range slices.Sorted(maps.Keys(filter.Metadata)) {
+		attr := "m" + strconv.Itoa(i)
+		q.names["#"+attr] = name
+		// the value can match a string, or the number or boolean it spells
+		var matches []string
+		for j, value := range models.MetadataValues(filter.Metadata[name]) {
+			placeholder := fmt.Sprintf(":%s_%d", attr, j)
+			q.values[placeholder] = metadataValue(value)
+			matches = append(matches, fmt.Sprintf("#metadata.#%s = %s", attr, placeholder))
+		}
+		q.filter = append(q.filter, "("+strings.Join(matches, " OR ")+")")
+	}
+	return q
+}
+
+// metadataValue is the attribute value a metadata filter value is compared to
+func metadataValue(value any) types.AttributeValue {
+	switch value := value.(type) {
+	case float64:
+		return &types.AttributeValueMemberN{Value: strconv.FormatFloat(value, 'f', -1, 64)}
+	case bool:
+		return &types.AttributeValueMemberBOOL{Value: value}
+	default:
+		return &types.AttributeValueMemberS{Value: fmt.Sprint(value)}
+	}
+}
+
+// listPage reads a page of up to limit tokens, returning the key to continue from
+func (d *DynamoStore) listPage(ctx context.Context, q *listQuery, startKey map[string]types.AttributeValue, limit int32) ([]map[string]types.AttributeValue, map[string]types.AttributeValue, error) {
+	output, err := d.Api.Query(ctx, &dynamodb.QueryInput{
+		TableName:                 TokenTableName,
+		IndexName:                 aws.String(q.index),
+		KeyConditionExpression:    aws.String(strings.Join(q.keyCondition, " AND ")),
+		FilterExpression:          aws.String(strings.Join(q.filter, " AND ")),
+		ExpressionAttributeNames:  q.names,
+		ExpressionAttributeValues: q.values,
+		ExclusiveStartKey:         startKey,
+		Limit:                     aws.Int32(limit),
+	})
+	if err != nil {
+		return nil, nil, translateError(err)
+	}
+	return output.Items, output.LastEvaluatedKey, nil
+}
+
+// encodeCursor turns the key a page ended at into an opaque cursor
+func encodeCursor(key map[string]types.AttributeValue) (string, error) {
+	values := map[string]string{}
+	for name, value := range key {
+		s, ok := value.(*types.AttributeValueMemberS)
+		if !ok {
+			return "", fmt.Errorf("unexpected type of key attribute %q", name)
+		}
+		values[name] = s.Value
+	}
+	data, err := json.Marshal(values)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// decodeCursor turns a cursor back into the key to start the next page after, nil for the first page
+func decodeCursor(cursor string) (map[string]types.AttributeValue, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, persistence.ErrInvalidCursor
+	}
+	values := map[string]string{}
+	if err := json.Unmarshal(data, &values); err != nil || values["token"] == "" {
+		return nil, persistence.ErrInvalidCursor
+	}
+	key := map[string]types.AttributeValue{}
+	for name, value := range values {
+		key[name] = &types.AttributeValueMemberS{Value: value}
+	}
+	return key, nil
+}
+
+// IndexTokens adds the list index keys to the tokens stored before the list indexes existed, reading a page of up to
+// limit tokens after the cursor. It returns how many tokens it updated and the cursor of the next page, which is empty
+// after the last page.
+func (d *DynamoStore) IndexTokens(ctx context.Context, cursor string, limit int32) (int, string, error) {
+	input := &dynamodb.ScanInput{
+		TableName:                TokenTableName,
+		FilterExpression:         aws.String("attribute_not_exists(#tenantKey)"),
+		ExpressionAttributeNames: map[string]string{"#tenantKey": tenantKeyAttribute},
+		Limit:                    aws.Int32(limit),
+	}
+	if cursor != "" {
+		input.ExclusiveStartKey = map[string]types.AttributeValue{
+			"token": &types.AttributeValueMemberS{Value: cursor},
+		}
+	}
+	output, err := d.Api.Scan(ctx, input)
+	if err != nil {
+		return 0, "", translateError(err)
+	}
+
+	indexed := 0
+	for _, item := range output.Items {
+		token, err := unmarshalToken(item)
+		if err != nil {
+			return indexed, "", err
+		}
+		var set []string
+		names := map[string]string{"#token": "token"}
+		values := map[string]types.AttributeValue{}
+		for name, value := range listKeys(token.Tenant, token.TokenType) {
+			set = append(set, fmt.Sprintf("#%s = :%s", name, name))
+			names["#"+name] = name
+			values[":"+name] = value
+		}
+		slices.Sort(set)
+		_, err = d.Api.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName:        TokenTableName,
+			Key:              tokenKey(token.Tenant, token.Token),
+			UpdateExpression: aws.String("SET " + strings.Join(set, ", ")),
+			// a token deleted since it was read is not stored again
+			ConditionExpression:       aws.String("attribute_exists(#token)"),
+			ExpressionAttributeNames:  names,
+			ExpressionAttributeValues: values,
+		})
+		if err != nil {
+			var conditionFailed *types.ConditionalCheckFailedException
+			if errors.As(err, &conditionFailed) {
+				continue
+			}
+			return indexed, "", translateError(err)
+		}
+		indexed++
+	}
+
+	next := ""
+	if lastKey, ok := output.LastEvaluatedKey["token"].(*types.AttributeValueMemberS); ok {
+		next = lastKey.Value
+	}
+	return indexed, next, nil
+}
@@ -0,0 +1,249 @@
+package dynamodb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"tokenize/models"
+	"tokenize/persistence"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// listItem is a stored token as DynamoDB returns it
+func listItem(token string, tokenType string, createdAt string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"token":      &types.AttributeValueMemberS{Value: token},
+		"token_type": &types.AttributeValueMemberS{Value: tokenType},
+		"createdAt":  &types.AttributeValueMemberS{Value: createdAt},
+	}
+}
+
+func TestListTokens(t *testing.T) {
+	created := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		name   string
+		tenant string
+		filter models.TokenFilter
+		cursor string
+		limit  int32
+		client func(t *testing.T) *mockDynamoAPI
+		expect func(t *testing.T, tokens []*models.Token, next string, err error)
+	}{
+		{
+			name:   "queries the tenant type index",
+			filter: models.TokenFilter{TokenType: "card", CreatedAfter: created, CreatedBefore: created.Add(time.Hour)},
+			limit:  10,
+			client: func(t *testing.T) *mockDynamoAPI {
+				return &mockDynamoAPI{
+					queryFunc: func(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+						assert.Equal(t, TenantTypeIndex, *params.IndexName)
+						assert.Equal(t, "#partition = :partition AND #createdAt BETWEEN :createdAfter AND :createdBefore", *params.KeyConditionExpression)
+						assert.Equal(t, "tenant_type", params.ExpressionAttributeNames["#partition"])
+						assert.Equal(t, &types.AttributeValueMemberS{Value: "#card"}, params.ExpressionAttributeValues[":partition"])
+						assert.Equal(t, "(attribute_not_exists(#expiresAt) OR #expiresAt > :now)", *params.FilterExpression)
+						assert.Equal(t, &types.AttributeValueMemberS{Value: "2025-03-01T12:00:00"}, params.ExpressionAttributeValues[":createdAfter"])
+						assert.Equal(t, &types.AttributeValueMemberS{Value: "2025-03-01T13:00:01"}, params.ExpressionAttributeValues[":createdBefore"])
+						assert.Equal(t, int32(10), *params.Limit)
+						return &dynamodb.QueryOutput{Items: []map[string]types.AttributeValue{
+							listItem("first", "card", "2025-03-01T12:30:00Z"),
+							// DynamoDB only compares to the second, the rest of the filter is applied to what it returns
+							listItem("too-late", "card", "2025-03-01T13:00:00.5Z"),
+						}}, nil
+					},
+				}
+			},
+			expect: func(t *testing.T, tokens []*models.Token, next string, err error) {
+				assert.NoError(t, err)
+				assert.Len(t, tokens, 1)
+				assert.Equal(t, "first", tokens[0].Token)
+				assert.Empty(t, next)
+			},
+		},
+		{
+			name:   "queries the tenant index without a token type",
+			tenant: "payments",
+			filter: models.TokenFilter{
+				CreatedAfter:  created,
+				ExpiresBefore: created,
+				Metadata:      map[string]string{"region": "eu", "retries": "3", "verified": "true"},
+			},
+			limit: 10,
+			client: func(t *testing.T) *mockDynamoAPI {
+				return &mockDynamoAPI{
+					queryFunc: func(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+						assert.Equal(t, TenantIndex, *params.IndexName)
+						assert.Equal(t, "#partition = :partition AND #createdAt >= :createdAfter", *params.KeyConditionExpression)
+						assert.Equal(t, "tenant_key", params.ExpressionAttributeNames["#partition"])
+						assert.Equal(t, &types.AttributeValueMemberS{Value: "payments#"}, params.ExpressionAttributeValues[":partition"])
+						assert.Equal(t, "(attribute_not_exists(#expiresAt) OR #expiresAt > :now) AND #expiresAt <= :expiresBefore AND "+
+							"(#metadata.#m0 = :m0_0) AND (#metadata.#m1 = :m1_0 OR #metadata.#m1 = :m1_1) AND "+
+							"(#metadata.#m2 = :m2_0 OR #metadata.#m2 = :m2_1)", *params.FilterExpression)
+						assert.Equal(t, "region", params.ExpressionAttributeNames["#m0"])
+						assert.Equal(t, "retries", params.ExpressionAttributeNames["#m1"])
+						assert.Equal(t, "verified", params.ExpressionAttributeNames["#m2"])
+						assert.Equal(t, &types.AttributeValueMemberS{Value: "eu"}, params.ExpressionAttributeValues[":m0_0"])
+						assert.Equal(t, &types.AttributeValueMemberS{Value: "3"}, params.ExpressionAttributeValues[":m1_0"])
+						assert.Equal(t, &types.AttributeValueMemberN{Value: "3"}, params.ExpressionAttributeValues[":m1_1"])
+						assert.Equal(t, &types.AttributeValueMemberBOOL{Value: true}, params.ExpressionAttributeValues[":m2_1"])
+						assert.Equal(t, &types.AttributeValueMemberN{Value: "1740830400"}, params.ExpressionAttributeValues[":expiresBefore"])
+						return &dynamodb.QueryOutput{}, nil
+					},
+				}
+			},
+			expect: func(t *testing.T, tokens []*models.Token, next string, err error) {
+				assert.NoError(t, err)
+				assert.Empty(t, tokens)
+				assert.Empty(t, next)
+			},
+		},
+		{
+			name:  "reads pages until there are enough tokens",
+			limit: 2,
+			client: func(t *testing.T) *mockDynamoAPI {
+				calls := 0
+				return &mockDynamoAPI{
+					queryFunc: func(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+						calls++
+						if calls == 1 {
+							assert.Nil(t, params.ExclusiveStartKey)
+							assert.Equal(t, int32(2), *params.Limit)
+							return &dynamodb.QueryOutput{
+								Items:            []map[string]types.AttributeValue{listItem("first", "card", "2025-03-01T12:00:00Z")},
+								LastEvaluatedKey: map[string]types.AttributeValue{"token": &types.AttributeValueMemberS{Value: "filtered"}},
+							}, nil
+						}
+						assert.Equal(t, &types.AttributeValueMemberS{Value: "filtered"}, params.ExclusiveStartKey["token"])
+						assert.Equal(t, int32(1), *params.Limit)
+						return &dynamodb.QueryOutput{
+							Items:            []map[string]types.AttributeValue{listItem("second", "card", "2025-03-01T12:00:00Z")},
+							LastEvaluatedKey: map[string]types.AttributeValue{"token": &types.AttributeValueMemberS{Value: "second"}},
+						}, nil
+					},
+				}
+			},
+			expect: func(t *testing.T, tokens []*models.Token, next string, err error) {
+				assert.NoError(t, err)
+				assert.Len(t, tokens, 2)
+				key, err := decodeCursor(next)
+				assert.NoError(t, err)
+				assert.Equal(t, map[string]types.AttributeValue{"token": &types.AttributeValueMemberS{Value: "second"}}, key)
+			},
+		},
+		{
+			name:   "continues from the cursor",
+			cursor: "eyJ0b2tlbiI6InNlY29uZCJ9",
+			limit:  2,
+			client: func(t *testing.T) *mockDynamoAPI {
+				return &mockDynamoAPI{
+					queryFunc: func(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+						assert.Equal(t, map[string]types.AttributeValue{"token": &types.AttributeValueMemberS{Value: "second"}}, params.ExclusiveStartKey)
+						return &dynamodb.QueryOutput{}, nil
+					},
+				}
+			},
+			expect: func(t *testing.T, tokens []*models.Token, next string, err error) {
+				assert.NoError(t, err)
+				assert.Empty(t, next)
+			},
+		},
+		{
+			name:   "invalid cursor",
+			cursor: "not a cursor",
+			client: func(t *testing.T) *mockDynamoAPI {
+				return &mockDynamoAPI{}
+			},
+			expect: func(t *testing.T, tokens []*models.Token, next string, err error) {
+				assert.ErrorIs(t, err, persistence.ErrInvalidCursor)
+			},
+		},
+		{
+			name:   "strips the tenant from tokens",
+			tenant: "payments",
+			filter: models.TokenFilter{TokenType: "card"},
+			client: func(t *testing.T) *mockDynamoAPI {
+				return &mockDynamoAPI{
+					queryFunc: func(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+						assert.Equal(t, int32(persistence.DefaultListLimit), *params.Limit)
+						item := listItem("payments#first", "card", "2025-03-01T12:00:00Z")
+						item["tenant"] = &types.AttributeValueMemberS{Value: "payments"}
+						return &dynamodb.QueryOutput{Items: []map[string]types.AttributeValue{item}}, nil
+					},
+				}
+			},
+			expect: func(t *testing.T, tokens []*models.Token, next string, err error) {
+				assert.NoError(t, err)
+				assert.Equal(t, "first", tokens[0].Token)
+			},
+		},
+		{
+			name:   "throttled",
+			filter: models.TokenFilter{TokenType: "card"},
+			client: func(t *testing.T) *mockDynamoAPI {
+				return &mockDynamoAPI{
+					queryFunc: func(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+						return nil, &types.ProvisionedThroughputExceededException{}
+					},
+				}
+			},
+			expect: func(t *testing.T, tokens []*models.Token, next string, err error) {
+				assert.ErrorIs(t, err, persistence.ErrThrottled)
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := &DynamoStore{Api: tc.client(t)}
+			tokens, next, err := store.ListTokens(context.Background(), tc.tenant, tc.filter, tc.cursor, tc.limit)
+			tc.expect(t, tokens, next, err)
+		})
+	}
+}
+
+func TestIndexTokens(t *testing.T) {
+	updated := map[string]*dynamodb.UpdateItemInput{}
+	client := &mockDynamoAPI{
+		scanFunc: func(ctx context.Context, params *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error) {
+			assert.Equal(t, "attribute_not_exists(#tenantKey)", *params.FilterExpression)
+			assert.Equal(t, &types.AttributeValueMemberS{Value: "start"}, params.ExclusiveStartKey["token"])
+			untyped := listItem("payments#second", "", "2025-03-01T12:00:00Z")
+			delete(untyped, "token_type")
+			untyped["tenant"] = &types.AttributeValueMemberS{Value: "payments"}
+			return &dynamodb.ScanOutput{
+				Items: []map[string]types.AttributeValue{
+					listItem("first", "card", "2025-03-01T12:00:00Z"),
+					untyped,
+					listItem("deleted", "card", "2025-03-01T12:00:00Z"),
+				},
+				LastEvaluatedKey: map[string]types.AttributeValue{"token": &types.AttributeValueMemberS{Value: "deleted"}},
+			}, nil
+		},
+		updateItemFunc: func(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+			key := params.Key["token"].(*types.AttributeValueMemberS).Value
+			if key == "deleted" {
+				return nil, &types.ConditionalCheckFailedException{}
+			}
+			updated[key] = params
+			return &dynamodb.UpdateItemOutput{}, nil
+		},
+	}
+
+	store := &DynamoStore{Api: client}
+	indexed, next, err := store.IndexTokens(context.Background(), "start", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, indexed)
+	assert.Equal(t, "deleted", next)
+
+	first := updated["first"]
+	assert.Equal(t, "SET #tenant_key = :tenant_key, #tenant_type = :tenant_type", *first.UpdateExpression)
+	assert.Equal(t, "attribute_exists(#token)", *first.ConditionExpression)
+	assert.Equal(t, &types.AttributeValueMemberS{Value: "#"}, first.ExpressionAttributeValues[":tenant_key"])
+	assert.Equal(t, &types.AttributeValueMemberS{Value: "#card"}, first.ExpressionAttributeValues[":tenant_type"])
+	second := updated["payments#second"]
+	assert.Equal(t, "SET #tenant_key = :tenant_key", *second.UpdateExpression)
+	assert.Equal(t, &types.AttributeValueMemberS{Value: "payments#"}, second.ExpressionAttributeValues[":tenant_key"])
+}
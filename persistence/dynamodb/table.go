@@ -3,6 +3,7 @@ package dynamodb
 import (
 	"context"
 	"errors"
+	"log/slog"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
@@ -10,16 +11,56 @@ import (
 )
 
 func SetupDynamoTable(ctx context.Context, client Api) {
-	_, err := client.DescribeTable(context.Background(), &dynamodb.DescribeTableInput{
+	output, err := client.DescribeTable(context.Background(), &dynamodb.DescribeTableInput{
 		TableName: aws.String("token_data"),
 	})
 	if err != nil {
 		var notFoundEx *types.ResourceNotFoundException
-		if errors.As(err, &notFoundEx) {
-			_ = CreateTable(ctx, client)
+		if !errors.As(err, &notFoundEx) {
+			return
+		}
+		if err := CreateTable(ctx, client); err != nil {
+			return
+		}
+	} else if err := addListIndexes(ctx, client, output.Table); err != nil {
+		// only listing tokens needs the indexes
+		slog.Warn("unable to add the list indexes to the token table", "error", err)
+	}
+
+	// expired tokens are also hidden when they are read, so the service keeps working until TTL can be enabled, such as
+	// while a new table is still being created
+	if err := EnableTimeToLive(ctx, client); err != nil {
+		slog.Warn("unable to enable TTL on the token table", "error", err)
+	}
+}
+
+// EnableTimeToLive turns on DynamoDB TTL for the token table, so expired tokens are deleted
+func EnableTimeToLive(ctx context.Context, client Api) error {
+	return enableTimeToLive(ctx, client, TokenTableName)
+}
+
+// enableTimeToLive turns on DynamoDB TTL for a table with an ExpiresAtAttribute
+func enableTimeToLive(ctx context.Context, client Api, table *string) error {
+	output, err := client.DescribeTimeToLive(ctx, &dynamodb.DescribeTimeToLiveInput{
+		TableName: table,
+	})
+	if err != nil {
+		return err
+	}
+	if ttl := output.TimeToLiveDescription; ttl != nil && aws.ToString(ttl.AttributeName) == ExpiresAtAttribute {
+		if ttl.TimeToLiveStatus == types.TimeToLiveStatusEnabled || ttl.TimeToLiveStatus == types.TimeToLiveStatusEnabling {
+			return nil
 		}
 	}
-	return
+
+	_, err = client.UpdateTimeToLive(ctx, &dynamodb.UpdateTimeToLiveInput{
+		TableName: table,
+		TimeToLiveSpecification: &types.TimeToLiveSpecification{
+			AttributeName: aws.String(ExpiresAtAttribute),
+			Enabled:       aws.Bool(true),
+		},
+	})
+	return err
 }
 
 func CreateTable(ctx context.Context, client Api) error {
@@ -30,6 +71,18 @@ func CreateTable(ctx context.Context, client Api) error {
 				AttributeName: aws.String("token"),
 				AttributeType: types.ScalarAttributeTypeS,
 			},
+			{
+				AttributeName: aws.String(tenantKeyAttribute),
+				AttributeType: types.ScalarAttributeTypeS,
+			},
+			{
+				AttributeName: aws.String(tenantTypeAttribute),
+				AttributeType: types.ScalarAttributeTypeS,
+			},
+			{
+				AttributeName: aws.String("createdAt"),
+				AttributeType: types.ScalarAttributeTypeS,
+			},
 		},
 		KeySchema: []types.KeySchemaElement{
 			{
@@ -38,7 +91,79 @@ func CreateTable(ctx context.Context, client Api) error {
 				KeyType:       types.KeyTypeHash,
 			},
 		},
-		BillingMode: types.BillingModePayPerRequest,
+		GlobalSecondaryIndexes: listIndexes(),
+		BillingMode:            types.BillingModePayPerRequest,
+	})
+	return err
+}
+
+// listIndexes are the indexes ListTokens queries for the tokens of a tenant, and of a type of a tenant, ordered by
+// when they were created
+func listIndexes() []types.GlobalSecondaryIndex {
+	return []types.GlobalSecondaryIndex{
+		listIndex(TenantIndex, tenantKeyAttribute),
+		listIndex(TenantTypeIndex, tenantTypeAttribute),
+	}
+}
+
+func listIndex(name string, partition string) types.GlobalSecondaryIndex {
+	return types.GlobalSecondaryIndex{
+		IndexName: aws.String(name),
+		KeySchema: []types.KeySchemaElement{
+			{
+				AttributeName: aws.String(partition),
+				KeyType:       types.KeyTypeHash,
+			},
+			{
+				AttributeName: aws.String("createdAt"),
+				KeyType:       types.KeyTypeRange,
+			},
+		},
+		Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+	}
+}
+
+// addListIndexes adds the list indexes to a token table created before they existed. DynamoDB only creates one index
+// at a time, so a table missing both gets the second one the next time the service starts.
+func addListIndexes(ctx context.Context, client Api, table *types.TableDescription) error {
+	existing := map[string]bool{}
+	if table != nil {
+		for _, index := range table.GlobalSecondaryIndexes {
+			existing[aws.ToString(index.IndexName)] = true
+		}
+	}
+
+	for _, index := range listIndexes() {
+		if !existing[aws.ToString(index.IndexName)] {
+			return createIndex(ctx, client, index)
+		}
+	}
+	return nil
+}
+
+// createIndex adds an index partitioned by a string attribute and sorted by creation time to the token table
+func createIndex(ctx context.Context, client Api, index types.GlobalSecondaryIndex) error {
+	_, err := client.UpdateTable(ctx, &dynamodb.UpdateTableInput{
+		TableName: TokenTableName,
+		AttributeDefinitions: []types.AttributeDefinition{
+			{
+				AttributeName: index.KeySchema[0].AttributeName,
+				AttributeType: types.ScalarAttributeTypeS,
+			},
+			{
+				AttributeName: aws.String("createdAt"),
+				AttributeType: types.ScalarAttributeTypeS,
+			},
+		},
+		GlobalSecondaryIndexUpdates: []types.GlobalSecondaryIndexUpdate{
+			{
+				Create: &types.CreateGlobalSecondaryIndexAction{
+					IndexName:  index.IndexName,
+					KeySchema:  index.KeySchema,
+					Projection: index.Projection,
+				},
+			},
+		},
 	})
 	return err
 }
@@ -26,7 +26,7 @@ func TestCreateTable(t *testing.T) {
 						assert.Equal(t, *TokenTableName, *params.TableName)
 
 						// Verify attribute definitions
-						assert.Len(t, params.AttributeDefinitions, 1)
+						assert.Len(t, params.AttributeDefinitions, 4)
 						assert.Equal(t, "token", *params.AttributeDefinitions[0].AttributeName)
 						assert.Equal(t, types.ScalarAttributeTypeS, params.AttributeDefinitions[0].AttributeType)
 
@@ -91,7 +91,7 @@ func TestCreateTable(t *testing.T) {
 						assert.Equal(t, "token_data", *params.TableName)
 
 						// Check attribute definitions structure
-						assert.Len(t, params.AttributeDefinitions, 1)
+						assert.Len(t, params.AttributeDefinitions, 4)
 						attr := params.AttributeDefinitions[0]
 						assert.Equal(t, "token", *attr.AttributeName)
 						assert.Equal(t, types.ScalarAttributeTypeS, attr.AttributeType)
@@ -105,6 +105,18 @@ func TestCreateTable(t *testing.T) {
 						// Verify billing mode is pay-per-request
 						assert.Equal(t, types.BillingModePayPerRequest, params.BillingMode)
 
+						// Check the list indexes
+						assert.Len(t, params.GlobalSecondaryIndexes, 2)
+						for i, partition := range []string{"tenant_key", "tenant_type"} {
+							index := params.GlobalSecondaryIndexes[i]
+							assert.Equal(t, partition+"-createdAt", *index.IndexName)
+							assert.Equal(t, partition, *index.KeySchema[0].AttributeName)
+							assert.Equal(t, types.KeyTypeHash, index.KeySchema[0].KeyType)
+							assert.Equal(t, "createdAt", *index.KeySchema[1].AttributeName)
+							assert.Equal(t, types.KeyTypeRange, index.KeySchema[1].KeyType)
+							assert.Equal(t, types.ProjectionTypeAll, index.Projection.ProjectionType)
+						}
+
 						// Verify no provisioned throughput is set (since we're using pay-per-request)
 						assert.Nil(t, params.ProvisionedThroughput)
 
@@ -2,83 +2,386 @@ package dynamodb
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"tokenize/models"
+	"tokenize/persistence"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/google/uuid"
 )
 
-func (d *DynamoStore) GetToken(ctx context.Context, token string) (*models.Token, error) {
-	awsTokenVal, err := attributevalue.Marshal(token)
-	if err != nil {
-		return nil, err
-	}
-
+func (d *DynamoStore) GetToken(ctx context.Context, tenant string, token string) (*models.Token, error) {
 	dynamoItem, err := d.Api.GetItem(ctx, &dynamodb.GetItemInput{
 		TableName: TokenTableName,
-		Key: map[string]types.AttributeValue{
-			"token": awsTokenVal,
-		},
+		Key:       tokenKey(tenant, token),
 	})
 	if err != nil {
-		return nil, err
+		return nil, translateError(err)
 	}
 	if dynamoItem == nil || dynamoItem.Item == nil {
 		return nil, models.ErrTokenNotFound
 	}
 
-	tokenPayload := &models.Token{}
-	err = attributevalue.UnmarshalMap(dynamoItem.Item, tokenPayload)
+	tokenPayload, err := unmarshalToken(dynamoItem.Item)
 	if err != nil {
 		return nil, err
 	}
+	// DynamoDB only deletes expired items eventually, they are gone as far as callers are concerned
+	if tokenPayload.Expired(time.Now()) {
+		return nil, models.ErrTokenNotFound
+	}
 	return tokenPayload, nil
 }
 
-func (d *DynamoStore) CreateToken(ctx context.Context, token *models.Token) (*models.Token, error) {
+// createCondition never overwrites an existing token, the caller decides whether to reuse it or generate another.
+// Expired tokens that have not been deleted yet can be replaced.
+const createCondition = "attribute_not_exists(#token) OR #expiresAt <= :now"
 
-	id, err := uuid.NewV7()
+func createConditionNames() map[string]string {
+	return map[string]string{
+		"#token":     "token",
+		"#expiresAt": ExpiresAtAttribute,
+	}
+}
+
+func createConditionValues(now time.Time) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		":now": epochValue(now),
+	}
+}
+
+func (d *DynamoStore) CreateToken(ctx context.Context, token *models.Token) (*models.Token, error) {
+	dynamoItem, err := tokenItem(token)
 	if err != nil {
 		return nil, err
 	}
+	if err := d.putNew(ctx, dynamoItem); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
 
-	token.Id = id
-	token.CreatedAt = time.Now()
-	token.UpdatedAt = time.Now()
+// putNew writes the item of a new token with createCondition, models.ErrTokenExists when the token is stored
+func (d *DynamoStore) putNew(ctx context.Context, item map[string]types.AttributeValue) error {
+	_, err := d.Api.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:                 TokenTableName,
+		Item:                      item,
+		ConditionExpression:       aws.String(createCondition),
+		ExpressionAttributeNames:  createConditionNames(),
+		ExpressionAttributeValues: createConditionValues(time.Now()),
+	})
+	if err != nil {
+		var conditionFailed *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionFailed) {
+			return models.ErrTokenExists
+		}
+		return translateError(err)
+	}
+	return nil
+}
+
+func (d *DynamoStore) UpdateToken(ctx context.Context, tenant string, token string, update models.UpdateToken) (*models.Token, error) {
+	if update.TTL == nil && update.Metadata == nil {
+		return nil, models.ErrEmptyUpdate
+	}
+
+	now := time.Now()
+	fields := map[string]any{"updatedAt": now}
+	if update.TTL != nil {
+		fields["ttl"] = *update.TTL
+	}
+	if update.Metadata != nil {
+		fields["metadata"] = update.Metadata
+	}
+
+	names := map[string]string{"#token": "token", "#expiresAt": ExpiresAtAttribute}
+	values := map[string]types.AttributeValue{":now": epochValue(now)}
+	sets := []string{}
+	removes := ""
+	// a new TTL counts from now, and a TTL of zero stops the token from expiring
+	if update.TTL != nil {
+		if expiresAt := models.ExpiresAfter(now, *update.TTL); expiresAt != 0 {
+			fields[ExpiresAtAttribute] = expiresAt
+		} else {
+			removes = " REMOVE #expiresAt"
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(fields)) {
+		value, err := attributevalue.Marshal(fields[name])
+		if err != nil {
+			return nil, err
+		}
+		names["#"+name] = name
+		values[":"+name] = value
+		sets = append(sets, fmt.Sprintf("#%s = :%s", name, name))
+	}
+
+	output, err := d.Api.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 TokenTableName,
+		Key:                       tokenKey(tenant, token),
+		UpdateExpression:          aws.String("SET " + strings.Join(sets, ", ") + removes),
+		ConditionExpression:       aws.String("attribute_exists(#token) AND (attribute_not_exists(#expiresAt) OR #expiresAt > :now)"),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+		ReturnValues:              types.ReturnValueAllNew,
+	})
+	if err != nil {
+		var conditionFailed *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionFailed) {
+			return nil, models.ErrTokenNotFound
+		}
+		return nil, translateError(err)
+	}
+
+	return unmarshalToken(output.Attributes)
+}
+
+// tokenItem prepares a new token for storing and returns it as a DynamoDB item. The token must have its ID, which is
+// assigned before encryption since the payload is bound to it, so a token without one could never be decrypted.
+func tokenItem(token *models.Token) (map[string]types.AttributeValue, error) {
+	if token.Id == uuid.Nil {
+		return nil, models.ErrMissingTokenID
+	}
+	token.ExpiresAt = models.ExpiresAfter(token.CreatedAt, token.TTL)
+	// creation times are stored in UTC so they sort in the list indexes
+	token.CreatedAt = token.CreatedAt.UTC()
 
 	dynamoItem, err := attributevalue.MarshalMap(token)
 	if err != nil {
 		return nil, err
 	}
+	maps.Copy(dynamoItem, tokenKey(token.Tenant, token.Token))
+	maps.Copy(dynamoItem, listKeys(token.Tenant, token.TokenType))
+	return dynamoItem, nil
+}
+
+// tokenKey is the key of a tenant's token. Tokens of a tenant are stored under the tenant prefixed token value, so the
+// same value can be used by several tenants without them seeing each other's tokens.
+func tokenKey(tenant string, token string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"token": &types.AttributeValueMemberS{Value: models.StorageKey(tenant, token)},
+	}
+}
+
+// unmarshalToken reads a stored token, removing the tenant prefix from its key
+func unmarshalToken(item map[string]types.AttributeValue) (*models.Token, error) {
+	token := &models.Token{}
+	if err := attributevalue.UnmarshalMap(item, token); err != nil {
+		return nil, err
+	}
+	if token.Tenant != "" {
+		token.Token = strings.TrimPrefix(token.Token, token.Tenant+"#")
+	}
+	return token, nil
+}
+
+// epochValue is a time as the number of seconds since the epoch, the format DynamoDB TTL expects
+func epochValue(t time.Time) types.AttributeValue {
+	return &types.AttributeValueMemberN{Value: strconv.FormatInt(t.Unix(), 10)}
+}
 
-	_, err = d.Api.PutItem(ctx, &dynamodb.PutItemInput{
+func (d *DynamoStore) DeleteToken(ctx context.Context, token *models.Token) error {
+	if token == nil {
+		return nil
+	}
+	_, err := d.Api.DeleteItem(ctx, &dynamodb.DeleteItemInput{
 		TableName: TokenTableName,
-		Item:      dynamoItem,
+		Key:       tokenKey(token.Tenant, token.Token),
+	})
+
+	return translateError(err)
+}
+
+// revealUpdate takes a reveal of the token. The decrement only happens while reveals are left, so of concurrent reveals
+// only as many succeed as were left.
+func revealUpdate(token *models.Token) *types.Update {
+	return &types.Update{
+		TableName:        TokenTableName,
+		Key:              tokenKey(token.Tenant, token.Token),
+		UpdateExpression: aws.String("SET #revealsLeft = #revealsLeft - :one"),
+		ConditionExpression: aws.String("attribute_exists(#token) AND #revealsLeft > :zero AND " +
+			"(attribute_not_exists(#expiresAt) OR #expiresAt > :now)"),
+		ExpressionAttributeNames: map[string]string{
+			"#token":       "token",
+			"#revealsLeft": RevealsLeftAttribute,
+			"#expiresAt":   ExpiresAtAttribute,
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one":  &types.AttributeValueMemberN{Value: "1"},
+			":zero": &types.AttributeValueMemberN{Value: "0"},
+			":now":  epochValue(time.Now()),
+		},
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	}
+}
+
+func (d *DynamoStore) ConsumeReveal(ctx context.Context, token *models.Token) (int64, error) {
+	update := revealUpdate(token)
+	output, err := d.Api.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                           update.TableName,
+		Key:                                 update.Key,
+		UpdateExpression:                    update.UpdateExpression,
+		ConditionExpression:                 update.ConditionExpression,
+		ExpressionAttributeNames:            update.ExpressionAttributeNames,
+		ExpressionAttributeValues:           update.ExpressionAttributeValues,
+		ReturnValues:                        types.ReturnValueUpdatedNew,
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
 	})
 	if err != nil {
-		return nil, err
+		var conditionFailed *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionFailed) {
+			return 0, revealFailure(conditionFailed.Item)
+		}
+		return 0, translateError(err)
 	}
 
-	return token, nil
+	var left int64
+	if err := attributevalue.Unmarshal(output.Attributes[RevealsLeftAttribute], &left); err != nil {
+		return 0, err
+	}
+	return left, nil
 }
 
-// func (d *DynamoStore) UpdateToken(ctx context.Context, token *models.Token) (*models.Token, error) {}
+// ConsumeReveals takes the reveals of the tokens in a single transaction. A transaction does not return the items it
+// updated, so the reveals left are read back with a consistent read once it succeeded.
+func (d *DynamoStore) ConsumeReveals(ctx context.Context, tokens []*models.Token) ([]int64, error) {
+	if len(tokens) > persistence.MaxConsumeReveals {
+		return nil, persistence.ErrTooManyReveals
+	}
+	if len(tokens) == 0 {
+		return []int64{}, nil
+	}
+	items := make([]types.TransactWriteItem, len(tokens))
+	keys := make([]map[string]types.AttributeValue, len(tokens))
+	for i, token := range tokens {
+		items[i] = types.TransactWriteItem{Update: revealUpdate(token)}
+		keys[i] = tokenKey(token.Tenant, token.Token)
+	}
+	_, err := d.Api.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+	var canceled *types.TransactionCanceledException
+	if errors.As(err, &canceled) {
+		for _, reason := range canceled.CancellationReasons {
+			switch aws.ToString(reason.Code) {
+			case "ConditionalCheckFailed":
+				return nil, revealFailure(reason.Item)
+			case "TransactionConflict":
+				return nil, models.ErrTokenChanged
+			}
+		}
+	}
+	if err != nil {
+		return nil, translateError(err)
+	}
 
-func (d *DynamoStore) DeleteToken(ctx context.Context, token *models.Token) error {
-	awsTokenVal, err := attributevalue.Marshal(token)
+	stored, err := d.readBatch(ctx, keys, true)
+	if err != nil {
+		return nil, err
+	}
+	left := map[string]int64{}
+	for _, item := range stored {
+		token, err := unmarshalToken(item)
+		if err != nil {
+			return nil, err
+		}
+		left[itemKey(item)] = token.RevealsLeft
+	}
+	counts := make([]int64, len(tokens))
+	for i, token := range tokens {
+		// a token deleted since by another request that took its last reveal has none left
+		counts[i] = left[models.StorageKey(token.Tenant, token.Token)]
+	}
+	return counts, nil
+}
+
+// revealFailure tells a token without reveals left from one that is gone, by the item a failed ConsumeReveal found
+func revealFailure(item map[string]types.AttributeValue) error {
+	if len(item) == 0 {
+		return models.ErrTokenNotFound
+	}
+	token, err := unmarshalToken(item)
 	if err != nil {
 		return err
 	}
-	_, err = d.Api.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+	if token.Expired(time.Now()) {
+		return models.ErrTokenNotFound
+	}
+	return models.ErrRevealsExhausted
+}
+
+func (d *DynamoStore) ScanTokens(ctx context.Context, cursor string, limit int32) ([]*models.Token, string, error) {
+	input := &dynamodb.ScanInput{
 		TableName: TokenTableName,
-		Key: map[string]types.AttributeValue{
-			"token": awsTokenVal,
-		},
+		Limit:     aws.Int32(limit),
+	}
+	if cursor != "" {
+		input.ExclusiveStartKey = map[string]types.AttributeValue{
+			"token": &types.AttributeValueMemberS{Value: cursor},
+		}
+	}
+
+	output, err := d.Api.Scan(ctx, input)
+	if err != nil {
+		return nil, "", translateError(err)
+	}
+
+	tokens := []*models.Token{}
+	for _, item := range output.Items {
+		token, err := unmarshalToken(item)
+		if err != nil {
+			return nil, "", err
+		}
+		tokens = append(tokens, token)
+	}
+
+	next := ""
+	if lastKey, ok := output.LastEvaluatedKey["token"].(*types.AttributeValueMemberS); ok {
+		next = lastKey.Value
+	}
+	return tokens, next, nil
+}
+
+func (d *DynamoStore) UpdateTokenKey(ctx context.Context, token *models.Token, previous *models.Token) error {
+	token.UpdatedAt = time.Now()
+	values, err := attributevalue.MarshalMap(map[string]any{
+		":payload":         token.Payload,
+		":wrappedKey":      token.WrappedKey,
+		":keyId":           token.KeyID,
+		":updatedAt":       token.UpdatedAt,
+		":previousPayload": previous.Payload,
 	})
+	if err != nil {
+		return err
+	}
+
+	condition := "payload = :previousPayload AND attribute_not_exists(wrapped_key)"
+	if previous.WrappedKey != "" {
+		condition = "payload = :previousPayload AND wrapped_key = :previousWrappedKey"
+		values[":previousWrappedKey"] = &types.AttributeValueMemberS{Value: previous.WrappedKey}
+	}
 
-	return err
+	_, err = d.Api.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 TokenTableName,
+		Key:                       tokenKey(token.Tenant, token.Token),
+		UpdateExpression:          aws.String("SET payload = :payload, wrapped_key = :wrappedKey, key_id = :keyId, updatedAt = :updatedAt"),
+		ConditionExpression:       aws.String(condition),
+		ExpressionAttributeValues: values,
+	})
+	if err != nil {
+		var conditionFailed *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionFailed) {
+			return models.ErrTokenChanged
+		}
+		return translateError(err)
+	}
+	return nil
 }
@@ -3,9 +3,11 @@ package dynamodb
 import (
 	"context"
 	"errors"
+	"strconv"
 	"testing"
 	"time"
 	"tokenize/models"
+	"tokenize/persistence"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
@@ -18,8 +20,17 @@ type mockDynamoAPI struct {
 	getItemFunc       func(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
 	putItemFunc       func(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
 	deleteItemFunc    func(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error)
+	batchGetFunc      func(ctx context.Context, params *dynamodb.BatchGetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error)
+	batchWriteFunc    func(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error)
 	createTableFunc   func(ctx context.Context, params *dynamodb.CreateTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.CreateTableOutput, error)
 	describeTableFunc func(ctx context.Context, params *dynamodb.DescribeTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTableOutput, error)
+	updateTableFunc   func(ctx context.Context, params *dynamodb.UpdateTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateTableOutput, error)
+	scanFunc          func(ctx context.Context, params *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error)
+	queryFunc         func(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error)
+	updateItemFunc    func(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error)
+	describeTTLFunc   func(ctx context.Context, params *dynamodb.DescribeTimeToLiveInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTimeToLiveOutput, error)
+	updateTTLFunc     func(ctx context.Context, params *dynamodb.UpdateTimeToLiveInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateTimeToLiveOutput, error)
+	transactFunc      func(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error)
 }
 
 func (m *mockDynamoAPI) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
@@ -43,6 +54,20 @@ func (m *mockDynamoAPI) DeleteItem(ctx context.Context, params *dynamodb.DeleteI
 	return nil, errors.New("DeleteItem not implemented")
 }
 
+func (m *mockDynamoAPI) BatchGetItem(ctx context.Context, params *dynamodb.BatchGetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error) {
+	if m.batchGetFunc != nil {
+		return m.batchGetFunc(ctx, params, optFns...)
+	}
+	return nil, errors.New("BatchGetItem not implemented")
+}
+
+func (m *mockDynamoAPI) BatchWriteItem(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+	if m.batchWriteFunc != nil {
+		return m.batchWriteFunc(ctx, params, optFns...)
+	}
+	return nil, errors.New("BatchWriteItem not implemented")
+}
+
 func (m *mockDynamoAPI) CreateTable(ctx context.Context, params *dynamodb.CreateTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.CreateTableOutput, error) {
 	if m.createTableFunc != nil {
 		return m.createTableFunc(ctx, params, optFns...)
@@ -57,13 +82,86 @@ func (m *mockDynamoAPI) DescribeTable(ctx context.Context, params *dynamodb.Desc
 	return nil, errors.New("DescribeTable not implemented")
 }
 
+func (m *mockDynamoAPI) UpdateTable(ctx context.Context, params *dynamodb.UpdateTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateTableOutput, error) {
+	if m.updateTableFunc != nil {
+		return m.updateTableFunc(ctx, params, optFns...)
+	}
+	return nil, errors.New("UpdateTable not implemented")
+}
+
+func (m *mockDynamoAPI) Scan(ctx context.Context, params *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error) {
+	if m.scanFunc != nil {
+		return m.scanFunc(ctx, params, optFns...)
+	}
+	return nil, errors.New("Scan not implemented")
+}
+
+func (m *mockDynamoAPI) Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+	if m.queryFunc != nil {
+		return m.queryFunc(ctx, params, optFns...)
+	}
+	return nil, errors.New("Query not implemented")
+}
+
+func (m *mockDynamoAPI) UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	if m.updateItemFunc != nil {
+		return m.updateItemFunc(ctx, params, optFns...)
+	}
+	return nil, errors.New("UpdateItem not implemented")
+}
+
+func (m *mockDynamoAPI) DescribeTimeToLive(ctx context.Context, params *dynamodb.DescribeTimeToLiveInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTimeToLiveOutput, error) {
+	if m.describeTTLFunc != nil {
+		return m.describeTTLFunc(ctx, params, optFns...)
+	}
+	return nil, errors.New("DescribeTimeToLive not implemented")
+}
+
+func (m *mockDynamoAPI) UpdateTimeToLive(ctx context.Context, params *dynamodb.UpdateTimeToLiveInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateTimeToLiveOutput, error) {
+	if m.updateTTLFunc != nil {
+		return m.updateTTLFunc(ctx, params, optFns...)
+	}
+	return nil, errors.New("UpdateTimeToLive not implemented")
+}
+
+func (m *mockDynamoAPI) TransactWriteItems(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error) {
+	if m.transactFunc != nil {
+		return m.transactFunc(ctx, params, optFns...)
+	}
+	return nil, errors.New("TransactWriteItems not implemented")
+}
+
 func TestGetToken(t *testing.T) {
 	testCases := []struct {
 		name   string
+		tenant string
 		token  string
 		client func(t *testing.T) *mockDynamoAPI
 		expect func(t *testing.T, token *models.Token, err error)
 	}{
+		{
+			name:   "tenant token",
+			tenant: "payments",
+			token:  "test-token-123",
+			client: func(t *testing.T) *mockDynamoAPI {
+				return &mockDynamoAPI{
+					getItemFunc: func(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+						assert.Equal(t, &types.AttributeValueMemberS{Value: "payments#test-token-123"}, params.Key["token"])
+						return &dynamodb.GetItemOutput{
+							Item: map[string]types.AttributeValue{
+								"token":  &types.AttributeValueMemberS{Value: "payments#test-token-123"},
+								"tenant": &types.AttributeValueMemberS{Value: "payments"},
+							},
+						}, nil
+					},
+				}
+			},
+			expect: func(t *testing.T, token *models.Token, err error) {
+				assert.NoError(t, err)
+				assert.Equal(t, "test-token-123", token.Token, "the tenant prefix is not part of the token")
+				assert.Equal(t, "payments", token.Tenant)
+			},
+		},
 		{
 			name:  "successful token retrieval",
 			token: "test-token-123",
@@ -113,6 +211,65 @@ func TestGetToken(t *testing.T) {
 				assert.NotNil(t, token.Metadata)
 			},
 		},
+		{
+			name:  "expired token not yet deleted",
+			token: "test-token-123",
+			client: func(t *testing.T) *mockDynamoAPI {
+				return &mockDynamoAPI{
+					getItemFunc: func(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+						return &dynamodb.GetItemOutput{
+							Item: map[string]types.AttributeValue{
+								"token":     &types.AttributeValueMemberS{Value: "test-token-123"},
+								"ttl":       &types.AttributeValueMemberN{Value: "60"},
+								"expiresAt": &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Add(-time.Second).Unix(), 10)},
+							},
+						}, nil
+					},
+				}
+			},
+			expect: func(t *testing.T, token *models.Token, err error) {
+				assert.ErrorIs(t, err, models.ErrTokenNotFound)
+				assert.Nil(t, token)
+			},
+		},
+		{
+			name:  "token not expired yet",
+			token: "test-token-123",
+			client: func(t *testing.T) *mockDynamoAPI {
+				return &mockDynamoAPI{
+					getItemFunc: func(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+						return &dynamodb.GetItemOutput{
+							Item: map[string]types.AttributeValue{
+								"token":     &types.AttributeValueMemberS{Value: "test-token-123"},
+								"ttl":       &types.AttributeValueMemberN{Value: "60"},
+								"expiresAt": &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10)},
+							},
+						}, nil
+					},
+				}
+			},
+			expect: func(t *testing.T, token *models.Token, err error) {
+				assert.NoError(t, err)
+				assert.Equal(t, "test-token-123", token.Token)
+			},
+		},
+		{
+			name:  "throttled by dynamodb",
+			token: "test-token-123",
+			client: func(t *testing.T) *mockDynamoAPI {
+				return &mockDynamoAPI{
+					getItemFunc: func(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+						return nil, &types.ProvisionedThroughputExceededException{Message: aws.String("Rate of requests exceeds the allowed throughput")}
+					},
+				}
+			},
+			expect: func(t *testing.T, token *models.Token, err error) {
+				assert.ErrorIs(t, err, persistence.ErrThrottled)
+				var throttled *types.ProvisionedThroughputExceededException
+				assert.ErrorAs(t, err, &throttled, "the dynamodb error should still be available")
+				assert.Nil(t, token)
+			},
+		},
 		{
 			name:  "token not found - nil item",
 			token: "nonexistent-token",
@@ -210,12 +367,23 @@ func TestGetToken(t *testing.T) {
 				Api: tc.client(t),
 			}
 
-			token, err := store.GetToken(context.Background(), tc.token)
+			token, err := store.GetToken(context.Background(), tc.tenant, tc.token)
 			tc.expect(t, token, err)
 		})
 	}
 }
 
+// withID assigns the token an ID and creation time, as handlers do before they encrypt its payload
+func withID(token *models.Token) *models.Token {
+	base, err := models.NewBaseModel()
+	if err != nil {
+		panic(err)
+	}
+	base.Tenant = token.Tenant
+	token.BaseModel = base
+	return token
+}
+
 func TestCreateToken(t *testing.T) {
 	testCases := []struct {
 		name   string
@@ -225,7 +393,7 @@ func TestCreateToken(t *testing.T) {
 	}{
 		{
 			name: "successful token creation",
-			input: &models.Token{
+			input: withID(&models.Token{
 				CreateToken: models.CreateToken{
 					Payload:   "test-payload",
 					TokenType: "bearer",
@@ -235,7 +403,7 @@ func TestCreateToken(t *testing.T) {
 						"user":   "testuser",
 					},
 				},
-			},
+			}),
 			client: func(t *testing.T) *mockDynamoAPI {
 				return &mockDynamoAPI{
 					putItemFunc: func(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
@@ -250,6 +418,8 @@ func TestCreateToken(t *testing.T) {
 						assert.NotNil(t, params.Item["token_type"])
 						assert.NotNil(t, params.Item["ttl"])
 						assert.NotNil(t, params.Item["metadata"])
+						assert.Equal(t, &types.AttributeValueMemberS{Value: "#"}, params.Item["tenant_key"])
+						assert.Equal(t, &types.AttributeValueMemberS{Value: "#bearer"}, params.Item["tenant_type"])
 
 						return &dynamodb.PutItemOutput{}, nil
 					},
@@ -270,39 +440,45 @@ func TestCreateToken(t *testing.T) {
 			},
 		},
 		{
-			name: "uuid generation failure simulation",
-			input: &models.Token{
-				CreateToken: models.CreateToken{
-					Payload:   "test-payload",
-					TokenType: "bearer",
-					TTL:       3600,
-					Metadata: map[string]any{
-						"source": "test",
-					},
-				},
-			},
+			name: "tenant token is stored under the tenant prefix",
+			input: withID(&models.Token{
+				BaseModel:   models.BaseModel{Tenant: "payments"},
+				CreateToken: models.CreateToken{Payload: "test-payload", TokenType: "bearer"},
+				Token:       "test-token-123",
+			}),
 			client: func(t *testing.T) *mockDynamoAPI {
-				// This test demonstrates the CreateToken method's marshal and put flow
-				// In practice, uuid.NewV7() and attributevalue.MarshalMap work for valid inputs
 				return &mockDynamoAPI{
 					putItemFunc: func(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
-						// Verify the input is properly structured
-						assert.NotNil(t, params.Item)
+						assert.Equal(t, &types.AttributeValueMemberS{Value: "payments#test-token-123"}, params.Item["token"])
+						assert.Equal(t, &types.AttributeValueMemberS{Value: "payments"}, params.Item["tenant"])
 						return &dynamodb.PutItemOutput{}, nil
 					},
 				}
 			},
 			expect: func(t *testing.T, token *models.Token, err error) {
 				assert.NoError(t, err)
-				assert.NotNil(t, token)
-				assert.Equal(t, "test-payload", token.Payload)
-				assert.Equal(t, "bearer", token.TokenType)
-				assert.Equal(t, int64(3600), token.TTL)
+				assert.Equal(t, "test-token-123", token.Token)
 			},
 		},
 		{
-			name: "dynamodb put item error",
+			name: "token without an ID",
 			input: &models.Token{
+				CreateToken: models.CreateToken{
+					Payload:   "v2:abcd",
+					TokenType: "bearer",
+				},
+			},
+			client: func(t *testing.T) *mockDynamoAPI {
+				return &mockDynamoAPI{}
+			},
+			expect: func(t *testing.T, token *models.Token, err error) {
+				assert.ErrorIs(t, err, models.ErrMissingTokenID)
+				assert.Nil(t, token)
+			},
+		},
+		{
+			name: "dynamodb put item error",
+			input: withID(&models.Token{
 				CreateToken: models.CreateToken{
 					Payload:   "test-payload",
 					TokenType: "bearer",
@@ -311,7 +487,7 @@ func TestCreateToken(t *testing.T) {
 						"source": "test",
 					},
 				},
-			},
+			}),
 			client: func(t *testing.T) *mockDynamoAPI {
 				return &mockDynamoAPI{
 					putItemFunc: func(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
@@ -325,16 +501,39 @@ func TestCreateToken(t *testing.T) {
 				assert.Nil(t, token)
 			},
 		},
+		{
+			name: "token already exists",
+			input: withID(&models.Token{
+				Token: "existing-token",
+				CreateToken: models.CreateToken{
+					Payload: "test-payload",
+				},
+			}),
+			client: func(t *testing.T) *mockDynamoAPI {
+				return &mockDynamoAPI{
+					putItemFunc: func(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+						assert.Equal(t, "attribute_not_exists(#token) OR #expiresAt <= :now", *params.ConditionExpression)
+						assert.Equal(t, map[string]string{"#token": "token", "#expiresAt": "expiresAt"}, params.ExpressionAttributeNames)
+						assert.Contains(t, params.ExpressionAttributeValues, ":now")
+						return nil, &types.ConditionalCheckFailedException{Message: aws.String("The conditional request failed")}
+					},
+				}
+			},
+			expect: func(t *testing.T, token *models.Token, err error) {
+				assert.ErrorIs(t, err, models.ErrTokenExists)
+				assert.Nil(t, token)
+			},
+		},
 		{
 			name: "empty payload token",
-			input: &models.Token{
+			input: withID(&models.Token{
 				CreateToken: models.CreateToken{
 					Payload:   "",
 					TokenType: "bearer",
 					TTL:       3600,
 					Metadata:  nil,
 				},
-			},
+			}),
 			client: func(t *testing.T) *mockDynamoAPI {
 				return &mockDynamoAPI{
 					putItemFunc: func(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
@@ -353,14 +552,40 @@ func TestCreateToken(t *testing.T) {
 			},
 		},
 		{
-			name: "successful creation with minimal data",
+			name: "keeps an ID assigned before encryption",
 			input: &models.Token{
+				BaseModel: models.BaseModel{
+					Id:        uuid.MustParse("01234567-89ab-cdef-0123-456789abcdef"),
+					CreatedAt: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+					UpdatedAt: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+				},
+				CreateToken: models.CreateToken{
+					Payload:   "v2:abcd",
+					TokenType: "api",
+				},
+			},
+			client: func(t *testing.T) *mockDynamoAPI {
+				return &mockDynamoAPI{
+					putItemFunc: func(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+						return &dynamodb.PutItemOutput{}, nil
+					},
+				}
+			},
+			expect: func(t *testing.T, token *models.Token, err error) {
+				assert.NoError(t, err)
+				assert.Equal(t, uuid.MustParse("01234567-89ab-cdef-0123-456789abcdef"), token.Id)
+				assert.Equal(t, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), token.CreatedAt)
+			},
+		},
+		{
+			name: "successful creation with minimal data",
+			input: withID(&models.Token{
 				CreateToken: models.CreateToken{
 					Payload:   "minimal",
 					TokenType: "api",
 					TTL:       1800,
 				},
-			},
+			}),
 			client: func(t *testing.T) *mockDynamoAPI {
 				return &mockDynamoAPI{
 					putItemFunc: func(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
@@ -381,6 +606,7 @@ func TestCreateToken(t *testing.T) {
 				now := time.Now()
 				assert.WithinDuration(t, now, token.CreatedAt, 1*time.Second)
 				assert.WithinDuration(t, now, token.UpdatedAt, 1*time.Second)
+				assert.Equal(t, token.CreatedAt.Add(1800*time.Second).Unix(), token.ExpiresAt)
 			},
 		},
 	}
@@ -428,9 +654,10 @@ func TestDeleteToken(t *testing.T) {
 						// Verify the table name is correct
 						assert.Equal(t, *TokenTableName, *params.TableName)
 
-						// Verify the key is provided
-						assert.NotNil(t, params.Key)
-						assert.NotNil(t, params.Key["token"])
+						// Verify the key is the token value
+						assert.Equal(t, map[string]types.AttributeValue{
+							"token": &types.AttributeValueMemberS{Value: "test-token-123"},
+						}, params.Key)
 
 						return &dynamodb.DeleteItemOutput{}, nil
 					},
@@ -638,7 +865,7 @@ func TestSetupDynamoTable(t *testing.T) {
 					createTableFunc: func(ctx context.Context, params *dynamodb.CreateTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.CreateTableOutput, error) {
 						// Verify CreateTable is called with correct parameters
 						assert.Equal(t, *TokenTableName, *params.TableName)
-						assert.Len(t, params.AttributeDefinitions, 1)
+						assert.Len(t, params.AttributeDefinitions, 4)
 						assert.Equal(t, "token", *params.AttributeDefinitions[0].AttributeName)
 						assert.Equal(t, types.ScalarAttributeTypeS, params.AttributeDefinitions[0].AttributeType)
 						assert.Len(t, params.KeySchema, 1)
@@ -660,6 +887,122 @@ func TestSetupDynamoTable(t *testing.T) {
 				assert.NotNil(t, mock.createTableFunc, "CreateTable should be called when table doesn't exist")
 			},
 		},
+		{
+			name: "enables ttl on the expiry attribute",
+			client: func(t *testing.T) *mockDynamoAPI {
+				m := &mockDynamoAPI{
+					describeTableFunc: func(ctx context.Context, params *dynamodb.DescribeTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTableOutput, error) {
+						return &dynamodb.DescribeTableOutput{}, nil
+					},
+					describeTTLFunc: func(ctx context.Context, params *dynamodb.DescribeTimeToLiveInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTimeToLiveOutput, error) {
+						return &dynamodb.DescribeTimeToLiveOutput{
+							TimeToLiveDescription: &types.TimeToLiveDescription{TimeToLiveStatus: types.TimeToLiveStatusDisabled},
+						}, nil
+					},
+				}
+				m.updateTTLFunc = func(ctx context.Context, params *dynamodb.UpdateTimeToLiveInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateTimeToLiveOutput, error) {
+					assert.Equal(t, *TokenTableName, *params.TableName)
+					assert.Equal(t, "expiresAt", *params.TimeToLiveSpecification.AttributeName)
+					assert.True(t, *params.TimeToLiveSpecification.Enabled)
+					m.updateTTLFunc = nil
+					return &dynamodb.UpdateTimeToLiveOutput{}, nil
+				}
+				return m
+			},
+			expect: func(t *testing.T, mock *mockDynamoAPI) {
+				assert.Nil(t, mock.updateTTLFunc, "UpdateTimeToLive should be called")
+			},
+		},
+		{
+			name: "adds the list indexes to an existing table one at a time",
+			client: func(t *testing.T) *mockDynamoAPI {
+				m := &mockDynamoAPI{
+					describeTableFunc: func(ctx context.Context, params *dynamodb.DescribeTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTableOutput, error) {
+						return &dynamodb.DescribeTableOutput{Table: &types.TableDescription{TableName: aws.String("token_data")}}, nil
+					},
+				}
+				m.updateTableFunc = func(ctx context.Context, params *dynamodb.UpdateTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateTableOutput, error) {
+					assert.Equal(t, *TokenTableName, *params.TableName)
+					assert.Len(t, params.GlobalSecondaryIndexUpdates, 1)
+					assert.Equal(t, TenantIndex, *params.GlobalSecondaryIndexUpdates[0].Create.IndexName)
+					assert.Len(t, params.AttributeDefinitions, 2)
+					assert.Equal(t, "tenant_key", *params.AttributeDefinitions[0].AttributeName)
+					m.updateTableFunc = nil
+					return &dynamodb.UpdateTableOutput{}, nil
+				}
+				return m
+			},
+			expect: func(t *testing.T, mock *mockDynamoAPI) {
+				assert.Nil(t, mock.updateTableFunc, "UpdateTable should be called")
+			},
+		},
+		{
+			name: "adds the missing list index",
+			client: func(t *testing.T) *mockDynamoAPI {
+				m := &mockDynamoAPI{
+					describeTableFunc: func(ctx context.Context, params *dynamodb.DescribeTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTableOutput, error) {
+						return &dynamodb.DescribeTableOutput{Table: &types.TableDescription{
+							TableName:              aws.String("token_data"),
+							GlobalSecondaryIndexes: []types.GlobalSecondaryIndexDescription{{IndexName: aws.String(TenantIndex)}},
+						}}, nil
+					},
+				}
+				m.updateTableFunc = func(ctx context.Context, params *dynamodb.UpdateTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateTableOutput, error) {
+					assert.Equal(t, TenantTypeIndex, *params.GlobalSecondaryIndexUpdates[0].Create.IndexName)
+					assert.Equal(t, "tenant_type", *params.AttributeDefinitions[0].AttributeName)
+					m.updateTableFunc = nil
+					return &dynamodb.UpdateTableOutput{}, nil
+				}
+				return m
+			},
+			expect: func(t *testing.T, mock *mockDynamoAPI) {
+				assert.Nil(t, mock.updateTableFunc, "UpdateTable should be called")
+			},
+		},
+		{
+			name: "list indexes already exist",
+			client: func(t *testing.T) *mockDynamoAPI {
+				return &mockDynamoAPI{
+					describeTableFunc: func(ctx context.Context, params *dynamodb.DescribeTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTableOutput, error) {
+						return &dynamodb.DescribeTableOutput{Table: &types.TableDescription{
+							TableName: aws.String("token_data"),
+							GlobalSecondaryIndexes: []types.GlobalSecondaryIndexDescription{
+								{IndexName: aws.String(TenantIndex)},
+								{IndexName: aws.String(TenantTypeIndex)},
+							},
+						}}, nil
+					},
+					updateTableFunc: func(ctx context.Context, params *dynamodb.UpdateTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateTableOutput, error) {
+						t.Error("UpdateTable should not be called when the indexes exist")
+						return nil, nil
+					},
+				}
+			},
+			expect: func(t *testing.T, mock *mockDynamoAPI) {},
+		},
+		{
+			name: "ttl already enabled",
+			client: func(t *testing.T) *mockDynamoAPI {
+				return &mockDynamoAPI{
+					describeTableFunc: func(ctx context.Context, params *dynamodb.DescribeTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTableOutput, error) {
+						return &dynamodb.DescribeTableOutput{}, nil
+					},
+					describeTTLFunc: func(ctx context.Context, params *dynamodb.DescribeTimeToLiveInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTimeToLiveOutput, error) {
+						return &dynamodb.DescribeTimeToLiveOutput{
+							TimeToLiveDescription: &types.TimeToLiveDescription{
+								AttributeName:    aws.String("expiresAt"),
+								TimeToLiveStatus: types.TimeToLiveStatusEnabled,
+							},
+						}, nil
+					},
+					updateTTLFunc: func(ctx context.Context, params *dynamodb.UpdateTimeToLiveInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateTimeToLiveOutput, error) {
+						t.Error("UpdateTimeToLive should not be called when TTL is enabled")
+						return nil, nil
+					},
+				}
+			},
+			expect: func(t *testing.T, mock *mockDynamoAPI) {},
+		},
 		{
 			name: "describe table generic error - no table creation",
 			client: func(t *testing.T) *mockDynamoAPI {
@@ -750,3 +1093,550 @@ func TestSetupDynamoTable(t *testing.T) {
 		})
 	}
 }
+
+func TestScanTokens(t *testing.T) {
+	testCases := []struct {
+		name   string
+		cursor string
+		client func(t *testing.T) *mockDynamoAPI
+		expect func(t *testing.T, tokens []*models.Token, next string, err error)
+	}{
+		{
+			name: "first page",
+			client: func(t *testing.T) *mockDynamoAPI {
+				return &mockDynamoAPI{
+					scanFunc: func(ctx context.Context, params *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error) {
+						assert.Equal(t, *TokenTableName, *params.TableName)
+						assert.Equal(t, int32(2), *params.Limit)
+						assert.Nil(t, params.ExclusiveStartKey)
+						return &dynamodb.ScanOutput{
+							Items: []map[string]types.AttributeValue{
+								{"token": &types.AttributeValueMemberS{Value: "token-1"}, "key_id": &types.AttributeValueMemberS{Value: "key-1"}},
+								{"token": &types.AttributeValueMemberS{Value: "token-2"}},
+							},
+							LastEvaluatedKey: map[string]types.AttributeValue{
+								"token": &types.AttributeValueMemberS{Value: "token-2"},
+							},
+						}, nil
+					},
+				}
+			},
+			expect: func(t *testing.T, tokens []*models.Token, next string, err error) {
+				assert.NoError(t, err)
+				assert.Len(t, tokens, 2)
+				assert.Equal(t, "token-1", tokens[0].Token)
+				assert.Equal(t, "key-1", tokens[0].KeyID)
+				assert.Equal(t, "token-2", next)
+			},
+		},
+		{
+			name:   "last page",
+			cursor: "token-2",
+			client: func(t *testing.T) *mockDynamoAPI {
+				return &mockDynamoAPI{
+					scanFunc: func(ctx context.Context, params *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error) {
+						assert.Equal(t, map[string]types.AttributeValue{
+							"token": &types.AttributeValueMemberS{Value: "token-2"},
+						}, params.ExclusiveStartKey)
+						return &dynamodb.ScanOutput{
+							Items: []map[string]types.AttributeValue{
+								{"token": &types.AttributeValueMemberS{Value: "token-3"}},
+							},
+						}, nil
+					},
+				}
+			},
+			expect: func(t *testing.T, tokens []*models.Token, next string, err error) {
+				assert.NoError(t, err)
+				assert.Len(t, tokens, 1)
+				assert.Empty(t, next)
+			},
+		},
+		{
+			name: "dynamodb scan error",
+			client: func(t *testing.T) *mockDynamoAPI {
+				return &mockDynamoAPI{
+					scanFunc: func(ctx context.Context, params *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error) {
+						return nil, errors.New("dynamodb error")
+					},
+				}
+			},
+			expect: func(t *testing.T, tokens []*models.Token, next string, err error) {
+				assert.Error(t, err)
+				assert.Nil(t, tokens)
+			},
+		},
+		{
+			name: "unmarshal error",
+			client: func(t *testing.T) *mockDynamoAPI {
+				return &mockDynamoAPI{
+					scanFunc: func(ctx context.Context, params *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error) {
+						return &dynamodb.ScanOutput{
+							Items: []map[string]types.AttributeValue{
+								{"createdAt": &types.AttributeValueMemberN{Value: "not-a-date"}},
+							},
+						}, nil
+					},
+				}
+			},
+			expect: func(t *testing.T, tokens []*models.Token, next string, err error) {
+				assert.Error(t, err)
+				assert.Nil(t, tokens)
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := &DynamoStore{
+				Api: tc.client(t),
+			}
+
+			tokens, next, err := store.ScanTokens(context.Background(), tc.cursor, 2)
+			tc.expect(t, tokens, next, err)
+		})
+	}
+}
+
+func TestUpdateTokenKey(t *testing.T) {
+	testCases := []struct {
+		name     string
+		previous *models.Token
+		client   func(t *testing.T) *mockDynamoAPI
+		expect   func(t *testing.T, err error)
+	}{
+		{
+			name: "successful key update",
+			client: func(t *testing.T) *mockDynamoAPI {
+				return &mockDynamoAPI{
+					updateItemFunc: func(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+						assert.Equal(t, *TokenTableName, *params.TableName)
+						assert.Equal(t, &types.AttributeValueMemberS{Value: "test-token"}, params.Key["token"])
+						assert.Equal(t, "payload = :previousPayload AND wrapped_key = :previousWrappedKey", *params.ConditionExpression)
+						assert.Equal(t, &types.AttributeValueMemberS{Value: "v1:new"}, params.ExpressionAttributeValues[":payload"])
+						assert.Equal(t, &types.AttributeValueMemberS{Value: "v1:newkey"}, params.ExpressionAttributeValues[":wrappedKey"])
+						assert.Equal(t, &types.AttributeValueMemberS{Value: "key-2"}, params.ExpressionAttributeValues[":keyId"])
+						assert.Equal(t, &types.AttributeValueMemberS{Value: "v1:old"}, params.ExpressionAttributeValues[":previousPayload"])
+						assert.Equal(t, &types.AttributeValueMemberS{Value: "v1:oldkey"}, params.ExpressionAttributeValues[":previousWrappedKey"])
+						return &dynamodb.UpdateItemOutput{}, nil
+					},
+				}
+			},
+			expect: func(t *testing.T, err error) {
+				assert.NoError(t, err)
+			},
+		},
+		{
+			name:     "token from before envelope encryption",
+			previous: &models.Token{CreateToken: models.CreateToken{Payload: "v1:old"}},
+			client: func(t *testing.T) *mockDynamoAPI {
+				return &mockDynamoAPI{
+					updateItemFunc: func(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+						assert.Equal(t, "payload = :previousPayload AND attribute_not_exists(wrapped_key)", *params.ConditionExpression)
+						assert.NotContains(t, params.ExpressionAttributeValues, ":previousWrappedKey")
+						return &dynamodb.UpdateItemOutput{}, nil
+					},
+				}
+			},
+			expect: func(t *testing.T, err error) {
+				assert.NoError(t, err)
+			},
+		},
+		{
+			name: "payload changed since it was read",
+			client: func(t *testing.T) *mockDynamoAPI {
+				return &mockDynamoAPI{
+					updateItemFunc: func(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+						return nil, &types.ConditionalCheckFailedException{Message: aws.String("The conditional request failed")}
+					},
+				}
+			},
+			expect: func(t *testing.T, err error) {
+				assert.ErrorIs(t, err, models.ErrTokenChanged)
+			},
+		},
+		{
+			name: "dynamodb update item error",
+			client: func(t *testing.T) *mockDynamoAPI {
+				return &mockDynamoAPI{
+					updateItemFunc: func(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+						return nil, errors.New("dynamodb error")
+					},
+				}
+			},
+			expect: func(t *testing.T, err error) {
+				assert.Error(t, err)
+				assert.Equal(t, "dynamodb error", err.Error())
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := &DynamoStore{
+				Api: tc.client(t),
+			}
+
+			token := &models.Token{
+				Token:      "test-token",
+				KeyID:      "key-2",
+				WrappedKey: "v1:newkey",
+				CreateToken: models.CreateToken{
+					Payload: "v1:new",
+				},
+			}
+			previous := tc.previous
+			if previous == nil {
+				previous = &models.Token{
+					Token:       "test-token",
+					KeyID:       "key-1",
+					WrappedKey:  "v1:oldkey",
+					CreateToken: models.CreateToken{Payload: "v1:old"},
+				}
+			}
+			err := store.UpdateTokenKey(context.Background(), token, previous)
+			tc.expect(t, err)
+		})
+	}
+}
+
+func TestUpdateToken(t *testing.T) {
+	ttl := int64(600)
+	testCases := []struct {
+		name   string
+		update models.UpdateToken
+		client func(t *testing.T) *mockDynamoAPI
+		expect func(t *testing.T, token *models.Token, err error)
+	}{
+		{
+			name:   "update metadata and ttl",
+			update: models.UpdateToken{TTL: &ttl, Metadata: map[string]any{"foo": "bar"}},
+			client: func(t *testing.T) *mockDynamoAPI {
+				return &mockDynamoAPI{
+					updateItemFunc: func(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+						assert.Equal(t, *TokenTableName, *params.TableName)
+						assert.Equal(t, &types.AttributeValueMemberS{Value: "test-token"}, params.Key["token"])
+						assert.Equal(t, "SET #expiresAt = :expiresAt, #metadata = :metadata, #ttl = :ttl, #updatedAt = :updatedAt", *params.UpdateExpression)
+						assert.Equal(t, "attribute_exists(#token) AND (attribute_not_exists(#expiresAt) OR #expiresAt > :now)", *params.ConditionExpression)
+						expiresAt, err := strconv.ParseInt(params.ExpressionAttributeValues[":expiresAt"].(*types.AttributeValueMemberN).Value, 10, 64)
+						assert.NoError(t, err)
+						assert.WithinDuration(t, time.Now().Add(600*time.Second), time.Unix(expiresAt, 0), time.Second)
+						assert.Equal(t, &types.AttributeValueMemberN{Value: "600"}, params.ExpressionAttributeValues[":ttl"])
+						assert.NotContains(t, params.ExpressionAttributeValues, ":payload")
+						assert.Equal(t, types.ReturnValueAllNew, params.ReturnValues)
+						return &dynamodb.UpdateItemOutput{
+							Attributes: map[string]types.AttributeValue{
+								"token":   &types.AttributeValueMemberS{Value: "test-token"},
+								"payload": &types.AttributeValueMemberS{Value: "v2:abcd"},
+								"ttl":     &types.AttributeValueMemberN{Value: "600"},
+								"metadata": &types.AttributeValueMemberM{Value: map[string]types.AttributeValue{
+									"foo": &types.AttributeValueMemberS{Value: "bar"},
+								}},
+							},
+						}, nil
+					},
+				}
+			},
+			expect: func(t *testing.T, token *models.Token, err error) {
+				assert.NoError(t, err)
+				assert.Equal(t, "test-token", token.Token)
+				assert.Equal(t, int64(600), token.TTL)
+				assert.Equal(t, "bar", token.Metadata["foo"])
+				assert.Equal(t, "v2:abcd", token.Payload)
+			},
+		},
+		{
+			name:   "update ttl only",
+			update: models.UpdateToken{TTL: &ttl},
+			client: func(t *testing.T) *mockDynamoAPI {
+				return &mockDynamoAPI{
+					updateItemFunc: func(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+						assert.Equal(t, "SET #expiresAt = :expiresAt, #ttl = :ttl, #updatedAt = :updatedAt", *params.UpdateExpression)
+						return &dynamodb.UpdateItemOutput{}, nil
+					},
+				}
+			},
+			expect: func(t *testing.T, token *models.Token, err error) {
+				assert.NoError(t, err)
+			},
+		},
+		{
+			name:   "ttl of zero stops the token expiring",
+			update: models.UpdateToken{TTL: new(int64)},
+			client: func(t *testing.T) *mockDynamoAPI {
+				return &mockDynamoAPI{
+					updateItemFunc: func(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+						assert.Equal(t, "SET #ttl = :ttl, #updatedAt = :updatedAt REMOVE #expiresAt", *params.UpdateExpression)
+						assert.NotContains(t, params.ExpressionAttributeValues, ":expiresAt")
+						return &dynamodb.UpdateItemOutput{}, nil
+					},
+				}
+			},
+			expect: func(t *testing.T, token *models.Token, err error) {
+				assert.NoError(t, err)
+			},
+		},
+		{
+			name: "nothing to update",
+			client: func(t *testing.T) *mockDynamoAPI {
+				return &mockDynamoAPI{}
+			},
+			expect: func(t *testing.T, token *models.Token, err error) {
+				assert.ErrorIs(t, err, models.ErrEmptyUpdate)
+			},
+		},
+		{
+			name:   "token does not exist",
+			update: models.UpdateToken{TTL: &ttl},
+			client: func(t *testing.T) *mockDynamoAPI {
+				return &mockDynamoAPI{
+					updateItemFunc: func(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+						return nil, &types.ConditionalCheckFailedException{Message: aws.String("The conditional request failed")}
+					},
+				}
+			},
+			expect: func(t *testing.T, token *models.Token, err error) {
+				assert.ErrorIs(t, err, models.ErrTokenNotFound)
+			},
+		},
+		{
+			name:   "dynamodb update item error",
+			update: models.UpdateToken{TTL: &ttl},
+			client: func(t *testing.T) *mockDynamoAPI {
+				return &mockDynamoAPI{
+					updateItemFunc: func(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+						return nil, errors.New("dynamodb error")
+					},
+				}
+			},
+			expect: func(t *testing.T, token *models.Token, err error) {
+				assert.EqualError(t, err, "dynamodb error")
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := &DynamoStore{
+				Api: tc.client(t),
+			}
+			token, err := store.UpdateToken(context.Background(), "", "test-token", tc.update)
+			tc.expect(t, token, err)
+		})
+	}
+}
+
+func TestConsumeReveal(t *testing.T) {
+	testCases := []struct {
+		name   string
+		client func(t *testing.T) *mockDynamoAPI
+		expect func(t *testing.T, left int64, err error)
+	}{
+		{
+			name: "reveal taken",
+			client: func(t *testing.T) *mockDynamoAPI {
+				return &mockDynamoAPI{
+					updateItemFunc: func(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+						assert.Equal(t, *TokenTableName, *params.TableName)
+						assert.Equal(t, &types.AttributeValueMemberS{Value: "tenant-a#test-token"}, params.Key["token"])
+						assert.Equal(t, "SET #revealsLeft = #revealsLeft - :one", *params.UpdateExpression)
+						assert.Equal(t, "attribute_exists(#token) AND #revealsLeft > :zero AND (attribute_not_exists(#expiresAt) OR #expiresAt > :now)", *params.ConditionExpression)
+						assert.Equal(t, "reveals_left", params.ExpressionAttributeNames["#revealsLeft"])
+						assert.Equal(t, types.ReturnValueUpdatedNew, params.ReturnValues)
+						assert.Equal(t, types.ReturnValuesOnConditionCheckFailureAllOld, params.ReturnValuesOnConditionCheckFailure)
+						return &dynamodb.UpdateItemOutput{
+							Attributes: map[string]types.AttributeValue{
+								"reveals_left": &types.AttributeValueMemberN{Value: "2"},
+							},
+						}, nil
+					},
+				}
+			},
+			expect: func(t *testing.T, left int64, err error) {
+				assert.NoError(t, err)
+				assert.Equal(t, int64(2), left)
+			},
+		},
+		{
+			name: "no reveals left",
+			client: func(t *testing.T) *mockDynamoAPI {
+				return &mockDynamoAPI{
+					updateItemFunc: func(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+						return nil, &types.ConditionalCheckFailedException{
+							Message: aws.String("The conditional request failed"),
+							Item: map[string]types.AttributeValue{
+								"token":        &types.AttributeValueMemberS{Value: "tenant-a#test-token"},
+								"tenant":       &types.AttributeValueMemberS{Value: "tenant-a"},
+								"reveals_left": &types.AttributeValueMemberN{Value: "0"},
+							},
+						}
+					},
+				}
+			},
+			expect: func(t *testing.T, left int64, err error) {
+				assert.ErrorIs(t, err, models.ErrRevealsExhausted)
+			},
+		},
+		{
+			name: "token does not exist",
+			client: func(t *testing.T) *mockDynamoAPI {
+				return &mockDynamoAPI{
+					updateItemFunc: func(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+						return nil, &types.ConditionalCheckFailedException{Message: aws.String("The conditional request failed")}
+					},
+				}
+			},
+			expect: func(t *testing.T, left int64, err error) {
+				assert.ErrorIs(t, err, models.ErrTokenNotFound)
+			},
+		},
+		{
+			name: "token expired",
+			client: func(t *testing.T) *mockDynamoAPI {
+				return &mockDynamoAPI{
+					updateItemFunc: func(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+						return nil, &types.ConditionalCheckFailedException{
+							Message: aws.String("The conditional request failed"),
+							Item: map[string]types.AttributeValue{
+								"token":        &types.AttributeValueMemberS{Value: "tenant-a#test-token"},
+								"reveals_left": &types.AttributeValueMemberN{Value: "1"},
+								"expiresAt":    epochValue(time.Now().Add(-time.Minute)),
+							},
+						}
+					},
+				}
+			},
+			expect: func(t *testing.T, left int64, err error) {
+				assert.ErrorIs(t, err, models.ErrTokenNotFound)
+			},
+		},
+		{
+			name: "dynamodb update item error",
+			client: func(t *testing.T) *mockDynamoAPI {
+				return &mockDynamoAPI{
+					updateItemFunc: func(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+						return nil, errors.New("dynamodb error")
+					},
+				}
+			},
+			expect: func(t *testing.T, left int64, err error) {
+				assert.EqualError(t, err, "dynamodb error")
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := &DynamoStore{
+				Api: tc.client(t),
+			}
+			token := &models.Token{BaseModel: models.BaseModel{Tenant: "tenant-a"}, Token: "test-token"}
+			left, err := store.ConsumeReveal(context.Background(), token)
+			tc.expect(t, left, err)
+		})
+	}
+}
+
+func TestConsumeReveals(t *testing.T) {
+	revealItem := func(key string, left string) map[string]types.AttributeValue {
+		return map[string]types.AttributeValue{
+			"token":        &types.AttributeValueMemberS{Value: key},
+			"tenant":       &types.AttributeValueMemberS{Value: "tenant-a"},
+			"reveals_left": &types.AttributeValueMemberN{Value: left},
+		}
+	}
+	testCases := []struct {
+		name   string
+		tokens int
+		client func(t *testing.T) *mockDynamoAPI
+		expect func(t *testing.T, left []int64, err error)
+	}{
+		{
+			name:   "reveals taken together",
+			tokens: 2,
+			client: func(t *testing.T) *mockDynamoAPI {
+				return &mockDynamoAPI{
+					transactFunc: func(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error) {
+						assert.Len(t, params.TransactItems, 2)
+						for i, item := range params.TransactItems {
+							assert.Equal(t, *TokenTableName, *item.Update.TableName)
+							assert.Equal(t, &types.AttributeValueMemberS{Value: "tenant-a#token-" + strconv.Itoa(i)}, item.Update.Key["token"])
+							assert.Equal(t, "SET #revealsLeft = #revealsLeft - :one", *item.Update.UpdateExpression)
+							assert.Equal(t, "attribute_exists(#token) AND #revealsLeft > :zero AND (attribute_not_exists(#expiresAt) OR #expiresAt > :now)", *item.Update.ConditionExpression)
+						}
+						return &dynamodb.TransactWriteItemsOutput{}, nil
+					},
+					batchGetFunc: func(ctx context.Context, params *dynamodb.BatchGetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error) {
+						assert.True(t, *params.RequestItems[*TokenTableName].ConsistentRead)
+						// the last reveal of token-1 was taken and another request deleted it
+						return &dynamodb.BatchGetItemOutput{Responses: map[string][]map[string]types.AttributeValue{
+							*TokenTableName: {revealItem("tenant-a#token-0", "2")},
+						}}, nil
+					},
+				}
+			},
+			expect: func(t *testing.T, left []int64, err error) {
+				assert.NoError(t, err)
+				assert.Equal(t, []int64{2, 0}, left)
+			},
+		},
+		{
+			name:   "a token without reveals left takes none",
+			tokens: 2,
+			client: func(t *testing.T) *mockDynamoAPI {
+				return &mockDynamoAPI{
+					transactFunc: func(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error) {
+						return nil, &types.TransactionCanceledException{CancellationReasons: []types.CancellationReason{
+							{Code: aws.String("None")},
+							{Code: aws.String("ConditionalCheckFailed"), Item: revealItem("tenant-a#token-1", "0")},
+						}}
+					},
+				}
+			},
+			expect: func(t *testing.T, left []int64, err error) {
+				assert.ErrorIs(t, err, models.ErrRevealsExhausted)
+			},
+		},
+		{
+			name:   "a token changed by another request",
+			tokens: 2,
+			client: func(t *testing.T) *mockDynamoAPI {
+				return &mockDynamoAPI{
+					transactFunc: func(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error) {
+						return nil, &types.TransactionCanceledException{CancellationReasons: []types.CancellationReason{
+							{Code: aws.String("TransactionConflict")},
+							{Code: aws.String("None")},
+						}}
+					},
+				}
+			},
+			expect: func(t *testing.T, left []int64, err error) {
+				assert.ErrorIs(t, err, models.ErrTokenChanged)
+			},
+		},
+		{
+			name:   "too many tokens",
+			tokens: persistence.MaxConsumeReveals + 1,
+			client: func(t *testing.T) *mockDynamoAPI {
+				return &mockDynamoAPI{}
+			},
+			expect: func(t *testing.T, left []int64, err error) {
+				assert.ErrorIs(t, err, persistence.ErrTooManyReveals)
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := &DynamoStore{
+				Api: tc.client(t),
+			}
+			tokens := []*models.Token{}
+			for i := range tc.tokens {
+				tokens = append(tokens, &models.Token{BaseModel: models.BaseModel{Tenant: "tenant-a"}, Token: "token-" + strconv.Itoa(i)})
+			}
+			left, err := store.ConsumeReveals(context.Background(), tokens)
+			tc.expect(t, left, err)
+		})
+	}
+}
@@ -2,25 +2,332 @@ package mock
 
 import (
 	"context"
+	"slices"
+	"sync"
+	"time"
 
+	"tokenize/audit"
+	"tokenize/keys"
 	"tokenize/models"
 )
 
 type Store struct {
 	Token       *models.Token
+	Tokens      []*models.Token
 	CreateError error
-	GetError    error
-	DeleteError error
+	// BatchErrors are the errors of CreateTokens by token value
+	BatchErrors    map[string]error
+	GetError       error
+	UpdateError    error
+	DeleteError    error
+	RevealError    error
+	ScanError      error
+	ListError      error
+	UpdateKeyError error
 }
 
-func (s Store) GetToken(_ context.Context, _ string) (*models.Token, error) {
+func (s Store) GetToken(_ context.Context, _ string, _ string) (*models.Token, error) {
 	return s.Token, s.GetError
 }
 
+// GetTokens returns the tenant's entries in Tokens that have not expired, or fails with GetError
+func (s Store) GetTokens(_ context.Context, tenant string, tokens []string) (map[string]*models.Token, error) {
+	if s.GetError != nil {
+		return nil, s.GetError
+	}
+	return s.stored(tenant, tokens), nil
+}
+
+// stored returns the tenant's entries in Tokens that have not expired
+func (s Store) stored(tenant string, tokens []string) map[string]*models.Token {
+	found := map[string]*models.Token{}
+	for _, stored := range s.Tokens {
+		if stored.Tenant == tenant && slices.Contains(tokens, stored.Token) && !stored.Expired(time.Now()) {
+			found[stored.Token] = stored
+		}
+	}
+	return found
+}
+
 func (s Store) CreateToken(_ context.Context, _ *models.Token) (*models.Token, error) {
 	return s.Token, s.CreateError
 }
 
+// CreateTokens fails every token with CreateError, or with its entry in BatchErrors. Tokens that are already in Tokens
+// fail with models.ErrTokenExists, like they do in the real store.
+func (s Store) CreateTokens(_ context.Context, tokens []*models.Token) []error {
+	errs := make([]error, len(tokens))
+	for i, token := range tokens {
+		errs[i] = s.CreateError
+		if err, found := s.BatchErrors[token.Token]; found {
+			errs[i] = err
+		}
+		if s.stored(token.Tenant, []string{token.Token})[token.Token] != nil {
+			errs[i] = models.ErrTokenExists
+		}
+	}
+	return errs
+}
+
+// UpdateToken returns a copy of Token with the update applied
+func (s Store) UpdateToken(_ context.Context, _ string, _ string, update models.UpdateToken) (*models.Token, error) {
+	if s.UpdateError != nil {
+		return nil, s.UpdateError
+	}
+	if s.Token == nil {
+		return nil, models.ErrTokenNotFound
+	}
+	updated := *s.Token
+	if update.TTL != nil {
+		updated.TTL = *update.TTL
+	}
+	if update.Metadata != nil {
+		updated.Metadata = update.Metadata
+	}
+	return &updated, nil
+}
+
 func (s Store) DeleteToken(_ context.Context, _ *models.Token) error {
 	return s.DeleteError
 }
+
+// revealsMu serializes ConsumeReveal, which changes the stored tokens
+var revealsMu sync.Mutex
+
+// ConsumeReveal takes a reveal of the matching entry in Tokens, or of Token, or fails with RevealError
+func (s Store) ConsumeReveal(_ context.Context, token *models.Token) (int64, error) {
+	if s.RevealError != nil {
+		return 0, s.RevealError
+	}
+	revealsMu.Lock()
+	defer revealsMu.Unlock()
+	for _, stored := range append(slices.Clone(s.Tokens), s.Token) {
+		if stored == nil || stored.Tenant != token.Tenant || stored.Token != token.Token {
+			continue
+		}
+		if stored.RevealsLeft <= 0 {
+			return 0, models.ErrRevealsExhausted
+		}
+		stored.RevealsLeft--
+		return stored.RevealsLeft, nil
+	}
+	return 0, models.ErrTokenNotFound
+}
+
+// ConsumeReveals takes a reveal of every token like ConsumeReveal, once each of them was found with reveals left, or
+// fails with RevealError
+func (s Store) ConsumeReveals(_ context.Context, tokens []*models.Token) ([]int64, error) {
+	if s.RevealError != nil {
+		return nil, s.RevealError
+	}
+	revealsMu.Lock()
+	defer revealsMu.Unlock()
+	found := make([]*models.Token, len(tokens))
+	for i, token := range tokens {
+		for _, stored := range append(slices.Clone(s.Tokens), s.Token) {
+			if stored != nil && stored.Tenant == token.Tenant && stored.Token == token.Token {
+				found[i] = stored
+				break
+			}
+		}
+		if found[i] == nil {
+			return nil, models.ErrTokenNotFound
+		}
+		if found[i].RevealsLeft <= 0 {
+			return nil, models.ErrRevealsExhausted
+		}
+	}
+	left := make([]int64, len(tokens))
+	for i, stored := range found {
+		stored.RevealsLeft--
+		left[i] = stored.RevealsLeft
+	}
+	return left, nil
+}
+
+// ScanTokens pages through Tokens, using the token value as the cursor
+func (s Store) ScanTokens(_ context.Context, cursor string, limit int32) ([]*models.Token, string, error) {
+	if s.ScanError != nil {
+		return nil, "", s.ScanError
+	}
+	if limit <= 0 {
+		limit = int32(len(s.Tokens))
+	}
+	start := 0
+	if cursor != "" {
+		for i, token := range s.Tokens {
+			if token.Token == cursor {
+				start = i + 1
+				break
+			}
+		}
+	}
+	end := min(start+int(limit), len(s.Tokens))
+	page := s.Tokens[start:end]
+	if end == len(s.Tokens) {
+		return page, "", nil
+	}
+	return page, page[len(page)-1].Token, nil
+}
+
+// ListTokens pages through the tenant's Tokens that match the filter and have not expired, using the token value as
+// the cursor
+func (s Store) ListTokens(_ context.Context, tenant string, filter models.TokenFilter, cursor string, limit int32) ([]*models.Token, string, error) {
+	if s.ListError != nil {
+		return nil, "", s.ListError
+	}
+	matching := []*models.Token{}
+	for _, token := range s.Tokens {
+		if token.Tenant == tenant && filter.Matches(token) && !token.Expired(time.Now()) {
+			matching = append(matching, token)
+		}
+	}
+	return Store{Tokens: matching}.ScanTokens(context.Background(), cursor, limit)
+}
+
+// UpdateTokenKey applies the rotated payload and keys to the matching entry in Tokens
+func (s Store) UpdateTokenKey(_ context.Context, token *models.Token, previous *models.Token) error {
+	if s.UpdateKeyError != nil {
+		return s.UpdateKeyError
+	}
+	for _, stored := range s.Tokens {
+		if stored.Tenant != token.Tenant || stored.Token != token.Token {
+			continue
+		}
+		if stored.Payload != previous.Payload || stored.WrappedKey != previous.WrappedKey {
+			return models.ErrTokenChanged
+		}
+		stored.Payload = token.Payload
+		stored.WrappedKey = token.WrappedKey
+		stored.KeyID = token.KeyID
+		return nil
+	}
+	return models.ErrTokenNotFound
+}
+
+// APIKeyStore keeps API keys in memory by their hash
+type APIKeyStore struct {
+	Keys        map[string]*models.APIKey
+	GetError    error
+	CreateError error
+}
+
+func (s *APIKeyStore) GetAPIKey(_ context.Context, keyHash string) (*models.APIKey, error) {
+	if s.GetError != nil {
+		return nil, s.GetError
+	}
+	key, ok := s.Keys[keyHash]
+	if !ok {
+		return nil, models.ErrAPIKeyNotFound
+	}
+	return key, nil
+}
+
+func (s *APIKeyStore) CreateAPIKey(_ context.Context, key *models.APIKey) error {
+	if s.CreateError != nil {
+		return s.CreateError
+	}
+	if s.Keys == nil {
+		s.Keys = map[string]*models.APIKey{}
+	}
+	s.Keys[key.KeyHash] = key
+	return nil
+}
+
+// GrantStore keeps reveal grants in memory by tenant and ID
+type GrantStore struct {
+	Grants      map[string]*models.RevealGrant
+	GetError    error
+	CreateError error
+}
+
+func (s *GrantStore) CreateGrant(_ context.Context, grant *models.RevealGrant) error {
+	if s.CreateError != nil {
+		return s.CreateError
+	}
+	if s.Grants == nil {
+		s.Grants = map[string]*models.RevealGrant{}
+	}
+	stored := *grant
+	s.Grants[models.StorageKey(grant.Tenant, grant.ID)] = &stored
+	return nil
+}
+
+func (s *GrantStore) GetGrant(_ context.Context, tenant string, id string) (*models.RevealGrant, error) {
+	if s.GetError != nil {
+		return nil, s.GetError
+	}
+	grant, ok := s.Grants[models.StorageKey(tenant, id)]
+	if !ok {
+		return nil, models.ErrGrantNotFound
+	}
+	stored := *grant
+	return &stored, nil
+}
+
+func (s *GrantStore) RevokeGrant(_ context.Context, tenant string, token string, id string) error {
+	grant, ok := s.Grants[models.StorageKey(tenant, id)]
+	if !ok || grant.Token != token {
+		return models.ErrGrantNotFound
+	}
+	grant.Revoked = true
+	return nil
+}
+
+// AuditKeys are the audit keys the AuditStore seals records with
+var AuditKeys = keys.Static("the audit key of the mock store.")
+
+// AuditStore keeps audit records in memory, chained like a real store
+type AuditStore struct {
+	Records []audit.Record
+	// Heads are the heads of the chains by storage key
+	Heads        map[string]audit.Head
+	AppendError  error
+	HistoryError error
+	// mu serializes Append and History, batches append records concurrently
+	mu sync.Mutex
+}
+
+func (s *AuditStore) Append(ctx context.Context, record *audit.Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.AppendError != nil {
+		return s.AppendError
+	}
+	key, err := AuditKeys.CurrentKey(ctx)
+	if err != nil {
+		return err
+	}
+	var prev *audit.Record
+	for i := range s.Records {
+		if s.Records[i].Tenant == record.Tenant && s.Records[i].Token == record.Token {
+			prev = &s.Records[i]
+		}
+	}
+	record.Seal(prev, key)
+	s.Records = append(s.Records, *record)
+	if s.Heads == nil {
+		s.Heads = map[string]audit.Head{}
+	}
+	s.Heads[models.StorageKey(record.Tenant, record.Token)] = *audit.NewHead(record, key)
+	return nil
+}
+
+func (s *AuditStore) History(_ context.Context, tenant string, token string, page audit.Page) ([]audit.Record, *audit.Head, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.HistoryError != nil {
+		return nil, nil, s.HistoryError
+	}
+	var head *audit.Head
+	if stored, ok := s.Heads[models.StorageKey(tenant, token)]; ok {
+		head = &stored
+	}
+	records := []audit.Record{}
+	for _, record := range s.Records {
+		if record.Tenant == tenant && record.Token == token {
+			records = append(records, record)
+		}
+	}
+	return page.Select(records), head, nil
+}
@@ -2,12 +2,74 @@ package persistence
 
 import (
 	"context"
+	"errors"
 
 	"tokenize/models"
 )
 
+// DefaultListLimit is the number of tokens in a page of ListTokens when no limit is given
+const DefaultListLimit = 100
+
+// MaxConsumeReveals is the most tokens ConsumeReveals takes reveals of together
+const MaxConsumeReveals = 100
+
+var (
+	// ErrThrottled is returned when the underlying store is throttling requests, they can be retried later
+	ErrThrottled = errors.New("store is throttling requests")
+	// ErrInvalidCursor is returned for a page cursor that was not handed out by the store
+	ErrInvalidCursor = errors.New("invalid page cursor")
+	// ErrTooManyReveals is returned by ConsumeReveals for more than MaxConsumeReveals tokens
+	ErrTooManyReveals = errors.New("too many tokens with a reveal limit to reveal together")
+)
+
+// Store keeps tokens partitioned by tenant, a token of one tenant cannot be read or changed through another
 type Store interface {
-	GetToken(context.Context, string) (*models.Token, error)
+	// GetToken returns the tenant's token, or models.ErrTokenNotFound
+	GetToken(ctx context.Context, tenant string, token string) (*models.Token, error)
+	// GetTokens returns those of the tenant's tokens that exist, by token value
+	GetTokens(ctx context.Context, tenant string, tokens []string) (map[string]*models.Token, error)
+	// CreateToken stores a new token, returning models.ErrTokenExists rather than overwriting an existing one
 	CreateToken(context.Context, *models.Token) (*models.Token, error)
+	// CreateTokens stores a batch of new tokens and returns the error of each token, in order, nil for those that were
+	// stored. Like CreateToken, a token that already exists fails with models.ErrTokenExists rather than being
+	// overwritten.
+	CreateTokens(ctx context.Context, tokens []*models.Token) []error
+	// UpdateToken changes the TTL and metadata of a tenant's token and returns the updated token, or
+	// models.ErrTokenNotFound when there is no such token
+	UpdateToken(ctx context.Context, tenant string, token string, update models.UpdateToken) (*models.Token, error)
 	DeleteToken(context.Context, *models.Token) error
+	// ConsumeReveal takes one of the reveals left of a token with a reveal limit and returns how many are left, or
+	// models.ErrRevealsExhausted when there are none. Concurrent calls never take more reveals than the token has.
+	ConsumeReveal(ctx context.Context, token *models.Token) (int64, error)
+	// ConsumeReveals takes one of the reveals left of each of up to MaxConsumeReveals different tokens, either of all
+	// of them or of none, and returns how many each has left. It fails like ConsumeReveal with the error of a token
+	// that has no reveals left or is gone.
+	ConsumeReveals(ctx context.Context, tokens []*models.Token) ([]int64, error)
+	// ScanTokens returns a page of up to limit tokens starting after the cursor, along with the cursor for the next
+	// page, which is empty once every token has been returned
+	ScanTokens(ctx context.Context, cursor string, limit int32) ([]*models.Token, string, error)
+	// ListTokens returns a page of up to limit of the tenant's tokens that match the filter, starting after the cursor,
+	// along with the cursor for the next page, which is empty once every matching token has been returned. Expired
+	// tokens are left out.
+	ListTokens(ctx context.Context, tenant string, filter models.TokenFilter, cursor string, limit int32) ([]*models.Token, string, error)
+	// UpdateTokenKey stores a rotated token's payload, wrapped data key and key ID, as long as the stored token has
+	// not changed from previous
+	UpdateTokenKey(ctx context.Context, token *models.Token, previous *models.Token) error
+}
+
+// APIKeyStore stores the API keys callers authenticate with, by the hash of the key
+type APIKeyStore interface {
+	// GetAPIKey returns the API key with the hash, or models.ErrAPIKeyNotFound
+	GetAPIKey(ctx context.Context, keyHash string) (*models.APIKey, error)
+	CreateAPIKey(ctx context.Context, key *models.APIKey) error
+}
+
+// GrantStore keeps the reveal grants that have been issued, so they can be revoked before they expire
+type GrantStore interface {
+	CreateGrant(ctx context.Context, grant *models.RevealGrant) error
+	// GetGrant returns the tenant's grant, or models.ErrGrantNotFound
+	GetGrant(ctx context.Context, tenant string, id string) (*models.RevealGrant, error)
+	// RevokeGrant revokes the tenant's grant for the token, or returns models.ErrGrantNotFound when there is no such
+	// grant
+	RevokeGrant(ctx context.Context, tenant string, token string, id string) error
 }
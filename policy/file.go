@@ -0,0 +1,99 @@
+package policy
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tokenize/auth"
+)
+
+// File is a policy read from a JSON file, which can be reloaded while the service is running. A reload that fails
+// keeps the policy that was loaded before.
+type File struct {
+	Path string
+
+	policy  atomic.Pointer[Policy]
+	mu      sync.Mutex
+	modTime time.Time
+}
+
+// LoadFile reads the policy at path
+func LoadFile(path string) (*File, error) {
+	file := &File{Path: path}
+	if err := file.Reload(); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// Reload reads the policy file again, swapping it in once it has been parsed
+func (f *File) Reload() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	info, err := os.Stat(f.Path)
+	if err != nil {
+		return err
+	}
+	// a broken file is only reported once, not every time it is watched
+	f.modTime = info.ModTime()
+	data, err := os.ReadFile(f.Path)
+	if err != nil {
+		return err
+	}
+	policy, err := Parse(data)
+	if err != nil {
+		return err
+	}
+	f.policy.Store(policy)
+	return nil
+}
+
+// Policy returns the policy currently in effect
+func (f *File) Policy() *Policy {
+	return f.policy.Load()
+}
+
+func (f *File) Authorize(principal *auth.Principal, action Action, resource Resource) error {
+	policy := f.Policy()
+	if policy == nil {
+		return ErrForbidden
+	}
+	return policy.Authorize(principal, action, resource)
+}
+
+// Watch reloads the policy every time the file is modified, checking every interval until the context is done
+func (f *File) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !f.modified() {
+				continue
+			}
+			if err := f.Reload(); err != nil {
+				slog.Error("unable to reload policy", "path", f.Path, "error", err)
+				continue
+			}
+			slog.Info("reloaded policy", "path", f.Path)
+		}
+	}
+}
+
+// modified reports whether the file has changed since it was last loaded
+func (f *File) modified() bool {
+	info, err := os.Stat(f.Path)
+	if err != nil {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return !info.ModTime().Equal(f.modTime)
+}
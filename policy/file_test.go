@@ -0,0 +1,62 @@
+package policy
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"tokenize/auth"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writePolicy(t *testing.T, path string, data string, modTime time.Time) {
+	t.Helper()
+	assert.NoError(t, os.WriteFile(path, []byte(data), 0o600))
+	assert.NoError(t, os.Chtimes(path, modTime, modTime))
+}
+
+func TestFile_Reload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	start := time.Now().Add(-time.Hour)
+	writePolicy(t, path, `{"roles": {"reader": [{"actions": ["read"]}]}}`, start)
+
+	file, err := LoadFile(path)
+	assert.NoError(t, err)
+	reader := &auth.Principal{Subject: "jwt:reader", Roles: []string{"reader"}}
+	assert.NoError(t, file.Authorize(reader, ActionRead, Resource{TokenType: "card"}))
+	assert.False(t, file.modified())
+
+	writePolicy(t, path, `{"roles": {"reader": [{"actions": ["read"], "token_types": ["access"]}]}}`, start.Add(time.Minute))
+	assert.True(t, file.modified())
+	assert.NoError(t, file.Reload())
+	assert.ErrorIs(t, file.Authorize(reader, ActionRead, Resource{TokenType: "card"}), ErrForbidden)
+
+	writePolicy(t, path, `{"roles": {"reader": [{"actions": ["everything"]}]}}`, start.Add(2*time.Minute))
+	assert.Error(t, file.Reload())
+	assert.NoError(t, file.Authorize(reader, ActionRead, Resource{TokenType: "access"}), "a broken file keeps the previous policy")
+	assert.False(t, file.modified(), "a broken file is not reloaded again until it changes")
+
+	_, err = LoadFile(filepath.Join(t.TempDir(), "missing.json"))
+	assert.Error(t, err)
+}
+
+func TestFile_Watch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	start := time.Now().Add(-time.Hour)
+	writePolicy(t, path, `{"roles": {}}`, start)
+	file, err := LoadFile(path)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go file.Watch(ctx, time.Millisecond)
+
+	writePolicy(t, path, `{"roles": {"admin": [{"actions": ["*"]}]}}`, start.Add(time.Minute))
+	admin := &auth.Principal{Subject: "jwt:admin", Roles: []string{"admin"}}
+	assert.Eventually(t, func() bool {
+		return file.Authorize(admin, ActionAdmin, Resource{}) == nil
+	}, time.Second, time.Millisecond)
+}
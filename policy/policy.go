@@ -0,0 +1,164 @@
+// Package policy decides what authenticated callers may do with tokens, based on their roles
+package policy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+
+	"tokenize/auth"
+)
+
+// ErrForbidden is returned when a caller's roles do not allow an action
+var ErrForbidden = errors.New("forbidden")
+
+// Action is something a caller can do with tokens
+type Action string
+
+const (
+	ActionTokenize   Action = "tokenize"
+	ActionRead       Action = "read"
+	ActionUpdate     Action = "update"
+	ActionDetokenize Action = "detokenize"
+	ActionDelete     Action = "delete"
+	// ActionAudit is reading the audit history of tokens
+	ActionAudit Action = "audit"
+	// ActionGrant is issuing and revoking reveal grants, which also needs detokenize with the grant's reveal policy
+	ActionGrant Action = "grant"
+	// ActionAdmin covers the admin endpoints, which are not about any one token
+	ActionAdmin Action = "admin"
+
+	// Any matches every action or token type
+	Any = "*"
+)
+
+var actions = []Action{
+	ActionTokenize, ActionRead, ActionUpdate, ActionDetokenize, ActionDelete, ActionAudit, ActionGrant, ActionAdmin, Any,
+}
+
+// Resource is what an action is taken on, the zero value for actions that are not about a token
+type Resource struct {
+	TokenType string
+	Metadata  map[string]any
+	// Reveal is the reveal policy a payload is detokenized with
+	Reveal string
+	// AnyMetadata matches grants whatever metadata they are limited to, for checks made before the metadata is known
+	AnyMetadata bool
+}
+
+// Grant allows actions on tokens of the token types, or any type when empty. When Metadata is set, each attribute of
+// the token's metadata must have one of the listed values. When Reveal is set, payloads can only be detokenized with
+// the listed reveal policies.
+type Grant struct {
+	Actions    []Action            `json:"actions"`
+	TokenTypes []string            `json:"token_types,omitempty"`
+	Metadata   map[string][]string `json:"metadata,omitempty"`
+	Reveal     []string            `json:"reveal,omitempty"`
+}
+
+// Policy holds the grants of each role
+type Policy struct {
+	Roles map[string][]Grant `json:"roles"`
+}
+
+// Authorizer decides whether a caller may take an action
+type Authorizer interface {
+	// Authorize returns an error wrapping ErrForbidden when the principal may not take the action on the resource
+	Authorize(principal *auth.Principal, action Action, resource Resource) error
+}
+
+// Default is the policy used when none is configured. Tokenizers create tokens, readers read them without their
+// payload, detokenizers also decrypt them and admins can do everything, for every token type.
+func Default() *Policy {
+	return &Policy{Roles: map[string][]Grant{
+		"tokenizer":   {{Actions: []Action{ActionTokenize}}},
+		"reader":      {{Actions: []Action{ActionRead}}},
+		"detokenizer": {{Actions: []Action{ActionRead, ActionDetokenize}}},
+		"admin":       {{Actions: []Action{Any}}},
+	}}
+}
+
+// Parse reads a policy from JSON, rejecting unknown actions
+func Parse(data []byte) (*Policy, error) {
+	policy := &Policy{}
+	if err := json.Unmarshal(data, policy); err != nil {
+		return nil, err
+	}
+	for role, grants := range policy.Roles {
+		for _, grant := range grants {
+			if len(grant.Actions) == 0 {
+				return nil, fmt.Errorf("role %q has a grant without actions", role)
+			}
+			for _, action := range grant.Actions {
+				if !slices.Contains(actions, action) {
+					return nil, fmt.Errorf("role %q has unknown action %q", role, action)
+				}
+			}
+		}
+	}
+	return policy, nil
+}
+
+func (p *Policy) Authorize(principal *auth.Principal, action Action, resource Resource) error {
+	if principal == nil {
+		return ErrForbidden
+	}
+	if !p.Allows(principal.Roles, action, resource) {
+		if resource.TokenType == "" {
+			return fmt.Errorf("%w: %s may not %s", ErrForbidden, principal.Subject, action)
+		}
+		if resource.Reveal != "" {
+			return fmt.Errorf("%w: %s may not %s %s tokens with the %s reveal policy", ErrForbidden, principal.Subject,
+				action, resource.TokenType, resource.Reveal)
+		}
+		return fmt.Errorf("%w: %s may not %s %s tokens", ErrForbidden, principal.Subject, action, resource.TokenType)
+	}
+	return nil
+}
+
+// Allows reports whether any of the roles has a grant for the action on the resource
+func (p *Policy) Allows(roles []string, action Action, resource Resource) bool {
+	for _, role := range roles {
+		for _, grant := range p.Roles[role] {
+			if grant.allows(action, resource) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (g Grant) allows(action Action, resource Resource) bool {
+	if !slices.Contains(g.Actions, action) && !slices.Contains(g.Actions, Any) {
+		return false
+	}
+	if len(g.TokenTypes) > 0 && !slices.Contains(g.TokenTypes, resource.TokenType) && !slices.Contains(g.TokenTypes, Any) {
+		return false
+	}
+	if resource.Reveal != "" && len(g.Reveal) > 0 && !slices.Contains(g.Reveal, resource.Reveal) && !slices.Contains(g.Reveal, Any) {
+		return false
+	}
+	if resource.AnyMetadata {
+		return true
+	}
+	for name, allowed := range g.Metadata {
+		value, ok := resource.Metadata[name]
+		if !ok || !slices.Contains(allowed, metadataString(value)) {
+			return false
+		}
+	}
+	return true
+}
+
+// metadataString is the text a metadata value is matched by, only strings, numbers and booleans can match
+func metadataString(value any) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64, int, int64, bool:
+		return fmt.Sprint(v)
+	default:
+		return ""
+	}
+}
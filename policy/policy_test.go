@@ -0,0 +1,226 @@
+package policy
+
+import (
+	"testing"
+
+	"tokenize/auth"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPolicy_Allows(t *testing.T) {
+	policy := &Policy{Roles: map[string][]Grant{
+		"card-detokenizer": {{
+			Actions:    []Action{ActionRead, ActionDetokenize},
+			TokenTypes: []string{"card"},
+			Metadata:   map[string][]string{"region": {"eu", "uk"}, "tier": {"1"}},
+		}},
+		"reader": {{Actions: []Action{ActionRead}, TokenTypes: []string{Any}}},
+		"tokenizer": {
+			{Actions: []Action{ActionTokenize}, TokenTypes: []string{"card"}},
+			{Actions: []Action{ActionTokenize}, TokenTypes: []string{"ssn"}},
+		},
+		"support": {{Actions: []Action{ActionRead, ActionDetokenize}, TokenTypes: []string{"card"}, Reveal: []string{"last4"}}},
+		"admin":   {{Actions: []Action{Any}}},
+	}}
+	euCard := Resource{TokenType: "card", Metadata: map[string]any{"region": "eu", "tier": float64(1)}}
+
+	tests := []struct {
+		name     string
+		roles    []string
+		action   Action
+		resource Resource
+		want     bool
+	}{
+		{
+			name:     "within the token type and metadata",
+			roles:    []string{"card-detokenizer"},
+			action:   ActionDetokenize,
+			resource: euCard,
+			want:     true,
+		},
+		{
+			name:     "action not granted",
+			roles:    []string{"card-detokenizer"},
+			action:   ActionDelete,
+			resource: euCard,
+		},
+		{
+			name:     "other token type",
+			roles:    []string{"card-detokenizer"},
+			action:   ActionDetokenize,
+			resource: Resource{TokenType: "ssn", Metadata: euCard.Metadata},
+		},
+		{
+			name:     "any metadata",
+			roles:    []string{"card-detokenizer"},
+			action:   ActionDetokenize,
+			resource: Resource{TokenType: "card", AnyMetadata: true},
+			want:     true,
+		},
+		{
+			name:     "any metadata of another token type",
+			roles:    []string{"card-detokenizer"},
+			action:   ActionDetokenize,
+			resource: Resource{TokenType: "ssn", AnyMetadata: true},
+		},
+		{
+			name:     "metadata value not allowed",
+			roles:    []string{"card-detokenizer"},
+			action:   ActionDetokenize,
+			resource: Resource{TokenType: "card", Metadata: map[string]any{"region": "us", "tier": float64(1)}},
+		},
+		{
+			name:     "metadata attribute missing",
+			roles:    []string{"card-detokenizer"},
+			action:   ActionDetokenize,
+			resource: Resource{TokenType: "card", Metadata: map[string]any{"region": "eu"}},
+		},
+		{
+			name:     "metadata values that are not text",
+			roles:    []string{"card-detokenizer"},
+			action:   ActionDetokenize,
+			resource: Resource{TokenType: "card", Metadata: map[string]any{"region": []any{"eu"}, "tier": float64(1)}},
+		},
+		{
+			name:     "any token type",
+			roles:    []string{"reader"},
+			action:   ActionRead,
+			resource: Resource{TokenType: "anything"},
+			want:     true,
+		},
+		{
+			name:     "any of several grants",
+			roles:    []string{"tokenizer"},
+			action:   ActionTokenize,
+			resource: Resource{TokenType: "ssn"},
+			want:     true,
+		},
+		{
+			name:     "any of several roles",
+			roles:    []string{"unknown", "reader"},
+			action:   ActionRead,
+			resource: euCard,
+			want:     true,
+		},
+		{
+			name:   "admin action",
+			roles:  []string{"admin"},
+			action: ActionAdmin,
+			want:   true,
+		},
+		{
+			name:   "admin action is not scoped to a token type",
+			roles:  []string{"tokenizer"},
+			action: ActionAdmin,
+		},
+		{
+			name:     "reveal policy granted",
+			roles:    []string{"support"},
+			action:   ActionDetokenize,
+			resource: Resource{TokenType: "card", Reveal: "last4"},
+			want:     true,
+		},
+		{
+			name:     "reveal policy not granted",
+			roles:    []string{"support"},
+			action:   ActionDetokenize,
+			resource: Resource{TokenType: "card", Reveal: "full"},
+		},
+		{
+			name:     "reveal policies do not limit other actions",
+			roles:    []string{"support"},
+			action:   ActionRead,
+			resource: Resource{TokenType: "card"},
+			want:     true,
+		},
+		{
+			name:     "grants without reveal policies allow any",
+			roles:    []string{"card-detokenizer"},
+			action:   ActionDetokenize,
+			resource: Resource{TokenType: "card", Metadata: euCard.Metadata, Reveal: "full"},
+			want:     true,
+		},
+		{
+			name:     "no roles",
+			action:   ActionRead,
+			resource: euCard,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, policy.Allows(tt.roles, tt.action, tt.resource))
+		})
+	}
+}
+
+func TestPolicy_Authorize(t *testing.T) {
+	policy := Default()
+	reader := &auth.Principal{Subject: "jwt:reader", Roles: []string{"reader"}}
+
+	assert.NoError(t, policy.Authorize(reader, ActionRead, Resource{TokenType: "card"}))
+	err := policy.Authorize(reader, ActionDetokenize, Resource{TokenType: "card"})
+	assert.ErrorIs(t, err, ErrForbidden)
+	assert.EqualError(t, err, "forbidden: jwt:reader may not detokenize card tokens")
+	assert.ErrorIs(t, policy.Authorize(nil, ActionRead, Resource{TokenType: "card"}), ErrForbidden)
+
+	support := &auth.Principal{Subject: "jwt:support", Roles: []string{"support"}}
+	policy.Roles["support"] = []Grant{{Actions: []Action{ActionDetokenize}, Reveal: []string{"last4"}}}
+	err = policy.Authorize(support, ActionDetokenize, Resource{TokenType: "card", Reveal: "full"})
+	assert.EqualError(t, err, "forbidden: jwt:support may not detokenize card tokens with the full reveal policy")
+}
+
+func TestDefault(t *testing.T) {
+	policy := Default()
+	card := Resource{TokenType: "card"}
+	assert.True(t, policy.Allows([]string{"tokenizer"}, ActionTokenize, card))
+	assert.False(t, policy.Allows([]string{"tokenizer"}, ActionRead, card))
+	assert.True(t, policy.Allows([]string{"reader"}, ActionRead, card))
+	assert.False(t, policy.Allows([]string{"reader"}, ActionDetokenize, card))
+	assert.True(t, policy.Allows([]string{"detokenizer"}, ActionDetokenize, card))
+	assert.False(t, policy.Allows([]string{"detokenizer"}, ActionDelete, card))
+	assert.True(t, policy.Allows([]string{"admin"}, ActionDelete, card))
+	assert.True(t, policy.Allows([]string{"admin"}, ActionAdmin, Resource{}))
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			data: `{"roles": {"reader": [{"actions": ["read"], "token_types": ["card"], "metadata": {"region": ["eu"]}}]}}`,
+		},
+		{
+			name: "no roles",
+			data: `{"roles": {}}`,
+		},
+		{
+			name:    "unknown action",
+			data:    `{"roles": {"reader": [{"actions": ["decrypt"]}]}}`,
+			wantErr: true,
+		},
+		{
+			name:    "grant without actions",
+			data:    `{"roles": {"reader": [{"token_types": ["card"]}]}}`,
+			wantErr: true,
+		},
+		{
+			name:    "not json",
+			data:    `roles: {}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.data))
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package rotation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Checkpoint persists the progress of a rotation run so it can be resumed
+type Checkpoint interface {
+	// Load returns the saved progress, or nil if there is none
+	Load(ctx context.Context) (*Progress, error)
+	Save(ctx context.Context, progress *Progress) error
+}
+
+// FileCheckpoint keeps the progress in a JSON file
+type FileCheckpoint struct {
+	Path string
+}
+
+func (f *FileCheckpoint) Load(_ context.Context) (*Progress, error) {
+	data, err := os.ReadFile(f.Path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	progress := &Progress{}
+	if err := json.Unmarshal(data, progress); err != nil {
+		return nil, err
+	}
+	return progress, nil
+}
+
+func (f *FileCheckpoint) Save(_ context.Context, progress *Progress) error {
+	data, err := json.Marshal(progress)
+	if err != nil {
+		return err
+	}
+	// write to a temporary file and rename it over the checkpoint so a crash never leaves a partial file
+	tmp, err := os.CreateTemp(filepath.Dir(f.Path), filepath.Base(f.Path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.Path)
+}
+
+// MemoryCheckpoint keeps the progress in memory, so a run can only be resumed within the same process
+type MemoryCheckpoint struct {
+	mu       sync.Mutex
+	progress *Progress
+}
+
+func (m *MemoryCheckpoint) Load(_ context.Context) (*Progress, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.progress == nil {
+		return nil, nil
+	}
+	progress := *m.progress
+	return &progress, nil
+}
+
+func (m *MemoryCheckpoint) Save(_ context.Context, progress *Progress) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	saved := *progress
+	m.progress = &saved
+	return nil
+}
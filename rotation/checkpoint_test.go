@@ -0,0 +1,70 @@
+package rotation
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileCheckpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rotation.json")
+	checkpoint := &FileCheckpoint{Path: path}
+
+	saved, err := checkpoint.Load(context.Background())
+	assert.NoError(t, err)
+	assert.Nil(t, saved, "no checkpoint before the first save")
+
+	progress := &Progress{
+		Status:    StatusRunning,
+		KeyID:     "key-2",
+		Cursor:    "token-100",
+		Scanned:   100,
+		Rotated:   98,
+		Failed:    2,
+		StartedAt: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	assert.NoError(t, checkpoint.Save(context.Background(), progress))
+
+	saved, err = checkpoint.Load(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, progress, saved)
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1, "temporary files should be cleaned up")
+}
+
+func TestFileCheckpoint_Errors(t *testing.T) {
+	dir := t.TempDir()
+
+	malformed := filepath.Join(dir, "malformed.json")
+	assert.NoError(t, os.WriteFile(malformed, []byte("{"), 0o600))
+	_, err := (&FileCheckpoint{Path: malformed}).Load(context.Background())
+	assert.Error(t, err)
+
+	_, err = (&FileCheckpoint{Path: dir}).Load(context.Background())
+	assert.Error(t, err)
+
+	err = (&FileCheckpoint{Path: filepath.Join(dir, "missing", "rotation.json")}).Save(context.Background(), &Progress{})
+	assert.Error(t, err)
+}
+
+func TestMemoryCheckpoint(t *testing.T) {
+	checkpoint := &MemoryCheckpoint{}
+
+	saved, err := checkpoint.Load(context.Background())
+	assert.NoError(t, err)
+	assert.Nil(t, saved)
+
+	progress := &Progress{Status: StatusRunning, Cursor: "token-1"}
+	assert.NoError(t, checkpoint.Save(context.Background(), progress))
+	progress.Cursor = "changed after saving"
+
+	saved, err = checkpoint.Load(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "token-1", saved.Cursor)
+}
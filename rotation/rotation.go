@@ -0,0 +1,273 @@
+package rotation
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"tokenize/models"
+	"tokenize/persistence"
+)
+
+// Status values of a rotation run
+const (
+	StatusIdle      = "idle"
+	StatusRunning   = "running"
+	StatusCompleted = "completed"
+	StatusFailed    = "failed"
+)
+
+// DefaultBatchSize is the number of tokens read from the store at a time when BatchSize is not set
+const DefaultBatchSize = 100
+
+var (
+	ErrAlreadyRunning = errors.New("key rotation is already running")
+)
+
+// Progress tracks a rotation run, it is checkpointed after every batch so an interrupted run can be resumed
+type Progress struct {
+	Status string `json:"status"`
+	// KeyID is the key tokens are being moved to
+	KeyID string `json:"key_id,omitempty"`
+	// Cursor is where the next batch starts from
+	Cursor string `json:"cursor,omitempty"`
+	// Scanned is the number of tokens looked at so far, Rotated were moved to the current key, Skipped changed while
+	// being rotated, and Failed could not be rotated
+	Scanned    int64      `json:"scanned"`
+	Rotated    int64      `json:"rotated"`
+	Skipped    int64      `json:"skipped"`
+	Failed     int64      `json:"failed"`
+	StartedAt  time.Time  `json:"started_at,omitempty"`
+	UpdatedAt  time.Time  `json:"updated_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// Rotator moves every stored token that is not wrapped by the current key-encryption key over to it. Tokens of a
+// tenant are moved to the current key of that tenant.
+type Rotator struct {
+	Store persistence.Store
+	// Keys are the key-encryption keys of tokens without a tenant, and Tenants has the keys of each tenant
+	Keys       models.KeyProvider
+	Tenants    models.TenantKeyResolver
+	Checkpoint Checkpoint
+	BatchSize  int32
+
+	mu       sync.Mutex
+	running  bool
+	progress Progress
+}
+
+// Run rotates the keys of every token and blocks until done. An interrupted run for the same key is resumed from
+// its checkpoint unless restart is set.
+func (r *Rotator) Run(ctx context.Context, restart bool) (Progress, error) {
+	if err := r.begin(); err != nil {
+		return r.Progress(), err
+	}
+	defer r.end()
+	return r.run(ctx, restart)
+}
+
+// Start runs the rotation in the background and returns straight away
+func (r *Rotator) Start(ctx context.Context, restart bool) (Progress, error) {
+	if err := r.begin(); err != nil {
+		return r.Progress(), err
+	}
+	r.setProgress(Progress{Status: StatusRunning, StartedAt: time.Now()})
+
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		defer r.end()
+		if _, err := r.run(ctx, restart); err != nil {
+			slog.Error("key rotation failed", "error", err)
+		}
+	}()
+	return r.Progress(), nil
+}
+
+// Progress returns the progress of the current or last run, falling back to the checkpoint if nothing has run yet
+func (r *Rotator) Progress() Progress {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.progress.Status == "" && r.Checkpoint != nil {
+		if saved, err := r.Checkpoint.Load(context.Background()); err == nil && saved != nil {
+			return *saved
+		}
+	}
+	if r.progress.Status == "" {
+		return Progress{Status: StatusIdle}
+	}
+	return r.progress
+}
+
+func (r *Rotator) begin() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.running {
+		return ErrAlreadyRunning
+	}
+	r.running = true
+	return nil
+}
+
+func (r *Rotator) end() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.running = false
+}
+
+func (r *Rotator) setProgress(progress Progress) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.progress = progress
+}
+
+func (r *Rotator) run(ctx context.Context, restart bool) (Progress, error) {
+	current, err := r.Keys.CurrentKey(ctx)
+	if err != nil {
+		return r.fail(ctx, Progress{StartedAt: time.Now()}, err)
+	}
+
+	progress, err := r.resume(ctx, current.ID, restart)
+	if err != nil {
+		return r.fail(ctx, Progress{KeyID: current.ID, StartedAt: time.Now()}, err)
+	}
+	progress.Status = StatusRunning
+	progress.Error = ""
+	if err := r.save(ctx, &progress); err != nil {
+		return r.fail(ctx, progress, err)
+	}
+
+	tenants := &tenantKeys{
+		resolver: r.Tenants,
+		defaults: r.Keys,
+		current:  map[string]string{"": current.ID},
+	}
+
+	batchSize := r.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return r.fail(ctx, progress, err)
+		}
+
+		tokens, next, err := r.Store.ScanTokens(ctx, progress.Cursor, batchSize)
+		if err != nil {
+			return r.fail(ctx, progress, err)
+		}
+		for _, token := range tokens {
+			progress.Scanned++
+			keys, currentID, err := tenants.keys(ctx, token.Tenant)
+			if err != nil {
+				progress.Failed++
+				slog.Warn("unable to find the keys of the token's tenant", "token", token.Token, "error", err)
+				continue
+			}
+			if !token.NeedsRotation(currentID) {
+				continue
+			}
+			r.rotate(ctx, token, keys, &progress)
+		}
+
+		progress.Cursor = next
+		if next == "" {
+			break
+		}
+		if err := r.save(ctx, &progress); err != nil {
+			return r.fail(ctx, progress, err)
+		}
+	}
+
+	finished := time.Now()
+	progress.Status = StatusCompleted
+	progress.FinishedAt = &finished
+	if err := r.save(ctx, &progress); err != nil {
+		return r.fail(ctx, progress, err)
+	}
+	return progress, nil
+}
+
+// tenantKeys looks up the keys of each tenant during a run, remembering the ID of each tenant's current key
+type tenantKeys struct {
+	resolver models.TenantKeyResolver
+	defaults models.KeyProvider
+	current  map[string]string
+}
+
+// keys returns the key-encryption keys of the tenant and the ID of its current key
+func (t *tenantKeys) keys(ctx context.Context, tenant string) (models.KeyProvider, string, error) {
+	keys, err := models.KeysForTenant(t.resolver, models.TenantKeys{Keys: t.defaults}, tenant)
+	if err != nil {
+		return nil, "", err
+	}
+	if id, ok := t.current[tenant]; ok {
+		return keys.Keys, id, nil
+	}
+	current, err := keys.Keys.CurrentKey(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	t.current[tenant] = current.ID
+	return keys.Keys, current.ID, nil
+}
+
+// rotate moves a single token to the current key and records the outcome
+func (r *Rotator) rotate(ctx context.Context, token *models.Token, keys models.KeyProvider, progress *Progress) {
+	rotated := *token
+	if err := rotated.Rotate(ctx, keys); err != nil {
+		progress.Failed++
+		slog.Warn("unable to rotate token", "token", token.Token, "error", err)
+		return
+	}
+
+	err := r.Store.UpdateTokenKey(ctx, &rotated, token)
+	switch {
+	case errors.Is(err, models.ErrTokenChanged), errors.Is(err, models.ErrTokenNotFound):
+		progress.Skipped++
+	case err != nil:
+		progress.Failed++
+		slog.Warn("unable to store re-encrypted token", "token", token.Token, "error", err)
+	default:
+		progress.Rotated++
+	}
+}
+
+// resume picks up the checkpointed run for keyID, or starts a new one
+func (r *Rotator) resume(ctx context.Context, keyID string, restart bool) (Progress, error) {
+	fresh := Progress{KeyID: keyID, StartedAt: time.Now()}
+	if restart || r.Checkpoint == nil {
+		return fresh, nil
+	}
+
+	saved, err := r.Checkpoint.Load(ctx)
+	if err != nil {
+		return fresh, err
+	}
+	if saved == nil || saved.Status == StatusCompleted || saved.KeyID != keyID {
+		return fresh, nil
+	}
+	return *saved, nil
+}
+
+func (r *Rotator) save(ctx context.Context, progress *Progress) error {
+	progress.UpdatedAt = time.Now()
+	r.setProgress(*progress)
+	if r.Checkpoint == nil {
+		return nil
+	}
+	return r.Checkpoint.Save(ctx, progress)
+}
+
+func (r *Rotator) fail(ctx context.Context, progress Progress, err error) (Progress, error) {
+	progress.Status = StatusFailed
+	progress.Error = err.Error()
+	if saveErr := r.save(ctx, &progress); saveErr != nil {
+		slog.Error("unable to checkpoint key rotation", "error", saveErr)
+	}
+	return progress, err
+}
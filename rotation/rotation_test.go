@@ -0,0 +1,312 @@
+package rotation
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"tokenize/keys"
+	"tokenize/models"
+	"tokenize/persistence/mock"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	oldKeys = &keys.Keyring{
+		Current: models.DefaultKeyID,
+		Keys:    map[string][]byte{models.DefaultKeyID: []byte("this is the secret key and stuff")},
+	}
+	newKeys = &keys.Keyring{
+		Current: "key-2",
+		Keys: map[string][]byte{
+			models.DefaultKeyID: []byte("this is the secret key and stuff"),
+			"key-2":             []byte("this is a different key material"),
+		},
+	}
+)
+
+// sealedTokens returns tokens encrypted under the old key, plus one using the legacy zero nonce format
+func sealedTokens(t *testing.T, count int) []*models.Token {
+	tokens := []*models.Token{{
+		Token: "legacy",
+		CreateToken: models.CreateToken{
+			Payload: "fc8df3ea16c7823811c85fead07f6589684f9799084fbad080134cc16d512339f5dfe9",
+		},
+	}}
+	for i := 1; i < count; i++ {
+		token := &models.Token{
+			Token:       string(rune('a' + i)),
+			CreateToken: models.CreateToken{Payload: "this is the payload"},
+		}
+		assert.NoError(t, token.Encrypt(context.Background(), oldKeys))
+		tokens = append(tokens, token)
+	}
+	return tokens
+}
+
+func TestRotator_Run(t *testing.T) {
+	testCases := []struct {
+		name       string
+		store      func(t *testing.T) mock.Store
+		checkpoint func() Checkpoint
+		restart    bool
+		expect     func(t *testing.T, store mock.Store, progress Progress, err error)
+	}{
+		{
+			name: "rotates every token",
+			store: func(t *testing.T) mock.Store {
+				return mock.Store{Tokens: sealedTokens(t, 5)}
+			},
+			checkpoint: func() Checkpoint { return &MemoryCheckpoint{} },
+			expect: func(t *testing.T, store mock.Store, progress Progress, err error) {
+				assert.NoError(t, err)
+				assert.Equal(t, StatusCompleted, progress.Status)
+				assert.Equal(t, "key-2", progress.KeyID)
+				assert.Equal(t, int64(5), progress.Scanned)
+				assert.Equal(t, int64(5), progress.Rotated)
+				assert.NotNil(t, progress.FinishedAt)
+				for _, token := range store.Tokens {
+					assert.Equal(t, "key-2", token.KeyID)
+					payload, err := token.Decrypt(context.Background(), newKeys)
+					assert.NoError(t, err)
+					assert.Equal(t, "this is the payload", payload)
+				}
+			},
+		},
+		{
+			name: "skips tokens already on the current key",
+			store: func(t *testing.T) mock.Store {
+				tokens := sealedTokens(t, 3)
+				assert.NoError(t, tokens[1].Reencrypt(context.Background(), newKeys))
+				return mock.Store{Tokens: tokens}
+			},
+			expect: func(t *testing.T, store mock.Store, progress Progress, err error) {
+				assert.NoError(t, err)
+				assert.Equal(t, int64(3), progress.Scanned)
+				assert.Equal(t, int64(2), progress.Rotated)
+			},
+		},
+		{
+			name: "resumes from the checkpoint",
+			store: func(t *testing.T) mock.Store {
+				return mock.Store{Tokens: sealedTokens(t, 5)}
+			},
+			checkpoint: func() Checkpoint {
+				return &MemoryCheckpoint{progress: &Progress{Status: StatusFailed, KeyID: "key-2", Cursor: "c", Scanned: 3, Rotated: 3}}
+			},
+			expect: func(t *testing.T, store mock.Store, progress Progress, err error) {
+				assert.NoError(t, err)
+				assert.Equal(t, int64(5), progress.Scanned)
+				assert.Equal(t, int64(5), progress.Rotated)
+				assert.Empty(t, progress.Error)
+				// the tokens before the cursor were rotated by the earlier run, not this one
+				assert.Empty(t, store.Tokens[0].KeyID)
+				assert.Equal(t, "key-2", store.Tokens[3].KeyID)
+			},
+		},
+		{
+			name: "restart ignores the checkpoint",
+			store: func(t *testing.T) mock.Store {
+				return mock.Store{Tokens: sealedTokens(t, 5)}
+			},
+			checkpoint: func() Checkpoint {
+				return &MemoryCheckpoint{progress: &Progress{Status: StatusFailed, KeyID: "key-2", Cursor: "c", Scanned: 3}}
+			},
+			restart: true,
+			expect: func(t *testing.T, store mock.Store, progress Progress, err error) {
+				assert.NoError(t, err)
+				assert.Equal(t, int64(5), progress.Scanned)
+				assert.Equal(t, int64(5), progress.Rotated)
+			},
+		},
+		{
+			name: "checkpoint for another key starts over",
+			store: func(t *testing.T) mock.Store {
+				return mock.Store{Tokens: sealedTokens(t, 2)}
+			},
+			checkpoint: func() Checkpoint {
+				return &MemoryCheckpoint{progress: &Progress{Status: StatusFailed, KeyID: "key-1", Cursor: "b", Scanned: 1}}
+			},
+			expect: func(t *testing.T, store mock.Store, progress Progress, err error) {
+				assert.NoError(t, err)
+				assert.Equal(t, int64(2), progress.Scanned)
+			},
+		},
+		{
+			name: "undecryptable tokens are counted as failed",
+			store: func(t *testing.T) mock.Store {
+				tokens := sealedTokens(t, 3)
+				tokens[2].Payload = "deadbeef"
+				return mock.Store{Tokens: tokens}
+			},
+			expect: func(t *testing.T, store mock.Store, progress Progress, err error) {
+				assert.NoError(t, err)
+				assert.Equal(t, int64(2), progress.Rotated)
+				assert.Equal(t, int64(1), progress.Failed)
+			},
+		},
+		{
+			name: "concurrent changes are skipped",
+			store: func(t *testing.T) mock.Store {
+				return mock.Store{Tokens: sealedTokens(t, 2), UpdateKeyError: models.ErrTokenChanged}
+			},
+			expect: func(t *testing.T, store mock.Store, progress Progress, err error) {
+				assert.NoError(t, err)
+				assert.Equal(t, int64(2), progress.Skipped)
+			},
+		},
+		{
+			name: "store update errors are counted as failed",
+			store: func(t *testing.T) mock.Store {
+				return mock.Store{Tokens: sealedTokens(t, 2), UpdateKeyError: errors.New("dynamodb error")}
+			},
+			expect: func(t *testing.T, store mock.Store, progress Progress, err error) {
+				assert.NoError(t, err)
+				assert.Equal(t, int64(2), progress.Failed)
+			},
+		},
+		{
+			name: "scan error fails the run",
+			store: func(t *testing.T) mock.Store {
+				return mock.Store{ScanError: errors.New("dynamodb error")}
+			},
+			checkpoint: func() Checkpoint { return &MemoryCheckpoint{} },
+			expect: func(t *testing.T, store mock.Store, progress Progress, err error) {
+				assert.Error(t, err)
+				assert.Equal(t, StatusFailed, progress.Status)
+				assert.Equal(t, "dynamodb error", progress.Error)
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := tc.store(t)
+			rotator := &Rotator{
+				Store:     store,
+				Keys:      newKeys,
+				BatchSize: 2,
+			}
+			if tc.checkpoint != nil {
+				rotator.Checkpoint = tc.checkpoint()
+			}
+
+			progress, err := rotator.Run(context.Background(), tc.restart)
+			tc.expect(t, store, progress, err)
+			assert.Equal(t, progress, rotator.Progress())
+		})
+	}
+}
+
+func TestRotator_RunTenants(t *testing.T) {
+	paymentsKeys := &keys.Keyring{
+		Current: "payments-2",
+		Keys: map[string][]byte{
+			"payments-1": []byte("this is the payments tenant key!"),
+			"payments-2": []byte("the rotated payments tenant key!"),
+		},
+	}
+	paymentsOld := &keys.Keyring{Current: "payments-1", Keys: paymentsKeys.Keys}
+
+	tokens := []*models.Token{}
+	for _, tenant := range []string{"", "payments", "shipping"} {
+		token := &models.Token{
+			BaseModel:   models.BaseModel{Tenant: tenant},
+			Token:       "same",
+			CreateToken: models.CreateToken{Payload: "this is the payload"},
+		}
+		sealWith := models.KeyProvider(oldKeys)
+		if tenant == "payments" {
+			sealWith = paymentsOld
+		}
+		assert.NoError(t, token.Encrypt(context.Background(), sealWith))
+		tokens = append(tokens, token)
+	}
+
+	rotator := &Rotator{
+		Store:   mock.Store{Tokens: tokens},
+		Keys:    newKeys,
+		Tenants: keys.Tenants{"payments": {Keys: paymentsKeys}},
+	}
+	progress, err := rotator.Run(context.Background(), false)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), progress.Scanned)
+	assert.Equal(t, int64(2), progress.Rotated)
+	assert.Equal(t, int64(1), progress.Failed, "tokens of unknown tenants cannot be rotated")
+
+	assert.Equal(t, "key-2", tokens[0].KeyID)
+	assert.Equal(t, "payments-2", tokens[1].KeyID, "tenant tokens move to the tenant's current key")
+	payload, err := tokens[1].Decrypt(context.Background(), paymentsKeys)
+	assert.NoError(t, err)
+	assert.Equal(t, "this is the payload", payload)
+}
+
+func TestRotator_RunKeyError(t *testing.T) {
+	rotator := &Rotator{
+		Store: mock.Store{},
+		Keys:  &keys.Keyring{Keys: map[string][]byte{}},
+	}
+	progress, err := rotator.Run(context.Background(), false)
+	assert.ErrorIs(t, err, keys.ErrNoKey)
+	assert.Equal(t, StatusFailed, progress.Status)
+}
+
+func TestRotator_RunCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	checkpoint := &MemoryCheckpoint{}
+	rotator := &Rotator{
+		Store:      mock.Store{Tokens: sealedTokens(t, 2)},
+		Keys:       newKeys,
+		Checkpoint: checkpoint,
+	}
+	progress, err := rotator.Run(ctx, false)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, StatusFailed, progress.Status)
+
+	saved, err := checkpoint.Load(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, StatusFailed, saved.Status)
+}
+
+func TestRotator_Start(t *testing.T) {
+	store := mock.Store{Tokens: sealedTokens(t, 3)}
+	rotator := &Rotator{
+		Store: store,
+		Keys:  newKeys,
+	}
+	assert.Equal(t, StatusIdle, rotator.Progress().Status)
+
+	progress, err := rotator.Start(context.Background(), false)
+	assert.NoError(t, err)
+	assert.Equal(t, StatusRunning, progress.Status)
+
+	assert.Eventually(t, func() bool {
+		return rotator.Progress().Status == StatusCompleted
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, int64(3), rotator.Progress().Rotated)
+}
+
+func TestRotator_AlreadyRunning(t *testing.T) {
+	rotator := &Rotator{
+		Store: mock.Store{},
+		Keys:  newKeys,
+	}
+	assert.NoError(t, rotator.begin())
+	defer rotator.end()
+
+	_, err := rotator.Start(context.Background(), false)
+	assert.ErrorIs(t, err, ErrAlreadyRunning)
+	_, err = rotator.Run(context.Background(), false)
+	assert.ErrorIs(t, err, ErrAlreadyRunning)
+}
+
+func TestRotator_ProgressFromCheckpoint(t *testing.T) {
+	rotator := &Rotator{
+		Checkpoint: &MemoryCheckpoint{progress: &Progress{Status: StatusFailed, Scanned: 10}},
+	}
+	assert.Equal(t, Progress{Status: StatusFailed, Scanned: 10}, rotator.Progress())
+}